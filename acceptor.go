@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Each session costs three goroutines (reading from the client, writing to
+// it, and talking to the server), and an idle one is just those parked in
+// the Go runtime's network poller, which is epoll (or kqueue) underneath
+// already. So tens of thousands of mostly idle sessions are mostly a
+// question of memory and file descriptors, not threads.
+//
+// What does get in the way is setting sessions up: that means connecting
+// and logging in to the server, which can take a while, and with a single
+// accept loop everybody else waits in the listen backlog meanwhile.
+// AcceptWorkers runs several accept loops, so one slow login only holds up
+// its own worker. Running out of file descriptors, which is the other thing
+// that happens with lots of sessions, makes us back off and try again
+// rather than give up on the listener altogether.
+
+// acceptMaxBackoff is the longest we wait between tries when accepting keeps
+// failing for lack of resources.
+const acceptMaxBackoff = time.Second
+
+// acceptConnections runs workers accept loops on the listener, handing each
+// connection to handle. It returns when the listener's closed: nil if that
+// was because of the context, or the error otherwise.
+func acceptConnections(ctx context.Context, listener net.Listener, workers int, handle func(net.Conn)) error {
+	var wait sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if err := acceptLoop(ctx, listener, handle); err != nil {
+				errs <- err
+				// Bring the other workers down with us.
+				listener.Close()
+			}
+		}()
+	}
+	wait.Wait()
+	close(errs)
+	return <-errs
+}
+
+func acceptLoop(ctx context.Context, listener net.Listener, handle func(net.Conn)) error {
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if !acceptRetryable(err) {
+				return err
+			}
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > acceptMaxBackoff {
+				backoff = acceptMaxBackoff
+			}
+			output.Log("Can't accept incoming connection, trying again in %s: %s", backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		handle(conn)
+	}
+}
+
+// acceptRetryable reports whether an Accept error is the kind that goes away
+// once some sessions close.
+func acceptRetryable(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED)
+}
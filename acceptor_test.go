@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAcceptConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Every connection blocks its worker until all of them have turned up,
+	// which only works if they're being handled in parallel.
+	const workers = 4
+	arrived := make(chan net.Conn, workers)
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- acceptConnections(ctx, listener, workers, func(conn net.Conn) {
+			arrived <- conn
+			<-release
+			conn.Close()
+		})
+	}()
+
+	for i := 0; i < workers; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Couldn't connect: %s", err)
+		}
+		defer conn.Close()
+	}
+	for i := 0; i < workers; i++ {
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only %d of %d connections were handled at once", i, workers)
+		}
+	}
+	close(release)
+
+	cancel()
+	listener.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Shutting down shouldn't be an error: %s", err)
+	}
+}
+
+// flakyListener fails to accept a few times before passing on a connection.
+type flakyListener struct {
+	net.Listener
+	failures []error
+}
+
+func (listener *flakyListener) Accept() (net.Conn, error) {
+	if len(listener.failures) > 0 {
+		err := listener.failures[0]
+		listener.failures = listener.failures[1:]
+		return nil, err
+	}
+	return listener.Listener.Accept()
+}
+
+func TestAcceptConnections_errors(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s", err)
+	}
+	defer inner.Close()
+	tooManyFiles := &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	listener := &flakyListener{inner, []error{tooManyFiles, tooManyFiles, errors.New("honk")}}
+
+	err = acceptConnections(context.Background(), listener, 1, func(conn net.Conn) {
+		t.Error("Bogus connection from a failing listener")
+	})
+	if err == nil || err.Error() != "honk" {
+		t.Errorf("Running out of files should be retried, and anything else returned: %v", err)
+	}
+}
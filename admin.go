@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Everyone logs into the server as MysqlUsername, so the password a client
+// sends us normally doesn't matter. The exception is AdminUsers: if a client
+// logs in as one of those with the right password, its session can run the
+// admin commands (COM_REFRESH, COM_SHUTDOWN and COM_DEBUG) that everyone else
+// is refused.
+
+const COM_REFRESH byte = 0x07
+const COM_SHUTDOWN byte = 0x08
+const COM_DEBUG byte = 0x0d
+
+var adminCommandNames = map[byte]string{
+	COM_REFRESH:  "COM_REFRESH",
+	COM_SHUTDOWN: "COM_SHUTDOWN",
+	COM_DEBUG:    "COM_DEBUG",
+}
+
+func adminCommand(packet mysqlproto.Packet) bool {
+	_, ok := adminCommandNames[packetCommand(packet)]
+	return ok
+}
+
+// isAdminLogin reports whether the handshake response logs in one of the
+// AdminUsers with the right password.
+func isAdminLogin(username string, contents HandshakeContents, authPluginData []byte) bool {
+	hash, ok := config.AdminUsers[username]
+	if !ok {
+		return false
+	}
+	if contents.authPluginName != "" && contents.authPluginName != "mysql_native_password" {
+		output.Log("Admin user %s tried to log in with %s, but we only support mysql_native_password", username, contents.authPluginName)
+		return false
+	}
+	return verifyNativePassword(authPluginData, []byte(contents.password), hash)
+}
+
+// verifyNativePassword checks a mysql_native_password auth response against
+// the password's hash, in the same format as mysql.user: "*" followed by the
+// hex of SHA1(SHA1(password)). You can get one with SELECT PASSWORD('...')
+// on MySQL 5.7.
+func verifyNativePassword(authPluginData []byte, response []byte, hash string) bool {
+	stored, err := hex.DecodeString(strings.TrimPrefix(hash, "*"))
+	if err != nil || len(stored) != sha1.Size || len(response) != sha1.Size {
+		return false
+	}
+
+	// The response is SHA1(password) XOR SHA1(authPluginData + SHA1(SHA1(password))).
+	mask := sha1.Sum(append(append([]byte{}, authPluginData...), stored...))
+	hashedPassword := make([]byte, sha1.Size)
+	for i := range hashedPassword {
+		hashedPassword[i] = response[i] ^ mask[i]
+	}
+	check := sha1.Sum(hashedPassword)
+	return subtle.ConstantTimeCompare(check[:], stored) == 1
+}
+
+// SetAdmin records whether the session is allowed to run admin commands.
+func (proxy *ProxyConnection) SetAdmin(admin bool) {
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	proxy.admin = admin
+}
+
+// IsAdmin reports whether the session is allowed to run admin commands.
+func (proxy *ProxyConnection) IsAdmin() bool {
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	return proxy.admin
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The admin API is an HTTP control plane for the running proxy: it lists the
+// open sessions and what they're up to, kills them, turns sanitizing off (or
+// back on) for one of them, and shows the column rules in effect. Anyone who
+// can reach it can see every query and unsanitized data, so it only listens
+// on localhost unless AdminAPIBind says otherwise, every request needs the
+// AdminAPIToken, and everything it changes goes into the audit log.
+//
+//   GET  /connections
+//   POST /connections/<id>/kill
+//   POST /connections/<id>/sanitizing?enabled=false
+//   GET  /rules
+//   POST /handoff?socket=<path>
+
+// SessionRegistry keeps track of the open proxy sessions.
+type SessionRegistry struct {
+	mutex    sync.Mutex
+	sessions map[uint64]*ProxyConnection
+	nextID   uint64
+}
+
+var sessions = &SessionRegistry{sessions: map[uint64]*ProxyConnection{}}
+
+// Add gives the session an ID and starts keeping track of it.
+func (registry *SessionRegistry) Add(proxy *ProxyConnection) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.nextID++
+	proxy.id = registry.nextID
+	registry.sessions[proxy.id] = proxy
+}
+
+// Remove forgets about a closed session.
+func (registry *SessionRegistry) Remove(proxy *ProxyConnection) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	delete(registry.sessions, proxy.id)
+}
+
+// Get returns the session with the given ID, or nil.
+func (registry *SessionRegistry) Get(id uint64) *ProxyConnection {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.sessions[id]
+}
+
+// List returns the open sessions, oldest first.
+func (registry *SessionRegistry) List() []*ProxyConnection {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	list := []*ProxyConnection{}
+	for _, proxy := range registry.sessions {
+		list = append(list, proxy)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// SetQuery records the query the server is working on for the session, or
+// "" once it's done.
+func (proxy *ProxyConnection) SetQuery(query string) {
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	proxy.query = query
+}
+
+// SetSanitizing turns sanitizing on or off for the session.
+func (proxy *ProxyConnection) SetSanitizing(enabled bool) {
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	proxy.unsanitized = !enabled
+}
+
+// Sanitizing reports whether the session's results get sanitized, which they
+// do unless someone turned it off through the admin API.
+func (proxy *ProxyConnection) Sanitizing() bool {
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	return !proxy.unsanitized
+}
+
+type adminSession struct {
+	ID         uint64 `json:"id"`
+	Username   string `json:"username"`
+	Client     string `json:"client"`
+	Started    string `json:"started"`
+	Query      string `json:"query"`
+	Sanitizing bool   `json:"sanitizing"`
+}
+
+func (proxy *ProxyConnection) adminSession() adminSession {
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	return adminSession{proxy.id, proxy.username, proxy.clientAddr,
+		proxy.started.UTC().Format(time.RFC3339), proxy.query, !proxy.unsanitized}
+}
+
+type adminRuleSet struct {
+	Version string   `json:"version"`
+	Rules   []string `json:"rules"`
+}
+
+func describeRuleSet(ruleSet *RuleSet) adminRuleSet {
+	described := adminRuleSet{ruleSet.Version, []string{}}
+	for _, rule := range ruleSet.Rules {
+		described.Rules = append(described.Rules, rule.describe())
+	}
+	return described
+}
+
+// ServeAdminAPI runs the admin API on the given port until the context is
+// cancelled.
+func ServeAdminAPI(ctx context.Context, bind string, port int) {
+	server := &http.Server{
+		Addr:        net.JoinHostPort(bind, strconv.Itoa(port)),
+		Handler:     adminAPIHandler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		output.Log("Admin API on %s stopped: %s", server.Addr, err)
+	}
+}
+
+// checkAdminAPIConfig makes sure the admin API isn't turned on without a
+// token, since anything on the machine could use it otherwise.
+func checkAdminAPIConfig() error {
+	if config.AdminAPIPort > 0 && config.AdminAPIToken == "" {
+		return fmt.Errorf("AdminAPIToken has to be set to turn on the admin API")
+	}
+	return nil
+}
+
+func adminAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", handleAdminConnections)
+	mux.HandleFunc("/connections/", handleAdminConnection)
+	mux.HandleFunc("/rules", handleAdminRules)
+	mux.HandleFunc("/handoff", handleAdminHandoff)
+	return requireAdminToken(mux)
+}
+
+// requireAdminToken only lets requests with the AdminAPIToken through. A web
+// page can get a browser to send requests to localhost too (with a form, or
+// by rebinding its own host name to 127.0.0.1), so anything with an Origin
+// header, or a Host header that isn't us, is turned away before that.
+func requireAdminToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			writeAdminResponse(w, http.StatusForbidden, map[string]string{"error": "Requests from web pages aren't allowed"})
+			return
+		}
+		if !adminHostAllowed(r.Host) {
+			writeAdminResponse(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("Unexpected host %s", r.Host)})
+			return
+		}
+		token := r.Header.Get("Authorization")
+		if config.AdminAPIToken == "" || !strings.HasPrefix(token, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(token, "Bearer ")), []byte(config.AdminAPIToken)) != 1 {
+			output.Audit("Admin API (%s) refused %s %s without a valid token", r.RemoteAddr, r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mysql-sanitizer"`)
+			writeAdminResponse(w, http.StatusUnauthorized, map[string]string{"error": "Expected Authorization: Bearer <AdminAPIToken>"})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// adminHostAllowed reports whether a Host header could be for us: an IP
+// address, localhost, or the name we're bound to. Any other name could be
+// somebody else's, pointed at us.
+func adminHostAllowed(host string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.Trim(host, "[]")
+	return net.ParseIP(host) != nil || strings.EqualFold(host, "localhost") || strings.EqualFold(host, config.AdminAPIBind)
+}
+
+func handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAdminResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Use GET"})
+		return
+	}
+	list := []adminSession{}
+	for _, proxy := range sessions.List() {
+		list = append(list, proxy.adminSession())
+	}
+	writeAdminResponse(w, http.StatusOK, list)
+}
+
+func handleAdminConnection(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/connections/"), "/")
+	if len(parts) != 2 {
+		writeAdminResponse(w, http.StatusNotFound, map[string]string{"error": "Not found"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAdminResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Use POST"})
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	proxy := sessions.Get(id)
+	if err != nil || proxy == nil {
+		writeAdminResponse(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("No connection %s", parts[0])})
+		return
+	}
+
+	switch parts[1] {
+	case "kill":
+		output.Audit("Admin API (%s) killed connection %d for %s", r.RemoteAddr, id, proxy.Username())
+		proxy.Fail(fmt.Errorf("Killed through the admin API"))
+	case "sanitizing":
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			writeAdminResponse(w, http.StatusBadRequest, map[string]string{"error": "Expected ?enabled=true or ?enabled=false"})
+			return
+		}
+		output.Audit("Admin API (%s) turned sanitizing %s for connection %d for %s", r.RemoteAddr, onOff(enabled), id, proxy.Username())
+		proxy.SetSanitizing(enabled)
+	default:
+		writeAdminResponse(w, http.StatusNotFound, map[string]string{"error": "Not found"})
+		return
+	}
+	writeAdminResponse(w, http.StatusOK, proxy.adminSession())
+}
+
+func handleAdminRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAdminResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Use GET"})
+		return
+	}
+	response := map[string]interface{}{"current": describeRuleSet(canary.current)}
+	if canary.next != nil {
+		response["canary"] = describeRuleSet(canary.next)
+	}
+	writeAdminResponse(w, http.StatusOK, response)
+}
+
+// handleAdminHandoff hands idle sessions over to the instance listening on
+// the socket, e.g. before restarting this one.
+func handleAdminHandoff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAdminResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Use POST"})
+		return
+	}
+	socket := r.URL.Query().Get("socket")
+	if socket == "" {
+		writeAdminResponse(w, http.StatusBadRequest, map[string]string{"error": "Expected ?socket=<the other instance's HandoffSocket>"})
+		return
+	}
+	handedOff, kept, err := handOffSessions(socket)
+	if err != nil {
+		writeAdminResponse(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("Can't reach %s: %s", socket, err)})
+		return
+	}
+	output.Audit("Admin API (%s) handed %d sessions off to %s, keeping %d", r.RemoteAddr, len(handedOff), socket, len(kept))
+	writeAdminResponse(w, http.StatusOK, map[string]interface{}{"handed_off": handedOff, "kept": kept})
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+func writeAdminResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminRequest sends a request to the admin API with the token.
+func adminRequest(t *testing.T, method string, url string) *http.Response {
+	request, _ := http.NewRequest(method, url, nil)
+	request.Header.Set("Authorization", "Bearer "+config.AdminAPIToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("%s %s failed: %s", method, url, err)
+	}
+	return response
+}
+
+func TestAdminAPI_connections(t *testing.T) {
+	defer func() { config.AdminAPIToken = "" }()
+	config.AdminAPIToken = "sesame"
+	proxy := &ProxyConnection{ctx: context.Background(), username: "honk", clientAddr: "10.0.0.1:1234"}
+	sessions.Add(proxy)
+	defer sessions.Remove(proxy)
+	proxy.SetQuery("SELECT 1")
+
+	server := httptest.NewServer(adminAPIHandler())
+	defer server.Close()
+
+	response := adminRequest(t, "GET", server.URL+"/connections")
+	var list []adminSession
+	json.NewDecoder(response.Body).Decode(&list)
+	response.Body.Close()
+	found := false
+	for _, session := range list {
+		if session.ID == proxy.id {
+			found = session.Username == "honk" && session.Client == "10.0.0.1:1234" && session.Query == "SELECT 1" && session.Sanitizing
+		}
+	}
+	if !found {
+		t.Errorf("Bogus connection list: %+v", list)
+	}
+
+	url := fmt.Sprintf("%s/connections/%d/sanitizing?enabled=false", server.URL, proxy.id)
+	response = adminRequest(t, "POST", url)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Turning sanitizing off failed: %v", response)
+	}
+	response.Body.Close()
+	if proxy.Sanitizing() {
+		t.Error("Sanitizing should be off for the connection")
+	}
+
+	for _, path := range []string{"/connections/999999/kill", "/connections/honk/kill", fmt.Sprintf("/connections/%d/bonk", proxy.id)} {
+		response = adminRequest(t, "POST", server.URL+path)
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("Bogus response for %s: %v", path, response)
+		}
+		response.Body.Close()
+	}
+}
+
+func TestAdminAPI_rules(t *testing.T) {
+	oldCanary := canary
+	defer func() { canary = oldCanary }()
+	rules, _ := NewColumnRules(map[string]interface{}{"honk.bonk.secret": "redact"}, []PatternRule{})
+	canary = &Canary{current: &RuleSet{Version: "v1", Rules: rules}}
+
+	defer func() { config.AdminAPIToken = "" }()
+	config.AdminAPIToken = "sesame"
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "http://127.0.0.1/rules", nil)
+	request.Header.Set("Authorization", "Bearer sesame")
+	adminAPIHandler().ServeHTTP(recorder, request)
+	var response map[string]adminRuleSet
+	json.NewDecoder(recorder.Body).Decode(&response)
+	current := response["current"]
+	if current.Version != "v1" || len(current.Rules) != 1 || current.Rules[0] != `"honk.bonk.secret" = "redact"` {
+		t.Errorf("Bogus rules: %+v", response)
+	}
+	if _, ok := response["canary"]; ok {
+		t.Errorf("There's no canary, but got %+v", response)
+	}
+}
+
+func TestAdminAPI_auth(t *testing.T) {
+	defer func() { config.AdminAPIToken, config.AdminAPIPort = "", 0 }()
+	config.AdminAPIToken = "sesame"
+
+	requests := map[string]int{
+		"http://127.0.0.1:9000/rules Bearer sesame":         http.StatusOK,
+		"http://localhost/rules Bearer sesame":              http.StatusOK,
+		"http://127.0.0.1/rules Bearer sesam":               http.StatusUnauthorized,
+		"http://127.0.0.1/rules sesame":                     http.StatusUnauthorized,
+		"http://127.0.0.1/rules ":                           http.StatusUnauthorized,
+		"http://rebound.example.com/rules Bearer sesame":    http.StatusForbidden,
+		"http://127.0.0.1/connections/1/kill Bearer sesame": http.StatusNotFound,
+	}
+	for described, status := range requests {
+		parts := strings.SplitN(described, " ", 2)
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", parts[0], nil)
+		if strings.HasSuffix(parts[0], "/rules") {
+			request.Method = "GET"
+		}
+		request.Header.Set("Authorization", parts[1])
+		adminAPIHandler().ServeHTTP(recorder, request)
+		if recorder.Code != status {
+			t.Errorf("Expected %d for %s, got %d", status, described, recorder.Code)
+		}
+	}
+
+	// A form on some web page, with the right token somehow.
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "http://127.0.0.1/connections/1/sanitizing?enabled=false", nil)
+	request.Header.Set("Authorization", "Bearer sesame")
+	request.Header.Set("Origin", "https://evil.example.com")
+	adminAPIHandler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Requests with an Origin should be refused, got %d", recorder.Code)
+	}
+
+	config.AdminAPIToken, config.AdminAPIPort = "", 8080
+	if checkAdminAPIConfig() == nil {
+		t.Error("The admin API shouldn't start without a token")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha1"
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// SELECT PASSWORD('password')
+const testAdminHash = "*2470C0C06DEE42FD1618BB99005ADCA2EC9D1E19"
+
+// nativePasswordResponse does what a client does with its password.
+func nativePasswordResponse(authPluginData []byte, password string) []byte {
+	hash1 := sha1.Sum([]byte(password))
+	hash2 := sha1.Sum(hash1[:])
+	mask := sha1.Sum(append(append([]byte{}, authPluginData...), hash2[:]...))
+	response := make([]byte, sha1.Size)
+	for i := range response {
+		response[i] = hash1[i] ^ mask[i]
+	}
+	return response
+}
+
+func TestVerifyNativePassword(t *testing.T) {
+	authPluginData := []byte("0123456789abcdefghij")
+
+	if !verifyNativePassword(authPluginData, nativePasswordResponse(authPluginData, "password"), testAdminHash) {
+		t.Error("The right password should have been accepted")
+	}
+	if verifyNativePassword(authPluginData, nativePasswordResponse(authPluginData, "hunter2"), testAdminHash) {
+		t.Error("The wrong password should have been rejected")
+	}
+	if verifyNativePassword(authPluginData, []byte{}, testAdminHash) {
+		t.Error("An empty password should have been rejected")
+	}
+	if verifyNativePassword(authPluginData, nativePasswordResponse(authPluginData, "password"), "*bogus") {
+		t.Error("A bogus hash should never match")
+	}
+}
+
+func TestCheckCommandPolicy_Admin(t *testing.T) {
+	for _, command := range []byte{COM_REFRESH, COM_SHUTDOWN, COM_DEBUG} {
+		packet := mysqlproto.Packet{0, []byte{command}}
+		if !supportedCommand(packet) {
+			t.Errorf("Command 0x%02x should be supported", command)
+		}
+		if checkCommandPolicy(packet, false) == nil {
+			t.Errorf("Command 0x%02x should be refused for non-admins", command)
+		}
+		if err := checkCommandPolicy(packet, true); err != nil {
+			t.Errorf("Command 0x%02x should be allowed for admins: %s", command, err)
+		}
+	}
+}
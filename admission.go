@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// AdmissionConfig sheds queries from less important users while the MySQL
+// server is struggling, so the important ones still get through. "Struggling"
+// means the average time to the first response packet, or the fraction of
+// queries that failed in a way that smells like an overloaded server, went
+// over a threshold in the last Window seconds.
+//
+// Priorities go by the username the client sent, which nothing verifies, so
+// they're only as good as everybody's manners: a client can claim an
+// important user's name and get their priority.
+type AdmissionConfig struct {
+	Latency    int            // Average milliseconds to first response that counts as degraded (0 ignores latency)
+	ErrorRate  float64        // Fraction of failed queries that counts as degraded (0 ignores errors)
+	Window     int            // Seconds of queries to look at
+	MinQueries int            // Don't judge the server on fewer queries than this
+	Priorities map[string]int // Priority by username, with "*" for everyone else
+	ShedBelow  int            // While degraded, refuse queries from users with a lower priority than this
+	RetryAfter int            // Seconds we tell shed clients to wait before trying again
+}
+
+var defaultAdmissionConfig = AdmissionConfig{
+	0,                // Latency
+	0,                // ErrorRate
+	30,               // Window
+	20,               // MinQueries
+	map[string]int{}, // Priorities
+	1,                // ShedBelow
+	30,               // RetryAfter
+}
+
+// overloadErrorCodes are the server errors that count against its health.
+// Syntax errors and the like are the client's problem, not the server's.
+var overloadErrorCodes = map[uint16]bool{
+	1040: true, // ER_CON_COUNT_ERROR
+	1205: true, // ER_LOCK_WAIT_TIMEOUT
+	1317: true, // ER_QUERY_INTERRUPTED
+	3024: true, // ER_QUERY_TIMEOUT
+}
+
+type admissionBucket struct {
+	second  int64
+	queries int
+	errors  int
+	latency time.Duration
+}
+
+// AdmissionControl keeps per-second buckets of query outcomes and decides
+// who gets in.
+type AdmissionControl struct {
+	config   AdmissionConfig
+	mutex    sync.Mutex
+	buckets  []admissionBucket
+	shedding bool
+}
+
+// NewAdmissionControl returns an AdmissionControl, or nil if there are no
+// thresholds configured.
+func NewAdmissionControl(admissionConfig AdmissionConfig) (*AdmissionControl, error) {
+	if admissionConfig.Latency <= 0 && admissionConfig.ErrorRate <= 0 {
+		return nil, nil
+	}
+	if admissionConfig.Window < 1 {
+		return nil, fmt.Errorf("Window must be at least 1")
+	}
+	if admissionConfig.ErrorRate > 1 {
+		return nil, fmt.Errorf("ErrorRate is a fraction, so it can't be more than 1")
+	}
+	for username := range admissionConfig.Priorities {
+		if username != "*" {
+			output.Log("Admission priorities are set by username, but clients pick their own usernames, so anybody can claim a higher priority")
+			break
+		}
+	}
+	return &AdmissionControl{config: admissionConfig, buckets: make([]admissionBucket, admissionConfig.Window)}, nil
+}
+
+// Observe records how long the server took to start answering a query, and
+// whether the answer (nil if it never came) means it's in trouble.
+func (admission *AdmissionControl) Observe(latency time.Duration, response *mysqlproto.Packet) {
+	if admission == nil {
+		return
+	}
+	failed := response == nil || (packetIsERR(*response) && len(response.Payload) >= 3 &&
+		overloadErrorCodes[binary.LittleEndian.Uint16(response.Payload[1:3])])
+
+	now := time.Now().Unix()
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	bucket := &admission.buckets[now%int64(len(admission.buckets))]
+	if bucket.second != now {
+		*bucket = admissionBucket{second: now}
+	}
+	bucket.queries++
+	bucket.latency += latency
+	if failed {
+		bucket.errors++
+	}
+}
+
+// degraded reports whether the server's recent queries cross a threshold.
+// The caller holds the mutex.
+func (admission *AdmissionControl) degraded() bool {
+	now := time.Now().Unix()
+	var queries, errors int
+	var latency time.Duration
+	for _, bucket := range admission.buckets {
+		if now-bucket.second < int64(len(admission.buckets)) {
+			queries += bucket.queries
+			errors += bucket.errors
+			latency += bucket.latency
+		}
+	}
+	if queries == 0 || queries < admission.config.MinQueries {
+		return false
+	}
+	if admission.config.Latency > 0 && latency/time.Duration(queries) > time.Duration(admission.config.Latency)*time.Millisecond {
+		return true
+	}
+	return admission.config.ErrorRate > 0 && float64(errors)/float64(queries) > admission.config.ErrorRate
+}
+
+// Admit reports whether a query from the user should go to the server.
+func (admission *AdmissionControl) Admit(username string) bool {
+	if admission == nil {
+		return true
+	}
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+
+	degraded := admission.degraded()
+	if degraded != admission.shedding {
+		admission.shedding = degraded
+		if degraded {
+			output.Log("MySQL server looks degraded; shedding queries from users with priority below %d", admission.config.ShedBelow)
+		} else {
+			output.Log("MySQL server looks healthy again; no longer shedding queries")
+		}
+	}
+	return !degraded || admission.priority(username) >= admission.config.ShedBelow
+}
+
+func (admission *AdmissionControl) priority(username string) int {
+	if priority, ok := admission.config.Priorities[username]; ok {
+		return priority
+	}
+	return admission.config.Priorities["*"]
+}
+
+// statusRows returns a SHOW SANITIZER STATUS row saying whether we're
+// shedding, or nothing if admission control is off.
+func (admission *AdmissionControl) statusRows() [][]string {
+	if admission == nil {
+		return [][]string{}
+	}
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	return [][]string{{"Admission_shedding", onOff(admission.shedding)}}
+}
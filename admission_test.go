@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewAdmissionControl(t *testing.T) {
+	if admission, err := NewAdmissionControl(defaultAdmissionConfig); admission != nil || err != nil {
+		t.Errorf("No thresholds should mean no admission control: %v %v", admission, err)
+	}
+	bogus := defaultAdmissionConfig
+	bogus.ErrorRate = 5
+	if _, err := NewAdmissionControl(bogus); err == nil {
+		t.Error("ErrorRate over 1 should be an error")
+	}
+}
+
+func TestAdmissionControl_latency(t *testing.T) {
+	admissionConfig := defaultAdmissionConfig
+	admissionConfig.Latency = 100
+	admissionConfig.MinQueries = 5
+	admissionConfig.Priorities = map[string]int{"important": 1}
+	admission, err := NewAdmissionControl(admissionConfig)
+	if err != nil {
+		t.Fatalf("NewAdmissionControl failed: %s", err)
+	}
+
+	ok := OKPacket(0)
+	for i := 0; i < 4; i++ {
+		admission.Observe(time.Second, &ok)
+	}
+	if !admission.Admit("nobody") {
+		t.Error("Too few queries to call the server degraded")
+	}
+	admission.Observe(time.Second, &ok)
+	if admission.Admit("nobody") {
+		t.Error("Low-priority query should have been shed")
+	}
+	if !admission.Admit("important") {
+		t.Error("High-priority query should have been admitted")
+	}
+	if rows := admission.statusRows(); rows[0][1] != "on" {
+		t.Errorf("Bogus status rows: %v", rows)
+	}
+}
+
+func TestAdmissionControl_errors(t *testing.T) {
+	admissionConfig := defaultAdmissionConfig
+	admissionConfig.ErrorRate = 0.5
+	admissionConfig.MinQueries = 1
+	admission, _ := NewAdmissionControl(admissionConfig)
+
+	syntaxError := ErrorPacket(0, 1064, "42000", "Honk")
+	admission.Observe(time.Millisecond, &syntaxError)
+	if !admission.Admit("nobody") {
+		t.Error("Syntax errors aren't the server's fault")
+	}
+
+	lockTimeout := ErrorPacket(0, 1205, "HY000", "Bonk")
+	admission.Observe(time.Millisecond, &lockTimeout)
+	admission.Observe(time.Millisecond, nil)
+	if admission.Admit("nobody") {
+		t.Error("Two failures out of three queries should count as degraded")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Clients never log into the server themselves (we swap in our own
+// credentials), so they can't take part in any auth plugin negotiation
+// either. Instead, we always start with mysql_native_password, and if the
+// server wants something else (like MySQL 8's caching_sha2_password), we
+// handle the back-and-forth here and only pass the final OK or ERR along.
+
+const nativePasswordPlugin = "mysql_native_password"
+const cachingSha2Plugin = "caching_sha2_password"
+
+const authSwitchRequest byte = 0xFE
+const authMoreData byte = 0x01
+
+// caching_sha2_password's AuthMoreData statuses, and the request for the
+// server's public key.
+const cachingSha2FastAuthSuccess byte = 0x03
+const cachingSha2PerformFullAuth byte = 0x04
+const cachingSha2RequestPublicKey byte = 0x02
+
+// Without TLS, caching_sha2_password's full auth sends the password
+// encrypted with the server's RSA public key. Asking the server for that
+// key over the same plaintext connection lets anyone in the middle hand
+// over their own and read the password, so the key has to be pinned with
+// MysqlServerPublicKey, unless MysqlGetServerPublicKey says to take the
+// risk (like the mysql client's --get-server-public-key).
+var mysqlServerPublicKey *rsa.PublicKey
+
+// loadServerPublicKey reads MysqlServerPublicKey's PEM file, if there is
+// one.
+func loadServerPublicKey(path string) (*rsa.PublicKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePublicKey(contents)
+}
+
+// authenticate takes the server's response to our handshake response and
+// finishes logging in, returning the final OK packet.
+func authenticate(stream *mysqlproto.Stream, response mysqlproto.Packet, password string, authPluginData []byte) (mysqlproto.Packet, error) {
+	plugin := nativePasswordPlugin
+	requestedKey := false
+
+	for {
+		switch {
+		case packetIsOK(response):
+			return response, nil
+		case packetIsERR(response):
+			return response, fmt.Errorf("Login failed: %s", errorPacketMessage(response))
+		case response.Payload[0] == authSwitchRequest:
+			parser := NewPacketParser(response)
+			parser.ReadFixedInt1() // header
+			plugin = parser.ReadNullTermString()
+			authPluginData = []byte(parser.ReadFixedString(uint64(len(response.Payload)) - parser.offset))
+			if len(authPluginData) > 0 && authPluginData[len(authPluginData)-1] == 0x00 {
+				authPluginData = authPluginData[:len(authPluginData)-1]
+			}
+
+			var scramble []byte
+			switch plugin {
+			case nativePasswordPlugin:
+				scramble = nativePasswordScramble(authPluginData, password)
+			case cachingSha2Plugin:
+				scramble = cachingSha2Scramble(authPluginData, password)
+			default:
+				return response, fmt.Errorf("Server wants auth plugin %s, which we don't support", plugin)
+			}
+			WritePacket(stream, mysqlproto.Packet{response.SequenceID + 1, scramble})
+		case response.Payload[0] == authMoreData && plugin == cachingSha2Plugin:
+			if len(response.Payload) == 2 && response.Payload[1] == cachingSha2FastAuthSuccess {
+				// The OK follows.
+			} else if len(response.Payload) == 2 && response.Payload[1] == cachingSha2PerformFullAuth {
+				// We don't use TLS to the server, so the password has to
+				// be encrypted with its public key.
+				switch {
+				case mysqlServerPublicKey != nil:
+					encrypted, err := encryptPassword(mysqlServerPublicKey, authPluginData, password)
+					if err != nil {
+						return response, err
+					}
+					WritePacket(stream, mysqlproto.Packet{response.SequenceID + 1, encrypted})
+				case config.MysqlGetServerPublicKey:
+					WritePacket(stream, mysqlproto.Packet{response.SequenceID + 1, []byte{cachingSha2RequestPublicKey}})
+					requestedKey = true
+				default:
+					return response, fmt.Errorf("Server wants the password for caching_sha2_password, and there's no MysqlServerPublicKey to encrypt it with")
+				}
+			} else if requestedKey {
+				key, err := parsePublicKey(response.Payload[1:])
+				if err != nil {
+					return response, fmt.Errorf("Server sent a bogus public key: %s", err)
+				}
+				encrypted, err := encryptPassword(key, authPluginData, password)
+				if err != nil {
+					return response, err
+				}
+				WritePacket(stream, mysqlproto.Packet{response.SequenceID + 1, encrypted})
+				requestedKey = false
+			} else {
+				return response, fmt.Errorf("Unexpected packet during login: %v", response.Payload)
+			}
+		default:
+			return response, fmt.Errorf("Unexpected packet during login: %v", response.Payload)
+		}
+
+		var err error
+		response, err = stream.NextPacket()
+		if err != nil {
+			return response, err
+		}
+	}
+}
+
+// nativePasswordScramble is mysql_native_password's response:
+// SHA1(password) XOR SHA1(nonce + SHA1(SHA1(password))).
+func nativePasswordScramble(nonce []byte, password string) []byte {
+	if password == "" {
+		return []byte{}
+	}
+	hashed := sha1.Sum([]byte(password))
+	doubleHashed := sha1.Sum(hashed[:])
+	mask := sha1.Sum(append(append([]byte{}, nonce...), doubleHashed[:]...))
+	for i := range hashed {
+		hashed[i] ^= mask[i]
+	}
+	return hashed[:]
+}
+
+// cachingSha2Scramble is caching_sha2_password's fast auth response:
+// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + nonce).
+func cachingSha2Scramble(nonce []byte, password string) []byte {
+	if password == "" {
+		return []byte{}
+	}
+	hashed := sha256.Sum256([]byte(password))
+	doubleHashed := sha256.Sum256(hashed[:])
+	mask := sha256.Sum256(append(doubleHashed[:], nonce...))
+	for i := range hashed {
+		hashed[i] ^= mask[i]
+	}
+	return hashed[:]
+}
+
+// parsePublicKey parses a PEM-encoded RSA public key.
+func parsePublicKey(publicKey []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM-encoded key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse public key: %s", err)
+		}
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Public key isn't an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// encryptPassword encrypts the password for caching_sha2_password's full
+// auth, with the server's public key.
+func encryptPassword(key *rsa.PublicKey, nonce []byte, password string) ([]byte, error) {
+	if len(nonce) == 0 {
+		return nil, fmt.Errorf("Server didn't send a nonce to encrypt the password with")
+	}
+	plaintext := append([]byte(password), 0x00)
+	for i := range plaintext {
+		plaintext[i] ^= nonce[i%len(nonce)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, key, plaintext, nil)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestNativePasswordScramble(t *testing.T) {
+	nonce := []byte("abcdefghijklmnopqrst")
+	stage1 := sha1.Sum([]byte("hunter2"))
+	stage2 := sha1.Sum(stage1[:])
+	hash := "*" + hex.EncodeToString(stage2[:])
+
+	if !verifyNativePassword(nonce, nativePasswordScramble(nonce, "hunter2"), hash) {
+		t.Error("Scramble didn't verify")
+	}
+	if len(nativePasswordScramble(nonce, "")) != 0 {
+		t.Error("Empty password should have an empty scramble")
+	}
+}
+
+// fullAuthServer pretends to be a MySQL 8 server that has never seen this
+// user before, so the fast auth can't work. If sendKey, it expects to be
+// asked for its public key. It reports any problems on the channel, or ""
+// once the password checks out.
+func fullAuthServer(key *rsa.PrivateKey, nonce []byte, sendKey bool) (net.Conn, chan string) {
+	publicKey, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})
+	client, server := net.Pipe()
+	serverErrors := make(chan string, 1)
+
+	go func() {
+		defer server.Close()
+		stream := mysqlproto.NewStream(server)
+
+		scramble, _ := stream.NextPacket()
+		stage1 := sha256.Sum256([]byte("hunter2"))
+		stage2 := sha256.Sum256(stage1[:])
+		mask := sha256.Sum256(append(stage2[:], nonce...))
+		for i := range mask {
+			mask[i] ^= scramble.Payload[i]
+		}
+		if check := sha256.Sum256(mask[:]); !bytes.Equal(check[:], stage2[:]) {
+			serverErrors <- "Bogus fast auth scramble"
+			return
+		}
+		WritePacket(stream, mysqlproto.Packet{scramble.SequenceID + 1, []byte{authMoreData, cachingSha2PerformFullAuth}})
+
+		encrypted, err := stream.NextPacket()
+		if err != nil {
+			serverErrors <- ""
+			return
+		}
+		if sendKey {
+			if !bytes.Equal(encrypted.Payload, []byte{cachingSha2RequestPublicKey}) {
+				serverErrors <- "Didn't ask for the public key"
+				return
+			}
+			WritePacket(stream, mysqlproto.Packet{encrypted.SequenceID + 1, append([]byte{authMoreData}, publicKeyPEM...)})
+			encrypted, _ = stream.NextPacket()
+		}
+		plaintext, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, encrypted.Payload, nil)
+		if err != nil {
+			serverErrors <- "Can't decrypt password: " + err.Error()
+			return
+		}
+		for i := range plaintext {
+			plaintext[i] ^= nonce[i%len(nonce)]
+		}
+		if string(plaintext) != "hunter2\x00" {
+			serverErrors <- "Bogus password: " + string(plaintext)
+			return
+		}
+		WritePacket(stream, OKPacket(encrypted.SequenceID))
+		serverErrors <- ""
+	}()
+	return client, serverErrors
+}
+
+func TestAuthenticate_CachingSha2FullAuth(t *testing.T) {
+	defer func() { mysqlServerPublicKey, config.MysqlGetServerPublicKey = nil, false }()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := []byte("ABCDEFGHIJKLMNOPQRST")
+	switchRequest := append([]byte{authSwitchRequest}, cachingSha2Plugin+"\x00"...)
+	switchRequest = append(switchRequest, nonce...)
+	switchRequest = append(switchRequest, 0x00)
+
+	// The pinned key, then the one the server sends if we're allowed to
+	// ask for it.
+	for _, sendKey := range []bool{false, true} {
+		mysqlServerPublicKey, config.MysqlGetServerPublicKey = &key.PublicKey, false
+		if sendKey {
+			mysqlServerPublicKey, config.MysqlGetServerPublicKey = nil, true
+		}
+		client, serverErrors := fullAuthServer(key, nonce, sendKey)
+		response, err := authenticate(mysqlproto.NewStream(client), mysqlproto.Packet{2, switchRequest}, "hunter2", []byte("original nonce......"))
+		if err != nil {
+			t.Fatalf("authenticate failed: %s", err)
+		}
+		if !packetIsOK(response) {
+			t.Errorf("Expected OK, got %v", response.Payload)
+		}
+		if problem := <-serverErrors; problem != "" {
+			t.Error(problem)
+		}
+		client.Close()
+	}
+
+	// Neither, so there's nothing safe to encrypt the password with.
+	mysqlServerPublicKey, config.MysqlGetServerPublicKey = nil, false
+	client, serverErrors := fullAuthServer(key, nonce, false)
+	if _, err := authenticate(mysqlproto.NewStream(client), mysqlproto.Packet{2, switchRequest}, "hunter2", nil); err == nil {
+		t.Error("Full auth without a pinned key should have failed")
+	}
+	client.Close()
+	<-serverErrors
+}
+
+func TestLoadServerPublicKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "public_key.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}), 0644)
+
+	if loaded, err := loadServerPublicKey(path); err != nil || loaded.N.Cmp(key.PublicKey.N) != 0 {
+		t.Errorf("Bogus public key: %v, %v", loaded, err)
+	}
+	if loaded, err := loadServerPublicKey(""); loaded != nil || err != nil {
+		t.Errorf("No file should mean no key: %v, %v", loaded, err)
+	}
+	os.WriteFile(path, []byte("honk"), 0644)
+	if _, err := loadServerPublicKey(path); err == nil {
+		t.Error("Bogus key file should be an error")
+	}
+}
+
+func TestAuthenticate_UnknownPlugin(t *testing.T) {
+	client, _ := net.Pipe()
+	defer client.Close()
+
+	switchRequest := append([]byte{authSwitchRequest}, "auth_gssapi_client\x00"...)
+	if _, err := authenticate(mysqlproto.NewStream(client), mysqlproto.Packet{2, switchRequest}, "hunter2", nil); err == nil {
+		t.Error("Unknown plugin should have failed")
+	}
+}
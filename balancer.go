@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With MysqlHosts set, sessions are spread over a bunch of servers (usually
+// read replicas) instead of all going to MysqlHost. A server we couldn't
+// connect to is skipped for BackendRetryInterval seconds, unless every
+// other one is failing too. StandbyHosts only get sessions while all of the
+// main servers are failing, and are tried in the order they're listed.
+
+const (
+	balanceRoundRobin       = "round-robin"
+	balanceLeastConnections = "least-connections"
+)
+
+func checkBalancePolicy(policy string) bool {
+	return policy == balanceRoundRobin || policy == balanceLeastConnections
+}
+
+// backendDialTimeout is how long we wait for one server before trying the
+// next.
+const backendDialTimeout = 5 * time.Second
+
+type backend struct {
+	address     string
+	connections int64 // Open sessions, for least-connections
+	downUntil   time.Time
+	lastError   string
+}
+
+// Balancer picks which server each new session goes to.
+type Balancer struct {
+	policy        string
+	retryInterval time.Duration
+	mutex         sync.Mutex
+	backends      []*backend
+	standbys      []*backend
+	next          int // Where round-robin starts next time
+}
+
+// NewBalancer returns a Balancer for the "host:port" addresses and
+// standbys, or nil if there aren't any.
+func NewBalancer(addresses []string, standbys []string, policy string, retryInterval int) (*Balancer, error) {
+	if len(addresses) == 0 {
+		return nil, nil
+	}
+	if !checkBalancePolicy(policy) {
+		return nil, fmt.Errorf("Unknown BalancePolicy '%s' (expected %s or %s)", policy, balanceRoundRobin, balanceLeastConnections)
+	}
+	balancer := Balancer{policy: policy, retryInterval: time.Duration(retryInterval) * time.Second}
+	var err error
+	if balancer.backends, err = newBackends(addresses); err != nil {
+		return nil, err
+	}
+	if balancer.standbys, err = newBackends(standbys); err != nil {
+		return nil, err
+	}
+	return &balancer, nil
+}
+
+func newBackends(addresses []string) ([]*backend, error) {
+	backends := []*backend{}
+	for _, address := range addresses {
+		if _, port, err := net.SplitHostPort(address); err != nil || port == "" {
+			return nil, fmt.Errorf("Backend '%s' should look like host:port", address)
+		}
+		backends = append(backends, &backend{address: address})
+	}
+	return backends, nil
+}
+
+// candidates returns the backends in the order we should try them: healthy
+// ones first, in policy order and then the standbys, then the ones that
+// failed recently.
+func (balancer *Balancer) candidates() []*backend {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+
+	count := len(balancer.backends)
+	ordered := make([]*backend, 0, count)
+	for i := 0; i < count; i++ {
+		ordered = append(ordered, balancer.backends[(balancer.next+i)%count])
+	}
+	balancer.next = (balancer.next + 1) % count
+
+	if balancer.policy == balanceLeastConnections {
+		// Stable, so ties still take turns.
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return atomicLoad(&ordered[i].connections) < atomicLoad(&ordered[j].connections)
+		})
+	}
+	ordered = append(ordered, balancer.standbys...)
+	now := time.Now()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !now.Before(ordered[i].downUntil) && now.Before(ordered[j].downUntil)
+	})
+	return ordered
+}
+
+// Dial connects to the first backend that'll have us.
+func (balancer *Balancer) Dial() (net.Conn, error) {
+	var lastErr error
+	for _, backend := range balancer.candidates() {
+		conn, err := net.DialTimeout("tcp", backend.address, backendDialTimeout)
+		balancer.markResult(backend, err)
+		if err != nil {
+			output.Log("Can't connect to backend %s, trying the next one: %s", backend.address, err)
+			lastErr = err
+			continue
+		}
+		atomic.AddInt64(&backend.connections, 1)
+		return &balancedConn{Conn: conn, backend: backend}, nil
+	}
+	return nil, fmt.Errorf("Can't connect to any of the %d backends; last error: %s", len(balancer.backends)+len(balancer.standbys), lastErr)
+}
+
+func (balancer *Balancer) markResult(backend *backend, err error) {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+
+	if err != nil {
+		backend.downUntil = time.Now().Add(balancer.retryInterval)
+		backend.lastError = err.Error()
+	} else {
+		backend.downUntil = time.Time{}
+		backend.lastError = ""
+	}
+}
+
+func (balancer *Balancer) statusRows() [][]string {
+	if balancer == nil {
+		return nil
+	}
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+
+	rows := [][]string{}
+	now := time.Now()
+	for _, backend := range append(append([]*backend{}, balancer.backends...), balancer.standbys...) {
+		health := "ok"
+		if now.Before(backend.downUntil) {
+			health = "failing: " + backend.lastError
+		}
+		rows = append(rows,
+			[]string{"Backend_" + backend.address + "_health", health},
+			[]string{"Backend_" + backend.address + "_sessions", strconv.FormatInt(atomicLoad(&backend.connections), 10)})
+	}
+	return rows
+}
+
+// balancedConn gives its backend's connection back when it's closed.
+type balancedConn struct {
+	net.Conn
+	backend   *backend
+	closeOnce sync.Once
+}
+
+func (conn *balancedConn) Close() error {
+	conn.closeOnce.Do(func() { atomic.AddInt64(&conn.backend.connections, -1) })
+	return conn.Conn.Close()
+}
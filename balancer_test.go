@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestNewBalancer_bogus(t *testing.T) {
+	if balancer, err := NewBalancer([]string{}, nil, balanceRoundRobin, 10); balancer != nil || err != nil {
+		t.Errorf("No hosts should mean no balancer: %v (%v)", balancer, err)
+	}
+	if _, err := NewBalancer([]string{"honk"}, nil, balanceRoundRobin, 10); err == nil {
+		t.Error("Host without a port should be an error")
+	}
+	if _, err := NewBalancer([]string{"honk:3306"}, nil, "random", 10); err == nil {
+		t.Error("Unknown policy should be an error")
+	}
+}
+
+func testBackends(t *testing.T, count int) ([]string, func()) {
+	addresses := []string{}
+	listeners := []net.Listener{}
+	for i := 0; i < count; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Couldn't start a fake backend: %s", err)
+		}
+		go func() {
+			for {
+				if _, err := listener.Accept(); err != nil {
+					return
+				}
+			}
+		}()
+		listeners = append(listeners, listener)
+		addresses = append(addresses, listener.Addr().String())
+	}
+	return addresses, func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+}
+
+func TestBalancer_roundRobin(t *testing.T) {
+	addresses, stop := testBackends(t, 2)
+	defer stop()
+	balancer, _ := NewBalancer(addresses, nil, balanceRoundRobin, 10)
+
+	for i := 0; i < 4; i++ {
+		conn, err := balancer.Dial()
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		if address := conn.RemoteAddr().String(); address != addresses[i%2] {
+			t.Errorf("Connection %d went to %s", i, address)
+		}
+		conn.Close()
+	}
+}
+
+func TestBalancer_leastConnections(t *testing.T) {
+	addresses, stop := testBackends(t, 2)
+	defer stop()
+	balancer, _ := NewBalancer(addresses, nil, balanceLeastConnections, 10)
+
+	first, _ := balancer.Dial()
+	second, _ := balancer.Dial()
+	if first.RemoteAddr().String() == second.RemoteAddr().String() {
+		t.Error("Second session should have gone to the idle backend")
+	}
+	first.Close()
+	first.Close() // Only counts once
+	third, _ := balancer.Dial()
+	if third.RemoteAddr().String() != first.RemoteAddr().String() {
+		t.Errorf("Third session should have gone to %s, went to %s", first.RemoteAddr(), third.RemoteAddr())
+	}
+	if atomicLoad(&balancer.backends[0].connections) != 1 || atomicLoad(&balancer.backends[1].connections) != 1 {
+		t.Error("Bogus connection counts")
+	}
+}
+
+func TestBalancer_deadBackend(t *testing.T) {
+	addresses, stop := testBackends(t, 2)
+	defer stop()
+	// Nothing's listening on the first one any more.
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+	addresses[0] = dead.Addr().String()
+	balancer, _ := NewBalancer(addresses, nil, balanceRoundRobin, 10)
+
+	for i := 0; i < 3; i++ {
+		conn, err := balancer.Dial()
+		if err != nil || conn.RemoteAddr().String() != addresses[1] {
+			t.Fatalf("Dead backend should have been skipped: %v", err)
+		}
+		conn.Close()
+	}
+	if rows := balancer.statusRows(); rows[0][1] == "ok" || rows[2][1] != "ok" {
+		t.Errorf("Bogus backend status: %v", rows)
+	}
+
+	stop()
+	if _, err := balancer.Dial(); err == nil {
+		t.Error("Dial should fail with every backend down")
+	}
+}
+
+func TestBalancer_standby(t *testing.T) {
+	addresses, stop := testBackends(t, 2)
+	defer stop()
+	balancer, _ := NewBalancer(addresses[:1], addresses[1:], balanceRoundRobin, 10)
+
+	conn, err := balancer.Dial()
+	if err != nil || conn.RemoteAddr().String() != addresses[0] {
+		t.Fatalf("Standby shouldn't get sessions while the main server is up: %v", err)
+	}
+	balancer.connLost(conn, errors.New("honk"))
+	conn.Close()
+
+	conn, err = balancer.Dial()
+	if err != nil || conn.RemoteAddr().String() != addresses[1] {
+		t.Fatalf("Standby should get sessions while the main server is down: %v", err)
+	}
+	conn.Close()
+}
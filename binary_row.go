@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Prepared statements (COM_STMT_EXECUTE) send rows in the binary protocol,
+// where numbers and dates aren't strings. To sanitize them the same way as
+// text rows, we convert each value to the text protocol's format, run it
+// through sanitizeRowValues, and convert the result back.
+
+var binaryDateRegex = regexp.MustCompile(`^(\d{4})-(\d{2})-(\d{2})(?: (\d{2}):(\d{2}):(\d{2})(?:\.(\d{1,6}))?)?$`)
+var binaryTimeRegex = regexp.MustCompile(`^(-)?(\d+):(\d{2}):(\d{2})(?:\.(\d{1,6}))?$`)
+
+// ReadBinaryRow reads a binary protocol row, returning each value in the
+// format the text protocol would have used. NULLs are nil.
+func (parser *PacketParser) ReadBinaryRow(columns []Column) ([][]byte, error) {
+	if header := parser.ReadFixedInt1(); header != 0x00 {
+		return nil, fmt.Errorf("Weird header for binary row: 0x%02x", header)
+	}
+	nullBitmap := []byte(parser.ReadFixedString(uint64(len(columns)+7+2) / 8))
+
+	values := [][]byte{}
+	for i, col := range columns {
+		// The first two bits of the bitmap are reserved, for some reason.
+		if nullBitmap[(i+2)/8]&(1<<uint((i+2)%8)) != 0 {
+			values = append(values, nil)
+			continue
+		}
+		value, err := parser.readBinaryValue(col)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, []byte(value))
+	}
+	return values, nil
+}
+
+func (parser *PacketParser) readBinaryValue(col Column) (string, error) {
+	unsigned := col.Flags&UNSIGNED_FLAG != 0
+
+	switch col.Type {
+	case TYPE_LONGLONG:
+		value := parser.ReadFixedInt8()
+		if unsigned {
+			return strconv.FormatUint(value, 10), nil
+		}
+		return strconv.FormatInt(int64(value), 10), nil
+	case TYPE_LONG, TYPE_INT24:
+		value := parser.ReadFixedInt4()
+		if unsigned {
+			return strconv.FormatUint(uint64(value), 10), nil
+		}
+		return strconv.FormatInt(int64(int32(value)), 10), nil
+	case TYPE_SHORT, TYPE_YEAR:
+		value := parser.ReadFixedInt2()
+		if unsigned || col.Type == TYPE_YEAR {
+			return strconv.FormatUint(uint64(value), 10), nil
+		}
+		return strconv.FormatInt(int64(int16(value)), 10), nil
+	case TYPE_TINY:
+		value := parser.ReadFixedInt1()
+		if unsigned {
+			return strconv.FormatUint(uint64(value), 10), nil
+		}
+		return strconv.FormatInt(int64(int8(value)), 10), nil
+	case TYPE_DOUBLE:
+		return strconv.FormatFloat(math.Float64frombits(parser.ReadFixedInt8()), 'g', -1, 64), nil
+	case TYPE_FLOAT:
+		return strconv.FormatFloat(float64(math.Float32frombits(parser.ReadFixedInt4())), 'g', -1, 32), nil
+	case TYPE_DATE, TYPE_NEWDATE, TYPE_DATETIME, TYPE_TIMESTAMP:
+		return parser.readBinaryDate(col.Type)
+	case TYPE_TIME:
+		return parser.readBinaryTime()
+	}
+
+	// Everything else (strings, decimals, enums, blobs, etc.) is a
+	// length-encoded string, just like in the text protocol.
+	return parser.ReadVariableString(), nil
+}
+
+func (parser *PacketParser) readBinaryDate(colType byte) (string, error) {
+	length := parser.ReadFixedInt1()
+	if length != 0 && length != 4 && length != 7 && length != 11 {
+		return "", fmt.Errorf("Weird length for binary date: %d", length)
+	}
+
+	var year uint16
+	var month, day, hour, minute, second uint8
+	var micro uint32
+	if length >= 4 {
+		year = parser.ReadFixedInt2()
+		month = parser.ReadFixedInt1()
+		day = parser.ReadFixedInt1()
+	}
+	if length >= 7 {
+		hour = parser.ReadFixedInt1()
+		minute = parser.ReadFixedInt1()
+		second = parser.ReadFixedInt1()
+	}
+	if length == 11 {
+		micro = parser.ReadFixedInt4()
+	}
+
+	value := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if colType == TYPE_DATE || colType == TYPE_NEWDATE {
+		return value, nil
+	}
+	value += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+	if micro != 0 {
+		value += fmt.Sprintf(".%06d", micro)
+	}
+	return value, nil
+}
+
+func (parser *PacketParser) readBinaryTime() (string, error) {
+	length := parser.ReadFixedInt1()
+	if length != 0 && length != 8 && length != 12 {
+		return "", fmt.Errorf("Weird length for binary time: %d", length)
+	}
+	if length == 0 {
+		return "00:00:00", nil
+	}
+
+	negative := parser.ReadFixedInt1() == 1
+	days := parser.ReadFixedInt4()
+	hour := parser.ReadFixedInt1()
+	minute := parser.ReadFixedInt1()
+	second := parser.ReadFixedInt1()
+	var micro uint32
+	if length == 12 {
+		micro = parser.ReadFixedInt4()
+	}
+
+	value := fmt.Sprintf("%02d:%02d:%02d", days*24+uint32(hour), minute, second)
+	if negative {
+		value = "-" + value
+	}
+	if micro != 0 {
+		value += fmt.Sprintf(".%06d", micro)
+	}
+	return value, nil
+}
+
+// encodeBinaryRow is the opposite of ReadBinaryRow.
+func encodeBinaryRow(columns []Column, values [][]byte) ([]byte, error) {
+	nullBitmap := make([]byte, (len(columns)+7+2)/8)
+	encoded := []byte{}
+	for i, col := range columns {
+		if values[i] == nil {
+			nullBitmap[(i+2)/8] |= 1 << uint((i+2)%8)
+			continue
+		}
+		value, err := encodeBinaryValue(col, string(values[i]))
+		if err != nil {
+			return nil, fmt.Errorf("Can't encode %s.%s.%s: %s", col.Database, col.Table, col.Name, err)
+		}
+		encoded = append(encoded, value...)
+	}
+
+	row := append([]byte{0x00}, nullBitmap...)
+	return append(row, encoded...), nil
+}
+
+func encodeBinaryValue(col Column, value string) ([]byte, error) {
+	unsigned := col.Flags&UNSIGNED_FLAG != 0 || col.Type == TYPE_YEAR
+
+	switch col.Type {
+	case TYPE_LONGLONG, TYPE_LONG, TYPE_INT24, TYPE_SHORT, TYPE_YEAR, TYPE_TINY:
+		size := map[byte]int{TYPE_LONGLONG: 8, TYPE_LONG: 4, TYPE_INT24: 4, TYPE_SHORT: 2, TYPE_YEAR: 2, TYPE_TINY: 1}[col.Type]
+		var num uint64
+		if unsigned {
+			parsed, err := strconv.ParseUint(value, 10, size*8)
+			if err != nil {
+				return nil, err
+			}
+			num = parsed
+		} else {
+			parsed, err := strconv.ParseInt(value, 10, size*8)
+			if err != nil {
+				return nil, err
+			}
+			num = uint64(parsed)
+		}
+		return littleEndian(num, size), nil
+	case TYPE_DOUBLE:
+		num, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		return littleEndian(math.Float64bits(num), 8), nil
+	case TYPE_FLOAT:
+		num, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return nil, err
+		}
+		return littleEndian(uint64(math.Float32bits(float32(num))), 4), nil
+	case TYPE_DATE, TYPE_NEWDATE, TYPE_DATETIME, TYPE_TIMESTAMP:
+		return encodeBinaryDate(value)
+	case TYPE_TIME:
+		return encodeBinaryTime(value)
+	}
+
+	return VariableString("%s", value), nil
+}
+
+func encodeBinaryDate(value string) ([]byte, error) {
+	match := binaryDateRegex.FindStringSubmatch(value)
+	if match == nil {
+		return nil, fmt.Errorf("'%s' isn't a date", value)
+	}
+	year, _ := strconv.ParseUint(match[1], 10, 16)
+	fields := []byte{}
+	for _, field := range match[2:7] {
+		num, _ := strconv.ParseUint("0"+field, 10, 8)
+		fields = append(fields, byte(num))
+	}
+	micro := parseMicroseconds(match[7])
+
+	encoded := append(littleEndian(year, 2), fields[0], fields[1])
+	if micro != 0 {
+		encoded = append(encoded, fields[2], fields[3], fields[4])
+		encoded = append(encoded, littleEndian(micro, 4)...)
+	} else if fields[2] != 0 || fields[3] != 0 || fields[4] != 0 {
+		encoded = append(encoded, fields[2], fields[3], fields[4])
+	} else if year == 0 && fields[0] == 0 && fields[1] == 0 {
+		encoded = []byte{}
+	}
+	return append([]byte{byte(len(encoded))}, encoded...), nil
+}
+
+func encodeBinaryTime(value string) ([]byte, error) {
+	match := binaryTimeRegex.FindStringSubmatch(value)
+	if match == nil {
+		return nil, fmt.Errorf("'%s' isn't a time", value)
+	}
+	hours, err := strconv.ParseUint(match[2], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	minute, _ := strconv.ParseUint(match[3], 10, 8)
+	second, _ := strconv.ParseUint(match[4], 10, 8)
+	micro := parseMicroseconds(match[5])
+
+	negative := byte(0)
+	if match[1] == "-" {
+		negative = 1
+	}
+	if hours == 0 && minute == 0 && second == 0 && micro == 0 {
+		return []byte{0}, nil
+	}
+
+	encoded := []byte{negative}
+	encoded = append(encoded, littleEndian(hours/24, 4)...)
+	encoded = append(encoded, byte(hours%24), byte(minute), byte(second))
+	if micro != 0 {
+		encoded = append(encoded, littleEndian(micro, 4)...)
+	}
+	return append([]byte{byte(len(encoded))}, encoded...), nil
+}
+
+// parseMicroseconds turns the digits after the decimal point into
+// microseconds, so "5" is 500000.
+func parseMicroseconds(fraction string) uint64 {
+	if fraction == "" {
+		return 0
+	}
+	micro, _ := strconv.ParseUint(fraction+strings.Repeat("0", 6-len(fraction)), 10, 32)
+	return micro
+}
+
+func littleEndian(num uint64, size int) []byte {
+	bytes := make([]byte, size)
+	for i := range bytes {
+		bytes[i] = byte((num >> (8 * uint(i))) & 0xFF)
+	}
+	return bytes
+}
+
+// readBinaryRowValues is readRowValues for binary protocol rows.
+func readBinaryRowValues(packet mysqlproto.Packet, columns []Column) ([][]byte, error) {
+	raw, err := NewPacketParser(packet).ReadBinaryRow(columns)
+	if err != nil {
+		return nil, err
+	}
+	return sanitizeRowValues(columns, raw)
+}
+
+// constructNewBinaryResponse is constructNewResponse for binary protocol
+// rows.
+func constructNewBinaryResponse(originalPacket mysqlproto.Packet, columns []Column, rows [][]byte) (mysqlproto.Packet, error) {
+	payload, err := encodeBinaryRow(columns, rows)
+	if err != nil {
+		return mysqlproto.Packet{}, err
+	}
+	return mysqlproto.Packet{originalPacket.SequenceID, payload}, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestReadBinaryRow(t *testing.T) {
+	columns := []Column{
+		{false, "honk", "bonk", "id", "id", 20, TYPE_LONGLONG, UNSIGNED_FLAG, nil, "", false, nil},
+		{false, "honk", "bonk", "delta", "delta", 6, TYPE_SHORT, 0, nil, "", false, nil},
+		{true, "honk", "bonk", "name", "name", 255, TYPE_VAR_STRING, 0, nil, "", false, nil},
+		{false, "honk", "bonk", "missing", "missing", 11, TYPE_LONG, 0, nil, "", false, nil},
+		{false, "honk", "bonk", "created", "created", 26, TYPE_DATETIME, 0, nil, "", false, nil},
+		{false, "honk", "bonk", "elapsed", "elapsed", 10, TYPE_TIME, 0, nil, "", false, nil},
+		{false, "honk", "bonk", "score", "score", 22, TYPE_DOUBLE, 0, nil, "", false, nil},
+	}
+	payload := []byte{0x00, 0x20, 0x00} // header, and the NULL bitmap with "missing" set
+	payload = append(payload, 42, 0, 0, 0, 0, 0, 0, 0)
+	payload = append(payload, 0xFE, 0xFF)
+	payload = append(payload, VariableString("Alice")...)
+	payload = append(payload, 11, 0xE2, 0x07, 12, 31, 23, 59, 58, 0x3F, 0x42, 0x0F, 0x00)
+	payload = append(payload, 8, 1, 1, 0, 0, 0, 2, 3, 4)
+	payload = append(payload, littleEndian(0x3FF8000000000000, 8)...)
+	packet := mysqlproto.Packet{3, payload}
+
+	values, err := NewPacketParser(packet).ReadBinaryRow(columns)
+	if err != nil {
+		t.Fatalf("ReadBinaryRow failed: %s", err)
+	}
+	expected := []string{"42", "-2", "Alice", "", "2018-12-31 23:59:58.999999", "-26:03:04", "1.5"}
+	for i, value := range values {
+		if i == 3 {
+			if value != nil {
+				t.Errorf("Bogus value for NULL: %v", value)
+			}
+			continue
+		}
+		if string(value) != expected[i] {
+			t.Errorf("Bogus value for %s: '%s' instead of '%s'", columns[i].Name, value, expected[i])
+		}
+	}
+
+	// And it should all survive the trip back.
+	encoded, err := encodeBinaryRow(columns, values)
+	if err != nil {
+		t.Fatalf("encodeBinaryRow failed: %s", err)
+	}
+	if !bytes.Equal(encoded, payload) {
+		t.Errorf("Bogus round trip:\n%v\n%v", encoded, payload)
+	}
+}
+
+func TestReadBinaryRowValues_Sanitized(t *testing.T) {
+	columns := []Column{
+		{true, "honk", "bonk", "name", "name", 255, TYPE_VAR_STRING, 0, nil, "", false, nil},
+		{false, "honk", "bonk", "day", "day", 10, TYPE_DATE, 0, nil, "", false, nil},
+	}
+	payload := append([]byte{0x00, 0x00}, VariableString("Alice")...)
+	payload = append(payload, 4, 0xE2, 0x07, 1, 2)
+	packet := mysqlproto.Packet{3, payload}
+
+	rows, err := readBinaryRowValues(packet, columns)
+	if err != nil {
+		t.Fatalf("readBinaryRowValues failed: %s", err)
+	}
+	if string(rows[0]) == "Alice" {
+		t.Error("Name should have been sanitized")
+	}
+	if string(rows[1]) != "2018-01-02" {
+		t.Errorf("Bogus date: %s", rows[1])
+	}
+
+	response, err := constructNewBinaryResponse(packet, columns, rows)
+	if err != nil {
+		t.Fatalf("constructNewBinaryResponse failed: %s", err)
+	}
+	if !bytes.HasSuffix(response.Payload, []byte{4, 0xE2, 0x07, 1, 2}) {
+		t.Errorf("Bogus binary row: %v", response.Payload)
+	}
+}
+
+func TestEncodeBinaryValue_Invalid(t *testing.T) {
+	column := Column{false, "honk", "bonk", "id", "id", 11, TYPE_LONG, 0, nil, "", false, nil}
+	if _, err := encodeBinaryValue(column, "a1b2c3"); err == nil {
+		t.Error("Hash in an integer column should have been refused")
+	}
+	column.Type = TYPE_DATETIME
+	if _, err := encodeBinaryValue(column, "yesterday"); err == nil {
+		t.Error("Bogus datetime should have been refused")
+	}
+}
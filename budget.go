@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// BudgetConfig caps how much one session can do, so a notebook looping over
+// full-table scans can't hog the server forever. Once a session is over any
+// of the limits, each of its queries is either delayed by ThrottleDelay or
+// refused and the session closed, depending on Policy. Budgets are only
+// checked between queries, so the query that goes over still finishes (see
+// MaxResultDuration for capping single queries).
+type BudgetConfig struct {
+	Queries       int64  // Queries per session (0 for no limit)
+	Rows          int64  // Rows returned per session, plus rows affected by writes (0 for no limit)
+	Bytes         int64  // Bytes of rows returned per session (0 for no limit)
+	Policy        string // "throttle" or "terminate"
+	ThrottleDelay int    // Milliseconds to hold each query of a throttled session
+}
+
+const (
+	budgetThrottle  = "throttle"
+	budgetTerminate = "terminate"
+)
+
+var defaultBudgetConfig = BudgetConfig{
+	0,              // Queries
+	0,              // Rows
+	0,              // Bytes
+	budgetThrottle, // Policy
+	1000,           // ThrottleDelay
+}
+
+func checkBudgetPolicy(policy string) bool {
+	return policy == budgetThrottle || policy == budgetTerminate
+}
+
+// overBudget returns which of the session's budgets it's used up, or "".
+func (proxy *ProxyConnection) overBudget() string {
+	switch budget := config.Budget; {
+	case budget.Queries > 0 && atomicLoad(&proxy.usedQueries) > budget.Queries:
+		return fmt.Sprintf("%d queries", budget.Queries)
+	case budget.Rows > 0 && atomicLoad(&proxy.usedRows) > budget.Rows:
+		return fmt.Sprintf("%d rows", budget.Rows)
+	case budget.Bytes > 0 && atomicLoad(&proxy.usedBytes) > budget.Bytes:
+		return fmt.Sprintf("%d bytes", budget.Bytes)
+	}
+	return ""
+}
+
+// countAffectedRows charges the session for the rows a write touched, going
+// by the server's OK packet.
+func (proxy *ProxyConnection) countAffectedRows(packet mysqlproto.Packet) {
+	ok, err := proxy.ParseOK(packet)
+	if err != nil {
+		return
+	}
+	atomic.AddInt64(&proxy.usedRows, int64(ok.AffectedRows))
+}
+
+// enforceBudget deals with a query from a session that's over its budget.
+// It returns false if the query shouldn't run.
+func (server *ServerConnection) enforceBudget(packet mysqlproto.Packet, exceeded string) bool {
+	if config.Budget.Policy == budgetTerminate {
+		server.proxy.Output().Audit("Closing session for %s: it used up its budget of %s", server.proxy.Username(), exceeded)
+		err := NewProxyError(ErrPolicyViolation, nil, "This session used up its budget of %s; reconnect to start over", exceeded)
+		server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), packet.SequenceID, err))
+		server.proxy.Fail(fmt.Errorf("Session budget of %s used up", exceeded))
+		server.finished = true
+		return false
+	}
+
+	if !server.proxy.throttled {
+		server.proxy.throttled = true
+		server.proxy.Output().Log("Throttling session for %s: it used up its budget of %s", server.proxy.Username(), exceeded)
+	}
+	select {
+	case <-time.After(time.Duration(config.Budget.ThrottleDelay) * time.Millisecond):
+		return true
+	case <-server.proxy.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestOverBudget(t *testing.T) {
+	oldBudget := config.Budget
+	defer func() { config.Budget = oldBudget }()
+	config.Budget = BudgetConfig{Queries: 2, Rows: 10, Bytes: 0, Policy: budgetThrottle, ThrottleDelay: 1}
+
+	proxy := &ProxyConnection{ctx: context.Background()}
+	proxy.countQuery()
+	proxy.countQuery()
+	proxy.countRow(1000000)
+	if exceeded := proxy.overBudget(); exceeded != "" {
+		t.Errorf("Session shouldn't be over budget yet, but used up %s", exceeded)
+	}
+
+	// An UPDATE that touched 20 rows.
+	proxy.countAffectedRows(mysqlproto.Packet{1, []byte{0x00, 20, 0x00, 0x02, 0x00, 0x00, 0x00}})
+	if exceeded := proxy.overBudget(); exceeded != "10 rows" {
+		t.Errorf("Bogus budget check: %q", exceeded)
+	}
+	proxy.countQuery()
+	if exceeded := proxy.overBudget(); exceeded != "2 queries" {
+		t.Errorf("Bogus budget check: %q", exceeded)
+	}
+}
+
+func TestEnforceBudget(t *testing.T) {
+	oldBudget := config.Budget
+	defer func() { config.Budget = oldBudget }()
+	config.Budget = BudgetConfig{Queries: 1, Policy: budgetThrottle, ThrottleDelay: 1}
+
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	server := &ServerConnection{proxy, nil, false, false, false, nil, time.Now()}
+	query := mysqlproto.Packet{0, []byte{COM_QUERY, 'x'}}
+	if !server.enforceBudget(query, "1 queries") || !proxy.throttled || server.finished {
+		t.Error("Throttled query should still run")
+	}
+
+	clientEnd, _ := net.Pipe()
+	serverEnd, _ := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy = &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: ctx, cancel: cancel}
+	proxy.client = &ClientConnection{proxy, clientEnd, mysqlproto.NewStream(clientEnd), nil}
+	server = &ServerConnection{proxy, mysqlproto.NewStream(serverEnd), false, false, false, serverEnd, time.Now()}
+	proxy.server = server
+	stats.SessionOpened() // Closing the session counts it as closed
+	config.Budget.Policy = budgetTerminate
+	if server.enforceBudget(query, "1 queries") || !server.finished {
+		t.Error("Session over budget should have been terminated")
+	}
+	if errPacket := <-proxy.ClientChannel; !packetIsERR(errPacket) {
+		t.Errorf("Bogus budget error: %v", errPacket)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+)
+
+// CanaryConfig rolls a new version of the column rules out to some sessions
+// before everybody gets it. Sessions pick their rules when they log in and
+// keep them until they disconnect.
+//
+// Users goes by the username the client sent, which nothing verifies, so
+// anybody can pick which rules they get by logging in as one of them (or as
+// somebody else). It's for trying rules out, not for keeping anyone on the
+// stricter ones.
+type CanaryConfig struct {
+	Version      string                 // Name for the new rules in logs and SHOW SANITIZER STATUS
+	Percent      int                    // Percentage of new sessions that get the new rules
+	Users        []string               // Users who always get the new rules
+	Rules        map[string]interface{} // Like the top-level Rules
+	PatternRules []PatternRule          // Like the top-level PatternRules
+}
+
+var defaultCanaryConfig = CanaryConfig{
+	"canary",                 // Version
+	0,                        // Percent
+	[]string{},               // Users
+	map[string]interface{}{}, // Rules
+	[]PatternRule{},          // PatternRules
+}
+
+// A RuleSet is one version of the column rules, with counters so the
+// versions can be compared.
+type RuleSet struct {
+	Version         string
+	Rules           ColumnRules
+	sessions        int64
+	valuesSanitized int64
+}
+
+// A Canary decides which sessions get the new rules.
+type Canary struct {
+	current *RuleSet
+	next    *RuleSet
+	percent int
+	users   map[string]bool
+}
+
+// NewCanary compiles the canary rules. If there's nothing to roll out, every
+// session gets the current rules.
+func NewCanary(canaryConfig CanaryConfig, current *RuleSet) (*Canary, error) {
+	if canaryConfig.Percent <= 0 && len(canaryConfig.Users) == 0 {
+		return &Canary{current: current}, nil
+	}
+	rules, err := NewColumnRules(canaryConfig.Rules, canaryConfig.PatternRules)
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]bool{}
+	for _, username := range canaryConfig.Users {
+		users[username] = true
+	}
+	if len(users) > 0 {
+		output.Log("Canary rules go to users by name, but clients pick their own usernames, so anybody can choose which rules they get")
+	}
+	return &Canary{current, &RuleSet{Version: canaryConfig.Version, Rules: rules}, canaryConfig.Percent, users}, nil
+}
+
+// Choose picks the rules for a new session, and counts it.
+func (canary *Canary) Choose(username string) *RuleSet {
+	ruleSet := canary.current
+	if canary.next != nil && (canary.users[username] || rand.Intn(100) < canary.percent) {
+		ruleSet = canary.next
+	}
+	atomic.AddInt64(&ruleSet.sessions, 1)
+	return ruleSet
+}
+
+// statusRows returns SHOW SANITIZER STATUS rows comparing the two versions,
+// or nothing if there's no rollout going on.
+func (canary *Canary) statusRows() [][]string {
+	if canary == nil || canary.next == nil {
+		return [][]string{}
+	}
+	rows := [][]string{}
+	for _, ruleSet := range []*RuleSet{canary.current, canary.next} {
+		rows = append(rows,
+			[]string{"Sessions{rules=" + ruleSet.Version + "}", strconv.FormatInt(atomicLoad(&ruleSet.sessions), 10)},
+			[]string{"Values_sanitized{rules=" + ruleSet.Version + "}", strconv.FormatInt(atomicLoad(&ruleSet.valuesSanitized), 10)},
+		)
+	}
+	return rows
+}
+
+// SetRuleSet picks the session's column rules once we know who it is.
+func (proxy *ProxyConnection) SetRuleSet(username string) {
+	if canary == nil {
+		return
+	}
+	ruleSet := canary.Choose(username)
+	if ruleSet == canary.next {
+		proxy.Output().Audit("Session for %s is using the %s rules", username, ruleSet.Version)
+	}
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	proxy.ruleSet = ruleSet
+}
+
+// RuleSet returns the session's column rules, or nil before it's logged in.
+func (proxy *ProxyConnection) RuleSet() *RuleSet {
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	return proxy.ruleSet
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCanary_Choose(t *testing.T) {
+	current := &RuleSet{Version: "v1"}
+	canaryConfig := CanaryConfig{"v2", 0, []string{"tester"}, map[string]interface{}{"users.email": "redact"}, nil}
+	testCanary, err := NewCanary(canaryConfig, current)
+	if err != nil {
+		t.Fatalf("NewCanary failed: %s", err)
+	}
+
+	if ruleSet := testCanary.Choose("tester"); ruleSet.Version != "v2" {
+		t.Errorf("Canary users should get the new rules, not %s", ruleSet.Version)
+	}
+	if ruleSet := testCanary.Choose("somebody"); ruleSet != current {
+		t.Errorf("Everybody else should get the current rules, not %s", ruleSet.Version)
+	}
+
+	col := Column{true, "honk", "users", "email", "email", 255, 0, 0, testCanary.next, "", false, nil}
+	if col.Rules().Action(col) != ruleRedact || col.IsSafe() {
+		t.Error("Columns should follow their session's rules")
+	}
+
+	rows := testCanary.statusRows()
+	if len(rows) != 4 || rows[0][0] != "Sessions{rules=v1}" || rows[0][1] != "1" || rows[2][0] != "Sessions{rules=v2}" || rows[2][1] != "1" {
+		t.Errorf("Bogus status rows: %v", rows)
+	}
+
+	canaryConfig.Users, canaryConfig.Percent = nil, 100
+	testCanary, _ = NewCanary(canaryConfig, current)
+	if ruleSet := testCanary.Choose("somebody"); ruleSet.Version != "v2" {
+		t.Errorf("At 100%%, everybody should get the new rules, not %s", ruleSet.Version)
+	}
+
+	canaryConfig.Percent = 0
+	testCanary, _ = NewCanary(canaryConfig, current)
+	if ruleSet := testCanary.Choose("somebody"); ruleSet != current || len(testCanary.statusRows()) != 0 {
+		t.Error("Without a rollout, everybody should get the current rules")
+	}
+}
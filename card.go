@@ -0,0 +1,65 @@
+package main
+
+// Card numbers are 12 to 19 digits long, and the first six are the BIN
+// (issuer identification number), which we leave alone so the masked value
+// still looks like it came from the same issuer.
+const (
+	cardMinDigits = 12
+	cardMaxDigits = 19
+	cardBINDigits = 6
+)
+
+// maskCardNumber deterministically replaces the account digits of a card
+// number, keeping the BIN, the length, and any separators in place and
+// fixing up the final digit so the result passes a Luhn check. It returns
+// false if the value doesn't look like a card number.
+func maskCardNumber(value []byte, salt []byte) ([]byte, bool) {
+	digits := []byte{}
+	for _, char := range value {
+		if char >= '0' && char <= '9' {
+			digits = append(digits, char)
+		} else if char != ' ' && char != '-' {
+			return nil, false
+		}
+	}
+	if len(digits) < cardMinDigits || len(digits) > cardMaxDigits {
+		return nil, false
+	}
+
+	sum := hasher.Sum(digits, salt)
+	for i := cardBINDigits; i < len(digits)-1; i++ {
+		digits[i] = '0' + sum[i]%10
+	}
+	digits[len(digits)-1] = luhnCheckDigit(digits[:len(digits)-1])
+
+	masked := make([]byte, len(value))
+	next := 0
+	for i, char := range value {
+		if char >= '0' && char <= '9' {
+			masked[i] = digits[next]
+			next++
+		} else {
+			masked[i] = char
+		}
+	}
+	return masked, true
+}
+
+// luhnCheckDigit returns the digit that makes the given payload pass a Luhn
+// check when appended to it.
+func luhnCheckDigit(payload []byte) byte {
+	total := 0
+	for i := 0; i < len(payload); i++ {
+		digit := int(payload[len(payload)-1-i] - '0')
+		// Starting from the right, every other digit gets doubled, beginning
+		// with the one right next to the check digit.
+		if i%2 == 0 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		total += digit
+	}
+	return byte('0' + (10-total%10)%10)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func luhnValid(number string) bool {
+	digits := []byte{}
+	for _, char := range []byte(number) {
+		if char >= '0' && char <= '9' {
+			digits = append(digits, char)
+		}
+	}
+	return luhnCheckDigit(digits[:len(digits)-1]) == digits[len(digits)-1]
+}
+
+func TestLuhnCheckDigit(t *testing.T) {
+	// Well-known test card numbers.
+	for _, number := range []string{"4111111111111111", "5500005555555559", "378282246310005", "6011111111111117"} {
+		if !luhnValid(number) {
+			t.Errorf("Test card number %s doesn't pass our Luhn check!", number)
+		}
+	}
+	if luhnValid("4111111111111112") {
+		t.Error("Invalid card number passed our Luhn check!")
+	}
+}
+
+func TestMaskCardNumber(t *testing.T) {
+	masked, ok := maskCardNumber([]byte("4111111111111111"), []byte("salt"))
+	if !ok {
+		t.Fatal("Valid card number wasn't masked!")
+	}
+	if len(masked) != 16 {
+		t.Errorf("Masked card number changed length: '%s'", masked)
+	}
+	if string(masked[:6]) != "411111" {
+		t.Errorf("Masked card number lost its BIN: '%s'", masked)
+	}
+	if string(masked) == "4111111111111111" {
+		t.Error("Card number wasn't actually masked!")
+	}
+	if !luhnValid(string(masked)) {
+		t.Errorf("Masked card number fails Luhn check: '%s'", masked)
+	}
+
+	again, _ := maskCardNumber([]byte("4111111111111111"), []byte("salt"))
+	if string(again) != string(masked) {
+		t.Errorf("Card masking isn't deterministic: '%s' vs. '%s'", masked, again)
+	}
+}
+
+func TestMaskCardNumber_Separators(t *testing.T) {
+	masked, ok := maskCardNumber([]byte("3782-822463-10005"), []byte("salt"))
+	if !ok {
+		t.Fatal("Card number with dashes wasn't masked!")
+	}
+	if masked[4] != '-' || masked[11] != '-' || len(masked) != 17 {
+		t.Errorf("Masked card number lost its separators: '%s'", masked)
+	}
+	if !luhnValid(string(masked)) {
+		t.Errorf("Masked card number fails Luhn check: '%s'", masked)
+	}
+}
+
+func TestMaskCardNumber_NotACard(t *testing.T) {
+	for _, value := range []string{"12345", "4111 1111 1111 111x", "41111111111111111111"} {
+		if _, ok := maskCardNumber([]byte(value), []byte("salt")); ok {
+			t.Errorf("'%s' was treated as a card number!", value)
+		}
+	}
+}
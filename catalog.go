@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CatalogConfig points us at a data catalog that classifies columns, so the
+// governance folks can manage what's sensitive in one place. Columns tagged
+// as public are treated as if they were whitelisted, and columns tagged as
+// sensitive are always sanitized, even if whitelist.json says otherwise.
+//
+// The URL should return JSON like
+//
+//	[{"column": "database.table.column", "tags": ["PII"]}, ...]
+//
+// Catalogs like DataHub or Amundsen need a small adapter to produce that.
+type CatalogConfig struct {
+	URL           string   // Where to fetch column tags from (empty disables)
+	Interval      int      // Seconds between fetches
+	PublicTags    []string // Tags that mark a column as safe to show
+	SensitiveTags []string // Tags that mark a column as needing sanitization
+}
+
+var defaultCatalogConfig = CatalogConfig{
+	"",                     // URL
+	300,                    // Interval
+	[]string{"public"},     // PublicTags
+	[]string{"pii", "pci"}, // SensitiveTags
+}
+
+type columnClass int
+
+const (
+	classUnknown columnClass = iota
+	classPublic
+	classSensitive
+)
+
+type catalogEntry struct {
+	Column string
+	Tags   []string
+}
+
+// Catalog holds the latest column classifications from the data catalog.
+type Catalog struct {
+	url           string
+	publicTags    map[string]bool
+	sensitiveTags map[string]bool
+	client        *http.Client
+	classes       atomic.Value // map[string]columnClass
+}
+
+// NewCatalog returns a Catalog with no classifications yet.
+func NewCatalog(catalogConfig CatalogConfig) *Catalog {
+	catalog := Catalog{
+		url:           catalogConfig.URL,
+		publicTags:    map[string]bool{},
+		sensitiveTags: map[string]bool{},
+		client:        &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, tag := range catalogConfig.PublicTags {
+		catalog.publicTags[strings.ToLower(tag)] = true
+	}
+	for _, tag := range catalogConfig.SensitiveTags {
+		catalog.sensitiveTags[strings.ToLower(tag)] = true
+	}
+	catalog.classes.Store(map[string]columnClass{})
+	return &catalog
+}
+
+// Classify returns what the catalog thinks of the column.
+func (catalog *Catalog) Classify(col Column) columnClass {
+	classes := catalog.classes.Load().(map[string]columnClass)
+	return classes[col.Database+"."+col.Table+"."+col.Name]
+}
+
+// Refresh fetches the latest tags from the catalog. If anything goes wrong,
+// we keep using the previous ones.
+func (catalog *Catalog) Refresh() error {
+	response, err := catalog.client.Get(catalog.url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Catalog returned %s", response.Status)
+	}
+
+	entries := []catalogEntry{}
+	if err := json.NewDecoder(response.Body).Decode(&entries); err != nil {
+		return fmt.Errorf("Can't parse catalog response: %s", err)
+	}
+
+	classes := map[string]columnClass{}
+	public := 0
+	sensitive := 0
+	for _, entry := range entries {
+		name := strings.ToLower(entry.Column)
+		if strings.Count(name, ".") != 2 {
+			return fmt.Errorf("Catalog column '%s' should look like database.table.column", entry.Column)
+		}
+
+		// Sensitive tags win over public ones.
+		class := classUnknown
+		for _, tag := range entry.Tags {
+			tag = strings.ToLower(tag)
+			if catalog.sensitiveTags[tag] {
+				class = classSensitive
+				break
+			} else if catalog.publicTags[tag] {
+				class = classPublic
+			}
+		}
+
+		if class == classPublic {
+			public++
+		} else if class == classSensitive {
+			sensitive++
+		} else {
+			continue
+		}
+		classes[name] = class
+	}
+
+	catalog.classes.Store(classes)
+	output.Audit("Loaded catalog tags from %s: %d public columns, %d sensitive columns", catalog.url, public, sensitive)
+	return nil
+}
+
+// RunRefreshes refreshes the tags forever.
+func (catalog *Catalog) RunRefreshes(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := catalog.Refresh(); err != nil {
+			output.Log("Couldn't refresh catalog tags, keeping the old ones: %s", err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCatalog_Refresh(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"column": "honk.bonk.name", "tags": ["PII"]},
+			{"column": "honk.bonk.color", "tags": ["public"]},
+			{"column": "honk.bonk.card", "tags": ["public", "PCI"]},
+			{"column": "honk.bonk.other", "tags": ["finance"]}
+		]`))
+	}))
+	defer server.Close()
+
+	catalog := NewCatalog(CatalogConfig{server.URL, 300, []string{"public"}, []string{"pii", "pci"}})
+	if err := catalog.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+
+	expected := map[string]columnClass{
+		"name":    classSensitive,
+		"color":   classPublic,
+		"card":    classSensitive,
+		"other":   classUnknown,
+		"missing": classUnknown,
+	}
+	for name, class := range expected {
+		column := Column{true, "honk", "bonk", name, name, 255, 0, 0, nil, "", false, nil}
+		if catalog.Classify(column) != class {
+			t.Errorf("Bogus class for %s: %d", name, catalog.Classify(column))
+		}
+	}
+}
+
+func TestCatalog_RefreshKeepsOldTags(t *testing.T) {
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "nope", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`[{"column": "honk.bonk.name", "tags": ["PII"]}]`))
+	}))
+	defer server.Close()
+
+	catalog := NewCatalog(CatalogConfig{server.URL, 300, []string{"public"}, []string{"pii"}})
+	if err := catalog.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+	fail = true
+	if err := catalog.Refresh(); err == nil {
+		t.Error("Refresh should have failed")
+	}
+
+	if catalog.Classify(Column{true, "honk", "bonk", "name", "name", 255, 0, 0, nil, "", false, nil}) != classSensitive {
+		t.Error("A failed refresh shouldn't throw away the old tags")
+	}
+}
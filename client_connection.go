@@ -1,7 +1,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/pubnative/mysqlproto-go"
 )
@@ -9,6 +13,7 @@ import (
 // A Client represents a single client connection to the MySQL server.
 type ClientConnection struct {
 	proxy          *ProxyConnection
+	conn           net.Conn
 	stream         *mysqlproto.Stream
 	authPluginData []byte
 }
@@ -22,77 +27,168 @@ type HandshakeContents struct {
 	database       string
 	authPluginName string
 	connectAttrs   map[string]string
+	zstdLevel      byte
 }
 
 // NewClientConnection returns a new ClientConnection object.
 func NewClientConnection(proxy *ProxyConnection, conn net.Conn) *ClientConnection {
 	var client ClientConnection
 	client.proxy = proxy
+	client.conn = conn
 	client.stream = mysqlproto.NewStream(conn)
 	return &client
 }
 
 // ProcessInput listens for client requests and proxies them to the MySQL server.
 func (client *ClientConnection) Run() {
-	firstPacket := true
+	defer client.proxy.dumpTraceOnPanic()
+	firstPacket := !client.proxy.adopted
+	loggingIn := false
 	incoming := make(chan mysqlproto.Packet)
 	go client.getPackets(incoming)
 
+	// Packets in either direction count as activity, so a long query isn't
+	// mistaken for an idle client.
+	var idle <-chan time.Time
+	idleTimeout := time.Duration(config.IdleTimeout) * time.Second
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
 	for {
 		select {
 		case packet := <-client.proxy.ClientChannel:
+			var compression *compressedConn
 			if firstPacket {
 				// This is the first packet the server sent, so it must be
 				// the start of the handshake.
 				client.authPluginData = client.getAuthPluginData(packet)
 				firstPacket = false
+				loggingIn = true
+			} else if loggingIn {
+				// The next one says whether the login worked, and if it did,
+				// everything after it might be compressed.
+				loggingIn = false
+				if packetIsOK(packet) {
+					compression = client.proxy.negotiatedCompression(client.conn)
+				}
+			}
+			if compression != nil {
+				compression.enableReads()
+			}
+			if err := client.write(packet); err != nil {
+				client.proxy.Fail(fmt.Errorf("Couldn't write to client: %s", err))
+				return
+			}
+			if compression != nil {
+				compression.enableWrites()
 			}
-			WritePacket(client.stream, packet)
+			resetTimer(idleTimer, idleTimeout)
 		case packet, more := <-incoming:
 			if more {
-				client.proxy.ServerChannel <- packet
+				client.proxy.SendToServer(packet)
+				atomic.AddInt64(&client.proxy.inFlight, -1)
+				resetTimer(idleTimer, idleTimeout)
 			} else {
 				client.proxy.Close()
 				return
 			}
+		case <-idle:
+			client.proxy.Fail(fmt.Errorf("Client was idle for %d seconds", config.IdleTimeout))
+			return
+		case <-client.proxy.ctx.Done():
+			return
 		}
 	}
 }
 
 func (client *ClientConnection) getPackets(channel chan mysqlproto.Packet) {
-	firstPacket := true
+	firstPacket := !client.proxy.adopted
 
 	for {
-		packet, err := client.stream.NextPacket()
+		packet, err := ReadPacket(client.stream)
 		if err != nil {
-			output.Log("Disconnected from client: %s", err)
+			if !errors.Is(err, errHandedOff) {
+				client.proxy.Output().Log("Disconnected from client: %s", err)
+			}
+			close(channel)
+			return
+		}
+		// Counted before anything can change it, so a hand-off can tell
+		// whether there's any of the next packet in the stream already.
+		atomic.AddInt64(&client.proxy.clientBytes, int64(len(packet.Payload)+4*packetPieces(len(packet.Payload))))
+		atomic.AddInt64(&client.proxy.inFlight, 1)
+		if firstPacket && isXProtocolHello(packet) {
+			client.proxy.Output().Log("Disconnecting X Protocol client: %s", xProtocolHelp())
 			close(channel)
 			return
 		}
 		if firstPacket {
 			// This is the first packet the client sent, so it must be a handshake.
-			packet = client.replacePassword(packet, config.MysqlUsername, config.MysqlPassword)
+			credentials := client.proxy.credentials
+			packet = client.replacePassword(packet, credentials.MysqlUsername, credentials.MysqlPassword)
 			firstPacket = false
 		}
-		output.Dump(packet.Payload, "Packet from client:\n")
-		channel <- packet
+		client.proxy.Output().Dump(packet.Payload, "Packet from client:\n")
+		select {
+		case channel <- packet:
+		case <-client.proxy.ctx.Done():
+			return
+		}
 	}
 }
 
+// write sends the client a packet, giving up if the client doesn't read it
+// within WriteTimeout.
+func (client *ClientConnection) write(packet mysqlproto.Packet) error {
+	client.conn.SetWriteDeadline(writeDeadline())
+	return WritePacket(client.stream, packet)
+}
+
 func (client *ClientConnection) Close() {
 	client.stream.Close()
 }
 
 func (client *ClientConnection) replacePassword(packet mysqlproto.Packet, username string, password string) mysqlproto.Packet {
 	contents := client.parseHandshakeResponse(packet)
-	contents.username = config.MysqlUsername
-	contents.password = config.MysqlPassword
+	clientUsername, labels := parseUsernameLabels(contents.username, config.AllowedLabels)
+	client.proxy.SetLabels(clientUsername, labels)
+	client.proxy.Output().Audit("Session opened for %s", clientUsername)
+	client.proxy.SetRuleSet(clientUsername)
+	client.proxy.SetWatermark(clientUsername, labels)
+	if err := client.proxy.StartRecording(clientUsername); err != nil {
+		client.proxy.Fail(fmt.Errorf("Couldn't start recording the session: %s", err))
+	}
+	if isAdminLogin(clientUsername, contents, client.authPluginData) {
+		client.proxy.SetAdmin(true)
+		client.proxy.Output().Audit("%s logged in as an admin", clientUsername)
+	}
+	contents.username = username
+	contents.password = password
+	// That's the only kind of scramble we send, whatever the client
+	// asked for. If the server wants another plugin, it'll ask to switch.
+	contents.authPluginName = nativePasswordPlugin
+	if config.PinnedDatabase != "" {
+		// Whatever they asked for, they get the pinned database.
+		contents.database = config.PinnedDatabase
+		contents.flags |= mysqlproto.CLIENT_CONNECT_WITH_DB
+	}
 	client.proxy.Database = contents.database
 
-	// We always disable MULTI_STATEMENTS for now because they're annoying
-	// to parse. If you need it, patches welcome!
+	// MULTI_STATEMENTS is off unless it's turned on in the config, since
+	// anything that looks at queries has to know to look at every statement.
+	flags := contents.flags & client.proxy.Capabilities
+	if !config.MultiStatements {
+		flags &^= mysqlproto.CLIENT_MULTI_STATEMENTS
+	}
+	if config.LocalInfile != localInfileRelay {
+		flags &^= mysqlproto.CLIENT_LOCAL_FILES
+	}
 	newPayload := mysqlproto.HandshakeResponse41(
-		contents.flags&client.proxy.Capabilities & ^mysqlproto.CLIENT_MULTI_STATEMENTS,
+		flags,
 		contents.characterSet,
 		contents.username,
 		contents.password,
@@ -101,6 +197,13 @@ func (client *ClientConnection) replacePassword(packet mysqlproto.Packet, userna
 		contents.authPluginName,
 		map[string]string{}, // FIXME: We don't support client connect attrs yet.
 	)
+	if flags&CLIENT_ZSTD_COMPRESSION_ALGORITHM > 0 {
+		// mysqlproto doesn't know about this, but it's always last.
+		newPayload = append(newPayload, contents.zstdLevel)
+		client.proxy.zstdLevel = contents.zstdLevel
+	}
+	// From here on, we need what both sides agreed on to parse OK packets.
+	client.proxy.Capabilities = flags
 	return mysqlproto.Packet{packet.SequenceID, newPayload[4:]}
 }
 
@@ -129,12 +232,29 @@ func (client *ClientConnection) parseHandshakeResponse(packet mysqlproto.Packet)
 		contents.authPluginName = parser.ReadNullTermString()
 	}
 
-	// FIXME: We don't support client connect attrs yet.
+	// FIXME: We don't support client connect attrs yet, so just skip them.
+	if contents.flags&mysqlproto.CLIENT_CONNECT_ATTRS > 0 && parser.Remaining() > 0 {
+		if length := parser.ReadEncodedInt(); length <= parser.Remaining() {
+			parser.ReadFixedString(length)
+		}
+	}
+
+	if contents.flags&CLIENT_ZSTD_COMPRESSION_ALGORITHM > 0 && parser.Remaining() > 0 {
+		contents.zstdLevel = parser.ReadFixedInt1()
+	}
 
 	return contents
 }
 
 func (client *ClientConnection) getAuthPluginData(packet mysqlproto.Packet) []byte {
+	data, capabilities := parseGreeting(packet)
+	client.proxy.Capabilities = capabilities
+	return data
+}
+
+// parseGreeting returns the auth plugin data and capability flags from a
+// server's initial handshake packet.
+func parseGreeting(packet mysqlproto.Packet) ([]byte, uint32) {
 	parser := NewPacketParser(packet)
 	parser.ReadFixedInt1()                    // protocol version
 	parser.ReadNullTermString()               // server version
@@ -144,23 +264,23 @@ func (client *ClientConnection) getAuthPluginData(packet mysqlproto.Packet) []by
 	lowerFlags := parser.ReadFixedInt2()      // capability flags
 
 	if uint64(len(packet.Payload)) <= parser.offset {
-		return data
+		return data, uint32(lowerFlags)
 	}
 
 	parser.ReadFixedInt1()               // character set
 	parser.ReadFixedInt2()               // status flags
 	upperFlags := parser.ReadFixedInt2() // more capability flags, sheesh
-	client.proxy.Capabilities = uint32(lowerFlags) | (uint32(upperFlags) << 16)
+	capabilities := uint32(lowerFlags) | (uint32(upperFlags) << 16)
 	var dataLen uint64 = uint64(parser.ReadFixedInt1() - 8)
 	if dataLen > 13 {
 		dataLen = 13
 	}
 	parser.ReadFixedString(10) // unused garbage
 
-	if client.proxy.Capabilities&mysqlproto.CLIENT_SECURE_CONNECTION > 0 {
+	if capabilities&mysqlproto.CLIENT_SECURE_CONNECTION > 0 {
 		// Don't ask about the -1. :~(
 		data = append(data, []byte(parser.ReadFixedString(dataLen-1))...)
 	}
 
-	return data
+	return data, capabilities
 }
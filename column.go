@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+
+	"github.com/pubnative/mysqlproto-go"
 )
 
 const TYPE_VARCHAR byte = 0x0F
@@ -12,14 +15,61 @@ const TYPE_LONG_BLOB byte = 0xFB
 const TYPE_BLOB byte = 0xFC
 const TYPE_VAR_STRING byte = 0xFD
 const TYPE_STRING byte = 0xFE
+const TYPE_DECIMAL byte = 0x00
+const TYPE_TINY byte = 0x01
+const TYPE_SHORT byte = 0x02
+const TYPE_LONG byte = 0x03
+const TYPE_FLOAT byte = 0x04
+const TYPE_DOUBLE byte = 0x05
+const TYPE_LONGLONG byte = 0x08
+const TYPE_INT24 byte = 0x09
+const TYPE_NEWDECIMAL byte = 0xF6
+const TYPE_TIMESTAMP byte = 0x07
+const TYPE_DATE byte = 0x0A
+const TYPE_TIME byte = 0x0B
+const TYPE_DATETIME byte = 0x0C
+const TYPE_YEAR byte = 0x0D
+const TYPE_NEWDATE byte = 0x0E
+
+const NOT_NULL_FLAG uint16 = 0x0001
+const UNSIGNED_FLAG uint16 = 0x0020
+const BINARY_FLAG uint16 = 0x0080
 
 type Column struct {
-	IsString bool
-	Database string
-	Table    string
-	Alias    string
-	Name     string
-	Length   uint32
+	IsString  bool
+	Database  string
+	Table     string
+	Alias     string
+	Name      string
+	Length    uint32
+	Type      byte
+	Flags     uint16
+	ruleSet   *RuleSet // The session's column rules, or nil for the global ones
+	watermark string   // The session's watermark key, or "" if its hashes aren't watermarked
+	tainted   bool     // Has no table, but might hold something from one anyway
+	inputs    []Column // For an expression we could trace, the columns it's made of (non-nil even if there are none)
+}
+
+// ColumnSet is a set of fully-qualified "database.table.column" names, for
+// config options that single out specific columns.
+type ColumnSet map[string]bool
+
+// NewColumnSet returns a ColumnSet, or an error if any of the names isn't
+// fully qualified.
+func NewColumnSet(names []string) (ColumnSet, error) {
+	set := ColumnSet{}
+	for _, name := range names {
+		if strings.Count(name, ".") != 2 {
+			return nil, fmt.Errorf("Column '%s' should look like database.table.column", name)
+		}
+		set[strings.ToLower(name)] = true
+	}
+	return set, nil
+}
+
+// Contains reports whether the column is in the set.
+func (set ColumnSet) Contains(col Column) bool {
+	return set[col.Database+"."+col.Table+"."+col.Name]
 }
 
 func ReadColumn(parser *PacketParser) (Column, error) {
@@ -39,6 +89,8 @@ func ReadColumn(parser *PacketParser) (Column, error) {
 	parser.ReadFixedInt2() // character set
 	column.Length = parser.ReadFixedInt4()
 	colType := parser.ReadFixedInt1()
+	column.Type = colType
+	column.Flags = parser.ReadFixedInt2()
 	// We ignore the remaining fields
 
 	if colType == TYPE_VARCHAR || colType == TYPE_TINY_BLOB || colType == TYPE_MEDIUM_BLOB ||
@@ -53,7 +105,35 @@ func ReadColumn(parser *PacketParser) (Column, error) {
 	return column, nil
 }
 
+// Rules returns the column rules that apply to the column, which depend on
+// which rules its session is trying out.
+func (col Column) Rules() ColumnRules {
+	if col.ruleSet != nil {
+		return col.ruleSet.Rules
+	}
+	return columnRules
+}
+
 func (col Column) IsSafe() bool {
+	// Somebody thinks the rules are broken, so trust nothing.
+	if currentMode() == modeForceSanitize {
+		return false
+	}
+
+	// An expression is no safer than the columns it's made of.
+	if _, unsafe := col.unsafeInput(); unsafe {
+		return false
+	}
+
+	// Explicit rules come before everything else, even for non-strings,
+	// except that the catalog can still insist on sanitizing a column.
+	switch col.Rules().Action(col) {
+	case rulePass:
+		return catalog.Classify(col) != classSensitive
+	case ruleHash, ruleRedact, ruleNull, rulePartial, ruleEmail, rulePhone, ruleFakeName, ruleFakeAddress, ruleFakeCompany:
+		return false
+	}
+
 	// At this time, we believe that all non-string columns are safe.
 	if !col.IsString {
 		return true
@@ -66,15 +146,27 @@ func (col Column) IsSafe() bool {
 	}
 
 	// Allow viewing the values of internal stuff like EXPLAIN output and "@@" MySQL variables.
-	if col.Database == "" && col.Table == "" {
-		// But not things like `CONCAT(address, " ")`, which suuuuuck. (We
-		// should inspect those more closely, but that's for later when we
-		// actually start parsing SQL.)
+	if col.Database == "" && col.Table == "" && !col.tainted {
+		// Expressions we could trace were checked above.
+		if config.MaskExpressions && col.inputs != nil {
+			return true
+		}
+		// Expressions have no original name. We couldn't tell what this
+		// one's made of, so it could be anything, but without
+		// MaskExpressions they all get through, the way they always have.
 		if col.Name == "" {
-			return !strings.Contains(col.Name, "(")
-		} else {
-			return !strings.Contains(col.Alias, "(")
+			return !config.MaskExpressions
 		}
+		// But not things like `CONCAT(address, " ")`, which suuuuuck.
+		return !strings.Contains(col.Alias, "(")
+	}
+
+	// The data catalog gets the final say, if it has an opinion.
+	switch catalog.Classify(col) {
+	case classSensitive:
+		return false
+	case classPublic:
+		return true
 	}
 
 	// If we've explicitly permitted this column in the JSON list, it's safe.
@@ -84,3 +176,117 @@ func (col Column) IsSafe() bool {
 
 	return false
 }
+
+// unsafeInput returns the first of an expression's inputs that would be
+// sanitized, taken as if it had the expression's type, if there is one.
+// Which of them is a string doesn't matter much: a function can turn one
+// into the other, so the result's type is the best guess we've got.
+func (col Column) unsafeInput() (Column, bool) {
+	if !config.MaskExpressions {
+		return Column{}, false
+	}
+	for _, input := range col.inputs {
+		input.IsString, input.Type, input.ruleSet = col.IsString, col.Type, col.ruleSet
+		if !input.IsSafe() {
+			return input, true
+		}
+	}
+	return Column{}, false
+}
+
+// integerBits returns the size of an integer column's type, or 0 if it's not
+// an integer.
+func (col Column) integerBits() int {
+	switch col.Type {
+	case TYPE_TINY:
+		return 8
+	case TYPE_SHORT:
+		return 16
+	case TYPE_INT24:
+		return 24
+	case TYPE_LONG:
+		return 32
+	case TYPE_LONGLONG:
+		return 64
+	}
+	return 0
+}
+
+// Sentinel is the value we send when we can't come up with a valid one.
+func (col Column) Sentinel() []byte {
+	if col.IsString {
+		return []byte{}
+	}
+	return []byte("0")
+}
+
+// CheckReplacement returns why a value we made up can't be sent in this
+// column, or "" if it's fine. Clients trust the column metadata, so a NULL in
+// a NOT NULL column or a number that doesn't fit can break them.
+func (col Column) CheckReplacement(value []byte) string {
+	if value == nil {
+		if col.Flags&NOT_NULL_FLAG != 0 {
+			return "NULL in a NOT NULL column"
+		}
+		return ""
+	}
+	if uint32(len(value)) > col.Length {
+		return fmt.Sprintf("%d bytes is longer than the column's %d", len(value), col.Length)
+	}
+
+	if col.IsString {
+		return ""
+	}
+	if bits := col.integerBits(); bits > 0 {
+		var err error
+		if col.Flags&UNSIGNED_FLAG != 0 {
+			_, err = strconv.ParseUint(string(value), 10, bits)
+		} else {
+			_, err = strconv.ParseInt(string(value), 10, bits)
+		}
+		if err != nil {
+			return fmt.Sprintf("'%s' isn't a valid %d-bit integer", value, bits)
+		}
+	} else if col.Type == TYPE_DECIMAL || col.Type == TYPE_NEWDECIMAL || col.Type == TYPE_FLOAT || col.Type == TYPE_DOUBLE {
+		if _, err := strconv.ParseFloat(string(value), 64); err != nil {
+			return fmt.Sprintf("'%s' isn't a number", value)
+		}
+	}
+	return ""
+}
+
+// hashedTextLength is how long a hashed value is allowed to be once its
+// column is retyped as text: 64 hex characters, at up to 3 bytes each in utf8.
+const hashedTextLength = 64 * 3
+
+// NeedsRetyping reports whether the column is a non-string we're going to
+// sanitize. Hashes are hex strings, and drivers choke on those if the column
+// definition still says it's a number or a date.
+func (col Column) NeedsRetyping() bool {
+	return !col.IsString && !col.IsSafe()
+}
+
+// RetypeAsText rewrites a column definition packet to say the column holds
+// utf8 strings, and returns it along with the matching Column.
+func RetypeAsText(packet mysqlproto.Packet, col Column) (mysqlproto.Packet, Column) {
+	parser := NewPacketParser(packet)
+	for i := 0; i < 6; i++ {
+		parser.ReadVariableString() // catalog, schema, tables, and names
+	}
+	parser.ReadEncodedInt() // length of the fixed fields
+
+	payload := append([]byte{}, packet.Payload...)
+	fixed := payload[parser.offset:]
+	fixed[0], fixed[1] = 0x21, 0x00 // character set (utf8_general_ci)
+	copy(fixed[2:6], littleEndian(hashedTextLength, 4))
+	fixed[6] = TYPE_VAR_STRING
+	flags := col.Flags & NOT_NULL_FLAG
+	fixed[7], fixed[8] = byte(flags&0xFF), byte(flags>>8)
+	fixed[9] = 0x00 // decimals
+
+	col.IsString = true
+	col.Type = TYPE_VAR_STRING
+	col.Length = hashedTextLength
+	col.Flags = flags
+	return mysqlproto.Packet{packet.SequenceID, payload}, col
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Column rules (the [rules] section of the config) say what to do with
+// specific columns, overriding the whitelist:
+//
+//	[rules]
+//	"users.email" = "hash"
+//	"users.id" = "pass"
+//	"*.ssn" = "redact"
+//
+// Names can be "column", "table.column", or "database.table.column", and any
+// part can be "*". When more than one rule matches, the most specific one
+// wins, counting a literal column name as more specific than a table name,
+// and that as more specific than a database name. So with the rules above,
+// users.ssn is redacted. Each action maps to a MaskStrategy.
+//
+// For naming conventions, PatternRules match names with regexes instead:
+//
+//	[[PatternRules]]
+//	Column = ".*_(email|phone)"
+//	Action = "hash"
+//
+// Each regex has to match the whole name (case-insensitively), and a missing
+// one matches anything. Pattern rules only apply to columns none of the
+// [rules] match, and the first one that matches wins.
+const (
+	ruleNone        = ""
+	rulePass        = "pass"         // Send the real value
+	ruleHash        = "hash"         // Sanitize it like any non-whitelisted column
+	ruleRedact      = "redact"       // Replace it with redactedValue
+	ruleNull        = "null"         // Replace it with NULL
+	rulePartial     = "partial"      // Star out all but the last few characters
+	ruleEmail       = "email"        // Replace it with a hashed email address
+	rulePhone       = "phone"        // Mask it like a phone number
+	ruleFakeName    = "fake_name"    // Replace it with a made-up name
+	ruleFakeAddress = "fake_address" // Replace it with a made-up street address
+	ruleFakeCompany = "fake_company" // Replace it with a made-up company name
+)
+
+const redactedValue = "REDACTED"
+
+type columnRule struct {
+	database string // "*" matches anything (for PatternRules, the regex as written)
+	table    string
+	column   string
+	action   string
+	weight   int
+	patterns []*regexp.Regexp // For PatternRules: database, table, and column, or nil to match anything
+}
+
+// PatternRule is a column rule that matches names with regexes.
+type PatternRule struct {
+	Database string // Regex for the database name (optional)
+	Table    string // Regex for the table name (optional)
+	Column   string // Regex for the column name (optional)
+	Action   string // Same as in [rules]
+}
+
+// ColumnRules are the compiled [rules], most specific first.
+type ColumnRules []columnRule
+
+// NewColumnRules checks and compiles the rules. Unquoted dotted names in the
+// TOML file come through as nested tables, so those get flattened first.
+func NewColumnRules(rules map[string]interface{}, patternRules []PatternRule) (ColumnRules, error) {
+	flattened := map[string]string{}
+	if err := flattenColumnRules("", rules, flattened); err != nil {
+		return nil, err
+	}
+
+	compiled := ColumnRules{}
+	for name, action := range flattened {
+		if err := checkRuleAction(action, name); err != nil {
+			return nil, err
+		}
+
+		parts := strings.Split(strings.ToLower(name), ".")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("Column '%s' should look like [[database.]table.]column", name)
+		}
+		for len(parts) < 3 {
+			parts = append([]string{"*"}, parts...)
+		}
+
+		rule := columnRule{parts[0], parts[1], parts[2], action, 0, nil}
+		if rule.column != "*" {
+			rule.weight += 4
+		}
+		if rule.table != "*" {
+			rule.weight += 2
+		}
+		if rule.database != "*" {
+			rule.weight += 1
+		}
+		compiled = append(compiled, rule)
+	}
+
+	sort.SliceStable(compiled, func(i, j int) bool {
+		if compiled[i].weight != compiled[j].weight {
+			return compiled[i].weight > compiled[j].weight
+		}
+		// Same specificity; be consistent, and err on the side of caution.
+		return actionStrictness(compiled[i].action) > actionStrictness(compiled[j].action)
+	})
+
+	for i, patternRule := range patternRules {
+		name := fmt.Sprintf("PatternRules[%d]", i)
+		if err := checkRuleAction(patternRule.Action, name); err != nil {
+			return nil, err
+		}
+		rule := columnRule{patternRule.Database, patternRule.Table, patternRule.Column, patternRule.Action, 0, []*regexp.Regexp{}}
+		for _, pattern := range []string{patternRule.Database, patternRule.Table, patternRule.Column} {
+			if pattern == "" {
+				rule.patterns = append(rule.patterns, nil)
+				continue
+			}
+			regex, err := regexp.Compile("(?i)^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("Bad regex in %s: %s", name, err)
+			}
+			rule.patterns = append(rule.patterns, regex)
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+func checkRuleAction(action string, name string) error {
+	switch action {
+	case rulePass, ruleHash, ruleRedact, ruleNull, rulePartial, ruleEmail, rulePhone,
+		ruleFakeName, ruleFakeAddress, ruleFakeCompany:
+		return nil
+	}
+	return fmt.Errorf("Unknown action \"%s\" for %s (expected pass, hash, email, phone, fake_name, fake_address, fake_company, partial, redact, or null)", action, name)
+}
+
+func flattenColumnRules(prefix string, rules map[string]interface{}, flattened map[string]string) error {
+	for key, value := range rules {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		switch value := value.(type) {
+		case string:
+			flattened[name] = value
+		case map[string]interface{}:
+			if err := flattenColumnRules(name, value, flattened); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("The rule for %s should be a string", name)
+		}
+	}
+	return nil
+}
+
+func actionStrictness(action string) int {
+	return map[string]int{
+		rulePass:        0,
+		rulePartial:     1,
+		rulePhone:       2,
+		ruleEmail:       3,
+		ruleFakeName:    4,
+		ruleFakeAddress: 5,
+		ruleFakeCompany: 6,
+		ruleHash:        7,
+		ruleRedact:      8,
+		ruleNull:        9,
+	}[action]
+}
+
+// Action returns what the most specific matching rule says to do with the
+// column, or ruleNone if no rules match.
+func (rules ColumnRules) Action(col Column) string {
+	if rule := rules.Match(col); rule != nil {
+		return rule.action
+	}
+	return ruleNone
+}
+
+// Match returns the most specific rule that matches the column, or nil.
+func (rules ColumnRules) Match(col Column) *columnRule {
+	for i, rule := range rules {
+		if rule.patterns != nil {
+			if patternMatches(rule.patterns[0], col.Database) && patternMatches(rule.patterns[1], col.Table) &&
+				patternMatches(rule.patterns[2], col.Name) {
+				return &rules[i]
+			}
+			continue
+		}
+		if (rule.database == "*" || rule.database == col.Database) &&
+			(rule.table == "*" || rule.table == col.Table) &&
+			(rule.column == "*" || rule.column == col.Name) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func patternMatches(pattern *regexp.Regexp, name string) bool {
+	return pattern == nil || pattern.MatchString(name)
+}
+
+// describe returns the rule the way it was written in the config, more or
+// less.
+func (rule columnRule) describe() string {
+	if rule.patterns == nil {
+		return fmt.Sprintf("\"%s.%s.%s\" = \"%s\"", rule.database, rule.table, rule.column, rule.action)
+	}
+	parts := []string{}
+	for i, field := range []string{"Database", "Table", "Column"} {
+		if rule.patterns[i] != nil {
+			parts = append(parts, fmt.Sprintf("%s = \"%s\"", field, []string{rule.database, rule.table, rule.column}[i]))
+		}
+	}
+	return fmt.Sprintf("{%s, Action = \"%s\"}", strings.Join(parts, ", "), rule.action)
+}
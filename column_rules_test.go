@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestNewColumnRules(t *testing.T) {
+	var parsed struct{ Rules map[string]interface{} }
+	_, err := toml.Decode(`
+[rules]
+"users.email" = "hash"
+"*.ssn" = "redact"
+"honk.users.id" = "pass"
+
+[rules.users]
+ssn = "null"
+`, &parsed)
+	if err != nil {
+		t.Fatalf("Couldn't parse rules: %s", err)
+	}
+	rules, err := NewColumnRules(parsed.Rules, nil)
+	if err != nil {
+		t.Fatalf("NewColumnRules failed: %s", err)
+	}
+
+	for _, test := range []struct {
+		col    Column
+		action string
+	}{
+		{Column{true, "honk", "users", "email", "email", 255, 0, 0, nil, "", false, nil}, ruleHash},
+		{Column{true, "honk", "users", "ssn", "ssn", 255, 0, 0, nil, "", false, nil}, ruleNull},
+		{Column{true, "honk", "employees", "ssn", "ssn", 255, 0, 0, nil, "", false, nil}, ruleRedact},
+		{Column{false, "honk", "users", "id", "id", 11, 0, 0, nil, "", false, nil}, rulePass},
+		{Column{false, "bonk", "users", "id", "id", 11, 0, 0, nil, "", false, nil}, ruleNone},
+	} {
+		if action := rules.Action(test.col); action != test.action {
+			t.Errorf("Bogus action for %s.%s.%s: '%s' instead of '%s'", test.col.Database, test.col.Table, test.col.Name, action, test.action)
+		}
+	}
+}
+
+func TestNewColumnRules_BadConfig(t *testing.T) {
+	if _, err := NewColumnRules(map[string]interface{}{"users.email": "scramble"}, nil); err == nil {
+		t.Error("Unknown action should have been refused")
+	}
+	if _, err := NewColumnRules(map[string]interface{}{"a.b.c.d": "hash"}, nil); err == nil {
+		t.Error("Too many name parts should have been refused")
+	}
+	if _, err := NewColumnRules(map[string]interface{}{"users.id": 1}, nil); err == nil {
+		t.Error("Non-string action should have been refused")
+	}
+}
+
+func TestSanitizeRowValues_ColumnRules(t *testing.T) {
+	columnRules, _ = NewColumnRules(map[string]interface{}{
+		"some_db.table2.honk": "hash",
+		"bonk.notes":          "pass",
+		"bonk.ssn":            "redact",
+	}, nil)
+	defer func() { columnRules = nil }()
+
+	columns := []Column{
+		{true, "some_db", "table2", "honk", "honk", 255, TYPE_VAR_STRING, 0, nil, "", false, nil}, // whitelisted
+		{true, "honk", "bonk", "notes", "notes", 255, TYPE_VAR_STRING, 0, nil, "", false, nil},
+		{true, "honk", "bonk", "ssn", "ssn", 4, TYPE_VAR_STRING, 0, nil, "", false, nil},
+	}
+	rows, err := sanitizeRowValues(columns, [][]byte{[]byte("secret"), []byte("hello"), []byte("123-45-6789")})
+	if err != nil {
+		t.Fatalf("sanitizeRowValues failed: %s", err)
+	}
+	if string(rows[0]) == "secret" {
+		t.Error("Hash rule should override the whitelist")
+	}
+	if string(rows[1]) != "hello" {
+		t.Errorf("Pass rule should have kept the value: %s", rows[1])
+	}
+	if string(rows[2]) != "REDA" {
+		t.Errorf("Bogus redacted value: %s", rows[2])
+	}
+}
+
+func TestColumnRules_Patterns(t *testing.T) {
+	rules, err := NewColumnRules(map[string]interface{}{"users.work_email": "pass"}, []PatternRule{
+		{Column: ".*_(email|phone)", Action: ruleHash},
+		{Table: "customer_.*", Action: ruleRedact},
+		{Database: "audit", Action: ruleNull},
+	})
+	if err != nil {
+		t.Fatalf("NewColumnRules failed: %s", err)
+	}
+
+	for _, test := range []struct {
+		col    Column
+		action string
+	}{
+		{Column{true, "honk", "users", "home_email", "home_email", 255, 0, 0, nil, "", false, nil}, ruleHash},
+		{Column{true, "honk", "users", "work_email", "work_email", 255, 0, 0, nil, "", false, nil}, rulePass},
+		{Column{true, "honk", "users", "email_verified", "email_verified", 255, 0, 0, nil, "", false, nil}, ruleNone},
+		{Column{true, "honk", "customer_notes", "mobile_phone", "mobile_phone", 255, 0, 0, nil, "", false, nil}, ruleHash},
+		{Column{true, "honk", "customer_notes", "body", "body", 255, 0, 0, nil, "", false, nil}, ruleRedact},
+		{Column{true, "audit", "events", "body", "body", 255, 0, 0, nil, "", false, nil}, ruleNull},
+	} {
+		if action := rules.Action(test.col); action != test.action {
+			t.Errorf("Bogus action for %s.%s.%s: '%s' instead of '%s'", test.col.Database, test.col.Table, test.col.Name, action, test.action)
+		}
+	}
+
+	if _, err := NewColumnRules(nil, []PatternRule{{Column: "(", Action: ruleHash}}); err == nil {
+		t.Error("Bad regex should have been refused")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/pubnative/mysqlproto-go"
@@ -28,44 +29,152 @@ func TestReadColumn(t *testing.T) {
 }
 
 func TestColumnIsSafe_NotString(t *testing.T) {
-	column := Column{false, "honk", "bonk", "blarp", "woopwoop", 255}
+	column := Column{false, "honk", "bonk", "blarp", "woopwoop", 255, 0, 0, nil, "", false, nil}
 	if !column.IsSafe() {
 		t.Error("Non-string columns should always be safe!")
 	}
 }
 
 func TestColumnIsSafe_String(t *testing.T) {
-	column := Column{true, "honk", "bonk", "blarp", "woopwoop", 255}
+	column := Column{true, "honk", "bonk", "blarp", "woopwoop", 255, 0, 0, nil, "", false, nil}
 	if column.IsSafe() {
 		t.Error("Non-whitelisted string columns shouldn't be safe!")
 	}
 }
 
 func TestColumnIsSafe_InfoSchema(t *testing.T) {
-	column := Column{true, "information_schema", "columns", "blarp", "woopwoop", 255}
+	column := Column{true, "information_schema", "columns", "blarp", "woopwoop", 255, 0, 0, nil, "", false, nil}
 	if !column.IsSafe() {
 		t.Error("information_schema.columns should always be safe!")
 	}
 
-	column = Column{true, "information_schema", "schemata", "blarp", "woopwoop", 255}
+	column = Column{true, "information_schema", "schemata", "blarp", "woopwoop", 255, 0, 0, nil, "", false, nil}
 	if !column.IsSafe() {
 		t.Error("information_schema.schemata should always be safe!")
 	}
 
-	column = Column{true, "information_schema", "table_names", "blarp", "woopwoop", 255}
+	column = Column{true, "information_schema", "table_names", "blarp", "woopwoop", 255, 0, 0, nil, "", false, nil}
 	if !column.IsSafe() {
 		t.Error("information_schema.table_names should always be safe!")
 	}
 
-	column = Column{true, "information_schema", "user_privileges", "blarp", "woopwoop", 255}
+	column = Column{true, "information_schema", "user_privileges", "blarp", "woopwoop", 255, 0, 0, nil, "", false, nil}
 	if column.IsSafe() {
 		t.Error("Other information_schema tables aren't safe!")
 	}
 }
 
 func TestColumnIsSafe_Internals(t *testing.T) {
-	column := Column{true, "", "", "", "@@woopwoop", 255}
+	column := Column{true, "", "", "", "@@woopwoop", 255, 0, 0, nil, "", false, nil}
 	if !column.IsSafe() {
 		t.Error("Columns without a schema should always be safe!")
 	}
 }
+
+func TestColumnIsSafe_Expressions(t *testing.T) {
+	defer func() { config.MaskExpressions, columnRules = true, nil }()
+	name := Column{Database: "some_db", Table: "table1", Name: "name"}     // whitelisted
+	secret := Column{Database: "some_db", Table: "table1", Name: "secret"} // not whitelisted
+
+	if column := (Column{true, "", "", "LOWER(name)", "", 255, 0, 0, nil, "", false, []Column{name}}); !column.IsSafe() {
+		t.Error("Expressions on safe columns should be safe")
+	}
+	if column := (Column{true, "", "", "x", "", 255, 0, 0, nil, "", false, []Column{name, secret}}); column.IsSafe() {
+		t.Error("Expressions on unsafe columns shouldn't be safe, aliased or not")
+	}
+	if column := (Column{true, "", "", "VERSION()", "", 255, 0, 0, nil, "", false, []Column{}}); !column.IsSafe() {
+		t.Error("Expressions on no columns at all should be safe")
+	}
+	if column := (Column{true, "", "", "CONCAT(secret, '')", "", 255, 0, 0, nil, "", false, nil}); column.IsSafe() {
+		t.Error("Expressions we couldn't trace shouldn't be safe")
+	}
+	if column := (Column{true, "", "", "x", "", 255, 0, 0, nil, "", false, nil}); column.IsSafe() {
+		t.Error("Expressions we couldn't trace shouldn't be safe, aliased or not")
+	}
+
+	// Non-strings are only unsafe if a rule says so.
+	sum := Column{false, "", "", "secret + 1", "", 11, TYPE_LONG, 0, nil, "", false, []Column{secret}}
+	if !sum.IsSafe() {
+		t.Error("Non-string expressions on columns with no rules should be safe")
+	}
+	columnRules, _ = NewColumnRules(map[string]interface{}{"some_db.table1.secret": "hash"}, nil)
+	if sum.IsSafe() {
+		t.Error("Non-string expressions on hashed columns shouldn't be safe")
+	}
+
+	config.MaskExpressions = false
+	if column := (Column{true, "", "", "CONCAT(secret, '')", "", 255, 0, 0, nil, "", false, []Column{secret}}); !column.IsSafe() {
+		t.Error("Without MaskExpressions, expressions should get through like they used to")
+	}
+}
+
+func TestColumnCheckReplacement(t *testing.T) {
+	notNull := Column{true, "honk", "bonk", "blarp", "blarp", 8, TYPE_VAR_STRING, NOT_NULL_FLAG, nil, "", false, nil}
+	if notNull.CheckReplacement(nil) == "" {
+		t.Error("NULL in a NOT NULL column should have been refused")
+	}
+	if notNull.CheckReplacement([]byte("123456789")) == "" {
+		t.Error("Too-long value should have been refused")
+	}
+	if problem := notNull.CheckReplacement([]byte("12345678")); problem != "" {
+		t.Errorf("Bogus problem with a valid value: %s", problem)
+	}
+
+	tiny := Column{false, "honk", "bonk", "tiny", "tiny", 4, TYPE_TINY, UNSIGNED_FLAG, nil, "", false, nil}
+	if problem := tiny.CheckReplacement([]byte("255")); problem != "" {
+		t.Errorf("Bogus problem with a valid TINYINT UNSIGNED: %s", problem)
+	}
+	if tiny.CheckReplacement([]byte("256")) == "" || tiny.CheckReplacement([]byte("-1")) == "" {
+		t.Error("Out of range TINYINT UNSIGNED should have been refused")
+	}
+	if tiny.CheckReplacement([]byte("")) == "" {
+		t.Error("Empty string in an integer column should have been refused")
+	}
+
+	decimal := Column{false, "honk", "bonk", "price", "price", 10, TYPE_NEWDECIMAL, 0, nil, "", false, nil}
+	if problem := decimal.CheckReplacement([]byte("-12.50")); problem != "" {
+		t.Errorf("Bogus problem with a valid DECIMAL: %s", problem)
+	}
+	if decimal.CheckReplacement([]byte("twelve")) == "" {
+		t.Error("Non-numeric DECIMAL should have been refused")
+	}
+}
+
+func TestRetypeAsText(t *testing.T) {
+	defer setMode(modeNormal)
+
+	// An INT UNSIGNED NOT NULL column.
+	packet := mysqlproto.Packet{2, []byte("\x03def\x04honk\x04bonk\x04bonk\x02id\x02id\x0c\x3f\x00\x0a\x00\x00\x00\x03\x21\x00\x00\x00\x00")}
+	column, err := ReadColumn(NewPacketParser(packet))
+	if err != nil {
+		t.Fatalf("ReadColumn failed: %s", err)
+	}
+	if column.NeedsRetyping() {
+		t.Error("Non-string columns are safe, so they shouldn't need retyping")
+	}
+
+	setMode(modeForceSanitize)
+	if !column.NeedsRetyping() {
+		t.Fatal("Column should need retyping in force-sanitize mode")
+	}
+	packet, column = RetypeAsText(packet, column)
+
+	reread, err := ReadColumn(NewPacketParser(packet))
+	if err != nil {
+		t.Fatalf("ReadColumn failed on retyped column: %s", err)
+	}
+	if !reflect.DeepEqual(reread, column) {
+		t.Errorf("Retyped packet and column don't match: %v, %v", reread, column)
+	}
+	if !column.IsString || column.Type != TYPE_VAR_STRING || column.Flags != NOT_NULL_FLAG || column.Length != hashedTextLength {
+		t.Errorf("Bogus retyped column: %v", column)
+	}
+
+	rows, err := sanitizeRowValues([]Column{column}, [][]byte{[]byte("42")})
+	if err != nil {
+		t.Fatalf("sanitizeRowValues failed: %s", err)
+	}
+	if len(rows[0]) != 64 {
+		t.Errorf("Retyped column should have gotten the whole hash: %s", rows[0])
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"unicode/utf8"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Analysts poking at a table rarely want every byte of the documents in its
+// TEXT and BLOB columns, and sending them all costs transfer time and proxy
+// memory for nothing. MaxColumnWidth cuts those values down to a number of
+// bytes, by username, and marks the cut with an ellipsis. It happens after
+// sanitizing, so safe columns get cut too; hashes and the like are short
+// enough to be left alone anyway.
+//
+// This is a convenience, not a control: clients pick their own usernames, so
+// anybody can get another user's width by logging in as them.
+
+// truncationMarker goes on the end of every value we cut short.
+const truncationMarker = "..."
+
+// maxColumnWidth returns how many bytes of each TEXT or BLOB value the user
+// gets, or 0 for all of them.
+func maxColumnWidth(username string) int {
+	if width, ok := config.MaxColumnWidth[username]; ok {
+		return width
+	}
+	return config.MaxColumnWidth["*"]
+}
+
+// warnAboutColumnWidths logs that per-user widths can be had by anybody, if
+// there are any.
+func warnAboutColumnWidths() {
+	for username := range config.MaxColumnWidth {
+		if username != "*" {
+			output.Log("MaxColumnWidth is set by username, but clients pick their own usernames, so anybody can get any of those widths")
+			return
+		}
+	}
+}
+
+// resultWidth returns the width to cut a result set's values down to for
+// the session, or 0 if there's nothing to cut.
+func (proxy *ProxyConnection) resultWidth(columns []Column) int {
+	width := maxColumnWidth(proxy.Username())
+	if width <= 0 {
+		return 0
+	}
+	for _, col := range columns {
+		if col.IsTextOrBlob() {
+			return width
+		}
+	}
+	return 0
+}
+
+// IsTextOrBlob returns whether the column is one of the TEXT or BLOB types.
+func (col Column) IsTextOrBlob() bool {
+	return col.Type == TYPE_TINY_BLOB || col.Type == TYPE_MEDIUM_BLOB || col.Type == TYPE_LONG_BLOB || col.Type == TYPE_BLOB
+}
+
+// truncateRow cuts a text protocol row's TEXT and BLOB values down to width
+// bytes. Rows with nothing that long come back as they are.
+func truncateRow(row mysqlproto.Packet, columns []Column, width int) mysqlproto.Packet {
+	parser := NewPacketParser(row)
+	values := [][]byte{}
+	for range columns {
+		value, nonNull := parser.ReadStringOrNull()
+		if !nonNull {
+			values = append(values, nil)
+			continue
+		}
+		values = append(values, []byte(value))
+	}
+	if !truncateValues(values, columns, width) {
+		return row
+	}
+	return constructNewResponse(row, values)
+}
+
+// truncateValues cuts a row's TEXT and BLOB values down to width bytes in
+// place, and returns whether there was anything to cut.
+func truncateValues(values [][]byte, columns []Column, width int) bool {
+	truncated := false
+	for i, col := range columns {
+		if values[i] != nil && col.IsTextOrBlob() && len(values[i]) > width {
+			values[i] = truncateValue(values[i], col, width)
+			truncated = true
+		}
+	}
+	return truncated
+}
+
+// truncateValue cuts a value down to width bytes and adds the marker. TEXT
+// gets cut at the start of a character, so it stays valid UTF-8.
+func truncateValue(value []byte, col Column, width int) []byte {
+	cut := width
+	if col.Flags&BINARY_FLAG == 0 {
+		for cut > 0 && !utf8.RuneStart(value[cut]) {
+			cut--
+		}
+	}
+	return append(append([]byte{}, value[:cut]...), truncationMarker...)
+}
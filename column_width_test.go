@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMaxColumnWidth(t *testing.T) {
+	config.MaxColumnWidth = map[string]int{"alice": 0, "*": 100}
+	defer func() { config.MaxColumnWidth = map[string]int{} }()
+
+	if width := maxColumnWidth("alice"); width != 0 {
+		t.Errorf("Bogus width for alice: %d", width)
+	}
+	if width := maxColumnWidth("bob"); width != 100 {
+		t.Errorf("Bogus width for bob: %d", width)
+	}
+
+	proxy := &ProxyConnection{}
+	varchar := Column{true, "honk", "bonk", "name", "name", 255, TYPE_VAR_STRING, 0, nil, "", false, nil}
+	text := Column{true, "honk", "bonk", "notes", "notes", 65535, TYPE_BLOB, 0, nil, "", false, nil}
+	if width := proxy.resultWidth([]Column{varchar}); width != 0 {
+		t.Errorf("Bogus width for a result without TEXT or BLOB columns: %d", width)
+	}
+	if width := proxy.resultWidth([]Column{varchar, text}); width != 100 {
+		t.Errorf("Bogus width for a result with a TEXT column: %d", width)
+	}
+}
+
+func TestTruncateRow(t *testing.T) {
+	columns := []Column{
+		{true, "honk", "bonk", "name", "name", 255, TYPE_VAR_STRING, 0, nil, "", false, nil},
+		{true, "honk", "bonk", "notes", "notes", 65535, TYPE_BLOB, 0, nil, "", false, nil},
+		{true, "honk", "bonk", "photo", "photo", 65535, TYPE_BLOB, BINARY_FLAG, nil, "", false, nil},
+		{true, "honk", "bonk", "bio", "bio", 65535, TYPE_BLOB, 0, nil, "", false, nil},
+	}
+	row := constructNewResponse(TextRowPacket(0, nil), [][]byte{[]byte("Goose Goosington"), []byte("naïve"), []byte("naïve"), nil})
+
+	parser := NewPacketParser(truncateRow(row, columns, 3))
+	name, _ := parser.ReadStringOrNull()
+	notes, _ := parser.ReadStringOrNull()
+	photo, _ := parser.ReadStringOrNull()
+	_, bioNonNull := parser.ReadStringOrNull()
+	if name != "Goose Goosington" {
+		t.Errorf("Bogus VARCHAR value: %q", name)
+	}
+	if notes != "na..." {
+		t.Errorf("Bogus TEXT value: %q", notes)
+	}
+	if photo != "na\xc3..." {
+		t.Errorf("Bogus BLOB value: %q", photo)
+	}
+	if bioNonNull {
+		t.Error("Bogus NULL: it isn't NULL any more")
+	}
+
+	if short := truncateRow(row, columns, 100); string(short.Payload) != string(row.Payload) {
+		t.Errorf("Bogus row with nothing to truncate: %v", short.Payload)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// With CLIENT_COMPRESS, once the login's done every packet travels inside a
+// compressed frame: a 7-byte header (compressed length, its own sequence ID,
+// uncompressed length) and then a zlib stream, or the bytes as they are if
+// the uncompressed length is 0. MySQL 8's CLIENT_ZSTD_COMPRESSION_ALGORITHM
+// is the same thing with zstd instead of zlib, at a level the client picks.
+// Frames don't have to line up with packets, so the simplest thing is to do
+// it underneath mysqlproto's stream, as if it were a different kind of
+// socket.
+//
+// The client and server sides are separate: the server side is compressed
+// when the client asked for it and the server agreed, and the client side
+// is compressed whenever the client asked. Pooled and reconnected server
+// connections log in on their own and never are.
+
+// CLIENT_ZSTD_COMPRESSION_ALGORITHM is newer than mysqlproto.
+const CLIENT_ZSTD_COMPRESSION_ALGORITHM uint32 = 1 << 26
+
+// zstdDefaultLevel is MySQL's default zstd level.
+const zstdDefaultLevel = 3
+
+// compressMinLength is the smallest payload worth compressing. It's what
+// libmysqlclient uses.
+const compressMinLength = 50
+
+// compressMaxFrame is the most a single frame can carry.
+const compressMaxFrame = 0xffffff
+
+// compressedConn speaks compressed framing once it's enabled, and passes
+// everything straight through before that. Reads and writes are switched
+// separately: reads before the login OK goes out, since the client might
+// answer it straight away, and writes after, since the OK itself isn't
+// compressed.
+type compressedConn struct {
+	net.Conn
+	codec   compressionCodec // Set before reads or writes are switched
+	reading int32
+	writing int32
+	raw     *bufio.Reader // Only once reads are compressed, so idle sessions don't pay for it
+	pending []byte        // Uncompressed bytes from the last frame that haven't been read yet
+
+	mutex    sync.Mutex
+	sequence byte // Compressed sequence ID for the next frame we send
+}
+
+func newCompressedConn(conn net.Conn) *compressedConn {
+	return &compressedConn{Conn: conn}
+}
+
+// enableReads switches reads to compressed framing. It has to happen
+// between packets, before the other side sends anything compressed.
+func (conn *compressedConn) enableReads() {
+	atomic.StoreInt32(&conn.reading, 1)
+}
+
+// enableWrites switches writes to compressed framing.
+func (conn *compressedConn) enableWrites() {
+	atomic.StoreInt32(&conn.writing, 1)
+}
+
+func (conn *compressedConn) enable() {
+	conn.enableReads()
+	conn.enableWrites()
+}
+
+func (conn *compressedConn) Read(data []byte) (int, error) {
+	if conn.raw == nil {
+		if atomic.LoadInt32(&conn.reading) == 0 {
+			n, err := conn.Conn.Read(data)
+			if n == 0 || atomic.LoadInt32(&conn.reading) == 0 {
+				return n, err
+			}
+			// Reads got switched while we were waiting, so what turned up
+			// is the start of a frame.
+			leftover := bytes.NewReader(append([]byte{}, data[:n]...))
+			conn.raw = bufio.NewReader(io.MultiReader(leftover, conn.Conn))
+		} else {
+			conn.raw = bufio.NewReader(conn.Conn)
+		}
+	}
+	for len(conn.pending) == 0 {
+		if err := conn.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
+
+// readFrame reads and unpacks the next frame into pending.
+func (conn *compressedConn) readFrame() error {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn.raw, header); err != nil {
+		return err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	uncompressedLength := int(header[4]) | int(header[5])<<8 | int(header[6])<<16
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn.raw, payload); err != nil {
+		return err
+	}
+
+	conn.mutex.Lock()
+	conn.sequence = header[3] + 1
+	conn.mutex.Unlock()
+
+	if uncompressedLength == 0 {
+		conn.pending = payload
+		return nil
+	}
+	uncompressed, err := conn.codec.decompress(payload, uncompressedLength)
+	if err != nil {
+		return fmt.Errorf("Bad compressed frame: %s", err)
+	}
+	if len(uncompressed) != uncompressedLength {
+		return fmt.Errorf("Bad compressed frame: expected %d bytes, got %d", uncompressedLength, len(uncompressed))
+	}
+	conn.pending = uncompressed
+	return nil
+}
+
+func (conn *compressedConn) Write(data []byte) (int, error) {
+	if atomic.LoadInt32(&conn.writing) == 0 {
+		return conn.Conn.Write(data)
+	}
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	// A packet with sequence ID 0 starts a new command, and the frames start
+	// counting again along with it.
+	if len(data) >= 4 && data[3] == 0 {
+		conn.sequence = 0
+	}
+	for written := 0; written < len(data); {
+		chunk := data[written:]
+		if len(chunk) > compressMaxFrame {
+			chunk = chunk[:compressMaxFrame]
+		}
+		if _, err := conn.Conn.Write(compressFrame(conn.codec, chunk, conn.sequence)); err != nil {
+			return written, err
+		}
+		conn.sequence++
+		written += len(chunk)
+	}
+	return len(data), nil
+}
+
+// compressFrame packs some bytes into a frame, compressing them if that's
+// worth it.
+func compressFrame(codec compressionCodec, data []byte, sequence byte) []byte {
+	payload := data
+	uncompressedLength := 0
+	if len(data) >= compressMinLength {
+		if compressed := codec.compress(data); len(compressed) < len(data) {
+			payload = compressed
+			uncompressedLength = len(data)
+		}
+	}
+
+	frame := make([]byte, 7, 7+len(payload))
+	frame[0] = byte(len(payload))
+	frame[1] = byte(len(payload) >> 8)
+	frame[2] = byte(len(payload) >> 16)
+	frame[3] = sequence
+	frame[4] = byte(uncompressedLength)
+	frame[5] = byte(uncompressedLength >> 8)
+	frame[6] = byte(uncompressedLength >> 16)
+	return append(frame, payload...)
+}
+
+// compressionCodec is how a frame's payload gets squeezed.
+type compressionCodec interface {
+	compress(data []byte) []byte
+	decompress(data []byte, length int) ([]byte, error)
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) compress(data []byte) []byte {
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	writer.Write(data)
+	writer.Close()
+	return compressed.Bytes()
+}
+
+func (zlibCodec) decompress(data []byte, length int) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	// One byte more than we expect, so the caller can tell it was too long.
+	return io.ReadAll(io.LimitReader(reader, int64(length)+1))
+}
+
+type zstdCodec struct {
+	encoder *zstd.Encoder
+}
+
+// zstdDecoder is safe to share, since we only use DecodeAll.
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(compressMaxFrame+1))
+
+// zstdEncoders are shared by level, for the same reason.
+var zstdEncoders sync.Map
+
+// newZstdCodec returns a codec for the zstd level (1 to 22) the client asked
+// for. The encoder only has four speeds, so levels share them.
+func newZstdCodec(level byte) zstdCodec {
+	if level == 0 {
+		level = zstdDefaultLevel
+	}
+	speed := zstd.EncoderLevelFromZstd(int(level))
+	if encoder, ok := zstdEncoders.Load(speed); ok {
+		return zstdCodec{encoder.(*zstd.Encoder)}
+	}
+	encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(speed))
+	shared, _ := zstdEncoders.LoadOrStore(speed, encoder)
+	return zstdCodec{shared.(*zstd.Encoder)}
+}
+
+func (codec zstdCodec) compress(data []byte) []byte {
+	return codec.encoder.EncodeAll(data, nil)
+}
+
+func (zstdCodec) decompress(data []byte, length int) ([]byte, error) {
+	return zstdDecoder.DecodeAll(data, make([]byte, 0, length))
+}
+
+// compressionOf digs the compressedConn out from under any tracing or
+// balancing, or returns nil if there isn't one.
+func compressionOf(conn net.Conn) *compressedConn {
+	for {
+		switch wrapped := conn.(type) {
+		case *compressedConn:
+			return wrapped
+		case *tracedConn:
+			conn = wrapped.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// negotiatedCompression returns the connection's compressedConn, ready to
+// use whichever kind of compression the client asked for, or nil if it
+// didn't. If it asked for both, zlib wins, like it does in MySQL.
+func (proxy *ProxyConnection) negotiatedCompression(conn net.Conn) *compressedConn {
+	var codec compressionCodec
+	if proxy.Capabilities&mysqlproto.CLIENT_COMPRESS != 0 {
+		codec = zlibCodec{}
+	} else if proxy.Capabilities&CLIENT_ZSTD_COMPRESSION_ALGORITHM != 0 {
+		codec = newZstdCodec(proxy.zstdLevel)
+	} else {
+		return nil
+	}
+	compression := compressionOf(conn)
+	if compression != nil {
+		compression.codec = codec
+	}
+	return compression
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestCompressedConn(t *testing.T) {
+	for name, codec := range map[string]compressionCodec{"zlib": zlibCodec{}, "zstd": newZstdCodec(3)} {
+		left, right := net.Pipe()
+		sender, receiver := newCompressedConn(left), newCompressedConn(right)
+		sender.codec, receiver.codec = codec, codec
+		sender.enable()
+		receiver.enable()
+
+		packets := []mysqlproto.Packet{
+			{0, append([]byte{COM_QUERY}, bytes.Repeat([]byte("SELECT 1 UNION "), 100)...)},
+			{1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}},
+		}
+		go func() {
+			stream := mysqlproto.NewStream(sender)
+			for _, packet := range packets {
+				WritePacket(stream, packet)
+			}
+		}()
+
+		stream := mysqlproto.NewStream(receiver)
+		for _, expected := range packets {
+			packet, err := stream.NextPacket()
+			if err != nil || packet.SequenceID != expected.SequenceID || !bytes.Equal(packet.Payload, expected.Payload) {
+				t.Errorf("Bogus packet through %s framing: %v (%v)", name, packet, err)
+			}
+		}
+		if receiver.sequence != 2 {
+			t.Errorf("Bogus %s sequence ID after two frames: %d", name, receiver.sequence)
+		}
+		sender.Close()
+		receiver.Close()
+	}
+}
+
+func TestCompressFrame(t *testing.T) {
+	short := []byte("honk")
+	if frame := compressFrame(zlibCodec{}, short, 3); !bytes.Equal(frame, append([]byte{4, 0, 0, 3, 0, 0, 0}, short...)) {
+		t.Errorf("Bogus frame for a short payload: %v", frame)
+	}
+
+	long := bytes.Repeat([]byte("bonk"), 100)
+	frame := compressFrame(zlibCodec{}, long, 0)
+	if len(frame) >= len(long) || frame[4] != 144 || frame[5] != 1 {
+		t.Errorf("Bogus frame for a long payload: %v", frame[:7])
+	}
+}
+
+func TestCompressedConn_enableWhileReading(t *testing.T) {
+	left, right := net.Pipe()
+	receiver := newCompressedConn(right)
+	receiver.codec = zlibCodec{}
+	defer left.Close()
+	defer receiver.Close()
+
+	// The receiver's already waiting for the next packet when the login
+	// finishes, and what turns up is a frame.
+	read := make(chan []byte)
+	go func() {
+		data := make([]byte, 5)
+		io.ReadFull(receiver, data)
+		read <- data
+	}()
+	receiver.enableReads()
+	left.Write(compressFrame(zlibCodec{}, []byte{1, 0, 0, 0, COM_PING}, 0))
+
+	if data := <-read; !bytes.Equal(data, []byte{1, 0, 0, 0, COM_PING}) {
+		t.Errorf("Bogus read across enabling compression: %v", data)
+	}
+}
+
+func TestNegotiatedCompression(t *testing.T) {
+	proxy := &ProxyConnection{}
+	conn := newCompressedConn(nil)
+	traced := newTracedConn(conn, NewPacketTrace(10), "client")
+
+	if proxy.negotiatedCompression(traced) != nil {
+		t.Error("Compression shouldn't start unless the client asked for it")
+	}
+	proxy.Capabilities = mysqlproto.CLIENT_COMPRESS | CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	if proxy.negotiatedCompression(traced) != conn {
+		t.Error("Compression should be found under a traced connection")
+	}
+	if _, ok := conn.codec.(zlibCodec); !ok {
+		t.Errorf("zlib should win over zstd: %T", conn.codec)
+	}
+	proxy.Capabilities = CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	if proxy.negotiatedCompression(traced); conn.codec == nil {
+		t.Error("zstd should be used when it's all the client asked for")
+	} else if _, ok := conn.codec.(zstdCodec); !ok {
+		t.Errorf("Bogus codec for zstd: %T", conn.codec)
+	}
+}
+
+func TestParseHandshakeResponse_zstd(t *testing.T) {
+	flags := mysqlproto.CLIENT_PROTOCOL_41 | mysqlproto.CLIENT_SECURE_CONNECTION | mysqlproto.CLIENT_PLUGIN_AUTH |
+		mysqlproto.CLIENT_CONNECT_ATTRS | CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	payload := mysqlproto.HandshakeResponse41(flags, 0x21, "alice", "", nil, "", nativePasswordPlugin, nil)[4:]
+	payload = append(payload, 4, 1, 'a', 1, 'b') // Connect attrs
+	payload = append(payload, 7)                 // zstd level
+
+	contents := (&ClientConnection{}).parseHandshakeResponse(mysqlproto.Packet{1, payload})
+	if contents.username != "alice" || contents.zstdLevel != 7 {
+		t.Errorf("Bogus handshake response with zstd: %+v", contents)
+	}
+}
@@ -10,33 +10,267 @@ import (
 	"github.com/BurntSushi/toml"
 )
 
-const usageString = "Usage: mysql-sanitizer [-v log-level] [-o output] [-p local-port] config-file"
+const usageString = "Usage: mysql-sanitizer [-v log-level] [-o output] [-p local-port] [--selftest] [--read-recording transcript] [--repl] config-file"
 
 // Config collects all the daemon's configuration options.
 type Config struct {
-	LogFile       string // The logfile we're writing to
-	MysqlHost     string // The host running MySQL
-	MysqlPort     int    // The MySQL server port on the MySQL host
-	MysqlUsername string // The username to log into MySQL with
-	MysqlPassword string // The password to log into MySQL with
-	ListeningPort int    // The port to listen for client connections on
-	LogLevel      int    // How much output to generate
-	WhitelistFile string // The path to the list of whitelisted string columns
-	HashSalt      string // A random value for generating consistent string garbage
-	HashSaltBytes []byte // For internal use only
+	LogFile       string      // The logfile we're writing to
+	MysqlHost     string      // The host running MySQL
+	MysqlPort     int         // The MySQL server port on the MySQL host
+	MysqlUsername string      // The username to log into MySQL with
+	MysqlPassword string      // The password to log into MySQL with
+	ListeningPort int         // The port to listen for client connections on
+	LogLevel      int         // How much output to generate
+	WhitelistFile string      // The path to the list of whitelisted string columns
+	HashSalt      string      // A random value for generating consistent string garbage
+	HashSaltBytes []byte      // For internal use only
+	HashAlgorithm string      // "hmac-sha256", "blake2b", or "sha256" (the old salted SHA-256)
+	FIPSMode      bool        // Refuse to start unless built against a FIPS-validated crypto module
+	Kdf           KdfConfig   // Slow hashing for low-entropy columns
+	CardColumns   []string    // "database.table.column" names holding card numbers
+	PhoneColumns  []string    // "database.table.column" names holding phone numbers
+	IPColumns     []string    // "database.table.column" names holding textual IP addresses
+	URLColumns    []string    // "database.table.column" names holding URLs
+	URLParams     []string    // Query string parameters whose values don't need masking in URLs
+	Scrub         ScrubConfig // Inline PII redaction for free-text columns
+
+	PIIDiscoveryInterval   int // Seconds between reports of columns that look like unclassified PII (0 disables)
+	PIIDiscoverySampleRate int // Inspect one value in this many for PII discovery
+
+	BlockedSetVariables    []string // Session variables clients aren't allowed to SET
+	AllowedIsolationLevels []string // Transaction isolation levels clients may switch to
+	StatementTimeout       int      // Seconds a statement may run before the server kills it
+	SessionInitStatements  []string // Statements to run on every new server session before the client's first query
+	MaxResultDuration      int      // Seconds a result set may take to stream to the client (0 means forever)
+
+	PreserveEmptyColumns []string // "database.table.column" names whose empty strings pass through unhashed
+	NullEmptyColumns     []string // "database.table.column" names whose empty strings are sent as NULL
+
+	PinnedDatabase string // If set, sessions always use this database and can't switch to another
+
+	SelfTest bool // Run the self-test and exit instead of accepting connections
+
+	PaginationColumns   []string // "database.table.column" keys to split big SELECTs on those tables by
+	PaginationChunkSize int      // Rows to fetch from the server per paginated query
+
+	LogSinks []LogSinkConfig // Extra places to send log messages, besides LogFile
+	Catalog  CatalogConfig   // A data catalog to take column classifications from
+
+	AllowedLabels map[string][]string // Session labels clients may set via "username?key=value", and their allowed values
+	RewriteRules  []RewriteRule       // Find-and-replace rules for incoming queries, applied in order
+
+	WarmConnections int // Server connections to keep logged in and ready for new clients (0 disables)
+
+	AdminUsers map[string]string // Usernames allowed to run admin commands, and their password hashes ("*" + hex SHA1(SHA1(password)))
+
+	RowRules []RowRule // Redaction that depends on other columns in the same row
+
+	CredentialsFile     string // A file with MysqlUsername and MysqlPassword to use instead, reloaded when it changes
+	CredentialsInterval int    // Seconds between checks of CredentialsFile for changes
+
+	XProtocolPort int // A port to turn X Protocol clients away on with an explanation, usually 33060 (0 disables)
+	PostgresPort  int // A port to accept PostgreSQL clients on, for simple SELECTs only (0 disables; experimental)
+
+	HTTPGatewayPort int // A port to accept queries as JSON over HTTP on (0 disables)
+
+	Rules        map[string]interface{} // Per-column actions ("pass", "hash", "redact", etc.) that override the whitelist
+	PatternRules []PatternRule          // Like Rules, but matching names with regexes
+	RulesVersion string                 // Name for Rules and PatternRules in logs and SHOW SANITIZER STATUS
+	Canary       CanaryConfig           // A new version of the rules to try out on some sessions first
+
+	WriteTimeout int // Seconds a write to a client or the server may take before we give up on the session (0 means forever)
+
+	SlowClientStall  int    // Seconds a result set may spend waiting for the client to read it before SlowClientPolicy kicks in (0 disables)
+	SlowClientPolicy string // "throttle" (keep waiting, and log it) or "evict" (kill the query and close the session)
+
+	Recording     RecordingConfig // Encrypted transcripts of some users' sessions, for compliance review
+	ReadRecording string          // Decrypt this transcript to stdout and exit instead of accepting connections
+
+	SchemaWatchInterval int // Seconds between checks for schema changes on the server (0 disables)
+
+	HashSalts []HashSaltConfig // Versioned salts to use instead of HashSalt, oldest first
+
+	LengthHistograms bool // Keep per-column histograms of value lengths before and after sanitizing
+	MinHashBits      int  // Warn about columns that truncate hashes to fewer bits than this
+
+	StrictDatabases []string // Databases whose columns all need a classification before anyone sees them ("*" for all)
+
+	SampledTables []SampledTable // Tables non-admins can only read a deterministic sample of
+
+	FastPing               bool // Answer COM_PING ourselves instead of asking the server
+	FastPingVerifyInterval int  // With FastPing, still pass a ping on if the server's been quiet this many seconds (0 never does)
+
+	HealthPort         int // Port for the /healthz and /readyz HTTP endpoints (0 disables)
+	HealthCacheSeconds int // How long /healthz reuses the last backend check
+
+	AdminAPIPort int    // Port for the HTTP admin API (0 disables)
+	AdminAPIBind string // Address the admin API listens on
+
+	Admission AdmissionConfig // Shedding low-priority users' queries while the server is degraded
+
+	IdentifierGroups []IdentifierGroup // Columns whose pseudonyms have to match each other, even across proxies
+
+	PolicyReport string // Print what happens to every column on the server in this format (markdown, html or csv) and exit
+
+	Budget BudgetConfig // Limits on how much one session can do
+
+	RedactSchemaComments bool // Redact table and column comments in SHOW CREATE TABLE, SHOW COLUMNS, etc.
+	RedactSchemaDefaults bool // Redact string column defaults in SHOW CREATE TABLE, SHOW COLUMNS, etc.
+
+	MaxConnections int // Clients to serve at once; more get a "Too many connections" error (0 for no limit)
+
+	IdleTimeout int // Seconds without a packet either way before we close a session (0 never does)
+
+	PacketTraceSize int // Packet headers each session remembers, to log if it dies of an error (0 disables)
+
+	DedupQueries  bool // Run identical concurrent SELECTs from the same user once and share the result
+	DedupMaxBytes int  // Results bigger than this are never shared
+
+	MysqlSocket string // Unix socket to reach the MySQL server on, instead of MysqlHost and MysqlPort
+
+	MysqlHosts           []string // "host:port" of servers to spread sessions over, instead of MysqlHost and MysqlPort
+	BalancePolicy        string   // How to pick one of MysqlHosts for each session: round-robin or least-connections
+	BackendRetryInterval int      // Seconds to skip one of MysqlHosts after we couldn't connect to it
+
+	Watermark         WatermarkConfig // Marking hashed values with who they were sanitized for
+	VerifyWatermark   string          // Check the hashed values in this file (one per line) for watermarks and exit
+	WatermarkProfiles string          // Comma-separated profiles VerifyWatermark checks for
+
+	SHA256Implementation string // "auto", "stdlib" or "simd" (sha256-simd, using SHA-NI or ARMv8 crypto instructions)
+
+	StandbyHosts []string // "host:port" of servers to fail over to, in order, while MysqlHost (or all of MysqlHosts) is down
+
+	AcceptWorkers int // Goroutines accepting clients and setting up their sessions in parallel
+
+	DLP DLPConfig // External DLP service to send fingerprints of result sets to
+
+	CompatibilityCheck string // What to do about a server that's missing features at startup: "warn", "require" or "off"
+
+	MaxColumnWidth map[string]int // Bytes of each TEXT or BLOB value to send, by username, with "*" for everyone else (0 for no limit)
+
+	TestMode bool // Use a fixed salt and a frozen clock, so output is the same every run (never for real data)
+
+	MultiStatements bool // Let clients send several statements in one query (CLIENT_MULTI_STATEMENTS)
+
+	AuditWrites []string // Usernames whose statements' affected rows, insert IDs and warnings go in the audit log ("*", the default, for everybody)
+
+	LocalInfile string // What to do with LOAD DATA LOCAL INFILE: "block" or "relay"
+
+	HandoffSocket string // Unix socket to take over idle sessions from other instances on (empty disables)
+
+	REPL bool // Explain what would happen to queries typed at the terminal and exit
+
+	QueryFilter QueryFilterConfig // Regexes for queries to refuse, or to allow and refuse the rest
+
+	MaskExpressions bool // Sanitize expressions on columns that would be sanitized themselves, like CONCAT(email, '')
+
+	AdminAPIToken string // Bearer token every admin API request has to carry (required with AdminAPIPort)
+
+	MysqlServerPublicKey    string // PEM file with the MySQL server's RSA public key, for caching_sha2_password without TLS
+	MysqlGetServerPublicKey bool   // Ask the server for its public key instead, which anyone on the network path could swap for theirs
 }
 
 var defaultConfig = Config{
-	"-",              // LogFile
-	"localhost",      // MysqlHost
-	3306,             // MysqlPort
-	"root",           // MysqlUsername
-	"",               // MysqlPassword
-	3306,             // ListeningPort
-	0,                // LogLevel
-	"whitelist.json", // WhitelistFile
-	randomHashSalt(), // HashSalt
-	[]byte{},         // HashSaltBytes
+	"-",                           // LogFile
+	"localhost",                   // MysqlHost
+	3306,                          // MysqlPort
+	"root",                        // MysqlUsername
+	"",                            // MysqlPassword
+	3306,                          // ListeningPort
+	0,                             // LogLevel
+	"whitelist.json",              // WhitelistFile
+	randomHashSalt(),              // HashSalt
+	[]byte{},                      // HashSaltBytes
+	"hmac-sha256",                 // HashAlgorithm
+	false,                         // FIPSMode
+	defaultKdfConfig,              // Kdf
+	[]string{},                    // CardColumns
+	[]string{},                    // PhoneColumns
+	[]string{},                    // IPColumns
+	[]string{},                    // URLColumns
+	[]string{},                    // URLParams
+	defaultScrubConfig,            // Scrub
+	0,                             // PIIDiscoveryInterval
+	100,                           // PIIDiscoverySampleRate
+	defaultBlockedSetVariables,    // BlockedSetVariables
+	defaultAllowedIsolationLevels, // AllowedIsolationLevels
+	20,                            // StatementTimeout
+	[]string{},                    // SessionInitStatements
+	0,                             // MaxResultDuration
+	[]string{},                    // PreserveEmptyColumns
+	[]string{},                    // NullEmptyColumns
+	"",                            // PinnedDatabase
+	false,                         // SelfTest
+	[]string{},                    // PaginationColumns
+	10000,                         // PaginationChunkSize
+	[]LogSinkConfig{},             // LogSinks
+	defaultCatalogConfig,          // Catalog
+	map[string][]string{},         // AllowedLabels
+	[]RewriteRule{},               // RewriteRules
+	0,                             // WarmConnections
+	map[string]string{},           // AdminUsers
+	[]RowRule{},                   // RowRules
+	"",                            // CredentialsFile
+	10,                            // CredentialsInterval
+	0,                             // XProtocolPort
+	0,                             // PostgresPort
+	0,                             // HTTPGatewayPort
+	map[string]interface{}{},      // Rules
+	[]PatternRule{},               // PatternRules
+	"current",                     // RulesVersion
+	defaultCanaryConfig,           // Canary
+	60,                            // WriteTimeout
+	0,                             // SlowClientStall
+	slowClientThrottle,            // SlowClientPolicy
+	defaultRecordingConfig,        // Recording
+	"",                            // ReadRecording
+	0,                             // SchemaWatchInterval
+	[]HashSaltConfig{},            // HashSalts
+	false,                         // LengthHistograms
+	32,                            // MinHashBits
+	[]string{},                    // StrictDatabases
+	[]SampledTable{},              // SampledTables
+	false,                         // FastPing
+	60,                            // FastPingVerifyInterval
+	0,                             // HealthPort
+	5,                             // HealthCacheSeconds
+	0,                             // AdminAPIPort
+	"127.0.0.1",                   // AdminAPIBind
+	defaultAdmissionConfig,        // Admission
+	[]IdentifierGroup{},           // IdentifierGroups
+	"",                            // PolicyReport
+	defaultBudgetConfig,           // Budget
+	true,                          // RedactSchemaComments
+	true,                          // RedactSchemaDefaults
+	0,                             // MaxConnections
+	0,                             // IdleTimeout
+	64,                            // PacketTraceSize
+	false,                         // DedupQueries
+	16 << 20,                      // DedupMaxBytes
+	"",                            // MysqlSocket
+	[]string{},                    // MysqlHosts
+	balanceRoundRobin,             // BalancePolicy
+	10,                            // BackendRetryInterval
+	defaultWatermarkConfig,        // Watermark
+	"",                            // VerifyWatermark
+	"",                            // WatermarkProfiles
+	"auto",                        // SHA256Implementation
+	[]string{},                    // StandbyHosts
+	1,                             // AcceptWorkers
+	defaultDLPConfig,              // DLP
+	"warn",                        // CompatibilityCheck
+	map[string]int{},              // MaxColumnWidth
+	false,                         // TestMode
+	false,                         // MultiStatements
+	[]string{"*"},                 // AuditWrites
+	"block",                       // LocalInfile
+	"",                            // HandoffSocket
+	false,                         // REPL
+	defaultQueryFilterConfig,      // QueryFilter
+	true,                          // MaskExpressions
+	"",                            // AdminAPIToken
+	"",                            // MysqlServerPublicKey
+	false,                         // MysqlGetServerPublicKey
 }
 
 func randomHashSalt() string {
@@ -78,14 +312,31 @@ func GetConfig() Config {
 	if config.MysqlUsername == "" {
 		log.Fatal("No MysqlUsername found in the config file!")
 	}
+	if len(config.HashSalts) > 0 {
+		newest, err := newestHashSalt(config.HashSalts)
+		if err != nil {
+			log.Fatalf("Bad HashSalts configuration: %s", err)
+		}
+		config.HashSaltBytes = []byte(newest.Salt)
+	}
 
 	// Read the command-line flags.
 	flag.StringVar(&config.LogFile, "o", "-", "The filename to log output to (default stdout)")
 	flag.IntVar(&config.ListeningPort, "p", config.ListeningPort, "The port to listen for client connections on (default 3306)")
 	flag.IntVar(&config.LogLevel, "v", config.LogLevel, "The verbosity level (0-3, default 0)")
 	flag.StringVar(&config.WhitelistFile, "w", "whitelist.json", "The filename of the json file detailing which columns do not need to be sanitized (default whitelist.json)")
+	flag.BoolVar(&config.SelfTest, "selftest", false, "Run the proxy against a fake MySQL server, report whether it works, and exit")
+	flag.StringVar(&config.ReadRecording, "read-recording", "", "Decrypt a session transcript to stdout and exit")
+	flag.StringVar(&config.PolicyReport, "policy-report", "", "Print the policy for every column on the server as markdown, html or csv, and exit")
+	flag.StringVar(&config.VerifyWatermark, "verify-watermark", "", "Check a file of hashed values, one per line, for the watermarks of -watermark-profiles, and exit")
+	flag.StringVar(&config.WatermarkProfiles, "watermark-profiles", "", "Comma-separated profiles (usernames or label values) for -verify-watermark")
+	flag.BoolVar(&config.REPL, "repl", false, "Type queries and see what the proxy would do with them, without a MySQL server")
+	flag.BoolVar(&config.TestMode, "test-mode", config.TestMode, "Hash with a fixed salt and freeze the clock, so output is the same every run")
 	flag.Parse()
 
+	if config.TestMode {
+		useTestMode(&config)
+	}
 	return config
 }
 
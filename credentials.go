@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Credentials are what we log into the MySQL server with. They start out as
+// MysqlUsername and MysqlPassword from the config, but can be rotated at
+// runtime through CredentialsFile.
+type Credentials struct {
+	MysqlUsername string
+	MysqlPassword string
+}
+
+var backendCredentials atomic.Value
+
+func currentCredentials() Credentials {
+	credentials, _ := backendCredentials.Load().(Credentials)
+	return credentials
+}
+
+func setCredentials(credentials Credentials) {
+	backendCredentials.Store(credentials)
+}
+
+// loadCredentialsFile reads a TOML file with MysqlUsername and MysqlPassword
+// in it, like the ones in the main config file.
+func loadCredentialsFile(path string) (Credentials, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Credentials{}, err
+	}
+	if info.Mode()&0077 > 0 {
+		return Credentials{}, fmt.Errorf("The credentials file has excessively permissive permissions! Try \"chmod 0600 %s\".", path)
+	}
+
+	var credentials Credentials
+	if _, err := toml.DecodeFile(path, &credentials); err != nil {
+		return Credentials{}, err
+	}
+	if credentials.MysqlUsername == "" {
+		return Credentials{}, fmt.Errorf("No MysqlUsername found in %s", path)
+	}
+	return credentials, nil
+}
+
+// checkCredentialsFile switches to the file's credentials if it's changed
+// since lastModified, and returns the modification time to compare against
+// next time. Sessions that are already logged in are left alone, so the old
+// credentials need to keep working on the server until they've gone away.
+func checkCredentialsFile(path string, lastModified time.Time) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		output.Log("Can't check credentials file %s, keeping the current credentials: %s", path, err)
+		return lastModified
+	}
+	if info.ModTime().Equal(lastModified) {
+		return lastModified
+	}
+
+	credentials, err := loadCredentialsFile(path)
+	if err != nil {
+		output.Log("Can't load new credentials from %s, keeping the current ones: %s", path, err)
+		return lastModified
+	}
+	if credentials != currentCredentials() {
+		setCredentials(credentials)
+		output.Audit("Switched to new MySQL credentials for user %s from %s", credentials.MysqlUsername, path)
+	}
+	return info.ModTime()
+}
+
+// WatchCredentialsFile checks the credentials file for changes forever.
+func WatchCredentialsFile(path string, interval time.Duration) {
+	lastModified := time.Time{}
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		lastModified = checkCredentialsFile(path, lastModified)
+	}
+}
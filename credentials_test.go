@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadCredentialsFile_Permissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials.toml")
+
+	ioutil.WriteFile(path, []byte("MysqlUsername = \"honk\"\nMysqlPassword = \"bonk\"\n"), 0644)
+	if _, err := loadCredentialsFile(path); err == nil {
+		t.Error("World-readable credentials file should have been refused")
+	}
+
+	os.Chmod(path, 0600)
+	credentials, err := loadCredentialsFile(path)
+	if err != nil {
+		t.Fatalf("loadCredentialsFile failed: %s", err)
+	}
+	if credentials != (Credentials{"honk", "bonk"}) {
+		t.Errorf("Bogus credentials: %v", credentials)
+	}
+}
+
+func TestCheckCredentialsFile(t *testing.T) {
+	old := currentCredentials()
+	defer setCredentials(old)
+	setCredentials(Credentials{"honk", "bonk"})
+
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials.toml")
+
+	ioutil.WriteFile(path, []byte("MysqlUsername = \"honk\"\nMysqlPassword = \"blarp\"\n"), 0600)
+	lastModified := checkCredentialsFile(path, time.Time{})
+	if currentCredentials() != (Credentials{"honk", "blarp"}) {
+		t.Errorf("Bogus credentials after rotation: %v", currentCredentials())
+	}
+
+	// A broken file keeps the current credentials.
+	ioutil.WriteFile(path, []byte("MysqlPassword = \"woopwoop\"\n"), 0600)
+	os.Chtimes(path, lastModified.Add(time.Second), lastModified.Add(time.Second))
+	if checkCredentialsFile(path, lastModified) != lastModified {
+		t.Error("Broken file shouldn't have been marked as seen")
+	}
+	if currentCredentials() != (Credentials{"honk", "blarp"}) {
+		t.Errorf("Bogus credentials after broken file: %v", currentCredentials())
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"net"
+)
+
+// CryptoPAn implements Crypto-PAn prefix-preserving IP pseudonymization
+// (Xu, Fan, Ammar & Moon, 2002): two addresses that share an n-bit prefix
+// map to pseudonyms that share an n-bit prefix, so per-subnet analytics
+// still work on sanitized data. Works for both IPv4 and IPv6.
+type CryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+}
+
+// NewCryptoPAn returns a CryptoPAn keyed with the given 32 bytes: the first
+// half is the AES key, and the second half is encrypted to make the pad.
+func NewCryptoPAn(key []byte) (*CryptoPAn, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Crypto-PAn key must be 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+
+	anonymizer := CryptoPAn{block: block}
+	block.Encrypt(anonymizer.pad[:], key[16:])
+	return &anonymizer, nil
+}
+
+// Anonymize returns the pseudonym for the given address.
+func (anonymizer *CryptoPAn) Anonymize(ip net.IP) net.IP {
+	addr := ip.To4()
+	if addr == nil {
+		addr = ip.To16()
+	}
+	bits := len(addr) * 8
+
+	var input, output [aes.BlockSize]byte
+	result := make(net.IP, len(addr))
+	for pos := 0; pos < bits; pos++ {
+		// The first pos bits come from the original address, and the rest
+		// come from the pad.
+		for i := range input {
+			keepBits := pos - i*8
+			switch {
+			case keepBits >= 8:
+				input[i] = addr[i]
+			case keepBits <= 0:
+				input[i] = anonymizer.pad[i]
+			default:
+				mask := byte(0xFF << uint(8-keepBits))
+				input[i] = (addr[i] & mask) | (anonymizer.pad[i] & ^mask)
+			}
+		}
+
+		anonymizer.block.Encrypt(output[:], input[:])
+		result[pos/8] |= (output[0] >> 7) << uint(7-pos%8)
+	}
+
+	for i := range result {
+		result[i] ^= addr[i]
+	}
+	return result
+}
+
+// maskIPAddress pseudonymizes a textual IPv4 or IPv6 address. It returns
+// false if the value doesn't parse as one.
+func maskIPAddress(value []byte, anonymizer *CryptoPAn) ([]byte, bool) {
+	ip := net.ParseIP(string(value))
+	if ip == nil {
+		return nil, false
+	}
+	return []byte(anonymizer.Anonymize(ip).String()), true
+}
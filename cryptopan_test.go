@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+const cryptoPAnTestKey = "boojahyoo3vaeToong0Eijee7Ahz3yee"
+
+func TestCryptoPAnAnonymize(t *testing.T) {
+	anonymizer, err := NewCryptoPAn([]byte(cryptoPAnTestKey))
+	if err != nil {
+		t.Fatalf("NewCryptoPAn failed: %s", err)
+	}
+
+	first := anonymizer.Anonymize(net.ParseIP("128.11.68.132"))
+	second := anonymizer.Anonymize(net.ParseIP("128.11.68.132"))
+	if !first.Equal(second) {
+		t.Errorf("Pseudonyms aren't deterministic: %s vs. %s", first, second)
+	}
+	if first.Equal(net.ParseIP("128.11.68.132")) {
+		t.Error("Address wasn't actually pseudonymized!")
+	}
+	if first.Equal(anonymizer.Anonymize(net.ParseIP("128.11.68.133"))) {
+		t.Errorf("Different addresses got the same pseudonym: %s", first)
+	}
+}
+
+func TestNewCryptoPAn_BadKey(t *testing.T) {
+	if _, err := NewCryptoPAn([]byte("too short")); err == nil {
+		t.Error("Short Crypto-PAn key was accepted!")
+	}
+}
+
+func TestCryptoPAnAnonymize_PrefixPreserving(t *testing.T) {
+	anonymizer, _ := NewCryptoPAn([]byte(cryptoPAnTestKey))
+
+	first := anonymizer.Anonymize(net.ParseIP("10.1.2.3")).To4()
+	second := anonymizer.Anonymize(net.ParseIP("10.1.2.200")).To4()
+	if first[0] != second[0] || first[1] != second[1] || first[2] != second[2] {
+		t.Errorf("Addresses in the same /24 got different prefixes: %s and %s", first, second)
+	}
+
+	first = anonymizer.Anonymize(net.ParseIP("2001:db8:1234::1"))
+	second = anonymizer.Anonymize(net.ParseIP("2001:db8:1234::ffff"))
+	if first.Mask(net.CIDRMask(48, 128)).String() != second.Mask(net.CIDRMask(48, 128)).String() {
+		t.Errorf("Addresses in the same /48 got different prefixes: %s and %s", first, second)
+	}
+}
+
+func TestMaskIPAddress(t *testing.T) {
+	anonymizer, _ := NewCryptoPAn([]byte(cryptoPAnTestKey))
+
+	if _, ok := maskIPAddress([]byte("not an address"), anonymizer); ok {
+		t.Error("Garbage was treated as an IP address!")
+	}
+	masked, ok := maskIPAddress([]byte("128.11.68.132"), anonymizer)
+	if !ok || net.ParseIP(string(masked)) == nil {
+		t.Errorf("Bogus masked IP address: '%s'", masked)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// checkDatabaseChange returns an error if the command would switch the
+// session to a database other than the pinned one. Either COM_INIT_DB or a
+// USE statement can do that.
+func checkDatabaseChange(packet mysqlproto.Packet, pinned string) error {
+	if pinned == "" {
+		return nil
+	}
+
+	database, changes := databaseChange(packet)
+	if changes && !strings.EqualFold(database, pinned) {
+		return fmt.Errorf("This mysql-sanitizer only allows access to the '%s' database", pinned)
+	}
+	return nil
+}
+
+// databaseChange returns the database a COM_INIT_DB or USE statement
+// switches to.
+func databaseChange(packet mysqlproto.Packet) (string, bool) {
+	switch packetCommand(packet) {
+	case COM_INIT_DB:
+		return string(packet.Payload[1:]), true
+	case COM_QUERY:
+		query := strings.TrimSpace(stripComments(string(packet.Payload[1:])))
+		if firstKeyword(query) != "USE" {
+			return "", false
+		}
+		return unquoteIdentifier(strings.TrimRight(query[len("USE"):], "; \t\r\n")), true
+	}
+	return "", false
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestCheckDatabaseChange(t *testing.T) {
+	packets := map[string]bool{
+		"\x02payments":            true,
+		"\x02PAYMENTS":            true,
+		"\x02users":               false,
+		"\x03USE payments":        true,
+		"\x03 use `payments`;":    true,
+		"\x03/* hi */ USE users":  false,
+		"\x03USE`users`":          false,
+		"\x03SELECT * FROM users": true,
+		"\x03user_stuff()":        true,
+		"\x0e":                    true,
+	}
+
+	for payload, allowed := range packets {
+		err := checkDatabaseChange(mysqlproto.Packet{0, []byte(payload)}, "payments")
+		if allowed && err != nil {
+			t.Errorf("Bogus error for %q: %s", payload, err)
+		} else if !allowed && err == nil {
+			t.Errorf("%q should have been rejected", payload)
+		}
+	}
+}
+
+func TestCheckDatabaseChange_NotPinned(t *testing.T) {
+	if err := checkDatabaseChange(mysqlproto.Packet{0, []byte("\x02users")}, ""); err != nil {
+		t.Errorf("Nothing should be rejected without a pinned database: %s", err)
+	}
+}
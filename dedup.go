@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Dashboards love to fire the same expensive SELECT from a dozen sessions at
+// once. With DedupQueries on, the first session to send a query runs it and
+// the others wait for its (already sanitized) result instead of piling onto
+// the server.
+//
+// Only sessions with the same username, database, rules and watermark share
+// results, since any of those can change what comes back. (Sessions with the
+// same username can still have different watermarks, with Watermark.Label.)
+// Session variables like time_zone aren't part of that, which is why this is
+// off by default. We also leave alone anything in a transaction and anything
+// that depends on which session runs it (NOW(), user variables, locking
+// reads, and so on).
+
+var dedupSelectRegex = regexp.MustCompile(`(?is)^SELECT\b`)
+var dedupBlockerRegex = regexp.MustCompile(`(?i)@|\b(FOR\s+UPDATE|LOCK\s+IN\s+SHARE\s+MODE|INTO|SQL_CALC_FOUND_ROWS|SQL_NO_CACHE|` +
+	`RAND|UUID|UUID_SHORT|NOW|SYSDATE|CURDATE|CURTIME|CURRENT_DATE|CURRENT_TIME|CURRENT_TIMESTAMP|UNIX_TIMESTAMP|UTC_TIMESTAMP|` +
+	`CONNECTION_ID|LAST_INSERT_ID|FOUND_ROWS|ROW_COUNT|USER|CURRENT_USER|SESSION_USER|SYSTEM_USER|DATABASE|SCHEMA|` +
+	`SLEEP|BENCHMARK|GET_LOCK|RELEASE_LOCK|IS_FREE_LOCK|IS_USED_LOCK)\b`)
+
+// dedupedQuery is one query somebody is running on everybody's behalf.
+type dedupedQuery struct {
+	done    chan struct{}
+	packets []mysqlproto.Packet // The result to replay, or nil if the others have to run it themselves
+	waiters int
+}
+
+// dedupCapture collects what the leading session sends its client.
+type dedupCapture struct {
+	packets  []mysqlproto.Packet
+	bytes    int
+	overflow bool // Too big to keep, so nobody gets to share it
+}
+
+// QueryDeduper keeps track of the queries in flight.
+type QueryDeduper struct {
+	maxBytes int
+	mutex    sync.Mutex
+	inflight map[string]*dedupedQuery
+	shared   int64 // Queries answered from somebody else's result
+}
+
+// NewQueryDeduper returns a QueryDeduper, or nil if deduplication is off.
+func NewQueryDeduper(enabled bool, maxBytes int) *QueryDeduper {
+	if !enabled {
+		return nil
+	}
+	return &QueryDeduper{maxBytes: maxBytes, inflight: map[string]*dedupedQuery{}}
+}
+
+// join returns the in-flight query for the key, and whether the caller is
+// the one who has to run it.
+func (deduper *QueryDeduper) join(key string) (*dedupedQuery, bool) {
+	deduper.mutex.Lock()
+	defer deduper.mutex.Unlock()
+
+	if query, ok := deduper.inflight[key]; ok {
+		query.waiters++
+		return query, false
+	}
+	query := &dedupedQuery{done: make(chan struct{})}
+	deduper.inflight[key] = query
+	return query, true
+}
+
+// finish hands the leader's result (or nil) to whoever's waiting.
+func (deduper *QueryDeduper) finish(key string, query *dedupedQuery, packets []mysqlproto.Packet) {
+	deduper.mutex.Lock()
+	delete(deduper.inflight, key)
+	waiters := query.waiters
+	deduper.mutex.Unlock()
+
+	if waiters > 0 && packets != nil {
+		output.Debug("Shared a query's result with %d other sessions", waiters)
+	}
+
+	query.packets = packets
+	close(query.done)
+}
+
+// waiting returns how many sessions are waiting on the query.
+func (deduper *QueryDeduper) waiting(query *dedupedQuery) int {
+	deduper.mutex.Lock()
+	defer deduper.mutex.Unlock()
+	return query.waiters
+}
+
+// dedupKey returns what a query has to match to share another session's
+// result, or false if it shouldn't be shared at all.
+func dedupKey(proxy *ProxyConnection, packet mysqlproto.Packet) (string, bool) {
+	if packetCommand(packet) != COM_QUERY || proxy.transactionOpen {
+		return "", false
+	}
+	query := stripLeadingComments(string(packet.Payload[1:]))
+	if !dedupSelectRegex.MatchString(query) || dedupBlockerRegex.MatchString(query) || len(splitStatements(query)) > 1 {
+		return "", false
+	}
+	ruleSet := ""
+	if rules := proxy.RuleSet(); rules != nil {
+		ruleSet = rules.Version
+	}
+	// Sessions with CLIENT_DEPRECATE_EOF get their results framed differently.
+	return proxy.Username() + "\x00" + proxy.Database + "\x00" + ruleSet + "\x00" + proxy.Watermark() + "\x00" +
+		strconv.FormatBool(proxy.Sanitizing()) + "\x00" + strconv.FormatBool(proxy.deprecateEOF()) + "\x00" + query, true
+}
+
+// runDeduplicated runs the query in the packet, or waits for another session
+// that's already running it. It returns false if the query isn't one we
+// share, or the other session couldn't share its result, and the caller
+// has to run it as usual.
+func (server *ServerConnection) runDeduplicated(packet mysqlproto.Packet) bool {
+	if deduper == nil {
+		return false
+	}
+	key, ok := dedupKey(server.proxy, packet)
+	if !ok {
+		return false
+	}
+
+	query, leader := deduper.join(key)
+	if !leader {
+		select {
+		case <-query.done:
+		case <-server.proxy.ctx.Done():
+			return true
+		}
+		if query.packets == nil {
+			return false
+		}
+		atomic.AddInt64(&deduper.shared, 1)
+		server.proxy.Output().Debug("Answered query from another session's result")
+		server.replayResult(query.packets)
+		return true
+	}
+
+	capture := &dedupCapture{}
+	server.proxy.capture = capture
+	defer func() { server.proxy.capture = nil }()
+
+	if err := server.write(packet); err != nil {
+		deduper.finish(key, query, nil)
+		server.lostBackend(packet.SequenceID, fmt.Errorf("Couldn't write to MySQL server: %s", err))
+		return true
+	}
+	server.handleQueryResponse()
+	if server.finished || capture.overflow {
+		deduper.finish(key, query, nil)
+	} else {
+		deduper.finish(key, query, capture.packets)
+	}
+	return true
+}
+
+// add keeps a packet the leader sent, unless the result's got too big.
+func (capture *dedupCapture) add(packet mysqlproto.Packet) {
+	if capture.overflow {
+		return
+	}
+	capture.bytes += len(packet.Payload)
+	if capture.bytes > deduper.maxBytes {
+		capture.overflow = true
+		capture.packets = nil
+		return
+	}
+	// Copy it, in case anything reuses the buffer once it's sent.
+	capture.packets = append(capture.packets, mysqlproto.Packet{packet.SequenceID, append([]byte{}, packet.Payload...)})
+}
+
+// replayResult sends the client a result another session got, charging the
+// rows to this session's budget and recording it like any other.
+func (server *ServerConnection) replayResult(packets []mysqlproto.Packet) {
+	for _, packet := range packets {
+		server.proxy.SendToClient(packet)
+	}
+
+	last := packets[len(packets)-1]
+	if len(packets) > 1 {
+		// A result set: column count, definitions, EOF (unless
+		// CLIENT_DEPRECATE_EOF), rows, and EOF, OK or ERR.
+		columnCount := int(NewPacketParser(packets[0]).ReadEncodedInt())
+		columns := []Column{}
+		for _, definition := range packets[1 : columnCount+1] {
+			if col, err := ReadColumn(NewPacketParser(definition)); err == nil {
+				columns = append(columns, col)
+			}
+		}
+		firstRow := columnCount + 2
+		if server.proxy.deprecateEOF() {
+			firstRow--
+		}
+		rows := packets[firstRow : len(packets)-1]
+		for _, row := range rows {
+			server.proxy.countRow(len(row.Payload))
+		}
+		server.proxy.Record(RecordingEntry{Event: "columns", Columns: columnNames(columns)})
+		server.proxy.Record(RecordingEntry{Event: "rows", Rows: uint64(len(rows))})
+	}
+	server.proxy.recordResponse(last)
+}
+
+// noteStatus keeps track of whether the session's in a transaction, going by
+// the status flags on the last packet of each response.
+func (proxy *ProxyConnection) noteStatus(packet mysqlproto.Packet) {
+	flags, ok := proxy.statusFlags(packet)
+	if !ok {
+		return
+	}
+	proxy.transactionOpen = flags&SERVER_STATUS_IN_TRANS != 0 || flags&SERVER_STATUS_AUTOCOMMIT == 0
+}
+
+func (deduper *QueryDeduper) statusRows() [][]string {
+	if deduper == nil {
+		return nil
+	}
+	return [][]string{{"Queries_deduplicated", strconv.FormatInt(atomicLoad(&deduper.shared), 10)}}
+}
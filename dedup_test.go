@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestDedupKey(t *testing.T) {
+	proxy := &ProxyConnection{Database: "honk", username: "alice"}
+	queries := map[string]bool{
+		"SELECT * FROM bonk":                          true,
+		"/* dashboard */ select count(*) from bonk":   true,
+		"SELECT * FROM bonk WHERE created_at > NOW()": false,
+		"SELECT @foo":                                 false,
+		"SELECT * FROM bonk FOR UPDATE":               false,
+		"SELECT id INTO @id FROM bonk":                false,
+		"SELECT CURRENT_USER()":                       false,
+		"UPDATE bonk SET name = NULL":                 false,
+		"SHOW TABLES":                                 false,
+	}
+	for query, shared := range queries {
+		if _, ok := dedupKey(proxy, mysqlproto.Packet{0, append([]byte{COM_QUERY}, query...)}); ok != shared {
+			t.Errorf("Bogus deduplication for %q: %v", query, ok)
+		}
+	}
+
+	key, _ := dedupKey(proxy, mysqlproto.Packet{0, []byte("\x03SELECT 1")})
+	other := &ProxyConnection{Database: "honk", username: "bob"}
+	if otherKey, _ := dedupKey(other, mysqlproto.Packet{0, []byte("\x03SELECT 1")}); otherKey == key {
+		t.Error("Different users shouldn't share results")
+	}
+
+	// Same user, but labelled with different watermark profiles.
+	defer func() { config.Watermark = defaultWatermarkConfig }()
+	config.Watermark = WatermarkConfig{Bits: 8, Label: "tenant"}
+	acme := &ProxyConnection{Database: "honk", username: "alice"}
+	acme.SetWatermark("alice", map[string]string{"tenant": "acme"})
+	initech := &ProxyConnection{Database: "honk", username: "alice"}
+	initech.SetWatermark("alice", map[string]string{"tenant": "initech"})
+	acmeKey, _ := dedupKey(acme, mysqlproto.Packet{0, []byte("\x03SELECT 1")})
+	if initechKey, _ := dedupKey(initech, mysqlproto.Packet{0, []byte("\x03SELECT 1")}); initechKey == acmeKey {
+		t.Error("Sessions with different watermarks shouldn't share results")
+	}
+	proxy.transactionOpen = true
+	if _, ok := dedupKey(proxy, mysqlproto.Packet{0, []byte("\x03SELECT 1")}); ok {
+		t.Error("Queries in a transaction shouldn't share results")
+	}
+}
+
+func TestNoteStatus(t *testing.T) {
+	proxy := &ProxyConnection{}
+	proxy.noteStatus(mysqlproto.Packet{1, []byte{0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00}})
+	if !proxy.transactionOpen {
+		t.Error("SERVER_STATUS_IN_TRANS should open a transaction")
+	}
+	proxy.noteStatus(EOFPacket(4))
+	if proxy.transactionOpen {
+		t.Error("Autocommit with no transaction shouldn't count as one")
+	}
+	proxy.noteStatus(mysqlproto.Packet{1, []byte{0xFE, 0x00, 0x00, 0x00, 0x00}})
+	if !proxy.transactionOpen {
+		t.Error("Autocommit off should count as a transaction")
+	}
+}
+
+func TestRunDeduplicated(t *testing.T) {
+	oldDeduper := deduper
+	defer func() { deduper = oldDeduper }()
+	deduper = NewQueryDeduper(true, 1<<20)
+
+	proxyEnd, backendEnd := net.Pipe()
+	defer proxyEnd.Close()
+	leader := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background(), Database: "honk"}
+	server := &ServerConnection{leader, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+	query := mysqlproto.Packet{0, []byte("\x03SELECT id FROM bonk")}
+
+	// The fake server answers once, when we say so.
+	release := make(chan bool)
+	asked := make(chan bool)
+	go func() {
+		backend := mysqlproto.NewStream(backendEnd)
+		if _, err := backend.NextPacket(); err != nil {
+			return
+		}
+		asked <- true
+		<-release
+		packets := []mysqlproto.Packet{{1, LengthEncodedInt(1)}, selftestColumnPacket(1, "id", 0x03), EOFPacket(2)}
+		packets = append(packets, TextRowPacket(3, []string{"1"}), TextRowPacket(4, []string{"2"}), EOFPacket(5))
+		for _, packet := range packets {
+			WritePacket(backend, packet)
+		}
+	}()
+
+	done := make(chan bool)
+	go func() { done <- server.runDeduplicated(query) }()
+	<-asked
+	key, _ := dedupKey(leader, query)
+	inflight, isLeader := deduper.join(key)
+	if isLeader {
+		t.Fatal("The first session should be running the query")
+	}
+	close(release)
+	if !<-done {
+		t.Fatal("The first session should have run the query itself")
+	}
+	<-inflight.done
+	if len(inflight.packets) != 6 || len(leader.ClientChannel) != 6 {
+		t.Fatalf("Bogus shared result: %d packets, %d sent to the client", len(inflight.packets), len(leader.ClientChannel))
+	}
+
+	// A second session waiting on the same query gets the same packets
+	// without going near the server.
+	follower := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background(), Database: "honk"}
+	followerServer := &ServerConnection{follower, nil, false, false, false, nil, time.Time{}}
+	inflight, _ = deduper.join(key)
+	go func() { done <- followerServer.runDeduplicated(query) }()
+	for deduper.waiting(inflight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	deduper.finish(key, inflight, leaderPackets(leader))
+	if !<-done {
+		t.Fatal("The second session should have used the shared result")
+	}
+	if len(follower.ClientChannel) != 6 || atomicLoad(&follower.usedRows) != 2 || atomicLoad(&deduper.shared) != 1 {
+		t.Errorf("Bogus replayed result: %d packets, %d rows", len(follower.ClientChannel), atomicLoad(&follower.usedRows))
+	}
+
+	// If there's nothing to share, the waiting session has to run the query
+	// itself.
+	inflight, _ = deduper.join(key)
+	go func() { done <- followerServer.runDeduplicated(query) }()
+	for deduper.waiting(inflight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	deduper.finish(key, inflight, nil)
+	if <-done {
+		t.Error("The second session should have been told to run the query itself")
+	}
+}
+
+func leaderPackets(proxy *ProxyConnection) []mysqlproto.Packet {
+	packets := []mysqlproto.Packet{}
+	for len(proxy.ClientChannel) > 0 {
+		packets = append(packets, <-proxy.ClientChannel)
+	}
+	return packets
+}
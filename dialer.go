@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// BackendDialer opens a connection to the MySQL server. The default one
+// uses MysqlSocket or MysqlHosts if either is set, and MysqlHost and
+// MysqlPort otherwise.
+// Deployments that have to get to the server some other way (through an
+// SSH tunnel, a SOCKS proxy, ...) can build in a file that calls
+// SetBackendDialer from its init function.
+type BackendDialer func() (net.Conn, error)
+
+var backendDialer BackendDialer = dialBackend
+
+// SetBackendDialer replaces how we connect to the MySQL server. It has to
+// be called before we start accepting clients.
+func SetBackendDialer(dialer BackendDialer) {
+	backendDialer = dialer
+}
+
+func dialBackend() (net.Conn, error) {
+	if balancer != nil {
+		return balancer.Dial()
+	}
+	if config.MysqlSocket != "" {
+		conn, err := net.Dial("unix", config.MysqlSocket)
+		if err != nil {
+			return nil, fmt.Errorf("Can't connect to socket %s: %s", config.MysqlSocket, err)
+		}
+		return conn, nil
+	}
+
+	addrString := config.MysqlHost + ":" + strconv.Itoa(config.MysqlPort)
+	addr, err := net.ResolveTCPAddr("tcp", addrString)
+	if err != nil {
+		return nil, fmt.Errorf("Can't resolve host %s: %s", config.MysqlHost, err)
+	}
+	addr.Port = config.MysqlPort
+
+	socket, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("Can't connect to %s on port %d:  %s", config.MysqlHost, addr.Port, err)
+	}
+	return socket, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestDialBackend_socket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mysql.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Couldn't listen on %s: %s", path, err)
+	}
+	defer listener.Close()
+
+	oldSocket := config.MysqlSocket
+	defer func() { config.MysqlSocket = oldSocket }()
+	config.MysqlSocket = path
+
+	server, err := NewServerConnection(nil)
+	if err != nil {
+		t.Fatalf("Couldn't connect over the socket: %s", err)
+	}
+	server.Close()
+
+	config.MysqlSocket = filepath.Join(t.TempDir(), "nope.sock")
+	if _, err := NewServerConnection(nil); err == nil {
+		t.Error("Connecting to a missing socket should fail")
+	}
+}
+
+func TestSetBackendDialer(t *testing.T) {
+	defer SetBackendDialer(dialBackend)
+
+	proxyEnd, backendEnd := net.Pipe()
+	defer backendEnd.Close()
+	SetBackendDialer(func() (net.Conn, error) { return proxyEnd, nil })
+
+	server, err := NewServerConnection(nil)
+	if err != nil || compressionOf(server.conn) == nil || compressionOf(server.conn).Conn != proxyEnd {
+		t.Errorf("Bogus connection from a custom dialer: %v (%v)", server, err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Some security teams want every data egress path to go past their DLP
+// tooling. With DLP.URL set, we POST a sample of result sets there after
+// they've been sent: which columns came back, how many rows, and SHA-256
+// fingerprints of the values the client actually got (so after
+// sanitization), for the DLP service to match against whatever it's looking
+// for. The values themselves never leave the proxy.
+//
+// The service answers with a verdict:
+//
+//	{"verdict": "allow"}
+//	{"verdict": "alert", "reason": "Looks like card numbers"}
+//	{"verdict": "block", "reason": "Bulk export of customer emails"}
+//
+// An alert goes in the audit log, and a block does too and then closes the
+// session. All of this happens off to the side, so the client never waits
+// on the DLP service; a block stops whatever comes next, not the result that
+// set it off.
+
+// DLPConfig is the [DLP] section of the config file.
+type DLPConfig struct {
+	URL        string  // Where to POST result sets for scanning (empty disables)
+	SampleRate float64 // Fraction of result sets to scan, from 0 to 1
+	MaxRows    int     // Rows per result set to fingerprint
+	Timeout    int     // Seconds to wait for a verdict
+	FailClosed bool    // Close sessions whose results couldn't be scanned
+}
+
+var defaultDLPConfig = DLPConfig{
+	"",    // URL
+	1,     // SampleRate
+	100,   // MaxRows
+	10,    // Timeout
+	false, // FailClosed
+}
+
+// dlpQueueSize is how many result sets can wait to be scanned. Past that we
+// drop them (and count it), rather than slow down sessions.
+const dlpQueueSize = 1000
+
+// dlpWorkers is how many requests we have out to the DLP service at once.
+const dlpWorkers = 4
+
+func checkDLPConfig(dlpConfig DLPConfig) error {
+	if dlpConfig.URL == "" {
+		return nil
+	}
+	if dlpConfig.SampleRate < 0 || dlpConfig.SampleRate > 1 {
+		return fmt.Errorf("SampleRate should be between 0 and 1")
+	}
+	if dlpConfig.MaxRows < 0 {
+		return fmt.Errorf("MaxRows can't be negative")
+	}
+	if dlpConfig.Timeout < 1 {
+		return fmt.Errorf("Timeout should be at least 1")
+	}
+	return nil
+}
+
+type dlpColumn struct {
+	Name         string   `json:"name"`
+	Type         byte     `json:"type"`
+	Fingerprints []string `json:"fingerprints"` // Empty strings for NULLs
+}
+
+// dlpReport is what we send the DLP service about one result set.
+type dlpReport struct {
+	Session    uint64      `json:"session"`
+	Username   string      `json:"username"`
+	Client     string      `json:"client"`
+	Database   string      `json:"database"`
+	Sanitizing bool        `json:"sanitizing"`
+	Columns    []dlpColumn `json:"columns"`
+	Rows       uint64      `json:"rows"`
+
+	proxy   *ProxyConnection
+	scanner *DLPScanner
+}
+
+type dlpVerdict struct {
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason"`
+}
+
+// DLPScanner sends result sets off to be scanned.
+type DLPScanner struct {
+	url        string
+	sampleRate float64
+	maxRows    int
+	failClosed bool
+	client     *http.Client
+	queue      chan *dlpReport
+
+	scanned int64
+	alerts  int64
+	blocks  int64
+	dropped int64
+	errors  int64
+}
+
+// NewDLPScanner returns a DLPScanner, or nil if DLP scanning is off.
+func NewDLPScanner(dlpConfig DLPConfig) *DLPScanner {
+	if dlpConfig.URL == "" {
+		return nil
+	}
+	return &DLPScanner{
+		url:        dlpConfig.URL,
+		sampleRate: dlpConfig.SampleRate,
+		maxRows:    dlpConfig.MaxRows,
+		failClosed: dlpConfig.FailClosed,
+		client:     &http.Client{Timeout: time.Duration(dlpConfig.Timeout) * time.Second},
+		queue:      make(chan *dlpReport, dlpQueueSize),
+	}
+}
+
+// Run sends queued result sets to the DLP service forever.
+func (scanner *DLPScanner) Run() {
+	for i := 0; i < dlpWorkers; i++ {
+		go func() {
+			for report := range scanner.queue {
+				scanner.scan(report)
+			}
+		}()
+	}
+}
+
+// Start returns a report to fill in for a result set with these columns, or
+// nil if this one isn't in the sample.
+func (scanner *DLPScanner) Start(proxy *ProxyConnection, columns []Column) *dlpReport {
+	if scanner == nil || rand.Float64() >= scanner.sampleRate {
+		return nil
+	}
+	report := dlpReport{
+		Session:    proxy.id,
+		Username:   proxy.Username(),
+		Client:     proxy.clientAddr,
+		Database:   proxy.Database,
+		Sanitizing: proxy.Sanitizing(),
+		Columns:    []dlpColumn{},
+		proxy:      proxy,
+		scanner:    scanner,
+	}
+	for _, col := range columns {
+		name := col.Database + "." + col.Table + "." + col.Name
+		report.Columns = append(report.Columns, dlpColumn{name, col.Type, []string{}})
+	}
+	return &report
+}
+
+// addRow fingerprints a text row, as sent to the client.
+func (report *dlpReport) addRow(packet mysqlproto.Packet) {
+	if report == nil {
+		return
+	}
+	report.Rows++
+	if report.Rows > uint64(report.scanner.maxRows) {
+		return
+	}
+	parser := NewPacketParser(packet)
+	for i := range report.Columns {
+		fingerprint := ""
+		if value, nonNull := parser.ReadStringOrNull(); nonNull {
+			sum := sha256.Sum256([]byte(value))
+			fingerprint = hex.EncodeToString(sum[:])
+		}
+		report.Columns[i].Fingerprints = append(report.Columns[i].Fingerprints, fingerprint)
+	}
+}
+
+// finish queues the report to be scanned.
+func (report *dlpReport) finish() {
+	if report == nil {
+		return
+	}
+	select {
+	case report.scanner.queue <- report:
+	default:
+		atomic.AddInt64(&report.scanner.dropped, 1)
+		report.proxy.Output().Log("DLP queue is full, so a result set went unscanned")
+	}
+}
+
+// scan sends one report to the DLP service and acts on the verdict.
+func (scanner *DLPScanner) scan(report *dlpReport) {
+	verdict, err := scanner.ask(report)
+	if err != nil {
+		atomic.AddInt64(&scanner.errors, 1)
+		report.proxy.Output().Log("Couldn't get a verdict from the DLP service: %s", err)
+		if scanner.failClosed {
+			report.proxy.Output().Audit("Closing %s's session, since its results couldn't be scanned", report.Username)
+			report.proxy.Fail(fmt.Errorf("Couldn't scan results: %s", err))
+		}
+		return
+	}
+	atomic.AddInt64(&scanner.scanned, 1)
+
+	switch verdict.Verdict {
+	case "alert":
+		atomic.AddInt64(&scanner.alerts, 1)
+		report.proxy.Output().Audit("DLP alert for %s: %s", report.Username, verdict.Reason)
+	case "block":
+		atomic.AddInt64(&scanner.blocks, 1)
+		report.proxy.Output().Audit("DLP service blocked %s: %s", report.Username, verdict.Reason)
+		report.proxy.Fail(fmt.Errorf("DLP service blocked the session: %s", verdict.Reason))
+	}
+}
+
+func (scanner *DLPScanner) ask(report *dlpReport) (dlpVerdict, error) {
+	var verdict dlpVerdict
+	body, err := json.Marshal(report)
+	if err != nil {
+		return verdict, err
+	}
+	response, err := scanner.client.Post(scanner.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return verdict, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return verdict, fmt.Errorf("DLP service returned %s", response.Status)
+	}
+	if err := json.NewDecoder(response.Body).Decode(&verdict); err != nil {
+		return verdict, fmt.Errorf("Can't parse DLP verdict: %s", err)
+	}
+	if verdict.Verdict != "allow" && verdict.Verdict != "alert" && verdict.Verdict != "block" {
+		return verdict, fmt.Errorf("Unknown DLP verdict '%s'", verdict.Verdict)
+	}
+	return verdict, nil
+}
+
+func (scanner *DLPScanner) statusRows() [][]string {
+	if scanner == nil {
+		return nil
+	}
+	return [][]string{
+		{"DLP_scanned", strconv.FormatInt(atomicLoad(&scanner.scanned), 10)},
+		{"DLP_alerts", strconv.FormatInt(atomicLoad(&scanner.alerts), 10)},
+		{"DLP_blocks", strconv.FormatInt(atomicLoad(&scanner.blocks), 10)},
+		{"DLP_dropped", strconv.FormatInt(atomicLoad(&scanner.dropped), 10)},
+		{"DLP_errors", strconv.FormatInt(atomicLoad(&scanner.errors), 10)},
+	}
+}
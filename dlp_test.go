@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newDLPTestSession returns a real session on a fake MySQL server, so
+// there's something for a verdict to close.
+func newDLPTestSession(t *testing.T) *ProxyConnection {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't start the fake MySQL server: %s", err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go serveSelftestBackend(backend)
+
+	oldHost, oldPort := config.MysqlHost, config.MysqlPort
+	t.Cleanup(func() { config.MysqlHost, config.MysqlPort = oldHost, oldPort })
+	config.MysqlHost = "127.0.0.1"
+	config.MysqlPort = backend.Addr().(*net.TCPAddr).Port
+
+	clientEnd, proxyEnd := net.Pipe()
+	t.Cleanup(func() { clientEnd.Close() })
+	proxy, err := NewProxyConnection(context.Background(), proxyEnd)
+	if err != nil {
+		t.Fatalf("NewProxyConnection failed: %s", err)
+	}
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestDLPScanner(t *testing.T) {
+	var report dlpReport
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&report)
+		w.Write([]byte(`{"verdict": "block", "reason": "Too many geese"}`))
+	}))
+	defer service.Close()
+
+	scanner := NewDLPScanner(DLPConfig{service.URL, 1, 1, 10, false})
+	proxy := newDLPTestSession(t)
+	columns := []Column{{true, "db", "birds", "", "name", 255, 0xfd, 0, nil, "", false, nil}}
+
+	scan := scanner.Start(proxy, columns)
+	scan.addRow(TextRowPacket(3, []string{"honk"}))
+	scan.addRow(TextRowPacket(4, []string{"bonk"}))
+	scanner.scan(scan)
+
+	honk := sha256.Sum256([]byte("honk"))
+	if report.Rows != 2 || len(report.Columns) != 1 || report.Columns[0].Name != "db.birds.name" ||
+		len(report.Columns[0].Fingerprints) != 1 || report.Columns[0].Fingerprints[0] != hex.EncodeToString(honk[:]) {
+		t.Errorf("Bogus report to the DLP service: %+v", report)
+	}
+	if proxy.ctx.Err() == nil || atomicLoad(&scanner.blocks) != 1 {
+		t.Error("A block verdict should close the session")
+	}
+}
+
+func TestDLPScanner_errors(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"verdict": "shrug"}`))
+	}))
+	defer service.Close()
+	columns := []Column{{true, "db", "birds", "", "name", 255, 0xfd, 0, nil, "", false, nil}}
+
+	scanner := NewDLPScanner(DLPConfig{service.URL, 1, 100, 10, false})
+	proxy := newDLPTestSession(t)
+	scanner.scan(scanner.Start(proxy, columns))
+	if proxy.ctx.Err() != nil || atomicLoad(&scanner.errors) != 1 {
+		t.Error("A bogus verdict should be counted, but leave the session alone")
+	}
+
+	scanner.failClosed = true
+	scanner.scan(scanner.Start(proxy, columns))
+	if proxy.ctx.Err() == nil {
+		t.Error("With FailClosed, a bogus verdict should close the session")
+	}
+}
+
+func TestDLPScanner_sampling(t *testing.T) {
+	if NewDLPScanner(defaultDLPConfig) != nil {
+		t.Error("DLP scanning should be off without a URL")
+	}
+	scanner := NewDLPScanner(DLPConfig{"http://dlp.invalid", 0, 100, 10, false})
+	if scanner.Start(&ProxyConnection{}, nil) != nil {
+		t.Error("Nothing should be scanned with a SampleRate of 0")
+	}
+	if checkDLPConfig(DLPConfig{"http://dlp.invalid", 1.5, 100, 10, false}) == nil {
+		t.Error("SampleRate over 1 should be rejected")
+	}
+}
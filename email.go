@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+)
+
+// Masked emails all go to example.com, which is reserved for exactly this.
+const (
+	emailMaskDomain      = "@example.com"
+	emailMaskLocalLength = 16
+)
+
+// maskEmail deterministically replaces an email address with
+// "<hash>@example.com", so it still looks like an email to whatever
+// validates it. The hash ignores case, since email addresses mostly do too.
+// It returns false if the value doesn't look like an email address, or if
+// the masked one wouldn't fit in maxLength bytes.
+func maskEmail(value []byte, salt []byte, maxLength uint32) ([]byte, bool) {
+	at := bytes.LastIndexByte(value, '@')
+	if at < 1 || at == len(value)-1 || bytes.ContainsAny(value, " \t\r\n") {
+		return nil, false
+	}
+
+	localLength := emailMaskLocalLength
+	if int(maxLength)-len(emailMaskDomain) < localLength {
+		localLength = int(maxLength) - len(emailMaskDomain)
+	}
+	if localLength < 1 {
+		return nil, false
+	}
+
+	sum := hasher.Sum(bytes.ToLower(value), salt)
+	local := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(local, sum)
+	return append(local[:localLength], emailMaskDomain...), true
+}
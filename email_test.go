@@ -0,0 +1,29 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestMaskEmail(t *testing.T) {
+	salt := []byte("honk")
+	masked, ok := maskEmail([]byte("Alice.Example@gmail.com"), salt, 255)
+	if !ok || !regexp.MustCompile(`^[0-9a-f]{16}@example\.com$`).Match(masked) {
+		t.Errorf("Bogus masked email: '%s'", masked)
+	}
+	if again, _ := maskEmail([]byte("alice.example@GMAIL.com"), salt, 255); string(again) != string(masked) {
+		t.Errorf("Masking should ignore case: '%s' vs. '%s'", again, masked)
+	}
+	if short, ok := maskEmail([]byte("alice@gmail.com"), salt, 16); !ok || len(short) != 16 {
+		t.Errorf("Bogus masked email for a short column: '%s'", short)
+	}
+
+	for _, value := range []string{"not an email", "@gmail.com", "alice@", "alice smith@gmail.com"} {
+		if masked, ok := maskEmail([]byte(value), salt, 255); ok {
+			t.Errorf("'%s' isn't an email, but it was masked as '%s'", value, masked)
+		}
+	}
+	if _, ok := maskEmail([]byte("alice@gmail.com"), salt, 12); ok {
+		t.Error("Masked emails shouldn't come out longer than the column")
+	}
+}
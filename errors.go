@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// ErrorKind says what sort of trouble a ProxyError is, which decides the
+// MySQL error code and SQL state the client sees.
+type ErrorKind int
+
+const (
+	ErrInternal           ErrorKind = iota // Our bug
+	ErrBackendUnavailable                  // Can't reach the MySQL server
+	ErrBackendFailed                       // The server refused something we needed to do
+	ErrPolicyViolation                     // The client asked for something we don't allow
+	ErrUnsupported                         // The client asked for something we can't do
+	ErrOffline                             // We're refusing everything right now
+	ErrTimeout                             // Something took too long
+	ErrProtocol                            // We couldn't make sense of a packet
+	ErrOverloaded                          // We're shedding load to keep the server alive
+)
+
+type errorCode struct {
+	name     string
+	code     int
+	sqlState string
+}
+
+var errorCodes = map[ErrorKind]errorCode{
+	ErrInternal:           {"internal", 1105, "HY000"},            // ER_UNKNOWN_ERROR
+	ErrBackendUnavailable: {"backend unavailable", 2003, "HY000"}, // CR_CONN_HOST_ERROR
+	ErrBackendFailed:      {"backend failed", 1105, "HY000"},      // ER_UNKNOWN_ERROR
+	ErrPolicyViolation:    {"policy violation", 1227, "42000"},    // ER_SPECIFIC_ACCESS_DENIED_ERROR
+	ErrUnsupported:        {"unsupported", 1047, "08S01"},         // ER_UNKNOWN_COM_ERROR
+	ErrOffline:            {"offline", 3032, "HY000"},             // ER_SERVER_OFFLINE_MODE
+	ErrTimeout:            {"timeout", 1317, "70100"},             // ER_QUERY_INTERRUPTED
+	ErrProtocol:           {"protocol", 1835, "HY000"},            // ER_MALFORMED_PACKET
+	ErrOverloaded:         {"overloaded", 1040, "08004"},          // ER_CON_COUNT_ERROR
+}
+
+// ProxyError is an error we need to tell the client about. Message is all
+// the client gets to see; Err has the details (hostnames, server errors,
+// etc.), which only go to the logs.
+type ProxyError struct {
+	Kind    ErrorKind
+	Message string
+	Err     error
+}
+
+// NewProxyError returns a ProxyError with the given client-safe message.
+func NewProxyError(kind ErrorKind, err error, format string, args ...interface{}) *ProxyError {
+	return &ProxyError{kind, fmt.Sprintf(format, args...), err}
+}
+
+func (e *ProxyError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// clientErrorPacket logs the whole error and returns the ERR packet to send
+// the client instead, following the packet with the given sequence ID.
+// Errors that aren't ProxyErrors are assumed to be bugs, so the client gets
+// a generic message.
+func clientErrorPacket(out Output, sequenceId byte, err error) mysqlproto.Packet {
+	proxyErr, ok := err.(*ProxyError)
+	if !ok {
+		proxyErr = NewProxyError(ErrInternal, err, "mysql-sanitizer hit an internal error")
+	}
+
+	code := errorCodes[proxyErr.Kind]
+	out.Log("Sending client a %s error: %s", code.name, proxyErr)
+	return ErrorPacket(sequenceId, code.code, code.sqlState, "%s", proxyErr.Message)
+}
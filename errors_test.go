@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestClientErrorPacket_Redacted(t *testing.T) {
+	logged := ""
+	out := Output{[]OutputSink{SinkFunc(func(entry LogEntry) { logged = entry.Message })}, logLevelNormal, nil}
+
+	err := NewProxyError(ErrBackendUnavailable, errors.New("dial tcp 10.1.2.3:3306: connection refused"), "mysql-sanitizer can't reach the MySQL server")
+	packet := clientErrorPacket(out, 0, err)
+
+	if message := errorPacketMessage(packet); message != "2003: mysql-sanitizer can't reach the MySQL server" {
+		t.Errorf("Bogus client message: %s", message)
+	}
+	if string(packet.Payload[4:9]) != "HY000" {
+		t.Errorf("Bogus SQL state: %s", packet.Payload[4:9])
+	}
+	if !strings.Contains(logged, "10.1.2.3") {
+		t.Errorf("The details should have been logged: %s", logged)
+	}
+}
+
+func TestClientErrorPacket_Internal(t *testing.T) {
+	packet := clientErrorPacket(Output{}, 0, errors.New("Couldn't run argon2id on secret.stuff.here"))
+	if message := errorPacketMessage(packet); message != "1105: mysql-sanitizer hit an internal error" {
+		t.Errorf("Bogus client message: %s", message)
+	}
+}
+
+func TestErrorCodes_Complete(t *testing.T) {
+	for kind := ErrInternal; kind <= ErrProtocol; kind++ {
+		if _, ok := errorCodes[kind]; !ok {
+			t.Errorf("No error code for kind %d", kind)
+		}
+	}
+}
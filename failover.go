@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// When the server we're talking to dies in the middle of a command, the
+// client gets a clean error for that command instead of a dropped
+// connection. If there's anywhere else to go (MysqlHosts or StandbyHosts),
+// we also log the session back in on the next healthy server, so the client
+// can just retry. Anything that lived in the old server session
+// (transactions, variables, temporary tables) is gone, and the error says
+// so. Without another server to go to, the session ends there.
+
+// lostBackend handles a read or write on the server connection failing
+// partway through a command. sequenceId is the last packet the client got.
+func (server *ServerConnection) lostBackend(sequenceId byte, err error) {
+	if server.proxy.ctx.Err() != nil {
+		// The session's closing anyway, which is why the connection went.
+		server.finished = true
+		return
+	}
+	server.proxy.Output().Log("Lost connection to MySQL server: %s", err)
+	balancer.connLost(server.conn, err)
+	server.stream.Close()
+
+	if balancer == nil {
+		proxyErr := NewProxyError(ErrBackendUnavailable, err, "mysql-sanitizer lost its connection to the MySQL server")
+		server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), sequenceId, proxyErr))
+		server.finished = true
+		return
+	}
+	if reconnectErr := server.reconnect(); reconnectErr != nil {
+		proxyErr := NewProxyError(ErrBackendUnavailable, reconnectErr, "mysql-sanitizer lost its connection to the MySQL server and couldn't reach another one")
+		server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), sequenceId, proxyErr))
+		server.finished = true
+		return
+	}
+	server.proxy.Output().Log("Reconnected session for %s to another MySQL server", server.proxy.Username())
+	proxyErr := NewProxyError(ErrBackendUnavailable, err, "mysql-sanitizer lost its connection to the MySQL server and reconnected to another one; "+
+		"transactions, session variables and prepared statements were lost, so start over from there")
+	server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), sequenceId, proxyErr))
+	server.proxy.transactionOpen = false
+}
+
+// reconnect replaces the server connection with a new, logged-in one,
+// using the session's database.
+func (server *ServerConnection) reconnect() error {
+	replacement, err := replacementServer(server.proxy)
+	if err != nil {
+		return err
+	}
+	server.conn = replacement.conn
+	server.stream = replacement.stream
+	server.proxy.statements = nil
+	return nil
+}
+
+// replacementServer connects and logs in to a server for a session whose
+// client is already logged in, and switches it to the session's database.
+func replacementServer(proxy *ProxyConnection) (*ServerConnection, error) {
+	replacement, err := NewServerConnection(proxy)
+	if err != nil {
+		return nil, err
+	}
+	replacement.traceWith(proxy.trace)
+	// The client's still expecting results framed the way it negotiated,
+	// and might send what it was told it could.
+	carried := proxy.Capabilities & (mysqlproto.CLIENT_DEPRECATE_EOF | mysqlproto.CLIENT_MULTI_STATEMENTS | mysqlproto.CLIENT_LOCAL_FILES)
+	flags, err := replacement.logInWith(pooledCapabilities | carried)
+	if err != nil {
+		replacement.Close()
+		return nil, fmt.Errorf("Couldn't log in: %s", err)
+	}
+	if flags&mysqlproto.CLIENT_DEPRECATE_EOF != carried&mysqlproto.CLIENT_DEPRECATE_EOF {
+		replacement.Close()
+		return nil, fmt.Errorf("Server doesn't support CLIENT_DEPRECATE_EOF")
+	}
+	if proxy.Database != "" {
+		if err := replacement.command(append([]byte{COM_INIT_DB}, proxy.Database...)); err != nil {
+			replacement.Close()
+			return nil, fmt.Errorf("Couldn't switch to database '%s': %s", proxy.Database, err)
+		}
+	}
+	return replacement, nil
+}
+
+// connLost marks the backend behind a connection as down, so new sessions
+// (and this one, when it reconnects) skip it for a while.
+func (balancer *Balancer) connLost(conn net.Conn, err error) {
+	if balancer == nil {
+		return
+	}
+	for {
+		switch wrapped := conn.(type) {
+		case *balancedConn:
+			balancer.markResult(wrapped.backend, err)
+			return
+		case *tracedConn:
+			conn = wrapped.Conn
+		case *compressedConn:
+			conn = wrapped.Conn
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestLostBackend(t *testing.T) {
+	proxyEnd, backendEnd := net.Pipe()
+	backendEnd.Close() // The server died
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+	server.handleQueryResponse()
+	if !server.finished {
+		t.Error("Session with nowhere else to go should be over")
+	}
+	if packet := <-proxy.ClientChannel; !packetIsERR(packet) || packet.SequenceID != 1 || !strings.HasPrefix(errorPacketMessage(packet), "2003:") {
+		t.Errorf("Bogus error for a lost server: %v", packet)
+	}
+}
+
+func TestLostBackend_reconnect(t *testing.T) {
+	standby, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't start the fake standby: %s", err)
+	}
+	defer standby.Close()
+	go serveSelftestBackend(standby)
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+
+	oldBalancer := balancer
+	defer func() { balancer = oldBalancer }()
+	balancer, _ = NewBalancer([]string{dead.Addr().String()}, []string{standby.Addr().String()}, balanceRoundRobin, 10)
+
+	proxyEnd, backendEnd := net.Pipe()
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+	// The server sends the column definitions and then dies.
+	go func() {
+		backend := mysqlproto.NewStream(backendEnd)
+		packets := []mysqlproto.Packet{{1, LengthEncodedInt(1)}, selftestColumnPacket(1, "id", 0x03), EOFPacket(2)}
+		for _, packet := range packets {
+			WritePacket(backend, packet)
+		}
+		backendEnd.Close()
+	}()
+	server.handleQueryResponse()
+	defer server.Close()
+
+	if server.finished {
+		t.Fatal("Session should have moved to the standby")
+	}
+	packets := []mysqlproto.Packet{}
+	for len(proxy.ClientChannel) > 0 {
+		packets = append(packets, <-proxy.ClientChannel)
+	}
+	last := packets[len(packets)-1]
+	if len(packets) != 4 || !packetIsERR(last) || last.SequenceID != 4 {
+		t.Errorf("Bogus result set cut off by a lost server: %v", packets)
+	}
+	if err := server.execute(selftestQuery); err != nil {
+		t.Errorf("Reconnected session doesn't work: %s", err)
+	}
+}
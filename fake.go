@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Fake data for staging copies, where hashes make the app hard to use. The
+// same value (and salt) always turns into the same fake, so joins and
+// GROUP BYs still line up. The dictionaries are deliberately small and
+// boring; nobody should mistake the results for real people.
+
+var fakeFirstNames = []string{
+	"Alice", "Bruno", "Carmen", "Dmitri", "Elena", "Farid", "Grace", "Hiroshi",
+	"Ingrid", "Jamal", "Keiko", "Liam", "Maya", "Nikolai", "Olivia", "Pedro",
+	"Quinn", "Rosa", "Samir", "Tara", "Umar", "Vera", "Wen", "Ximena",
+	"Yusuf", "Zoe",
+}
+
+var fakeLastNames = []string{
+	"Abbott", "Becker", "Castillo", "Dubois", "Eriksen", "Fischer", "Garcia",
+	"Haddad", "Ivanova", "Jensen", "Kowalski", "Larsen", "Moreau", "Nakamura",
+	"Okafor", "Petrov", "Quintero", "Rossi", "Schmidt", "Tanaka", "Umarov",
+	"Vasquez", "Weber", "Xu", "Yilmaz", "Zhang",
+}
+
+var fakeStreets = []string{
+	"Maple", "Oak", "Cedar", "Elm", "Willow", "Birch", "Pine", "Chestnut",
+	"Walnut", "Juniper", "Magnolia", "Sycamore", "Hawthorn", "Aspen",
+}
+
+var fakeStreetSuffixes = []string{"St", "Ave", "Rd", "Ln", "Blvd", "Way", "Ct", "Dr"}
+
+var fakeCities = []string{
+	"Springfield", "Riverton", "Fairview", "Lakewood", "Greenville",
+	"Brookside", "Milltown", "Ashford", "Clearwater", "Hillcrest",
+}
+
+var fakeCompanyWords = []string{
+	"Acme", "Globex", "Initech", "Umbrella", "Vandelay", "Stark", "Wonka",
+	"Tyrell", "Cyberdyne", "Soylent", "Hooli", "Massive Dynamic",
+}
+
+var fakeCompanySuffixes = []string{"Inc.", "LLC", "Ltd.", "Group", "Holdings", "Partners", "Industries"}
+
+// fakeValue returns a fake of the given kind ("name", "address", or
+// "company") for the value.
+func fakeValue(kind string, value []byte, salt []byte) []byte {
+	sum := hasher.Sum(append([]byte(kind), value...), salt)
+
+	// Each pick gets its own slice of the hash, so they're independent.
+	pick := func(i int, words []string) string {
+		return words[binary.BigEndian.Uint32(sum[i*4:])%uint32(len(words))]
+	}
+
+	switch kind {
+	case "name":
+		return []byte(pick(0, fakeFirstNames) + " " + pick(1, fakeLastNames))
+	case "address":
+		number := binary.BigEndian.Uint32(sum[8:])%9999 + 1
+		return []byte(fmt.Sprintf("%d %s %s, %s", number, pick(0, fakeStreets), pick(1, fakeStreetSuffixes), pick(3, fakeCities)))
+	case "company":
+		return []byte(pick(0, fakeCompanyWords) + " " + pick(1, fakeCompanySuffixes))
+	}
+	return nil
+}
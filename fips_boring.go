@@ -0,0 +1,17 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package main
+
+import (
+	"crypto/boring"
+
+	// Restricts crypto/tls to FIPS-approved ciphers and curves.
+	_ "crypto/tls/fipsonly"
+)
+
+const fipsCryptoModule = "BoringCrypto"
+
+func fipsCryptoEnabled() bool {
+	return boring.Enabled()
+}
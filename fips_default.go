@@ -0,0 +1,12 @@
+//go:build !boringcrypto
+// +build !boringcrypto
+
+package main
+
+const fipsCryptoModule = "Go standard library"
+
+// Without the boringcrypto toolchain we're not using a validated module, no
+// matter which algorithms we pick.
+func fipsCryptoEnabled() bool {
+	return false
+}
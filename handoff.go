@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Restarting the proxy for maintenance disconnects everybody, which is a
+// pain for tools that sit on an idle connection all day. With HandoffSocket
+// set, another instance on the same host can give us its idle sessions
+// instead: the client's socket comes over a Unix socket (SCM_RIGHTS), along
+// with who the client is, its database and the SETs it ran, and we log in
+// to a server of our own and replay them. The client never notices.
+//
+// Only idle sessions go: nothing in flight on either side, no transaction
+// open, and no compression (whose framing state we'd have to bring along).
+// Anything else the old server session had, like temporary tables, is gone.
+// The sending side pauses the session's client reader between packets and
+// makes sure it hasn't read any of the next one before letting go, and if
+// anything goes wrong before the peer has the socket, the session carries on
+// where it was.
+
+// handoffPauseTimeout is how long we wait for a session's client reader to
+// park before deciding it's busy.
+const handoffPauseTimeout = time.Second
+
+// handoffWait is how long we wait for a session to finish whatever command
+// it's running before skipping it.
+const handoffWait = time.Second
+
+// handoffReplyTimeout is how long the peer gets to log in to a server and
+// say whether it took a session.
+const handoffReplyTimeout = 10 * time.Second
+
+// handoffMaxState is the most session state we'll read in one message.
+const handoffMaxState = 64 * 1024
+
+// errHandedOff stops the client reader of a session that's gone elsewhere.
+var errHandedOff = errors.New("Session was handed off")
+
+// handoffState is what we send along with the client's socket.
+type handoffState struct {
+	Username     string            `json:"username"`
+	Labels       map[string]string `json:"labels"`
+	Admin        bool              `json:"admin"`
+	Sanitizing   bool              `json:"sanitizing"`
+	Database     string            `json:"database"`
+	Capabilities uint32            `json:"capabilities"`
+	Settings     []string          `json:"settings"`
+	Started      time.Time         `json:"started"`
+	UsedQueries  int64             `json:"used_queries"`
+	UsedRows     int64             `json:"used_rows"`
+	UsedBytes    int64             `json:"used_bytes"`
+}
+
+type handoffReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+// handoffRequest asks a session's server goroutine to hand it to the peer.
+type handoffRequest struct {
+	peer *net.UnixConn
+	done chan error
+}
+
+// handoffConn lets a session's client reader be parked between packets. It
+// counts what's been read, so the session can tell whether that's all been
+// turned into packets.
+type handoffConn struct {
+	net.Conn
+	read int64
+
+	mutex   sync.Mutex
+	pausing bool
+	parked  bool
+	parks   chan struct{} // Gets a value when Read parks
+	resumes chan error    // nil to keep reading, or the error for Read to return
+}
+
+func newHandoffConn(conn net.Conn) *handoffConn {
+	return &handoffConn{Conn: conn, parks: make(chan struct{}, 1), resumes: make(chan error)}
+}
+
+func (conn *handoffConn) Read(data []byte) (int, error) {
+	for {
+		n, err := conn.Conn.Read(data)
+		atomic.AddInt64(&conn.read, int64(n))
+		if n > 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, err
+		}
+		// Nothing else sets read deadlines on clients, so it's a pause, or
+		// one that's already been called off.
+		conn.mutex.Lock()
+		parking := conn.pausing
+		if parking {
+			conn.parked = true
+			conn.parks <- struct{}{}
+		} else {
+			conn.Conn.SetReadDeadline(time.Time{})
+		}
+		conn.mutex.Unlock()
+		if parking {
+			if err := <-conn.resumes; err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// pause interrupts the reader and returns true once it's parked, or false if
+// it didn't within the timeout. Either way, resume has to be called after.
+func (conn *handoffConn) pause(timeout time.Duration) bool {
+	conn.mutex.Lock()
+	conn.pausing = true
+	conn.Conn.SetReadDeadline(time.Unix(1, 0))
+	conn.mutex.Unlock()
+
+	select {
+	case <-conn.parks:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// resume lets the reader carry on, or with an error, makes it give up.
+func (conn *handoffConn) resume(err error) {
+	conn.mutex.Lock()
+	conn.pausing = false
+	parked := conn.parked
+	conn.parked = false
+	select {
+	case <-conn.parks:
+	default:
+	}
+	conn.Conn.SetReadDeadline(time.Time{})
+	conn.mutex.Unlock()
+	if parked {
+		conn.resumes <- err
+	}
+}
+
+// rememberSession keeps track of the SETs and USEs the server accepted, so
+// they can be replayed after a hand-off. Which statement of a multi-statement
+// query an OK is for isn't worth working out, so those just keep the session
+// where it is.
+func (proxy *ProxyConnection) rememberSession(query string) {
+	statements := splitStatements(query)
+	for _, statement := range statements {
+		database, isUse := databaseChange(mysqlproto.Packet{0, append([]byte{COM_QUERY}, statement...)})
+		_, _, isSet := parseSetStatement(statement)
+		switch {
+		case !isUse && !isSet:
+		case len(statements) > 1:
+			proxy.unreplayable = true
+		case isUse:
+			proxy.Database = database
+		default:
+			proxy.settings = append(proxy.settings, statement)
+		}
+	}
+}
+
+// handoffBlocker returns why the session can't be handed off, or "".
+func (proxy *ProxyConnection) handoffBlocker() string {
+	switch {
+	case proxy.clientConn == nil || proxy.Username() == "":
+		return "it isn't logged in"
+	case proxy.transactionOpen:
+		return "it's in a transaction"
+	case proxy.Capabilities&(mysqlproto.CLIENT_COMPRESS|CLIENT_ZSTD_COMPRESSION_ALGORITHM) != 0:
+		return "it's compressed"
+	case proxy.unreplayable:
+		return "it ran a SET or USE in a multi-statement query"
+	case len(proxy.statements) > 0:
+		return "it has prepared statements"
+	}
+	return ""
+}
+
+func (proxy *ProxyConnection) handoffState() handoffState {
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	return handoffState{
+		Username:     proxy.username,
+		Labels:       proxy.labels,
+		Admin:        proxy.admin,
+		Sanitizing:   !proxy.unsanitized,
+		Database:     proxy.Database,
+		Capabilities: proxy.Capabilities,
+		Settings:     proxy.settings,
+		Started:      proxy.started,
+		UsedQueries:  atomicLoad(&proxy.usedQueries),
+		UsedRows:     atomicLoad(&proxy.usedRows),
+		UsedBytes:    atomicLoad(&proxy.usedBytes),
+	}
+}
+
+// handOff gives the session to the peer, if it's idle. It runs on the server
+// goroutine between commands, so there's nothing going on on that side.
+func (server *ServerConnection) handOff(peer *net.UnixConn) error {
+	proxy := server.proxy
+	if reason := proxy.handoffBlocker(); reason != "" {
+		return fmt.Errorf("Session can't be handed off, since %s", reason)
+	}
+	client := proxy.clientConn
+	if !client.pause(handoffPauseTimeout) || atomicLoad(&client.read) != atomicLoad(&proxy.clientBytes) || atomicLoad(&proxy.inFlight) != 0 {
+		client.resume(nil)
+		return fmt.Errorf("Client is in the middle of sending something")
+	}
+	file, err := client.file()
+	if err != nil {
+		client.resume(nil)
+		return fmt.Errorf("Can't get the client's socket: %s", err)
+	}
+	defer file.Close()
+
+	sent, err := sendHandoff(peer, proxy.handoffState(), file)
+	if !sent {
+		client.resume(nil)
+		return err
+	}
+	// The peer has the socket now (or might, if we didn't hear back), so
+	// reading from it here as well would only make a mess.
+	client.resume(errHandedOff)
+	server.finished = true
+	if err != nil {
+		proxy.Output().Log("Letting go of the session anyway, since the peer might have it: %s", err)
+		return err
+	}
+	proxy.Output().Audit("Handed %s's session off to the mysql-sanitizer at %s", proxy.Username(), peer.RemoteAddr())
+	return nil
+}
+
+// file returns a copy of the client's socket.
+func (conn *handoffConn) file() (*os.File, error) {
+	socket, ok := conn.Conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T isn't a socket", conn.Conn)
+	}
+	return socket.File()
+}
+
+// sendHandoff sends the peer the session's state and socket, and waits for
+// it to say whether it took them. sent is false if the peer definitely
+// doesn't have the socket.
+func sendHandoff(peer *net.UnixConn, state handoffState, file *os.File) (sent bool, err error) {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return false, err
+	}
+	peer.SetDeadline(time.Now().Add(handoffReplyTimeout))
+	defer peer.SetDeadline(time.Time{})
+	if _, _, err := peer.WriteMsgUnix(body, syscall.UnixRights(int(file.Fd())), nil); err != nil {
+		return false, fmt.Errorf("Couldn't send the session: %s", err)
+	}
+
+	var reply handoffReply
+	buffer := make([]byte, handoffMaxState)
+	n, err := peer.Read(buffer)
+	if err != nil {
+		return true, fmt.Errorf("Couldn't hear back from the peer: %s", err)
+	}
+	if err := json.Unmarshal(buffer[:n], &reply); err != nil {
+		return true, fmt.Errorf("Can't parse the peer's reply: %s", err)
+	}
+	if reply.Error != "" {
+		return false, fmt.Errorf("Peer didn't take the session: %s", reply.Error)
+	}
+	return true, nil
+}
+
+// handOffSessions offers every session to the peer listening at path. It
+// returns the IDs of the ones it took, and why the rest stayed.
+func handOffSessions(path string) ([]uint64, map[uint64]string, error) {
+	conn, err := net.DialTimeout("unixpacket", path, backendDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	peer := conn.(*net.UnixConn)
+
+	handedOff := []uint64{}
+	kept := map[uint64]string{}
+	for _, proxy := range sessions.List() {
+		request := &handoffRequest{peer, make(chan error, 1)}
+		select {
+		case proxy.handoffs <- request:
+			err = <-request.done
+		case <-time.After(handoffWait):
+			err = fmt.Errorf("Session is busy with a command")
+		case <-proxy.ctx.Done():
+			err = fmt.Errorf("Session closed")
+		}
+		if err != nil {
+			kept[proxy.id] = err.Error()
+		} else {
+			handedOff = append(handedOff, proxy.id)
+		}
+	}
+	return handedOff, kept, nil
+}
+
+// listenForHandoffs opens the socket other instances hand us sessions on.
+// Only our own user gets to use it.
+func listenForHandoffs(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unixpacket", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("Another instance is already listening there")
+	}
+	// Anything that's there is left over from an instance that didn't shut
+	// down cleanly.
+	os.Remove(path)
+	listener, err := net.Listen("unixpacket", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ServeHandoffs takes over the sessions other instances hand us, until the
+// context is cancelled.
+func ServeHandoffs(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				output.Log("Stopped taking session hand-offs: %s", err)
+			}
+			return
+		}
+		go receiveHandoffs(ctx, conn.(*net.UnixConn))
+	}
+}
+
+func receiveHandoffs(ctx context.Context, peer *net.UnixConn) {
+	defer peer.Close()
+	for {
+		body, file, err := readHandoff(peer)
+		if err != nil {
+			output.Log("Couldn't read session hand-off: %s", err)
+			return
+		}
+		if body == nil {
+			return
+		}
+
+		var state handoffState
+		if err = json.Unmarshal(body, &state); err != nil {
+			err = fmt.Errorf("Can't parse session state: %s", err)
+		} else {
+			err = adoptSession(ctx, file, state)
+		}
+		file.Close()
+		var reply handoffReply
+		if err != nil {
+			output.Log("Couldn't take over %s's session: %s", state.Username, err)
+			reply.Error = err.Error()
+		}
+		body, _ = json.Marshal(reply)
+		if _, err := peer.Write(body); err != nil {
+			output.Log("Couldn't answer session hand-off: %s", err)
+			return
+		}
+	}
+}
+
+// readHandoff reads the next session's state and socket from the peer, or
+// returns a nil body once the peer's done.
+func readHandoff(peer *net.UnixConn) ([]byte, *os.File, error) {
+	body := make([]byte, handoffMaxState)
+	control := make([]byte, syscall.CmsgSpace(4))
+	n, controlLength, flags, _, err := peer.ReadMsgUnix(body, control)
+	if errors.Is(err, io.EOF) || (err == nil && n == 0) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var fds []int
+	messages, err := syscall.ParseSocketControlMessage(control[:controlLength])
+	if err == nil && len(messages) == 1 {
+		fds, err = syscall.ParseUnixRights(&messages[0])
+	}
+	if err != nil || len(fds) != 1 || flags&(syscall.MSG_TRUNC|syscall.MSG_CTRUNC) != 0 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, nil, fmt.Errorf("Expected one socket and at most %d bytes of state", handoffMaxState)
+	}
+	return body[:n], os.NewFile(uintptr(fds[0]), "handed-off client"), nil
+}
+
+// adoptSession sets up a session for a client that's already logged in
+// through another instance.
+func adoptSession(ctx context.Context, file *os.File, state handoffState) error {
+	if config.MaxConnections > 0 {
+		if !stats.ReserveSession(config.MaxConnections) {
+			return fmt.Errorf("Already at MaxConnections (%d)", config.MaxConnections)
+		}
+		defer stats.ReleaseSession()
+	}
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return err
+	}
+
+	proxy := newProxyConnection(ctx, conn)
+	proxy.adopted = true
+	proxy.started = state.Started
+	proxy.Capabilities = state.Capabilities
+	proxy.Database = state.Database
+	proxy.settings = state.Settings
+	proxy.usedQueries, proxy.usedRows, proxy.usedBytes = state.UsedQueries, state.UsedRows, state.UsedBytes
+	proxy.server, err = replacementServer(proxy)
+	if err == nil {
+		for _, setting := range state.Settings {
+			if err = proxy.server.command(append([]byte{COM_QUERY}, setting...)); err != nil {
+				err = fmt.Errorf("Couldn't replay '%s': %s", setting, err)
+				proxy.server.Close()
+				break
+			}
+		}
+	}
+	if err == nil {
+		proxy.SetLabels(state.Username, state.Labels)
+		err = proxy.StartRecording(state.Username)
+		if err != nil {
+			proxy.server.Close()
+		}
+	}
+	if err != nil {
+		proxy.cancel()
+		conn.Close()
+		return err
+	}
+
+	proxy.SetRuleSet(state.Username)
+	proxy.SetWatermark(state.Username, state.Labels)
+	proxy.SetAdmin(state.Admin)
+	proxy.SetSanitizing(state.Sanitizing)
+	proxy.opened()
+	proxy.Output().Audit("Took over %s's session from another mysql-sanitizer", state.Username)
+	proxy.Start()
+	return nil
+}
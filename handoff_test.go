@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestHandoffConn(t *testing.T) {
+	proxyEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	conn := newHandoffConn(proxyEnd)
+	reads := make(chan error, 10)
+	go func() {
+		data := make([]byte, 10)
+		for {
+			n, err := conn.Read(data)
+			if err != nil {
+				reads <- err
+				return
+			}
+			if string(data[:n]) != "honk" {
+				t.Errorf("Bogus read: '%s'", data[:n])
+			}
+			reads <- nil
+		}
+	}()
+
+	if !conn.pause(time.Second) {
+		t.Fatal("Idle reader didn't park")
+	}
+	conn.resume(nil)
+	clientEnd.Write([]byte("honk"))
+	if err := <-reads; err != nil {
+		t.Fatalf("Bogus error after resuming: %s", err)
+	}
+	if read := atomicLoad(&conn.read); read != 4 {
+		t.Errorf("Expected 4 bytes read, got %d", read)
+	}
+
+	if !conn.pause(time.Second) {
+		t.Fatal("Idle reader didn't park the second time")
+	}
+	conn.resume(errHandedOff)
+	if err := <-reads; err != errHandedOff {
+		t.Errorf("Expected the reader to give up, got %v", err)
+	}
+}
+
+func TestRememberSession(t *testing.T) {
+	proxy := &ProxyConnection{}
+	proxy.rememberSession("SELECT 1")
+	proxy.rememberSession("SET @@session.sql_mode = 'ANSI'")
+	proxy.rememberSession("USE `reports`")
+	proxy.rememberSession("SET NAMES utf8mb4")
+	if !reflect.DeepEqual(proxy.settings, []string{"SET @@session.sql_mode = 'ANSI'", "SET NAMES utf8mb4"}) {
+		t.Errorf("Bogus settings: %v", proxy.settings)
+	}
+	if proxy.Database != "reports" || proxy.unreplayable {
+		t.Errorf("Bogus session: database '%s', unreplayable %v", proxy.Database, proxy.unreplayable)
+	}
+
+	proxy.rememberSession("SELECT 1; SELECT 2")
+	if proxy.unreplayable {
+		t.Error("Multi-statement queries without SET or USE are fine to replay around")
+	}
+	proxy.rememberSession("SET @x = 1; SELECT @x")
+	if !proxy.unreplayable {
+		t.Error("A SET in a multi-statement query should keep the session where it is")
+	}
+}
+
+// handoffSession returns a logged-in session for a real client socket, with
+// its client reader running, and the client's end of the socket.
+func handoffSession(t *testing.T) (*ServerConnection, chan mysqlproto.Packet, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen for the client: %s", err)
+	}
+	defer listener.Close()
+	clientEnd, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't connect the client: %s", err)
+	}
+	t.Cleanup(func() { clientEnd.Close() })
+	proxyEnd, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Couldn't accept the client: %s", err)
+	}
+
+	proxy := newProxyConnection(context.Background(), proxyEnd)
+	proxy.adopted = true // Skips the handshake
+	proxy.Capabilities = pooledCapabilities
+	proxy.SetLabels("alice", map[string]string{})
+	proxy.settings = []string{"SET @@session.sql_mode = 'ANSI'"}
+	incoming := make(chan mysqlproto.Packet, 10)
+	go proxy.client.getPackets(incoming)
+
+	serverEnd, _ := net.Pipe()
+	server := &ServerConnection{proxy, mysqlproto.NewStream(serverEnd), false, false, false, serverEnd, time.Time{}}
+	proxy.server = server
+	proxy.opened()
+	return server, incoming, clientEnd
+}
+
+func TestHandOff(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't start the fake backend: %s", err)
+	}
+	defer backend.Close()
+	go serveSelftestBackend(backend)
+	oldBalancer := balancer
+	defer func() { balancer = oldBalancer }()
+	balancer, _ = NewBalancer([]string{backend.Addr().String()}, nil, balanceRoundRobin, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	listener, err := listenForHandoffs(path)
+	if err != nil {
+		t.Fatalf("Couldn't listen for hand-offs: %s", err)
+	}
+	go ServeHandoffs(ctx, listener)
+	peerConn, err := net.Dial("unixpacket", path)
+	if err != nil {
+		t.Fatalf("Couldn't connect to the peer: %s", err)
+	}
+	defer peerConn.Close()
+	peer := peerConn.(*net.UnixConn)
+
+	// A session the peer can't set up stays where it is.
+	server, incoming, clientEnd := handoffSession(t)
+	server.proxy.Database = "nowhere"
+	if err := server.handOff(peer); err == nil || server.finished {
+		t.Fatal("Session whose database the peer couldn't switch to shouldn't have been handed off")
+	}
+	WritePacket(mysqlproto.NewStream(clientEnd), mysqlproto.Packet{0, []byte{COM_PING}})
+	if packet := <-incoming; packetCommand(packet) != COM_PING {
+		t.Errorf("Bogus packet from a session that stayed: %v", packet)
+	}
+	atomic.AddInt64(&server.proxy.inFlight, -1) // What the client goroutine would do
+
+	server.proxy.transactionOpen = true
+	if err := server.handOff(peer); err == nil {
+		t.Error("Session in a transaction shouldn't have been handed off")
+	}
+	server.proxy.transactionOpen = false
+
+	server.proxy.Database = ""
+	if err := server.handOff(peer); err != nil {
+		t.Fatalf("Couldn't hand off an idle session: %s", err)
+	}
+	if !server.finished {
+		t.Error("Handed-off session should be finished here")
+	}
+	if _, open := <-incoming; open {
+		t.Error("Client reader should have stopped")
+	}
+	server.proxy.Close()
+
+	// The peer's got the client now, and the client never noticed.
+	stream := mysqlproto.NewStream(clientEnd)
+	clientEnd.SetDeadline(time.Now().Add(5 * time.Second))
+	WritePacket(stream, mysqlproto.Packet{0, append([]byte{COM_QUERY}, selftestQuery...)})
+	response, err := ReadPacket(stream)
+	if err != nil || packetIsERR(response) || response.Payload[0] != 3 {
+		t.Errorf("Bogus response from the adopted session: %v, %v", response, err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"hash"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// A Hasher is the keyed hash sanitizeRow turns values into garbage with.
+// HashAlgorithm picks one:
+//
+//   - "hmac-sha256" (the default) is HMAC-SHA-256 keyed with the salt.
+//   - "blake2b" is BLAKE2b-256 keyed with the salt, which is faster but not
+//     FIPS-approved.
+//   - "sha256" is SHA-256 over the value with the salt appended, which is
+//     what we always used to do. It's only here so existing sanitized data
+//     stays comparable; use one of the others if you can.
+type Hasher interface {
+	Sum(value []byte, salt []byte) []byte
+}
+
+type hmacSHA256Hasher struct{}
+type blake2bHasher struct{}
+type saltedSHA256Hasher struct{}
+
+// NewHasher returns the Hasher for the algorithm.
+func NewHasher(algorithm string) (Hasher, error) {
+	switch algorithm {
+	case "hmac-sha256":
+		return hmacSHA256Hasher{}, nil
+	case "blake2b":
+		return blake2bHasher{}, nil
+	case "sha256":
+		return saltedSHA256Hasher{}, nil
+	}
+	return nil, fmt.Errorf("Unknown hash algorithm '%s' (expected hmac-sha256, blake2b, or sha256)", algorithm)
+}
+
+// Keying an HMAC costs as much as hashing a short value, so we keep keyed
+// ones around for each salt and just reset them between values. Watermark
+// keys count as salts too, and clients can make up as many profiles as they
+// like, so past maxHMACPools salts we throw them all out and start over.
+var hmacPools sync.Map // string(salt) -> *sync.Pool
+var hmacPoolCount int64
+
+const maxHMACPools = 256
+
+func (hmacSHA256Hasher) Sum(value []byte, salt []byte) []byte {
+	pool, ok := hmacPools.Load(string(salt))
+	if !ok {
+		if atomic.AddInt64(&hmacPoolCount, 1) > maxHMACPools {
+			hmacPools.Range(func(salt, _ interface{}) bool {
+				hmacPools.Delete(salt)
+				return true
+			})
+			atomic.StoreInt64(&hmacPoolCount, 1)
+		}
+		key := append([]byte{}, salt...)
+		newSHA256 := newSHA256
+		pool, _ = hmacPools.LoadOrStore(string(salt), &sync.Pool{New: func() interface{} {
+			return hmac.New(newSHA256, key)
+		}})
+	}
+	mac := pool.(*sync.Pool).Get().(hash.Hash)
+	defer pool.(*sync.Pool).Put(mac)
+	mac.Reset()
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+func (blake2bHasher) Sum(value []byte, salt []byte) []byte {
+	// BLAKE2b keys top out at 64 bytes, so longer salts get hashed down.
+	key := salt
+	if len(key) > blake2b.Size {
+		sum := blake2b.Sum512(key)
+		key = sum[:]
+	}
+	hash, err := blake2b.New256(key)
+	if err != nil {
+		panic(fmt.Sprintf("Can't key BLAKE2b: %s", err)) // can't happen with a short enough key
+	}
+	hash.Write(value)
+	return hash.Sum(nil)
+}
+
+func (saltedSHA256Hasher) Sum(value []byte, salt []byte) []byte {
+	hash := newSHA256()
+	hash.Write(value)
+	hash.Write(salt)
+	return hash.Sum(nil)
+}
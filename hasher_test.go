@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNewHasher(t *testing.T) {
+	value, salt := []byte("honk"), []byte("bonk")
+
+	legacy, _ := NewHasher("sha256")
+	expected := sha256.Sum256([]byte("honkbonk"))
+	if !bytes.Equal(legacy.Sum(value, salt), expected[:]) {
+		t.Error("The sha256 hasher should match what we used to do")
+	}
+
+	// From RFC 4231, test case 2.
+	hmacHasher, _ := NewHasher("hmac-sha256")
+	sum := hmacHasher.Sum([]byte("what do ya want for nothing?"), []byte("Jefe"))
+	if hex.EncodeToString(sum) != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+		t.Errorf("Bogus HMAC-SHA-256: %x", sum)
+	}
+
+	blake, _ := NewHasher("blake2b")
+	if sum := blake.Sum(value, []byte(strings.Repeat("x", 100))); len(sum) != 32 {
+		t.Errorf("Bogus BLAKE2b sum with a long salt: %x", sum)
+	}
+	if bytes.Equal(blake.Sum(value, salt), blake.Sum(value, []byte("other"))) {
+		t.Error("BLAKE2b sums should depend on the salt")
+	}
+
+	if _, err := NewHasher("md5"); err == nil {
+		t.Error("Unknown hash algorithms should be refused")
+	}
+}
+
+func TestHMACPools(t *testing.T) {
+	hmacHasher, _ := NewHasher("hmac-sha256")
+	first := hmacHasher.Sum([]byte("honk"), []byte("profile 0"))
+
+	// Like a client making up a new watermark profile for every session.
+	for i := 0; i < 3*maxHMACPools; i++ {
+		hmacHasher.Sum([]byte("honk"), []byte(fmt.Sprintf("profile %d", i)))
+	}
+	pools := 0
+	hmacPools.Range(func(_, _ interface{}) bool {
+		pools++
+		return true
+	})
+	if pools > maxHMACPools {
+		t.Errorf("Kept %d HMAC pools, more than the %d allowed", pools, maxHMACPools)
+	}
+	if !bytes.Equal(hmacHasher.Sum([]byte("honk"), []byte("profile 0")), first) {
+		t.Error("Throwing out the pools shouldn't change any sums")
+	}
+}
+
+func TestMaskers_followHashAlgorithm(t *testing.T) {
+	defer func(old Hasher) { hasher = old }(hasher)
+	masks := func() string {
+		card, _ := maskCardNumber([]byte("4111 1111 1111 1111"), []byte("salt"))
+		email, _ := maskEmail([]byte("bob@example.com"), []byte("salt"), 255)
+		url, _ := maskURL([]byte("https://example.com/bob"), []byte("salt"), nil)
+		return string(card) + string(email) + string(url) + string(fakeValue("name", []byte("bob"), []byte("salt")))
+	}
+
+	hasher, _ = NewHasher("hmac-sha256")
+	hmacMasks := masks()
+	hasher, _ = NewHasher("blake2b")
+	if masks() == hmacMasks {
+		t.Error("Masking should use the configured HashAlgorithm")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The health server is for load balancers: /healthz says whether we can
+// still log into the MySQL server, and /readyz says whether we're accepting
+// connections. Backend checks are cached for HealthCacheSeconds so an eager
+// prober doesn't turn into a flood of logins.
+
+// healthCheckTimeout bounds how long one backend check can take, so a hung
+// server shows up as unhealthy rather than as a hung probe.
+const healthCheckTimeout = 5 * time.Second
+
+var listenerReady int32
+
+// setListenerReady records whether the main listener is accepting connections.
+func setListenerReady(ready bool) {
+	value := int32(0)
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&listenerReady, value)
+}
+
+// HealthChecker checks the MySQL server, remembering the answer for a while.
+type HealthChecker struct {
+	mutex   sync.Mutex
+	cache   time.Duration
+	checked time.Time
+	err     error
+	check   func() error
+}
+
+// NewHealthChecker returns a HealthChecker that caches results for the given
+// duration.
+func NewHealthChecker(cache time.Duration) *HealthChecker {
+	return &HealthChecker{cache: cache, check: checkBackend}
+}
+
+// Check returns nil if the server was fine the last time we looked, checking
+// again if that was too long ago. Concurrent callers share one check.
+func (checker *HealthChecker) Check() error {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	if !checker.checked.IsZero() && time.Since(checker.checked) < checker.cache {
+		return checker.err
+	}
+	checker.err = checker.check()
+	checker.checked = time.Now()
+	if checker.err != nil {
+		output.Log("Health check failed: %s", checker.err)
+	}
+	return checker.err
+}
+
+// checkBackend dials the server and logs in, like a new session would.
+func checkBackend() error {
+	server, err := NewServerConnection(nil)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	server.conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+	if _, err := server.logIn(); err != nil {
+		return fmt.Errorf("Can't log into %s: %s", config.MysqlHost, err)
+	}
+	return nil
+}
+
+// ServeHealth runs the health server on the given port until the context is
+// cancelled.
+func ServeHealth(ctx context.Context, port int, checker *HealthChecker) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := checker.Check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", handleReadyz)
+	server := &http.Server{
+		Addr:        fmt.Sprintf(":%d", port),
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		output.Log("Health server on port %d stopped: %s", port, err)
+	}
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&listenerReady) == 0 {
+		http.Error(w, "not accepting connections", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
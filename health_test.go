@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker_caches(t *testing.T) {
+	checks := 0
+	checker := NewHealthChecker(time.Minute)
+	checker.check = func() error {
+		checks++
+		return fmt.Errorf("Honk")
+	}
+
+	if checker.Check() == nil || checker.Check() == nil {
+		t.Error("Failed checks should stay failed")
+	}
+	if checks != 1 {
+		t.Errorf("Bogus number of backend checks: %d", checks)
+	}
+
+	checker.checked = time.Now().Add(-2 * time.Minute)
+	checker.check = func() error {
+		checks++
+		return nil
+	}
+	if err := checker.Check(); err != nil || checks != 2 {
+		t.Errorf("Stale result should have been rechecked: %v after %d checks", err, checks)
+	}
+}
+
+func TestHandleReadyz(t *testing.T) {
+	defer setListenerReady(false)
+
+	for _, ready := range []bool{false, true} {
+		setListenerReady(ready)
+		recorder := httptest.NewRecorder()
+		handleReadyz(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		if (recorder.Code == http.StatusOK) != ready {
+			t.Errorf("Bogus /readyz status %d when ready = %v", recorder.Code, ready)
+		}
+	}
+}
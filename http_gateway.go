@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// The HTTP gateway (see HTTPGatewayPort) runs queries sent as JSON, for
+// scripts that don't want to carry a MySQL driver around. Each request gets
+// its own LocalSession, so it goes through the same checks and sanitization
+// as any other client.
+
+type gatewayRequest struct {
+	SQL      string `json:"sql"`
+	Database string `json:"database"`
+}
+
+type gatewayResponse struct {
+	Columns      []string    `json:"columns,omitempty"`
+	Rows         [][]*string `json:"rows,omitempty"`
+	AffectedRows uint64      `json:"affected_rows"`
+	Error        string      `json:"error,omitempty"`
+}
+
+const gatewayMaxRequestSize = 1 << 20
+
+// ServeHTTPGateway serves the gateway until the context is cancelled.
+func ServeHTTPGateway(ctx context.Context, port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query", handleGatewayQuery)
+	server := &http.Server{
+		Addr:        fmt.Sprintf(":%d", port),
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		output.Log("HTTP gateway on port %d stopped: %s", port, err)
+	}
+}
+
+func handleGatewayQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeGatewayResponse(w, http.StatusMethodNotAllowed, gatewayResponse{Error: "Use POST"})
+		return
+	}
+
+	var request gatewayRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, gatewayMaxRequestSize))
+	if err := decoder.Decode(&request); err != nil || request.SQL == "" {
+		writeGatewayResponse(w, http.StatusBadRequest, gatewayResponse{Error: "Expected a JSON object like {\"sql\": \"SELECT ...\"}"})
+		return
+	}
+
+	// There's no password to check, since the server always sees
+	// MysqlUsername, but the username still labels the session.
+	username, _, ok := r.BasicAuth()
+	if !ok || username == "" {
+		username = "http-gateway"
+	}
+
+	session, err := OpenLocalSession(r.Context(), username, request.Database)
+	if err != nil {
+		output.Log("Can't open session for HTTP gateway request from %s: %s", r.RemoteAddr, err)
+		message := "mysql-sanitizer couldn't open a session"
+		if proxyErr, ok := err.(*ProxyError); ok {
+			message = proxyErr.Message
+		}
+		writeGatewayResponse(w, http.StatusServiceUnavailable, gatewayResponse{Error: message})
+		return
+	}
+	defer session.Close()
+
+	result, err := session.Query(request.SQL)
+	if err != nil {
+		writeGatewayResponse(w, http.StatusBadRequest, gatewayResponse{Error: err.Error()})
+		return
+	}
+	writeGatewayResponse(w, http.StatusOK, gatewayResponse{result.Columns, result.Rows, result.AffectedRows, ""})
+}
+
+func writeGatewayResponse(w http.ResponseWriter, status int, response gatewayResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
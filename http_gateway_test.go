@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleGatewayQuery(t *testing.T) {
+	oldHost, oldPort := config.MysqlHost, config.MysqlPort
+	defer func() { config.MysqlHost, config.MysqlPort = oldHost, oldPort }()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go serveSelftestBackend(backend)
+	config.MysqlHost = "127.0.0.1"
+	config.MysqlPort = backend.Addr().(*net.TCPAddr).Port
+
+	request := httptest.NewRequest("POST", "/query", strings.NewReader(`{"sql": "`+selftestQuery+`"}`))
+	recorder := httptest.NewRecorder()
+	handleGatewayQuery(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Bogus status %d: %s", recorder.Code, recorder.Body)
+	}
+	var response gatewayResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Bogus JSON: %s", err)
+	}
+	if strings.Join(response.Columns, ",") != "id,name,nickname" {
+		t.Errorf("Bogus columns: %v", response.Columns)
+	}
+	if len(response.Rows) != 1 {
+		t.Fatalf("Expected one row, got %v", response.Rows)
+	}
+	row := response.Rows[0]
+	if *row[0] != "42" || *row[1] == "Alice Example" || row[2] != nil {
+		t.Errorf("Bogus row: %v, %v, %v", *row[0], *row[1], row[2])
+	}
+}
+
+func TestHandleGatewayQuery_BadRequests(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	handleGatewayQuery(recorder, httptest.NewRequest("GET", "/query", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Bogus status for GET: %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	handleGatewayQuery(recorder, httptest.NewRequest("POST", "/query", strings.NewReader("SELECT 1")))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Bogus status for non-JSON: %d", recorder.Code)
+	}
+}
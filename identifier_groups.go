@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// IdentifierGroup is a set of columns holding the same kind of identifier
+// (say users.email, orders.customer_email and marketing.contacts.email) whose
+// pseudonyms have to match, so sanitized data can still be joined on them.
+// Plain hashing almost gets there, but the hashes get cut to each column's
+// width and carry the salt version, and other proxies use other salts. Group
+// members skip all that: they get exactly Length hex characters keyed on the
+// group's own Key, so any proxy with the same group config turns the same
+// value into the same pseudonym.
+type IdentifierGroup struct {
+	Name      string   // For logs, and to derive a key if there isn't one
+	Columns   []string // "database.table.column"
+	Key       string   // Shared secret for the group's pseudonyms (defaults to one derived from HashSalt)
+	Length    int      // Hex characters per pseudonym
+	Lowercase bool     // Lowercase values first, for case-insensitive identifiers like emails
+}
+
+type identifierGroup struct {
+	name      string
+	key       []byte
+	length    int
+	lowercase bool
+}
+
+// narrowGroupColumns remembers which columns we've already warned are too
+// narrow for their group's pseudonyms.
+var narrowGroupColumns sync.Map
+
+// IdentifierGroups maps each grouped "database.table.column" to its group.
+type IdentifierGroups map[string]*identifierGroup
+
+// NewIdentifierGroups checks and compiles the groups.
+func NewIdentifierGroups(groups []IdentifierGroup, salt []byte) (IdentifierGroups, error) {
+	compiled := IdentifierGroups{}
+	names := map[string]bool{}
+	for _, group := range groups {
+		if group.Name == "" || names[group.Name] {
+			return nil, fmt.Errorf("Identifier groups need unique names, but got '%s'", group.Name)
+		}
+		names[group.Name] = true
+		if group.Length == 0 {
+			group.Length = 32
+		}
+		if group.Length < 8 || group.Length > 2*len(hasher.Sum(nil, nil)) {
+			return nil, fmt.Errorf("Length for identifier group '%s' should be between 8 and %d", group.Name, 2*len(hasher.Sum(nil, nil)))
+		}
+
+		key := []byte(group.Key)
+		if group.Key == "" {
+			key = hasher.Sum([]byte("identifier group "+group.Name), salt)
+		}
+		members, err := NewColumnSet(group.Columns)
+		if err != nil {
+			return nil, fmt.Errorf("Bad columns for identifier group '%s': %s", group.Name, err)
+		}
+		for name := range members {
+			if other, ok := compiled[name]; ok {
+				return nil, fmt.Errorf("Column '%s' is in identifier groups '%s' and '%s'", name, other.name, group.Name)
+			}
+			compiled[name] = &identifierGroup{group.Name, key, group.Length, group.Lowercase}
+		}
+	}
+	return compiled, nil
+}
+
+// Pseudonym returns the group pseudonym for a value in the column, or false
+// if the column isn't in a group.
+func (groups IdentifierGroups) Pseudonym(value []byte, column Column) ([]byte, bool) {
+	name := column.Database + "." + column.Table + "." + column.Name
+	group, ok := groups[name]
+	if !ok {
+		return nil, false
+	}
+	if group.lowercase {
+		value = bytes.ToLower(value)
+	}
+	sum := hasher.Sum(value, group.key)
+	pseudonym := []byte(hex.EncodeToString(sum)[:group.length])
+	if uint32(len(pseudonym)) > column.Length {
+		if _, warned := narrowGroupColumns.LoadOrStore(name, true); !warned {
+			output.Log("Column %s is too narrow for identifier group '%s', so its pseudonyms won't match the rest of the group", name, group.name)
+		}
+		pseudonym = pseudonym[:column.Length]
+	}
+	return pseudonym, true
+}
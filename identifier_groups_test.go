@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewIdentifierGroups_bogus(t *testing.T) {
+	bogus := [][]IdentifierGroup{
+		{{"", []string{"a.b.c"}, "", 0, false}},
+		{{"email", []string{"a.b.c"}, "", 0, false}, {"email", []string{"a.b.d"}, "", 0, false}},
+		{{"email", []string{"a.b.c"}, "", 0, false}, {"user_id", []string{"a.b.c"}, "", 0, false}},
+		{{"email", []string{"a.b"}, "", 0, false}},
+		{{"email", []string{"a.b.c"}, "", 4, false}},
+		{{"email", []string{"a.b.c"}, "", 1000, false}},
+	}
+	for _, groups := range bogus {
+		if _, err := NewIdentifierGroups(groups, []byte("salt")); err == nil {
+			t.Errorf("Bogus identifier groups %v should be an error", groups)
+		}
+	}
+}
+
+func TestIdentifierGroups_Pseudonym(t *testing.T) {
+	columns := []string{"users.users.email", "shop.orders.customer_email"}
+	groups, err := NewIdentifierGroups([]IdentifierGroup{{"email", columns, "", 16, true}}, []byte("salt"))
+	if err != nil {
+		t.Fatalf("NewIdentifierGroups failed: %s", err)
+	}
+	wide := Column{true, "users", "users", "email", "email", 255, TYPE_VAR_STRING, 0, nil, "", false, nil}
+	narrow := Column{true, "shop", "orders", "customer_email", "customer_email", 20, TYPE_VAR_STRING, 0, nil, "", false, nil}
+
+	first, ok := groups.Pseudonym([]byte("Alice@Example.com"), wide)
+	second, _ := groups.Pseudonym([]byte("alice@example.com"), narrow)
+	if !ok || len(first) != 16 || string(first) != string(second) {
+		t.Errorf("Pseudonyms should match across the group: %q vs %q", first, second)
+	}
+
+	other := Column{true, "users", "users", "name", "name", 255, TYPE_VAR_STRING, 0, nil, "", false, nil}
+	if _, ok := groups.Pseudonym([]byte("Alice"), other); ok {
+		t.Error("Columns outside the group shouldn't get group pseudonyms")
+	}
+
+	// Another proxy with a different salt but the same shared key.
+	keyed := func(salt string) string {
+		groups, _ := NewIdentifierGroups([]IdentifierGroup{{"email", columns, "shared secret", 16, false}}, []byte(salt))
+		pseudonym, _ := groups.Pseudonym([]byte("alice@example.com"), wide)
+		return string(pseudonym)
+	}
+	if keyed("salt") != keyed("pepper") {
+		t.Error("A shared key should make pseudonyms independent of the salt")
+	}
+}
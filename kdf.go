@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KdfConfig configures the deliberately slow hash we use for low-entropy
+// columns (SSNs, phone numbers, etc.), where a salted SHA-256 could be
+// brute-forced by anyone who knows the format.
+type KdfConfig struct {
+	Algorithm       string   // "argon2id" or "scrypt"
+	Columns         []string // "database.table.column" names to run through the KDF
+	Workers         int      // Maximum number of KDF computations running at once
+	Argon2Time      uint32   // Number of argon2id passes
+	Argon2MemoryKiB uint32   // Memory used by each argon2id computation
+	Argon2Threads   uint8    // Parallelism within a single argon2id computation
+	ScryptN         int      // scrypt CPU/memory cost; must be a power of two
+	ScryptR         int      // scrypt block size
+	ScryptP         int      // scrypt parallelism
+}
+
+var defaultKdfConfig = KdfConfig{
+	"argon2id", // Algorithm
+	[]string{}, // Columns
+	4,          // Workers
+	1,          // Argon2Time
+	64 * 1024,  // Argon2MemoryKiB
+	1,          // Argon2Threads
+	1 << 15,    // ScryptN
+	8,          // ScryptR
+	1,          // ScryptP
+}
+
+const kdfOutputLen = 32
+
+// KdfHasher hashes values from the configured columns, never running more
+// than Workers computations at once so a big SELECT can't eat every core
+// (and all our memory) on the proxy.
+type KdfHasher struct {
+	config  KdfConfig
+	columns ColumnSet
+	workers chan struct{}
+}
+
+// NewKdfHasher returns a KdfHasher, or an error if the configuration is bogus.
+func NewKdfHasher(kdfConfig KdfConfig) (*KdfHasher, error) {
+	if kdfConfig.Algorithm != "argon2id" && kdfConfig.Algorithm != "scrypt" {
+		return nil, fmt.Errorf("Unknown KDF algorithm '%s'", kdfConfig.Algorithm)
+	}
+	if kdfConfig.Workers < 1 {
+		return nil, fmt.Errorf("KDF worker count must be at least 1, not %d", kdfConfig.Workers)
+	}
+	// argon2 panics and scrypt errors on these, which we'd otherwise only
+	// find out about at the first value.
+	switch kdfConfig.Algorithm {
+	case "argon2id":
+		if kdfConfig.Argon2Time < 1 || kdfConfig.Argon2Threads < 1 {
+			return nil, fmt.Errorf("Argon2Time and Argon2Threads must be at least 1")
+		}
+		if kdfConfig.Argon2MemoryKiB < 8*uint32(kdfConfig.Argon2Threads) {
+			return nil, fmt.Errorf("Argon2MemoryKiB must be at least 8 per thread")
+		}
+	case "scrypt":
+		if kdfConfig.ScryptN < 2 || kdfConfig.ScryptN&(kdfConfig.ScryptN-1) != 0 {
+			return nil, fmt.Errorf("ScryptN must be a power of two greater than 1, not %d", kdfConfig.ScryptN)
+		}
+		if kdfConfig.ScryptR < 1 || kdfConfig.ScryptP < 1 || uint64(kdfConfig.ScryptR)*uint64(kdfConfig.ScryptP) >= 1<<30 {
+			return nil, fmt.Errorf("ScryptR and ScryptP must be at least 1, and multiply to less than 2^30")
+		}
+	}
+
+	columns, err := NewColumnSet(kdfConfig.Columns)
+	if err != nil {
+		return nil, err
+	}
+	return &KdfHasher{kdfConfig, columns, make(chan struct{}, kdfConfig.Workers)}, nil
+}
+
+// Handles reports whether the column's values should go through the KDF.
+func (hasher *KdfHasher) Handles(col Column) bool {
+	return hasher.columns.Contains(col)
+}
+
+// Hash returns the hex-encoded KDF output for the given value, blocking
+// until a worker is free.
+func (hasher *KdfHasher) Hash(value []byte, salt []byte) ([]byte, error) {
+	hasher.workers <- struct{}{}
+	defer func() { <-hasher.workers }()
+
+	var sum []byte
+	if hasher.config.Algorithm == "scrypt" {
+		var err error
+		sum, err = scrypt.Key(value, salt, hasher.config.ScryptN, hasher.config.ScryptR, hasher.config.ScryptP, kdfOutputLen)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		sum = argon2.IDKey(value, salt, hasher.config.Argon2Time, hasher.config.Argon2MemoryKiB, hasher.config.Argon2Threads, kdfOutputLen)
+	}
+
+	encoded := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(encoded, sum)
+	return encoded, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+func testKdfConfig(algorithm string) KdfConfig {
+	kdfConfig := defaultKdfConfig
+	kdfConfig.Algorithm = algorithm
+	kdfConfig.Columns = []string{"HR.Employees.SSN"}
+	kdfConfig.Argon2MemoryKiB = 64
+	kdfConfig.ScryptN = 16
+	return kdfConfig
+}
+
+func TestNewKdfHasher_BadAlgorithm(t *testing.T) {
+	_, err := NewKdfHasher(testKdfConfig("md5"))
+	if err == nil {
+		t.Error("Bogus KDF algorithm was accepted!")
+	}
+}
+
+func TestNewKdfHasher_BadColumn(t *testing.T) {
+	kdfConfig := testKdfConfig("argon2id")
+	kdfConfig.Columns = []string{"employees.ssn"}
+	_, err := NewKdfHasher(kdfConfig)
+	if err == nil {
+		t.Error("Column without a database was accepted!")
+	}
+}
+
+func TestNewKdfHasher_BadParameters(t *testing.T) {
+	bogus := map[string]func(*KdfConfig){
+		"Argon2Time = 0":        func(kdfConfig *KdfConfig) { kdfConfig.Argon2Time = 0 },
+		"Argon2Threads = 0":     func(kdfConfig *KdfConfig) { kdfConfig.Argon2Threads = 0 },
+		"Argon2MemoryKiB = 0":   func(kdfConfig *KdfConfig) { kdfConfig.Argon2MemoryKiB = 0 },
+		"ScryptN = 1000":        func(kdfConfig *KdfConfig) { kdfConfig.Algorithm, kdfConfig.ScryptN = "scrypt", 1000 },
+		"ScryptN = 1":           func(kdfConfig *KdfConfig) { kdfConfig.Algorithm, kdfConfig.ScryptN = "scrypt", 1 },
+		"ScryptR = 0":           func(kdfConfig *KdfConfig) { kdfConfig.Algorithm, kdfConfig.ScryptR = "scrypt", 0 },
+		"ScryptR * ScryptP big": func(kdfConfig *KdfConfig) { kdfConfig.Algorithm, kdfConfig.ScryptP = "scrypt", 1<<28 },
+	}
+	for description, change := range bogus {
+		kdfConfig := testKdfConfig("argon2id")
+		change(&kdfConfig)
+		if _, err := NewKdfHasher(kdfConfig); err == nil {
+			t.Errorf("Bogus KDF config with %s was accepted!", description)
+		}
+	}
+}
+
+func TestKdfHasherHandles(t *testing.T) {
+	hasher, err := NewKdfHasher(testKdfConfig("argon2id"))
+	if err != nil {
+		t.Fatalf("NewKdfHasher failed: %s", err)
+	}
+	if !hasher.Handles(Column{true, "hr", "employees", "ssn", "ssn", 11, 0, 0, nil, "", false, nil}) {
+		t.Error("KDF column wasn't recognized!")
+	}
+	if hasher.Handles(Column{true, "hr", "employees", "name", "name", 255, 0, 0, nil, "", false, nil}) {
+		t.Error("Non-KDF column was recognized!")
+	}
+}
+
+func TestKdfHasherHash(t *testing.T) {
+	for _, algorithm := range []string{"argon2id", "scrypt"} {
+		hasher, err := NewKdfHasher(testKdfConfig(algorithm))
+		if err != nil {
+			t.Fatalf("NewKdfHasher failed: %s", err)
+		}
+
+		first, err := hasher.Hash([]byte("078-05-1120"), []byte("salt"))
+		if err != nil {
+			t.Fatalf("%s hash failed: %s", algorithm, err)
+		}
+		second, _ := hasher.Hash([]byte("078-05-1120"), []byte("salt"))
+		other, _ := hasher.Hash([]byte("078-05-1121"), []byte("salt"))
+
+		if len(first) != kdfOutputLen*2 {
+			t.Errorf("Unexpected %s output length: %d", algorithm, len(first))
+		}
+		if string(first) != string(second) {
+			t.Errorf("%s output isn't deterministic: '%s' vs. '%s'", algorithm, first, second)
+		}
+		if string(first) == string(other) {
+			t.Errorf("%s output collided for different values: '%s'", algorithm, first)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Clients can label their sessions by tacking a query string onto the
+// username, like "alice?team=growth&job=nightly-export". Labels have to be in
+// AllowedLabels (so nobody can blow up the metrics with made-up values), and
+// show up in the session's log messages and in SHOW SANITIZER STATUS.
+
+// parseUsernameLabels splits the username from its labels, dropping any
+// labels that aren't allowed.
+func parseUsernameLabels(username string, allowed map[string][]string) (string, map[string]string) {
+	labels := map[string]string{}
+	question := strings.Index(username, "?")
+	if question < 0 {
+		return username, labels
+	}
+
+	values, err := url.ParseQuery(username[question+1:])
+	username = username[:question]
+	if err != nil {
+		output.Log("Ignoring unparseable labels from %s: %s", username, err)
+		return username, labels
+	}
+
+	for key, value := range values {
+		if labelAllowed(key, value[len(value)-1], allowed) {
+			labels[key] = value[len(value)-1]
+		} else {
+			output.Log("Ignoring label %s=%s from %s, since it isn't in AllowedLabels", key, value[len(value)-1], username)
+		}
+	}
+	return username, labels
+}
+
+func labelAllowed(key string, value string, allowed map[string][]string) bool {
+	for _, allowedValue := range allowed[key] {
+		if value == allowedValue {
+			return true
+		}
+	}
+	return false
+}
+
+// formatLabels returns the labels as "key=value" strings, sorted by key.
+func formatLabels(labels map[string]string) []string {
+	formatted := []string{}
+	for key, value := range labels {
+		formatted = append(formatted, key+"="+value)
+	}
+	sort.Strings(formatted)
+	return formatted
+}
+
+// LabelCounters are the per-label versions of some of the Stats counters.
+type LabelCounters struct {
+	sessions int64
+	queries  int64
+	rows     int64
+}
+
+// labelCounters returns the counters for each of the labels, creating them if
+// necessary.
+func (stats *Stats) labelCounters(labels map[string]string) []*LabelCounters {
+	stats.labelMutex.Lock()
+	defer stats.labelMutex.Unlock()
+
+	counters := []*LabelCounters{}
+	for _, label := range formatLabels(labels) {
+		if stats.labels[label] == nil {
+			stats.labels[label] = &LabelCounters{}
+		}
+		counters = append(counters, stats.labels[label])
+	}
+	return counters
+}
+
+// labelRows returns SHOW SANITIZER STATUS rows for every label we've seen.
+func (stats *Stats) labelRows() [][]string {
+	stats.labelMutex.Lock()
+	defer stats.labelMutex.Unlock()
+
+	names := []string{}
+	for label := range stats.labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+
+	rows := [][]string{}
+	for _, label := range names {
+		counters := stats.labels[label]
+		rows = append(rows,
+			[]string{"Sessions{" + label + "}", strconv.FormatInt(atomicLoad(&counters.sessions), 10)},
+			[]string{"Queries{" + label + "}", strconv.FormatInt(atomicLoad(&counters.queries), 10)},
+			[]string{"Rows_forwarded{" + label + "}", strconv.FormatInt(atomicLoad(&counters.rows), 10)},
+		)
+	}
+	return rows
+}
+
+// SetLabels attaches the labels to the session's log messages and counters.
+func (proxy *ProxyConnection) SetLabels(username string, labels map[string]string) {
+	counters := stats.labelCounters(labels)
+	for _, counter := range counters {
+		atomic.AddInt64(&counter.sessions, 1)
+	}
+
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	proxy.username = username
+	proxy.labels = labels
+	proxy.output = output.WithLabels(labels)
+	proxy.labelCounters = counters
+}
+
+// Username returns the username the client logged in with, minus labels.
+func (proxy *ProxyConnection) Username() string {
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	return proxy.username
+}
+
+// Output returns the Output for messages about this session.
+func (proxy *ProxyConnection) Output() Output {
+	if proxy == nil {
+		// Pooled server connections don't have a session yet.
+		return output
+	}
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	return proxy.output
+}
+
+func (proxy *ProxyConnection) counters() []*LabelCounters {
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	return proxy.labelCounters
+}
+
+func (proxy *ProxyConnection) countQuery() {
+	stats.QueryReceived()
+	atomic.AddInt64(&proxy.usedQueries, 1)
+	for _, counter := range proxy.counters() {
+		atomic.AddInt64(&counter.queries, 1)
+	}
+}
+
+func (proxy *ProxyConnection) countRow(size int) {
+	stats.RowForwarded()
+	atomic.AddInt64(&proxy.usedRows, 1)
+	atomic.AddInt64(&proxy.usedBytes, int64(size))
+	for _, counter := range proxy.counters() {
+		atomic.AddInt64(&counter.rows, 1)
+	}
+}
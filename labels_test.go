@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var testAllowedLabels = map[string][]string{"team": {"growth", "payments"}}
+
+func TestParseUsernameLabels(t *testing.T) {
+	username, labels := parseUsernameLabels("alice?team=growth&env=prod", testAllowedLabels)
+	if username != "alice" {
+		t.Errorf("Bogus username: %s", username)
+	}
+	if len(labels) != 1 || labels["team"] != "growth" {
+		t.Errorf("Bogus labels: %v", labels)
+	}
+}
+
+func TestParseUsernameLabels_NotAllowed(t *testing.T) {
+	_, labels := parseUsernameLabels("alice?team=marketing", testAllowedLabels)
+	if len(labels) != 0 {
+		t.Errorf("Labels should have been dropped: %v", labels)
+	}
+}
+
+func TestParseUsernameLabels_None(t *testing.T) {
+	username, labels := parseUsernameLabels("alice", testAllowedLabels)
+	if username != "alice" || len(labels) != 0 {
+		t.Errorf("Bogus username or labels: %s, %v", username, labels)
+	}
+}
+
+func TestStats_LabelRows(t *testing.T) {
+	stats := NewStats()
+	counters := stats.labelCounters(map[string]string{"team": "growth"})
+	counters[0].queries = 3
+
+	rows := stats.labelRows()
+	if len(rows) != 3 || rows[1][0] != "Queries{team=growth}" || rows[1][1] != "3" {
+		t.Errorf("Bogus label rows: %v", rows)
+	}
+}
+
+func TestTextSink_Labels(t *testing.T) {
+	var buffer bytes.Buffer
+	out := Output{[]OutputSink{newTextSink(&buffer)}, logLevelNormal, nil}
+	out.WithLabels(map[string]string{"team": "growth", "job": "export"}).Log("Hi")
+
+	if !strings.HasSuffix(buffer.String(), "Hi [job=export team=growth]\n") {
+		t.Errorf("Bogus log line: %s", buffer.String())
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// LengthStats keeps histograms of how long values were before and after
+// sanitizing, per column, for SHOW SANITIZER STATUS. Hashes squeezed into a
+// short column lose most of their bits, and distinct values start colliding,
+// so we also warn (once per column) when that gets below MinHashBits.
+type LengthStats struct {
+	columns sync.Map // "database.table.column" -> *columnLengths
+}
+
+// Bucket i holds lengths up to lengthBuckets[i]; the last one holds the rest.
+var lengthBuckets = []int{0, 1, 3, 7, 15, 31, 63, 127, 255}
+
+type columnLengths struct {
+	original  [10]int64
+	sanitized [10]int64
+	truncated int64
+	warned    int32
+}
+
+var lengthStats = &LengthStats{}
+
+func (lengths *LengthStats) column(col Column) *columnLengths {
+	name := col.Database + "." + col.Table + "." + col.Name
+	if counters, ok := lengths.columns.Load(name); ok {
+		return counters.(*columnLengths)
+	}
+	counters, _ := lengths.columns.LoadOrStore(name, &columnLengths{})
+	return counters.(*columnLengths)
+}
+
+func lengthBucket(length int) int {
+	for i, limit := range lengthBuckets {
+		if length <= limit {
+			return i
+		}
+	}
+	return len(lengthBuckets)
+}
+
+// Observe records a value's length before and after sanitizing. NULLs
+// don't count.
+func (lengths *LengthStats) Observe(col Column, original []byte, sanitized []byte) {
+	if !config.LengthHistograms || sanitized == nil {
+		return
+	}
+	counters := lengths.column(col)
+	atomic.AddInt64(&counters.original[lengthBucket(len(original))], 1)
+	atomic.AddInt64(&counters.sanitized[lengthBucket(len(sanitized))], 1)
+}
+
+// HashTruncated records that a hash had to be cut down to bits bits to fit
+// the column, and warns about it the first time if that's too few.
+func (lengths *LengthStats) HashTruncated(col Column, bits int) {
+	counters := lengths.column(col)
+	atomic.AddInt64(&counters.truncated, 1)
+	if bits >= config.MinHashBits || !atomic.CompareAndSwapInt32(&counters.warned, 0, 1) {
+		return
+	}
+	// By the birthday bound, collisions get likely around 2^(bits/2) values.
+	output.Log("Hashes for %s.%s.%s only fit %d bits in the column, so distinct values will probably collide after about %s of them",
+		col.Database, col.Table, col.Name, bits, formatCount(math.Pow(2, float64(bits)/2)))
+}
+
+func formatCount(count float64) string {
+	if count < 1e6 {
+		return strconv.Itoa(int(count))
+	}
+	return fmt.Sprintf("%.3g", count)
+}
+
+func formatHistogram(buckets []int64) string {
+	parts := []string{}
+	for i := range buckets {
+		count := atomic.LoadInt64(&buckets[i])
+		if count == 0 {
+			continue
+		}
+		label := ">" + strconv.Itoa(lengthBuckets[len(lengthBuckets)-1])
+		if i < len(lengthBuckets) {
+			label = "<=" + strconv.Itoa(lengthBuckets[i])
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d", label, count))
+	}
+	return strings.Join(parts, " ")
+}
+
+// statusRows returns SHOW SANITIZER STATUS rows for every column we've
+// sanitized values from.
+func (lengths *LengthStats) statusRows() [][]string {
+	names := []string{}
+	lengths.columns.Range(func(name, _ interface{}) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	sort.Strings(names)
+
+	rows := [][]string{}
+	for _, name := range names {
+		counters, _ := lengths.columns.Load(name)
+		column := counters.(*columnLengths)
+		if config.LengthHistograms {
+			rows = append(rows,
+				[]string{"Original_lengths{" + name + "}", formatHistogram(column.original[:])},
+				[]string{"Sanitized_lengths{" + name + "}", formatHistogram(column.sanitized[:])},
+			)
+		}
+		if truncated := atomic.LoadInt64(&column.truncated); truncated > 0 {
+			rows = append(rows, []string{"Truncated_hashes{" + name + "}", strconv.FormatInt(truncated, 10)})
+		}
+	}
+	return rows
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLengthStats(t *testing.T) {
+	oldHistograms := config.LengthHistograms
+	defer func() { config.LengthHistograms = oldHistograms }()
+	config.LengthHistograms = true
+
+	lengths := &LengthStats{}
+	col := Column{true, "honk", "bonk", "code", "code", 6, 0, 0, nil, "", false, nil}
+	lengths.Observe(col, []byte("abc"), []byte("3fa9c1"))
+	lengths.Observe(col, []byte("abcdefghij"), []byte("0b12de"))
+	lengths.Observe(col, []byte("abc"), nil)
+	lengths.HashTruncated(col, 24)
+	lengths.HashTruncated(col, 24)
+
+	rows := lengths.statusRows()
+	if len(rows) != 3 {
+		t.Fatalf("Bogus status rows: %v", rows)
+	}
+	if rows[0][0] != "Original_lengths{honk.bonk.code}" || rows[0][1] != "<=3:1 <=15:1" {
+		t.Errorf("Bogus original lengths: %v", rows[0])
+	}
+	if rows[1][0] != "Sanitized_lengths{honk.bonk.code}" || rows[1][1] != "<=7:2" {
+		t.Errorf("Bogus sanitized lengths: %v", rows[1])
+	}
+	if rows[2][0] != "Truncated_hashes{honk.bonk.code}" || rows[2][1] != "2" {
+		t.Errorf("Bogus truncation count: %v", rows[2])
+	}
+}
+
+func TestCheckHashTruncation(t *testing.T) {
+	oldStats := lengthStats
+	defer func() { lengthStats = oldStats }()
+	lengthStats = &LengthStats{}
+
+	col := Column{true, "honk", "bonk", "code", "code", 6, 0, 0, nil, "", false, nil}
+	checkHashTruncation([]byte("v2:3fa9c1d2"), col)
+	checkHashTruncation([]byte("3fa9c1"), col)
+
+	counters := lengthStats.column(col)
+	if counters.truncated != 1 || counters.warned != 1 {
+		t.Errorf("Bogus truncation tracking: %d truncated, warned %d", counters.truncated, counters.warned)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// LOAD DATA LOCAL INFILE turns the usual request and response around: the
+// server answers the query by asking the client for a file (0xFB and the
+// filename), the client sends it in as many packets as it takes and then an
+// empty one, and only then does the server answer with an OK or ERR.
+//
+// By default (LocalInfile = "block") none of that happens: the server isn't
+// told the client can send files, and clients get a clear error for LOAD
+// DATA LOCAL before it gets that far. With LocalInfile = "relay", the file
+// goes through to the server as it is.
+
+const (
+	localInfileBlock = "block"
+	localInfileRelay = "relay"
+)
+
+func checkLocalInfileMode(mode string) bool {
+	return mode == localInfileBlock || mode == localInfileRelay
+}
+
+var localInfileRegex = regexp.MustCompile(`(?is)^LOAD\s+(DATA|XML)\s+((LOW_PRIORITY|CONCURRENT)\s+)?LOCAL\b`)
+
+// checkLocalInfile returns an error if the statement is a LOAD DATA LOCAL
+// and those are blocked.
+func checkLocalInfile(statement string) error {
+	if config.LocalInfile != localInfileRelay && localInfileRegex.MatchString(stripLeadingComments(statement)) {
+		return fmt.Errorf("LOAD DATA LOCAL INFILE is turned off in mysql-sanitizer")
+	}
+	return nil
+}
+
+func packetIsLocalInfileRequest(packet mysqlproto.Packet) bool {
+	return len(packet.Payload) > 0 && packet.Payload[0] == 0xFB
+}
+
+// handleLocalInfile deals with the server asking for a file. The request
+// still has the server's sequence ID, and sequenceId is the last packet the
+// client got, which gets updated. It returns true if the server's answer to
+// the query is still to come.
+func (server *ServerConnection) handleLocalInfile(request mysqlproto.Packet, sequenceId *byte) bool {
+	filename := string(request.Payload[1:])
+	if config.LocalInfile != localInfileRelay {
+		// checkLocalInfile should have stopped this, but just in case: tell
+		// the server the file's empty, and the client no.
+		server.proxy.Output().Audit("Refused the server's request for local file '%s' from %s", filename, server.proxy.Username())
+		if err := server.write(mysqlproto.Packet{request.SequenceID + 1, []byte{}}); err != nil {
+			server.lostBackend(*sequenceId, fmt.Errorf("Couldn't write to MySQL server: %s", err))
+			return false
+		}
+		reply, err := ReadPacket(server.stream)
+		if err == nil {
+			err = server.discardResults(reply)
+		}
+		if err != nil {
+			server.lostBackend(*sequenceId, fmt.Errorf("Couldn't receive packet from MySQL server: %s", err))
+			return false
+		}
+		err = NewProxyError(ErrPolicyViolation, nil, "LOAD DATA LOCAL INFILE is turned off in mysql-sanitizer")
+		server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), *sequenceId, err))
+		return false
+	}
+
+	// The two sides can be numbering packets differently, if an earlier
+	// result had big rows in it.
+	serverSequenceId := request.SequenceID
+	*sequenceId++
+	server.proxy.SendToClient(mysqlproto.Packet{*sequenceId, request.Payload})
+
+	size := 0
+	for {
+		var packet mysqlproto.Packet
+		select {
+		case packet = <-server.proxy.ServerChannel:
+		case <-server.proxy.ctx.Done():
+			server.finished = true
+			return false
+		}
+		*sequenceId = packet.SequenceID
+		serverSequenceId += byte(packetPieces(len(packet.Payload)))
+		if err := server.write(mysqlproto.Packet{serverSequenceId, packet.Payload}); err != nil {
+			server.lostBackend(*sequenceId, fmt.Errorf("Couldn't write to MySQL server: %s", err))
+			return false
+		}
+		if len(packet.Payload) == 0 {
+			break
+		}
+		size += len(packet.Payload)
+	}
+	server.proxy.Output().Audit("%s sent the server local file '%s' (%d bytes)", server.proxy.Username(), filename, size)
+	return true
+}
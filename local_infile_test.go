@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestCheckLocalInfile(t *testing.T) {
+	oldMode := config.LocalInfile
+	defer func() { config.LocalInfile = oldMode }()
+	config.LocalInfile = localInfileBlock
+
+	blocked := []string{
+		"LOAD DATA LOCAL INFILE '/etc/passwd' INTO TABLE users",
+		"/* hi */ load data concurrent local infile 'x' into table users",
+		"LOAD XML LOCAL INFILE 'x.xml' INTO TABLE users",
+	}
+	for _, statement := range blocked {
+		if checkLocalInfile(statement) == nil {
+			t.Errorf("'%s' should be blocked!", statement)
+		}
+	}
+	if err := checkLocalInfile("LOAD DATA INFILE '/tmp/x' INTO TABLE users"); err != nil {
+		t.Errorf("Bogus refusal of a server-side LOAD DATA: %s", err)
+	}
+	if checkCommandPolicy(mysqlproto.Packet{0, []byte("\x03LOAD DATA LOCAL INFILE 'x' INTO TABLE users")}, false) == nil {
+		t.Error("LOAD DATA LOCAL should be refused as a command")
+	}
+
+	config.LocalInfile = localInfileRelay
+	if err := checkLocalInfile(blocked[0]); err != nil {
+		t.Errorf("Bogus refusal with LocalInfile = relay: %s", err)
+	}
+}
+
+// localInfileSession returns a session whose server asks for a file and
+// then answers with an OK, and a channel with the packets the server got.
+func localInfileSession(t *testing.T) (*ServerConnection, chan mysqlproto.Packet) {
+	proxyEnd, backendEnd := net.Pipe()
+	t.Cleanup(func() { proxyEnd.Close() })
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ServerChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+	received := make(chan mysqlproto.Packet, 100)
+	go func() {
+		backend := mysqlproto.NewStream(backendEnd)
+		WritePacket(backend, mysqlproto.Packet{1, []byte("\xfbusers.csv")})
+		for {
+			packet, err := ReadPacket(backend)
+			if err != nil {
+				return
+			}
+			received <- packet
+			if len(packet.Payload) == 0 {
+				WritePacket(backend, OKPacket(packet.SequenceID))
+				break
+			}
+		}
+		close(received)
+	}()
+	return server, received
+}
+
+func TestHandleQueryResponse_localInfileRelay(t *testing.T) {
+	oldMode := config.LocalInfile
+	defer func() { config.LocalInfile = oldMode }()
+	config.LocalInfile = localInfileRelay
+
+	server, received := localInfileSession(t)
+	server.proxy.ServerChannel <- mysqlproto.Packet{2, []byte("1,honk\n")}
+	server.proxy.ServerChannel <- mysqlproto.Packet{3, []byte{}}
+	server.handleQueryResponse()
+
+	got := []mysqlproto.Packet{}
+	for packet := range received {
+		got = append(got, packet)
+	}
+	if len(got) != 2 || string(got[0].Payload) != "1,honk\n" || got[0].SequenceID != 2 || got[1].SequenceID != 3 {
+		t.Errorf("Bogus file sent to the server: %v", got)
+	}
+	if len(server.proxy.ClientChannel) != 2 {
+		t.Fatalf("Expected the request and an OK, got %d packets", len(server.proxy.ClientChannel))
+	}
+	request, ok := <-server.proxy.ClientChannel, <-server.proxy.ClientChannel
+	if !packetIsLocalInfileRequest(request) || request.SequenceID != 1 || !packetIsOK(ok) || ok.SequenceID != 4 {
+		t.Errorf("Bogus packets to the client: %v, %v", request, ok)
+	}
+}
+
+func TestHandleQueryResponse_localInfileBlocked(t *testing.T) {
+	oldMode := config.LocalInfile
+	defer func() { config.LocalInfile = oldMode }()
+	config.LocalInfile = localInfileBlock
+
+	server, received := localInfileSession(t)
+	server.handleQueryResponse()
+
+	if packet := <-received; len(packet.Payload) != 0 {
+		t.Errorf("Bogus file sent to the server: %v", packet)
+	}
+	if len(server.proxy.ClientChannel) != 1 {
+		t.Fatalf("Expected a single error packet, got %d packets", len(server.proxy.ClientChannel))
+	}
+	if packet := <-server.proxy.ClientChannel; !packetIsERR(packet) || packet.SequenceID != 1 {
+		t.Errorf("Bogus error packet: %v", packet)
+	}
+	if server.finished {
+		t.Error("The session should carry on after a refused file request")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// A LocalSession is a proxy session that we're the client of, for front-ends
+// that don't speak the MySQL protocol themselves. Queries go through exactly
+// the same checks and sanitization as a real client's, because they go
+// through a real ProxyConnection, just over a pipe instead of a socket.
+type LocalSession struct {
+	conn   net.Conn
+	stream *mysqlproto.Stream
+}
+
+// QueryResult is a query's result set, or its affected row count if it
+// didn't return one. NULLs are nil.
+type QueryResult struct {
+	Columns      []string
+	Rows         [][]*string
+	AffectedRows uint64
+}
+
+// OpenLocalSession starts a proxy session and logs into it as the given user.
+// The username is only used for labels and logging; the server always sees
+// MysqlUsername.
+func OpenLocalSession(ctx context.Context, username string, database string) (*LocalSession, error) {
+	clientSide, proxySide := net.Pipe()
+	proxy, err := NewProxyConnection(ctx, proxySide)
+	stats.BackendResult(err)
+	if err != nil {
+		clientSide.Close()
+		proxySide.Close()
+		return nil, NewProxyError(ErrBackendUnavailable, err, "mysql-sanitizer can't reach the MySQL server")
+	}
+	proxy.Start()
+
+	session := &LocalSession{clientSide, mysqlproto.NewStream(clientSide)}
+	if err := clientLogIn(session.stream, username, database); err != nil {
+		clientSide.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// Query runs a query and returns its (sanitized) result.
+func (session *LocalSession) Query(query string) (*QueryResult, error) {
+	return runTextQuery(session.stream, query)
+}
+
+// Close ends the session.
+func (session *LocalSession) Close() {
+	WritePacket(session.stream, mysqlproto.Packet{0, []byte{COM_QUIT}})
+	session.conn.Close()
+}
+
+// clientLogIn does the client's side of the handshake. The password doesn't
+// matter, since the proxy swaps in its own.
+func clientLogIn(stream *mysqlproto.Stream, username string, database string) error {
+	greeting, err := stream.NextPacket()
+	if err != nil {
+		return fmt.Errorf("No greeting: %s", err)
+	}
+	if packetIsERR(greeting) {
+		return fmt.Errorf("Connection refused: %s", errorPacketMessage(greeting))
+	}
+	if greeting.Payload[0] != 0x0A {
+		return fmt.Errorf("Bogus greeting: %v", greeting.Payload)
+	}
+
+	flags := mysqlproto.CLIENT_LONG_PASSWORD | mysqlproto.CLIENT_PROTOCOL_41 |
+		mysqlproto.CLIENT_SECURE_CONNECTION | mysqlproto.CLIENT_PLUGIN_AUTH
+	if database != "" {
+		flags |= mysqlproto.CLIENT_CONNECT_WITH_DB
+	}
+	response := mysqlproto.HandshakeResponse41(flags, 0x21, username, "", make([]byte, 20), database, "mysql_native_password", map[string]string{})
+	WritePacket(stream, mysqlproto.Packet{greeting.SequenceID + 1, response[4:]})
+
+	ok, err := stream.NextPacket()
+	if err != nil {
+		return fmt.Errorf("No response to handshake: %s", err)
+	}
+	if packetIsERR(ok) {
+		return fmt.Errorf("Handshake failed: %s", errorPacketMessage(ok))
+	}
+	if !packetIsOK(ok) {
+		return fmt.Errorf("Unexpected response to handshake: %v", ok.Payload)
+	}
+	return nil
+}
+
+// runTextQuery sends a query and reads back its result.
+func runTextQuery(stream *mysqlproto.Stream, query string) (*QueryResult, error) {
+	WritePacket(stream, mysqlproto.Packet{0, append([]byte{COM_QUERY}, query...)})
+
+	packet, err := stream.NextPacket()
+	if err != nil {
+		return nil, err
+	}
+	if packetIsERR(packet) {
+		return nil, fmt.Errorf("Query failed: %s", errorPacketMessage(packet))
+	}
+	if ok, err := ParseOK(packet, 0); err == nil {
+		return &QueryResult{AffectedRows: ok.AffectedRows}, nil
+	}
+
+	result := &QueryResult{Columns: []string{}, Rows: [][]*string{}}
+	columnCount := NewPacketParser(packet).ReadEncodedInt()
+	for i := uint64(0); i < columnCount; i++ {
+		packet, err := stream.NextPacket()
+		if err != nil {
+			return nil, err
+		}
+		col, err := ReadColumn(NewPacketParser(packet))
+		if err != nil {
+			return nil, err
+		}
+		result.Columns = append(result.Columns, col.Alias)
+	}
+	if _, err := stream.NextPacket(); err != nil { // EOF
+		return nil, err
+	}
+
+	for {
+		packet, err := stream.NextPacket()
+		if err != nil {
+			return nil, err
+		}
+		if packetIsERR(packet) {
+			return nil, fmt.Errorf("Result set failed: %s", errorPacketMessage(packet))
+		}
+		if packetIsEOF(packet) {
+			return result, nil
+		}
+
+		parser := NewPacketParser(packet)
+		row := []*string{}
+		for i := uint64(0); i < columnCount; i++ {
+			value, nonNull := parser.ReadStringOrNull()
+			if nonNull {
+				row = append(row, &value)
+			} else {
+				row = append(row, nil)
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+}
@@ -1,41 +1,367 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var output Output
 var config Config
 var whitelist Whitelist
+var hasher Hasher
+var kdf *KdfHasher
+var identifierGroups IdentifierGroups
+var cardColumns ColumnSet
+var phoneColumns ColumnSet
+var ipColumns ColumnSet
+var ipAnonymizer *CryptoPAn
+var urlColumns ColumnSet
+var urlParams map[string]bool
+var scrubber *Scrubber
+var piiDiscovery *PIIDiscovery
+var preserveEmptyColumns ColumnSet
+var nullEmptyColumns ColumnSet
+var paginationKeys map[string]string
+var catalog *Catalog
+var rewriter *Rewriter
+var sampler *Sampler
+var admission *AdmissionControl
+var deduper *QueryDeduper
+var dlpScanner *DLPScanner
+var clock = time.Now
+var balancer *Balancer
+var rowRules []compiledRowRule
+var columnRules ColumnRules
+var canary *Canary
+var recordings *RecordingArchive
+var queryFilter *QueryFilter
 
 func init() {
 	var err error
 
 	config = GetConfig()
 	output = NewOutput(config)
+	if config.TestMode {
+		output.Log("Test mode: hashing with a published salt, and the clock stopped at %s", testModeTime.Format(time.RFC3339))
+	}
+	verifyFIPSMode()
 	whitelist, err = NewWhitelist(config.WhitelistFile)
 	if err != nil {
 		log.Fatalf("Error reading whitelist file %s: %s", config.WhitelistFile, err)
 	}
+	logWhitelistActivation()
+	setCredentials(Credentials{config.MysqlUsername, config.MysqlPassword})
+	if config.CredentialsFile != "" {
+		if config.CredentialsInterval < 1 {
+			log.Fatal("CredentialsInterval must be at least 1")
+		}
+		credentials, err := loadCredentialsFile(config.CredentialsFile)
+		if err != nil {
+			log.Fatalf("Can't load credentials from %s: %s", config.CredentialsFile, err)
+		}
+		setCredentials(credentials)
+	}
+	if config.PolicyReport != "" && !policyReportFormats[config.PolicyReport] {
+		log.Fatalf("Unknown policy report format '%s' (expected markdown, html or csv)", config.PolicyReport)
+	}
+	if !checkBudgetPolicy(config.Budget.Policy) {
+		log.Fatalf("Unknown Budget.Policy '%s' (expected throttle or terminate)", config.Budget.Policy)
+	}
+	if !checkSlowClientPolicy(config.SlowClientPolicy) {
+		log.Fatalf("Unknown SlowClientPolicy '%s' (expected throttle or evict)", config.SlowClientPolicy)
+	}
+	admission, err = NewAdmissionControl(config.Admission)
+	if err != nil {
+		log.Fatalf("Bad Admission configuration: %s", err)
+	}
+	deduper = NewQueryDeduper(config.DedupQueries, config.DedupMaxBytes)
+	if err := checkDLPConfig(config.DLP); err != nil {
+		log.Fatalf("Bad DLP configuration: %s", err)
+	}
+	dlpScanner = NewDLPScanner(config.DLP)
+	if config.MysqlSocket != "" && (len(config.MysqlHosts) > 0 || len(config.StandbyHosts) > 0) {
+		log.Fatalf("MysqlSocket can't be combined with MysqlHosts or StandbyHosts")
+	}
+	if err := checkWatermarkConfig(config.Watermark); err != nil {
+		log.Fatalf("Bad Watermark configuration: %s", err)
+	}
+	if err := checkAdminAPIConfig(); err != nil {
+		log.Fatalf("Bad AdminAPI configuration: %s", err)
+	}
+	hosts := config.MysqlHosts
+	if len(hosts) == 0 && len(config.StandbyHosts) > 0 {
+		hosts = []string{net.JoinHostPort(config.MysqlHost, strconv.Itoa(config.MysqlPort))}
+	}
+	balancer, err = NewBalancer(hosts, config.StandbyHosts, config.BalancePolicy, config.BackendRetryInterval)
+	if err != nil {
+		log.Fatalf("Bad MysqlHosts configuration: %s", err)
+	}
+	sha256Implementation, err := chooseSHA256(config.SHA256Implementation, config.FIPSMode)
+	if err != nil {
+		log.Fatalf("Bad SHA256Implementation configuration: %s", err)
+	}
+	setSHA256(sha256Implementation)
+	if !checkCompatibilityMode(config.CompatibilityCheck) {
+		log.Fatalf("Bad CompatibilityCheck configuration: expected warn, require or off, not '%s'", config.CompatibilityCheck)
+	}
+	if !checkLocalInfileMode(config.LocalInfile) {
+		log.Fatalf("Bad LocalInfile configuration: expected block or relay, not '%s'", config.LocalInfile)
+	}
+	if config.AcceptWorkers < 1 {
+		log.Fatal("AcceptWorkers must be at least 1")
+	}
+	for username, width := range config.MaxColumnWidth {
+		if width < 0 {
+			log.Fatalf("Bad MaxColumnWidth configuration: %s's width can't be negative", username)
+		}
+	}
+	warnAboutColumnWidths()
+	output.Debug("Using the %s SHA-256 implementation", sha256Implementation)
+	mysqlServerPublicKey, err = loadServerPublicKey(config.MysqlServerPublicKey)
+	if err != nil {
+		log.Fatalf("Bad MysqlServerPublicKey configuration: %s", err)
+	}
+	hasher, err = NewHasher(config.HashAlgorithm)
+	if err != nil {
+		log.Fatalf("Bad HashAlgorithm configuration: %s", err)
+	}
+	recordings, err = NewRecordingArchive(config.Recording)
+	if err != nil {
+		log.Fatalf("Bad Recording configuration: %s", err)
+	}
+	warnAboutWriteAudit()
+	kdf, err = NewKdfHasher(config.Kdf)
+	if err != nil {
+		log.Fatalf("Bad Kdf configuration: %s", err)
+	}
+	identifierGroups, err = NewIdentifierGroups(config.IdentifierGroups, config.HashSaltBytes)
+	if err != nil {
+		log.Fatalf("Bad IdentifierGroups configuration: %s", err)
+	}
+	cardColumns, err = NewColumnSet(config.CardColumns)
+	if err != nil {
+		log.Fatalf("Bad CardColumns configuration: %s", err)
+	}
+	phoneColumns, err = NewColumnSet(config.PhoneColumns)
+	if err != nil {
+		log.Fatalf("Bad PhoneColumns configuration: %s", err)
+	}
+	ipColumns, err = NewColumnSet(config.IPColumns)
+	if err != nil {
+		log.Fatalf("Bad IPColumns configuration: %s", err)
+	}
+	ipKey := sha256.Sum256(config.HashSaltBytes)
+	ipAnonymizer, err = NewCryptoPAn(ipKey[:])
+	if err != nil {
+		log.Fatalf("Can't set up IP address pseudonymization: %s", err)
+	}
+	urlColumns, err = NewColumnSet(config.URLColumns)
+	if err != nil {
+		log.Fatalf("Bad URLColumns configuration: %s", err)
+	}
+	urlParams = map[string]bool{}
+	for _, param := range config.URLParams {
+		urlParams[param] = true
+	}
+	scrubber, err = NewScrubber(config.Scrub)
+	if err != nil {
+		log.Fatalf("Bad Scrub configuration: %s", err)
+	}
+	piiDiscovery = NewPIIDiscovery(config.PIIDiscoverySampleRate)
+	preserveEmptyColumns, err = NewColumnSet(config.PreserveEmptyColumns)
+	if err != nil {
+		log.Fatalf("Bad PreserveEmptyColumns configuration: %s", err)
+	}
+	nullEmptyColumns, err = NewColumnSet(config.NullEmptyColumns)
+	if err != nil {
+		log.Fatalf("Bad NullEmptyColumns configuration: %s", err)
+	}
+	paginationKeys, err = newPaginationKeys(config.PaginationColumns)
+	if err != nil {
+		log.Fatalf("Bad PaginationColumns configuration: %s", err)
+	}
+	if config.PaginationChunkSize < 1 {
+		log.Fatal("PaginationChunkSize must be at least 1")
+	}
+	rewriter, err = NewRewriter(config.RewriteRules)
+	if err != nil {
+		log.Fatalf("Bad RewriteRules configuration: %s", err)
+	}
+	queryFilter, err = NewQueryFilter(config.QueryFilter)
+	if err != nil {
+		log.Fatalf("Bad QueryFilter configuration: %s", err)
+	}
+	sampler, err = NewSampler(config.SampledTables, config.HashSaltBytes)
+	if err != nil {
+		log.Fatalf("Bad SampledTables configuration: %s", err)
+	}
+	columnRules, err = NewColumnRules(config.Rules, config.PatternRules)
+	if err != nil {
+		log.Fatalf("Bad rules configuration: %s", err)
+	}
+	canary, err = NewCanary(config.Canary, &RuleSet{Version: config.RulesVersion, Rules: columnRules})
+	if err != nil {
+		log.Fatalf("Bad Canary configuration: %s", err)
+	}
+	rowRules, err = NewRowRules(config.RowRules)
+	if err != nil {
+		log.Fatalf("Bad RowRules configuration: %s", err)
+	}
+	catalog = NewCatalog(config.Catalog)
+	if config.Catalog.URL != "" && config.Catalog.Interval < 1 {
+		log.Fatal("Catalog.Interval must be at least 1")
+	}
+	if config.Catalog.URL != "" {
+		// Without the catalog, columns it marks as sensitive might be
+		// whitelisted, so refuse to start rather than risk that.
+		if err := catalog.Refresh(); err != nil {
+			log.Fatalf("Can't load catalog tags from %s: %s", config.Catalog.URL, err)
+		}
+	}
 }
 
 func main() {
+	if config.SelfTest {
+		if !runSelfTest() {
+			os.Exit(1)
+		}
+		return
+	}
+	if config.REPL {
+		if err := RunREPL(os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if config.ReadRecording != "" {
+		if recordings == nil {
+			log.Fatal("Reading a transcript needs the Recording section of the config")
+		}
+		if err := recordings.Read(config.ReadRecording, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if config.VerifyWatermark != "" {
+		file, err := os.Open(config.VerifyWatermark)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		if err := VerifyWatermark(file, os.Stdout, strings.Split(config.WatermarkProfiles, ",")); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if config.PolicyReport != "" {
+		columns, err := fetchSchema()
+		if err != nil {
+			log.Fatalf("Can't read the schema from %s: %s", config.MysqlHost, err)
+		}
+		if err := WritePolicyReport(os.Stdout, config.PolicyReport, columns); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := checkCompatibility(config.CompatibilityCheck); err != nil {
+		log.Fatal(err)
+	}
 	listener := openListeningSocket(config.ListeningPort)
+	go handleModeSignals()
+	if config.XProtocolPort > 0 {
+		go ServeXProtocolPort(openListeningSocket(config.XProtocolPort))
+	}
+	if config.PIIDiscoveryInterval > 0 {
+		go piiDiscovery.RunReports(time.Duration(config.PIIDiscoveryInterval) * time.Second)
+	}
+	if config.WarmConnections > 0 {
+		serverPool = NewServerPool(config.WarmConnections)
+		go serverPool.Fill()
+	}
+	if config.CredentialsFile != "" {
+		go WatchCredentialsFile(config.CredentialsFile, time.Duration(config.CredentialsInterval)*time.Second)
+	}
+	if recordings != nil {
+		go recordings.RunPruning(time.Hour)
+	}
+	if config.SchemaWatchInterval > 0 {
+		schemaWatcher = NewSchemaWatcher()
+		go schemaWatcher.Run(time.Duration(config.SchemaWatchInterval) * time.Second)
+	}
+	if dlpScanner != nil {
+		dlpScanner.Run()
+	}
+	if config.Catalog.URL != "" {
+		go catalog.RunRefreshes(time.Duration(config.Catalog.Interval) * time.Second)
+	}
 
-	for {
-		conn, err := listener.Accept()
+	// Every connection hangs off this context, so cancelling it on shutdown
+	// closes them all.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		setListenerReady(false)
+		listener.Close()
+	}()
+	if config.PostgresPort > 0 {
+		go ServePostgresPort(ctx, openListeningSocket(config.PostgresPort))
+	}
+	if config.HTTPGatewayPort > 0 {
+		go ServeHTTPGateway(ctx, config.HTTPGatewayPort)
+	}
+	if config.HealthPort > 0 {
+		checker := NewHealthChecker(time.Duration(config.HealthCacheSeconds) * time.Second)
+		go ServeHealth(ctx, config.HealthPort, checker)
+	}
+	if config.AdminAPIPort > 0 {
+		go ServeAdminAPI(ctx, config.AdminAPIBind, config.AdminAPIPort)
+	}
+	if config.HandoffSocket != "" {
+		handoffListener, err := listenForHandoffs(config.HandoffSocket)
 		if err != nil {
-			log.Fatalf("Can't accept incoming connection on port %d: %s", config.ListeningPort, err)
+			log.Fatalf("Can't listen for session hand-offs on %s: %s", config.HandoffSocket, err)
 		}
+		go ServeHandoffs(ctx, handoffListener)
+	}
+	setListenerReady(true)
 
-		proxy, err := NewProxyConnection(conn)
-		if err == nil {
-			proxy.Start()
-		} else {
-			output.Log("Can't open connection to %s: %s", config.MysqlHost, err)
+	handle := func(conn net.Conn) { handleConnection(ctx, conn) }
+	if err := acceptConnections(ctx, listener, config.AcceptWorkers, handle); err != nil {
+		log.Fatalf("Can't accept incoming connection on port %d: %s", config.ListeningPort, err)
+	}
+	output.Log("Shutting down")
+}
+
+// handleConnection sets up a session for a new client, or tells it why not.
+func handleConnection(ctx context.Context, conn net.Conn) {
+	if config.MaxConnections > 0 {
+		if !stats.ReserveSession(config.MaxConnections) {
+			output.Log("Turning away client from %s: already at MaxConnections (%d)", conn.RemoteAddr(), config.MaxConnections)
+			go RefuseConnection(conn, NewProxyError(ErrOverloaded, nil, "Too many connections"))
+			return
 		}
+		defer stats.ReleaseSession() // The session counts itself once it's open
+	}
+
+	proxy, err := NewProxyConnection(ctx, conn)
+	stats.BackendResult(err)
+	if err == nil {
+		proxy.Start()
+	} else {
+		output.Log("Can't open connection to %s: %s", config.MysqlHost, err)
+		go RefuseConnection(conn, backendUnavailable(err))
 	}
 }
 
@@ -48,3 +374,14 @@ func openListeningSocket(port int) net.Listener {
 	}
 	return listener
 }
+
+// The whitelist is only ever loaded at startup, so that's the one place we
+// can record which version is in effect and who put it there.
+func logWhitelistActivation() {
+	username := "unknown"
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+	output.Audit("Activated whitelist version %s from %s (%s) as user %s",
+		whitelist.Version(), config.WhitelistFile, whitelist.Summary(), username)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"unicode/utf8"
+)
+
+// A MaskStrategy turns a value from a column that isn't safe into something
+// we can send to the client. Column rules pick which one a column gets.
+type MaskStrategy interface {
+	Mask(value []byte, col Column) ([]byte, error)
+}
+
+// PassMask sends the real value.
+type PassMask struct{}
+
+// HashMask sanitizes the value like any non-whitelisted column (hashing it,
+// or masking it in a format-preserving way for card numbers and such).
+type HashMask struct{}
+
+// RedactMask replaces the value with a fixed string, truncated to fit.
+type RedactMask struct {
+	Replacement string
+}
+
+// EmailMask replaces email addresses with "<hash>@example.com", and hashes
+// anything that isn't one.
+type EmailMask struct{}
+
+// PhoneMask masks phone numbers the way PhoneColumns does, keeping their
+// punctuation and length, and hashes anything that isn't one.
+type PhoneMask struct{}
+
+// FakeMask replaces the value with a made-up one of the given kind ("name",
+// "address", or "company"), truncated to fit.
+type FakeMask struct {
+	Kind string
+}
+
+// NullMask replaces the value with NULL.
+type NullMask struct{}
+
+// PartialMask keeps the last Reveal characters and stars out the rest, so
+// people can still tell which card or account they're looking at. Values
+// that short get starred out completely.
+type PartialMask struct {
+	Reveal int
+}
+
+// The last four is the usual amount for card and account numbers.
+const partialRevealLength = 4
+
+var maskStrategies = map[string]MaskStrategy{
+	rulePass:        PassMask{},
+	ruleHash:        HashMask{},
+	ruleRedact:      RedactMask{redactedValue},
+	ruleNull:        NullMask{},
+	rulePartial:     PartialMask{partialRevealLength},
+	ruleEmail:       EmailMask{},
+	rulePhone:       PhoneMask{},
+	ruleFakeName:    FakeMask{"name"},
+	ruleFakeAddress: FakeMask{"address"},
+	ruleFakeCompany: FakeMask{"company"},
+}
+
+// maskStrategyFor returns the strategy for a column rule action. Columns
+// with no rule get hashed, and so do ones whose "pass" rule got overridden
+// by force-sanitize mode or the catalog.
+func maskStrategyFor(action string) MaskStrategy {
+	if action == ruleNone || action == rulePass {
+		return maskStrategies[ruleHash]
+	}
+	return maskStrategies[action]
+}
+
+func (PassMask) Mask(value []byte, col Column) ([]byte, error) {
+	return value, nil
+}
+
+func (HashMask) Mask(value []byte, col Column) ([]byte, error) {
+	return sanitizeRow(value, col)
+}
+
+func (mask RedactMask) Mask(value []byte, col Column) ([]byte, error) {
+	masked := []byte(mask.Replacement)
+	if uint32(len(masked)) > col.Length {
+		masked = masked[:col.Length]
+	}
+	return masked, nil
+}
+
+func (EmailMask) Mask(value []byte, col Column) ([]byte, error) {
+	if masked, ok := maskEmail(value, config.HashSaltBytes, col.Length); ok {
+		return masked, nil
+	}
+	return sanitizeRow(value, col)
+}
+
+func (PhoneMask) Mask(value []byte, col Column) ([]byte, error) {
+	if masked, ok := maskPhoneNumber(value, config.HashSaltBytes); ok {
+		return masked, nil
+	}
+	return sanitizeRow(value, col)
+}
+
+func (mask FakeMask) Mask(value []byte, col Column) ([]byte, error) {
+	masked := fakeValue(mask.Kind, value, config.HashSaltBytes)
+	if uint32(len(masked)) > col.Length {
+		masked = masked[:col.Length]
+	}
+	return masked, nil
+}
+
+func (NullMask) Mask(value []byte, col Column) ([]byte, error) {
+	return nil, nil
+}
+
+func (mask PartialMask) Mask(value []byte, col Column) ([]byte, error) {
+	// Count characters rather than bytes, so we don't cut a multibyte
+	// character in half. Stars are never longer than what they replace.
+	hidden := utf8.RuneCount(value) - mask.Reveal
+	if hidden <= 0 {
+		hidden = utf8.RuneCount(value)
+	}
+
+	masked := []byte{}
+	offset := 0
+	for i := 0; i < hidden; i++ {
+		_, size := utf8.DecodeRune(value[offset:])
+		offset += size
+		masked = append(masked, '*')
+	}
+	return append(masked, value[offset:]...), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestPartialMask(t *testing.T) {
+	col := Column{true, "honk", "bonk", "card", "card", 255, 0, 0, nil, "", false, nil}
+	for value, expected := range map[string]string{
+		"4111111111111111": "************1111",
+		"héllo wörld":      "*******örld",
+		"1234":             "****",
+		"":                 "",
+	} {
+		masked, err := PartialMask{4}.Mask([]byte(value), col)
+		if err != nil {
+			t.Fatalf("PartialMask failed: %s", err)
+		}
+		if string(masked) != expected {
+			t.Errorf("Bogus partial mask of '%s': '%s' instead of '%s'", value, masked, expected)
+		}
+	}
+}
+
+func TestMaskStrategyFor(t *testing.T) {
+	col := Column{true, "honk", "bonk", "blarp", "blarp", 5, 0, 0, nil, "", false, nil}
+
+	redacted, _ := maskStrategyFor(ruleRedact).Mask([]byte("secret"), col)
+	if string(redacted) != "REDAC" {
+		t.Errorf("Bogus redaction: '%s'", redacted)
+	}
+	if nulled, _ := maskStrategyFor(ruleNull).Mask([]byte("secret"), col); nulled != nil {
+		t.Errorf("Bogus null mask: '%s'", nulled)
+	}
+	if _, ok := maskStrategyFor(rulePass).(HashMask); !ok {
+		t.Error("Overridden pass rules should still get hashed")
+	}
+	if _, ok := maskStrategyFor(ruleNone).(HashMask); !ok {
+		t.Error("Columns without rules should get hashed")
+	}
+}
+
+func TestFakeMask(t *testing.T) {
+	col := Column{true, "honk", "bonk", "name", "name", 255, 0, 0, nil, "", false, nil}
+	name, _ := FakeMask{"name"}.Mask([]byte("Jane Q. Public"), col)
+	again, _ := FakeMask{"name"}.Mask([]byte("Jane Q. Public"), col)
+	if string(name) != string(again) || string(name) == "Jane Q. Public" || len(name) == 0 {
+		t.Errorf("Bogus fake names: '%s', '%s'", name, again)
+	}
+
+	address, _ := FakeMask{"address"}.Mask([]byte("1600 Pennsylvania Ave"), col)
+	if !regexp.MustCompile(`^\d+ \w+ \w+, \w+$`).Match(address) {
+		t.Errorf("Bogus fake address: '%s'", address)
+	}
+	company, _ := FakeMask{"company"}.Mask([]byte("Honk Industries"), col)
+	if len(company) == 0 {
+		t.Error("Bogus fake company")
+	}
+
+	col.Length = 4
+	short, _ := FakeMask{"name"}.Mask([]byte("Jane Q. Public"), col)
+	if len(short) != 4 {
+		t.Errorf("Fake names should be truncated to fit: '%s'", short)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// The proxy-wide operating modes, for incident response when we suspect the
+// whitelist or config is letting something through.
+const (
+	modeNormal        int32 = 0 // Business as usual
+	modeLockdown      int32 = 1 // Reject every query
+	modeForceSanitize int32 = 2 // Sanitize every column, whitelisted or not
+)
+
+var modeNames = map[int32]string{
+	modeNormal:        "normal",
+	modeLockdown:      "lockdown",
+	modeForceSanitize: "force-sanitize",
+}
+
+var proxyMode int32 = modeNormal
+
+func currentMode() int32 {
+	return atomic.LoadInt32(&proxyMode)
+}
+
+func setMode(mode int32) {
+	atomic.StoreInt32(&proxyMode, mode)
+}
+
+// toggleMode switches into the given mode, or back to normal if we're
+// already in it, and returns the new mode.
+func toggleMode(mode int32) int32 {
+	for {
+		old := currentMode()
+		next := mode
+		if old == mode {
+			next = modeNormal
+		}
+		if atomic.CompareAndSwapInt32(&proxyMode, old, next) {
+			return next
+		}
+	}
+}
+
+// handleModeSignals flips modes when we get SIGUSR1 (lockdown) or SIGUSR2
+// (force-sanitize). Sending the same signal again goes back to normal.
+func handleModeSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for sig := range signals {
+		var mode int32
+		if sig == syscall.SIGUSR1 {
+			mode = toggleMode(modeLockdown)
+		} else {
+			mode = toggleMode(modeForceSanitize)
+		}
+		output.Audit("Got %s, now in %s mode", sig, modeNames[mode])
+	}
+}
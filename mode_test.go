@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestToggleMode(t *testing.T) {
+	defer setMode(modeNormal)
+
+	if toggleMode(modeLockdown) != modeLockdown || currentMode() != modeLockdown {
+		t.Errorf("Didn't switch into lockdown mode: %d", currentMode())
+	}
+	if toggleMode(modeForceSanitize) != modeForceSanitize {
+		t.Errorf("Didn't switch from lockdown to force-sanitize mode: %d", currentMode())
+	}
+	if toggleMode(modeForceSanitize) != modeNormal {
+		t.Errorf("Didn't switch back to normal mode: %d", currentMode())
+	}
+}
+
+func TestColumnIsSafe_ForceSanitize(t *testing.T) {
+	defer setMode(modeNormal)
+	setMode(modeForceSanitize)
+
+	column := Column{false, "honk", "bonk", "blarp", "woopwoop", 255, 0, 0, nil, "", false, nil}
+	if column.IsSafe() {
+		t.Error("Non-string columns shouldn't be safe in force-sanitize mode!")
+	}
+	column = Column{true, "some_db", "table2", "bonk", "bonk", 255, 0, 0, nil, "", false, nil}
+	if column.IsSafe() {
+		t.Error("Whitelisted columns shouldn't be safe in force-sanitize mode!")
+	}
+}
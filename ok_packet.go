@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// OK packets say more than "it worked": how many rows a write touched, the
+// AUTO_INCREMENT value it generated, the transaction status, and sometimes
+// an info string like "Rows matched: 3  Changed: 2  Warnings: 0". We used to
+// guess whether something was an OK packet from its length; now we parse
+// the whole thing so the budget, recordings and stats can use the numbers.
+
+// Server status flags from OK and EOF packets.
+const (
+	SERVER_STATUS_IN_TRANS       uint16 = 0x0001
+	SERVER_STATUS_AUTOCOMMIT     uint16 = 0x0002
+	SERVER_MORE_RESULTS_EXISTS   uint16 = 0x0008
+	SERVER_STATUS_CURSOR_EXISTS  uint16 = 0x0040
+	SERVER_SESSION_STATE_CHANGED uint16 = 0x4000
+)
+
+// OKResult is the contents of an OK packet.
+type OKResult struct {
+	AffectedRows uint64
+	LastInsertID uint64
+	StatusFlags  uint16
+	Warnings     uint16
+	Info         string
+	SessionState []byte // Only with CLIENT_SESSION_TRACK, and we don't look inside
+}
+
+// ParseOK parses an OK packet, given the capability flags the session
+// negotiated. Like everywhere else, we assume CLIENT_PROTOCOL_41.
+func ParseOK(packet mysqlproto.Packet, capabilities uint32) (OKResult, error) {
+	var ok OKResult
+	if len(packet.Payload) == 0 || packet.Payload[0] != 0x00 {
+		return ok, NewProxyError(ErrProtocol, nil, "Not an OK packet")
+	}
+	parser := NewPacketParser(packet)
+	parser.ReadFixedInt1() // header
+
+	if !parser.EncodedIntFits() {
+		return ok, NewProxyError(ErrProtocol, nil, "OK packet is missing its affected row count")
+	}
+	ok.AffectedRows = parser.ReadEncodedInt()
+	if !parser.EncodedIntFits() {
+		return ok, NewProxyError(ErrProtocol, nil, "OK packet is missing its last insert ID")
+	}
+	ok.LastInsertID = parser.ReadEncodedInt()
+	if parser.Remaining() < 4 {
+		return ok, NewProxyError(ErrProtocol, nil, "OK packet is missing its status flags")
+	}
+	ok.StatusFlags = parser.ReadFixedInt2()
+	ok.Warnings = parser.ReadFixedInt2()
+
+	if capabilities&mysqlproto.CLIENT_SESSION_TRACK == 0 {
+		// The info string is just whatever's left.
+		ok.Info = parser.ReadFixedString(parser.Remaining())
+		return ok, nil
+	}
+
+	// With session tracking it's length-encoded, and may be left out
+	// entirely if there's nothing else.
+	if parser.Remaining() == 0 {
+		return ok, nil
+	}
+	info, err := readOKString(parser)
+	if err != nil {
+		return ok, NewProxyError(ErrProtocol, err, "OK packet has a bogus info string")
+	}
+	ok.Info = info
+	if ok.StatusFlags&SERVER_SESSION_STATE_CHANGED != 0 {
+		state, err := readOKString(parser)
+		if err != nil {
+			return ok, NewProxyError(ErrProtocol, err, "OK packet has bogus session state changes")
+		}
+		ok.SessionState = []byte(state)
+	}
+	return ok, nil
+}
+
+// readOKString is ReadVariableString, but an error instead of a panic if
+// the length doesn't fit.
+func readOKString(parser *PacketParser) (string, error) {
+	if !parser.EncodedIntFits() {
+		return "", fmt.Errorf("Bad length")
+	}
+	length := parser.ReadEncodedInt()
+	if length > parser.Remaining() {
+		return "", fmt.Errorf("Length %d runs past the end of the packet", length)
+	}
+	return parser.ReadFixedString(length), nil
+}
+
+// ParseOK parses an OK packet from the server with the session's
+// capabilities.
+func (proxy *ProxyConnection) ParseOK(packet mysqlproto.Packet) (OKResult, error) {
+	return ParseOK(packet, proxy.Capabilities)
+}
+
+// deprecateEOF returns whether the session negotiated CLIENT_DEPRECATE_EOF,
+// which takes the EOF out from after a result set's column definitions and
+// ends its rows with an OK (with an EOF header) instead of an EOF.
+func (proxy *ProxyConnection) deprecateEOF() bool {
+	return proxy.Capabilities&mysqlproto.CLIENT_DEPRECATE_EOF != 0
+}
+
+// parseRowsEnd parses the OK that ends a result set's rows with
+// CLIENT_DEPRECATE_EOF. Apart from the header, it's an OK like any other.
+func (proxy *ProxyConnection) parseRowsEnd(packet mysqlproto.Packet) (OKResult, error) {
+	if !proxy.deprecateEOF() || !packetEndsRows(packet) {
+		return OKResult{}, NewProxyError(ErrProtocol, nil, "Not the end of a result set")
+	}
+	return proxy.ParseOK(mysqlproto.Packet{packet.SequenceID, append([]byte{0x00}, packet.Payload[1:]...)})
+}
+
+// statusFlags returns the server status flags on an OK, an EOF, or the OK
+// that ends a result set with CLIENT_DEPRECATE_EOF, or false if the packet
+// doesn't have any.
+func (proxy *ProxyConnection) statusFlags(packet mysqlproto.Packet) (uint16, bool) {
+	if ok, err := proxy.ParseOK(packet); err == nil {
+		return ok.StatusFlags, true
+	} else if ok, err := proxy.parseRowsEnd(packet); err == nil {
+		return ok.StatusFlags, true
+	} else if packetIsEOF(packet) && len(packet.Payload) >= 5 {
+		return uint16(packet.Payload[3]) | uint16(packet.Payload[4])<<8, true
+	}
+	return 0, false
+}
+
+// moreResults returns whether the server has another result to send after
+// the one this packet ends, as it does for multiple statements and for
+// CALLs.
+func (proxy *ProxyConnection) moreResults(packet mysqlproto.Packet) bool {
+	flags, ok := proxy.statusFlags(packet)
+	return ok && flags&SERVER_MORE_RESULTS_EXISTS != 0
+}
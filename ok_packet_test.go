@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestParseOK(t *testing.T) {
+	// 3 affected rows, insert ID 300 (0xFC-encoded), in a transaction with
+	// autocommit, 1 warning, and an info string.
+	payload := []byte{0x00, 3, 0xFC, 0x2C, 0x01, 0x03, 0x00, 0x01, 0x00}
+	payload = append(payload, "Rows matched: 3  Changed: 3  Warnings: 1"...)
+	ok, err := ParseOK(mysqlproto.Packet{1, payload}, 0)
+	if err != nil {
+		t.Fatalf("ParseOK failed: %s", err)
+	}
+	expected := OKResult{3, 300, SERVER_STATUS_IN_TRANS | SERVER_STATUS_AUTOCOMMIT, 1, "Rows matched: 3  Changed: 3  Warnings: 1", nil}
+	if ok.AffectedRows != expected.AffectedRows || ok.LastInsertID != expected.LastInsertID ||
+		ok.StatusFlags != expected.StatusFlags || ok.Warnings != expected.Warnings || ok.Info != expected.Info {
+		t.Errorf("Bogus OK packet contents: %+v", ok)
+	}
+
+	if ok, err := ParseOK(OKPacket(0), 0); err != nil || ok.StatusFlags != SERVER_STATUS_AUTOCOMMIT || ok.Info != "" {
+		t.Errorf("Bogus contents for our own OK packet: %+v (%v)", ok, err)
+	}
+}
+
+func TestParseOK_sessionTrack(t *testing.T) {
+	payload := []byte{0x00, 0, 0, 0x02, 0x40, 0x00, 0x00, 4, 'h', 'o', 'n', 'k', 2, 0x01, 0x00}
+	ok, err := ParseOK(mysqlproto.Packet{1, payload}, mysqlproto.CLIENT_SESSION_TRACK)
+	if err != nil || ok.Info != "honk" || string(ok.SessionState) != "\x01\x00" {
+		t.Errorf("Bogus OK packet contents with session tracking: %+v (%v)", ok, err)
+	}
+
+	// Nothing after the warnings is fine too.
+	if _, err := ParseOK(OKPacket(0), mysqlproto.CLIENT_SESSION_TRACK); err != nil {
+		t.Errorf("ParseOK failed on a minimal OK packet: %s", err)
+	}
+}
+
+func TestParseOK_bogus(t *testing.T) {
+	bogus := [][]byte{
+		{0x00},
+		{0x00, 0x00, 0x00, 0x02, 0x00, 0x00},
+		{0x00, 0xFC, 0x01},
+		{0x00, 0xFB, 0x03, 'h', 'o', 'n', 'k', 'x'},
+		{0xFE, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00},
+	}
+	for _, payload := range bogus {
+		if _, err := ParseOK(mysqlproto.Packet{1, payload}, 0); err == nil {
+			t.Errorf("Bogus OK packet %v should be an error", payload)
+		}
+		if packetIsOK(mysqlproto.Packet{1, payload}) {
+			t.Errorf("Bogus OK packet %v shouldn't count as OK", payload)
+		}
+	}
+
+	payload := []byte{0x00, 0, 0, 0x02, 0x00, 0x00, 0x00, 10, 'h', 'o', 'n', 'k'}
+	if _, err := ParseOK(mysqlproto.Packet{1, payload}, mysqlproto.CLIENT_SESSION_TRACK); err == nil {
+		t.Errorf("OK packet with an overlong info string should be an error")
+	}
+}
@@ -1,41 +1,184 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"log/syslog"
 	"os"
+	"strings"
+	"time"
 )
 
 const (
+	logLevelAudit   = -1
 	logLevelNormal  = 0
 	logLevelVerbose = 1
 	logLevelDebug   = 2
 	logLevelDump    = 3
 )
 
-// Output is just a wrapper around log.Logger.
+// LogSinkConfig describes an extra place to send log messages, on top of
+// LogFile.
+type LogSinkConfig struct {
+	Type string // "text", "json", "syslog", or "audit"
+	Path string // The file to write to (not used for syslog)
+}
+
+// A LogEntry is a single message on its way to the sinks.
+type LogEntry struct {
+	Time    time.Time
+	Level   int
+	Message string
+	Labels  map[string]string
+}
+
+// An OutputSink is somewhere log messages end up.
+type OutputSink interface {
+	Write(entry LogEntry)
+}
+
+// SinkFunc lets an ordinary function be a sink, for metrics hooks and the
+// like.
+type SinkFunc func(entry LogEntry)
+
+func (f SinkFunc) Write(entry LogEntry) {
+	f(entry)
+}
+
+// Output sends every message that's within the verbosity level to all of
+// its sinks. Audit messages always go through.
 type Output struct {
-	Logger *log.Logger
+	Sinks  []OutputSink
 	Level  int
+	Labels map[string]string // Attached to every message
 }
 
 // NewOutput returns a new Output object.
 func NewOutput(config Config) (out Output) {
-	var fileHandle io.Writer
+	out.Sinks = []OutputSink{newTextSink(openLogFile(config.LogFile))}
+	out.Level = config.LogLevel
 
-	if config.LogFile != "-" {
-		file, err := os.OpenFile(config.LogFile, os.O_WRONLY|os.O_CREATE, 0644)
+	for _, sinkConfig := range config.LogSinks {
+		sink, err := newOutputSink(sinkConfig)
 		if err != nil {
-			log.Fatalf("Can't open logfile %s: %s", config.LogFile, err)
+			log.Fatalf("Bad LogSinks configuration: %s", err)
 		}
-		fileHandle = file
-	} else {
-		fileHandle = os.Stdout
+		out.Sinks = append(out.Sinks, sink)
 	}
+	return out
+}
 
-	out.Logger = log.New(fileHandle, "", log.Ldate|log.Lmicroseconds|log.LUTC)
-	out.Level = config.LogLevel
+func newOutputSink(sinkConfig LogSinkConfig) (OutputSink, error) {
+	switch sinkConfig.Type {
+	case "text":
+		return newTextSink(openLogFile(sinkConfig.Path)), nil
+	case "json":
+		return newJSONSink(openLogFile(sinkConfig.Path), false), nil
+	case "audit":
+		return newJSONSink(openLogFile(sinkConfig.Path), true), nil
+	case "syslog":
+		writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "mysql-sanitizer")
+		if err != nil {
+			return nil, fmt.Errorf("Can't connect to syslog: %s", err)
+		}
+		return syslogSink{writer}, nil
+	}
+	return nil, fmt.Errorf("Unknown log sink type '%s'", sinkConfig.Type)
+}
+
+func openLogFile(path string) io.Writer {
+	if path == "-" {
+		return os.Stdout
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("Can't open logfile %s: %s", path, err)
+	}
+	return file
+}
+
+// textSink writes messages the way we always have.
+type textSink struct {
+	logger *log.Logger
+}
+
+func newTextSink(writer io.Writer) textSink {
+	return textSink{log.New(writer, "", log.Ldate|log.Lmicroseconds|log.LUTC)}
+}
+
+func (sink textSink) Write(entry LogEntry) {
+	message := entry.Message
+	if entry.Level == logLevelAudit {
+		message = "AUDIT: " + message
+	}
+	if len(entry.Labels) > 0 {
+		message += " [" + strings.Join(formatLabels(entry.Labels), " ") + "]"
+	}
+	sink.logger.Print(message)
+}
+
+// jsonSink writes one JSON object per message, for log shippers. In audit
+// mode, it ignores everything but audit messages.
+type jsonSink struct {
+	logger    *log.Logger
+	auditOnly bool
+}
+
+func newJSONSink(writer io.Writer, auditOnly bool) jsonSink {
+	return jsonSink{log.New(writer, "", 0), auditOnly}
+}
+
+func (sink jsonSink) Write(entry LogEntry) {
+	if sink.auditOnly && entry.Level != logLevelAudit {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"time":    entry.Time.UTC().Format(time.RFC3339Nano),
+		"level":   entry.Level,
+		"message": entry.Message,
+	}
+	if len(entry.Labels) > 0 {
+		fields["labels"] = entry.Labels
+	}
+
+	encoded, err := json.Marshal(fields)
+	if err == nil {
+		sink.logger.Print(string(encoded))
+	}
+}
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func (sink syslogSink) Write(entry LogEntry) {
+	switch entry.Level {
+	case logLevelAudit:
+		sink.writer.Notice(entry.Message)
+	case logLevelNormal:
+		sink.writer.Info(entry.Message)
+	default:
+		sink.writer.Debug(entry.Message)
+	}
+}
+
+func (out Output) write(level int, message string) {
+	if out.Level < level {
+		return
+	}
+	entry := LogEntry{clock(), level, message, out.Labels}
+	for _, sink := range out.Sinks {
+		sink.Write(entry)
+	}
+}
+
+// WithLabels returns a copy of the Output that attaches the labels to every
+// message.
+func (out Output) WithLabels(labels map[string]string) Output {
+	out.Labels = labels
 	return out
 }
 
@@ -70,25 +213,31 @@ func (out Output) Dump(slice []byte, format string, args ...interface{}) {
 
 			str += "\n"
 		}
-		out.Logger.Print(str)
+		out.write(logLevelDump, str)
 	}
 }
 
 // Debug prints internal debugging messages to the log.
 func (out Output) Debug(format string, args ...interface{}) {
 	if out.Level >= logLevelDebug {
-		out.Logger.Printf(format, args...)
+		out.write(logLevelDebug, fmt.Sprintf(format, args...))
 	}
 }
 
 // Verbose prints low-priority messages to the log.
 func (out Output) Verbose(format string, args ...interface{}) {
 	if out.Level >= logLevelVerbose {
-		out.Logger.Printf(format, args...)
+		out.write(logLevelVerbose, fmt.Sprintf(format, args...))
 	}
 }
 
 // Log prints ordinary messages to the log.
 func (out Output) Log(format string, args ...interface{}) {
-	out.Logger.Printf(format, args...)
+	out.write(logLevelNormal, fmt.Sprintf(format, args...))
+}
+
+// Audit records security-relevant events, like policy changes. These go to
+// every sink regardless of the log level.
+func (out Output) Audit(format string, args ...interface{}) {
+	out.write(logLevelAudit, fmt.Sprintf(format, args...))
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestOutput_Levels(t *testing.T) {
+	levels := []int{}
+	out := Output{[]OutputSink{SinkFunc(func(entry LogEntry) { levels = append(levels, entry.Level) })}, logLevelNormal, nil}
+
+	out.Log("one")
+	out.Verbose("two")
+	out.Debug("three")
+	out.Audit("four")
+
+	if len(levels) != 2 || levels[0] != logLevelNormal || levels[1] != logLevelAudit {
+		t.Errorf("Bogus levels logged: %v", levels)
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	var buffer bytes.Buffer
+	out := Output{[]OutputSink{newJSONSink(&buffer, false)}, logLevelNormal, nil}
+	out.Log("Hello %s", "there")
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &decoded); err != nil {
+		t.Fatalf("Bogus JSON: %s", buffer.String())
+	}
+	if decoded["message"] != "Hello there" || decoded["level"] != float64(logLevelNormal) {
+		t.Errorf("Bogus log entry: %v", decoded)
+	}
+}
+
+func TestJSONSink_AuditOnly(t *testing.T) {
+	var buffer bytes.Buffer
+	out := Output{[]OutputSink{newJSONSink(&buffer, true)}, logLevelDump, nil}
+	out.Log("Not audited")
+	if buffer.Len() != 0 {
+		t.Errorf("Audit sink logged an ordinary message: %s", buffer.String())
+	}
+
+	out.Audit("Audited")
+	if buffer.Len() == 0 {
+		t.Error("Audit sink didn't log an audit message")
+	}
+}
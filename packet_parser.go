@@ -116,3 +116,27 @@ func (parser *PacketParser) ReadFixedInt8() uint64 {
 	parser.offset += 8
 	return fixedInt
 }
+
+// Remaining returns how many bytes are left to read.
+func (parser *PacketParser) Remaining() uint64 {
+	return uint64(len(parser.data)) - parser.offset
+}
+
+// EncodedIntFits reports whether there's a whole length-encoded integer left
+// to read, so callers can check before ReadEncodedInt panics on them.
+func (parser *PacketParser) EncodedIntFits() bool {
+	if parser.Remaining() == 0 {
+		return false
+	}
+	switch parser.data[parser.offset] {
+	case 0xFB, 0xFF:
+		return false
+	case 0xFC:
+		return parser.Remaining() >= 3
+	case 0xFD:
+		return parser.Remaining() >= 4
+	case 0xFE:
+		return parser.Remaining() >= 9
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Desync bugs are miserable to debug after the fact, and dumping every
+// packet all the time (-v 3) is too much for production. So each session
+// remembers the headers of its last PacketTraceSize packets in both
+// directions (sizes, sequence IDs, and the first payload byte, which says
+// what sort of packet it is, but no data), and logs them when the session
+// dies of an error or a panic.
+
+type traceEntry struct {
+	at     time.Time
+	path   string // e.g. "client->proxy"
+	seq    byte
+	length int
+	kind   byte // The first payload byte
+}
+
+// PacketTrace is a ring buffer of packet headers.
+type PacketTrace struct {
+	mutex   sync.Mutex
+	entries []traceEntry
+	next    int
+	full    bool
+}
+
+// NewPacketTrace returns a trace that remembers the given number of
+// packets, or nil if that's 0.
+func NewPacketTrace(size int) *PacketTrace {
+	if size <= 0 {
+		return nil
+	}
+	return &PacketTrace{entries: make([]traceEntry, size)}
+}
+
+func (trace *PacketTrace) add(entry traceEntry) {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	trace.entries[trace.next] = entry
+	trace.next = (trace.next + 1) % len(trace.entries)
+	if trace.next == 0 {
+		trace.full = true
+	}
+}
+
+// Lines returns the trace, oldest first, one packet per line.
+func (trace *PacketTrace) Lines() []string {
+	if trace == nil {
+		return nil
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	entries := trace.entries[:trace.next]
+	if trace.full {
+		entries = append(append([]traceEntry{}, trace.entries[trace.next:]...), entries...)
+	}
+
+	lines := []string{}
+	for _, entry := range entries {
+		lines = append(lines, fmt.Sprintf("%s %s seq=%d len=%d %s", entry.at.Format("15:04:05.000000"),
+			entry.path, entry.seq, entry.length, packetKindName(entry)))
+	}
+	return lines
+}
+
+// packetKindName guesses what a packet was from its first byte. From the
+// client that's the command, and from the server it's OK/ERR/EOF or
+// something else (a handshake, result set or row).
+func packetKindName(entry traceEntry) string {
+	if entry.length == 0 {
+		return "empty"
+	}
+	if entry.path == "client->proxy" || entry.path == "proxy->server" {
+		if name, ok := commandNames[entry.kind]; ok {
+			return name
+		}
+	} else {
+		switch {
+		case entry.kind == 0x00 && entry.length >= 7:
+			return "OK"
+		case entry.kind == 0xFF:
+			return "ERR"
+		case entry.kind == 0xFE && entry.length < 9:
+			return "EOF"
+		}
+	}
+	return fmt.Sprintf("0x%02x", entry.kind)
+}
+
+var commandNames = map[byte]string{
+	COM_QUIT:         "COM_QUIT",
+	COM_INIT_DB:      "COM_INIT_DB",
+	COM_QUERY:        "COM_QUERY",
+	COM_FIELD_LIST:   "COM_FIELD_LIST",
+	COM_REFRESH:      "COM_REFRESH",
+	COM_SHUTDOWN:     "COM_SHUTDOWN",
+	COM_STATISTICS:   "COM_STATISTICS",
+	COM_PROCESS_KILL: "COM_PROCESS_KILL",
+	COM_DEBUG:        "COM_DEBUG",
+	COM_PING:         "COM_PING",
+}
+
+// DumpTrace logs the session's packet trace, if it has one.
+func (proxy *ProxyConnection) DumpTrace(reason string) {
+	lines := proxy.trace.Lines()
+	if len(lines) == 0 {
+		return
+	}
+	proxy.Output().Log("Last %d packets before %s:\n  %s", len(lines), reason, strings.Join(lines, "\n  "))
+}
+
+// dumpTraceOnPanic is for deferring at the top of the session's goroutines.
+func (proxy *ProxyConnection) dumpTraceOnPanic() {
+	if r := recover(); r != nil {
+		proxy.DumpTrace(fmt.Sprintf("panic: %v", r))
+		panic(r)
+	}
+}
+
+// packetScanner finds packet boundaries in a stream of bytes, however they
+// happen to be split up.
+type packetScanner struct {
+	header    [4]byte
+	have      int // Header bytes seen so far
+	remaining int // Payload bytes left in the current packet
+	needKind  bool
+	length    int
+}
+
+func (scanner *packetScanner) scan(data []byte, emit func(seq byte, length int, kind byte)) {
+	for len(data) > 0 {
+		if scanner.remaining == 0 {
+			n := copy(scanner.header[scanner.have:], data)
+			scanner.have += n
+			data = data[n:]
+			if scanner.have < 4 {
+				return
+			}
+			scanner.have = 0
+			scanner.length = int(scanner.header[0]) | int(scanner.header[1])<<8 | int(scanner.header[2])<<16
+			if scanner.length == 0 {
+				emit(scanner.header[3], 0, 0)
+				continue
+			}
+			scanner.remaining = scanner.length
+			scanner.needKind = true
+			continue
+		}
+		if scanner.needKind {
+			emit(scanner.header[3], scanner.length, data[0])
+			scanner.needKind = false
+		}
+		n := scanner.remaining
+		if n > len(data) {
+			n = len(data)
+		}
+		scanner.remaining -= n
+		data = data[n:]
+	}
+}
+
+// tracedConn records the packets going through a connection. Reads and
+// writes each only happen on one goroutine at a time, so the scanners don't
+// need locking.
+type tracedConn struct {
+	net.Conn
+	trace   *PacketTrace
+	in, out string
+	reads   packetScanner
+	writes  packetScanner
+}
+
+// newTracedConn wraps the connection, or returns it as-is if there's no
+// trace. The peer is "client" or "server".
+func newTracedConn(conn net.Conn, trace *PacketTrace, peer string) net.Conn {
+	if trace == nil {
+		return conn
+	}
+	return &tracedConn{Conn: conn, trace: trace, in: peer + "->proxy", out: "proxy->" + peer}
+}
+
+func (conn *tracedConn) Read(data []byte) (int, error) {
+	n, err := conn.Conn.Read(data)
+	conn.reads.scan(data[:n], func(seq byte, length int, kind byte) {
+		conn.trace.add(traceEntry{clock(), conn.in, seq, length, kind})
+	})
+	return n, err
+}
+
+func (conn *tracedConn) Write(data []byte) (int, error) {
+	n, err := conn.Conn.Write(data)
+	conn.writes.scan(data[:n], func(seq byte, length int, kind byte) {
+		conn.trace.add(traceEntry{clock(), conn.out, seq, length, kind})
+	})
+	return n, err
+}
+
+// traceWith starts recording the server connection's packets in the trace.
+// The connection has to be between packets.
+func (server *ServerConnection) traceWith(trace *PacketTrace) {
+	if trace == nil || server.conn == nil {
+		return
+	}
+	server.conn = newTracedConn(server.conn, trace, "server")
+	server.stream = mysqlproto.NewStream(server.conn)
+}
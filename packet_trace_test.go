@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestPacketScanner(t *testing.T) {
+	stream := []byte{}
+	stream = append(stream, 0x05, 0x00, 0x00, 0x00, COM_QUERY, 'x', 'y', 'z', 'w')
+	stream = append(stream, 0x00, 0x00, 0x00, 0x01)
+	stream = append(stream, 0x01, 0x00, 0x00, 0x02, 0xFF)
+
+	// However the bytes are split up, the packets should come out the same.
+	for chunk := 1; chunk <= len(stream); chunk++ {
+		var scanner packetScanner
+		found := []string{}
+		for i := 0; i < len(stream); i += chunk {
+			end := i + chunk
+			if end > len(stream) {
+				end = len(stream)
+			}
+			scanner.scan(stream[i:end], func(seq byte, length int, kind byte) {
+				found = append(found, string([]byte{'0' + seq, '0' + byte(length), kind}))
+			})
+		}
+		if strings.Join(found, ",") != "05\x03,10\x00,21\xff" {
+			t.Errorf("Bogus packets with %d-byte chunks: %q", chunk, found)
+		}
+	}
+}
+
+func TestPacketTrace(t *testing.T) {
+	if NewPacketTrace(0) != nil {
+		t.Error("A zero-size trace should be nil")
+	}
+
+	trace := NewPacketTrace(2)
+	clientEnd, proxyEnd := net.Pipe()
+	defer clientEnd.Close()
+	conn := newTracedConn(proxyEnd, trace, "client")
+	client := mysqlproto.NewStream(clientEnd)
+	go func() {
+		WritePacket(client, mysqlproto.Packet{0, []byte{COM_PING}})
+		WritePacket(client, mysqlproto.Packet{0, []byte{COM_QUERY, 'x'}})
+		client.NextPacket()
+	}()
+	stream := mysqlproto.NewStream(conn)
+	stream.NextPacket()
+	stream.NextPacket()
+	WritePacket(stream, OKPacket(0))
+
+	lines := trace.Lines()
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "client->proxy seq=0 len=2 COM_QUERY") ||
+		!strings.HasSuffix(lines[1], "proxy->client seq=1 len=7 OK") {
+		t.Errorf("Bogus trace: %q", lines)
+	}
+}
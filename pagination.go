@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Pagination turns a plain "SELECT ... FROM table [WHERE ...]" on a
+// configured table into a series of keyset-paginated queries ordered by the
+// table's key column, and stitches the results back together into one result
+// set for the client. That way a huge export doesn't hold a cursor open on the
+// server for as long as the client takes to read it.
+//
+// Only the simplest queries qualify. Anything with ORDER BY, LIMIT, joins,
+// grouping, etc. goes through untouched. The key column should be unique and
+// NOT NULL (i.e., the primary key), or rows will go missing.
+
+var paginationQueryRegex = regexp.MustCompile("(?is)^SELECT\\s+(.+?)\\s+FROM\\s+([\\w.`]+)(?:\\s+WHERE\\s+(.+?))?\\s*;?\\s*$")
+var paginationBlockerRegex = regexp.MustCompile(`(?i)\b(ORDER|LIMIT|GROUP|HAVING|UNION|JOIN|INTO|FOR|LOCK|PROCEDURE|DISTINCT|SQL_CALC_FOUND_ROWS)\b`)
+
+type paginationPlan struct {
+	columns string // The select list, as written
+	table   string // The table, as written
+	where   string // The WHERE condition, if any
+	key     string // The column to page through
+}
+
+// newPaginationKeys turns PaginationColumns into a map from "database.table"
+// to the key column to paginate that table by.
+func newPaginationKeys(names []string) (map[string]string, error) {
+	set, err := NewColumnSet(names)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]string{}
+	for name := range set {
+		dot := strings.LastIndex(name, ".")
+		if _, ok := keys[name[:dot]]; ok {
+			return nil, fmt.Errorf("Table '%s' has more than one pagination column", name[:dot])
+		}
+		keys[name[:dot]] = name[dot+1:]
+	}
+	return keys, nil
+}
+
+// planPagination returns a plan for paginating the query, or nil if it's not
+// one we can (or should) paginate. Unqualified table names are assumed to be
+// in the given database.
+func planPagination(query string, database string, keys map[string]string) *paginationPlan {
+	if len(keys) == 0 {
+		return nil
+	}
+	query = stripLeadingComments(query)
+	if strings.ContainsAny(query, "'\"") || paginationBlockerRegex.MatchString(query) {
+		// Quoted strings could be hiding anything from our regexes.
+		return nil
+	}
+
+	match := paginationQueryRegex.FindStringSubmatch(query)
+	if match == nil {
+		return nil
+	}
+
+	parts := strings.Split(match[2], ".")
+	name := strings.ToLower(database + "." + unquoteIdentifier(parts[0]))
+	if len(parts) == 2 {
+		name = strings.ToLower(unquoteIdentifier(parts[0]) + "." + unquoteIdentifier(parts[1]))
+	} else if len(parts) > 2 {
+		return nil
+	}
+	key, ok := keys[name]
+	if !ok {
+		return nil
+	}
+
+	// We need the key's value from every row to ask for the next chunk.
+	selectsKey := false
+	for _, column := range splitTopLevel(match[1], ',') {
+		column = strings.ToLower(unquoteIdentifier(column))
+		if column == "*" || column == key {
+			selectsKey = true
+		}
+	}
+	if !selectsKey {
+		return nil
+	}
+
+	return &paginationPlan{match[1], match[2], match[3], key}
+}
+
+// chunkQuery returns the query for the chunk of rows following the given key
+// value (or the first chunk, if after is nil).
+func (plan *paginationPlan) chunkQuery(after *string, size int) string {
+	conditions := []string{}
+	if plan.where != "" {
+		conditions = append(conditions, "("+plan.where+")")
+	}
+	if after != nil {
+		conditions = append(conditions, fmt.Sprintf("`%s` > %s", plan.key, quoteString(*after)))
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", plan.columns, plan.table)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return query + fmt.Sprintf(" ORDER BY `%s` LIMIT %d", plan.key, size)
+}
+
+// quoteString returns the value as a MySQL string literal. MySQL converts it
+// back to a number when comparing with a numeric column.
+func quoteString(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "'", "\\'", -1)
+	return "'" + value + "'"
+}
+
+// handlePaginatedQuery runs the plan one chunk at a time, sending the client
+// a single result set that follows the packet with the given sequence ID.
+func (server *ServerConnection) handlePaginatedQuery(sequenceId byte, plan *paginationPlan) {
+	started := time.Now()
+	forward := func(packet mysqlproto.Packet) {
+		sequenceId += byte(packetPieces(len(packet.Payload)))
+		server.proxy.SendToClient(mysqlproto.Packet{sequenceId, packet.Payload})
+	}
+
+	var columns []Column
+	var width int
+	var after *string
+	keyIndex := -1
+
+	for {
+		query := plan.chunkQuery(after, config.PaginationChunkSize)
+		server.proxy.Output().Debug("Paginated query: %s", query)
+		if err := server.write(mysqlproto.Packet{0, append([]byte{COM_QUERY}, query...)}); err != nil {
+			server.proxy.Fail(fmt.Errorf("Couldn't write to MySQL server: %s", err))
+			server.finished = true
+			return
+		}
+
+		response, err := ReadPacket(server.stream)
+		if err != nil {
+			server.proxy.Output().Log("Couldn't receive packet from MySQL server: %s", err)
+			server.finished = true
+			return
+		}
+		if packetIsOK(response) || packetIsERR(response) || packetIsEOF(response) {
+			forward(response)
+			return
+		}
+
+		definitions := []mysqlproto.Packet{response}
+		chunkColumns := []Column{}
+		columnCount := NewPacketParser(response).ReadEncodedInt()
+		traces := traceColumns(server.proxy.query, server.proxy.Database, int(columnCount))
+		for i := uint64(0); i < columnCount; i++ {
+			packet, err := ReadPacket(server.stream)
+			if err != nil {
+				server.proxy.Output().Log("Couldn't receive column definitions from MySQL server: %s", err)
+				server.finished = true
+				return
+			}
+			column, err := ReadColumn(NewPacketParser(packet))
+			if err != nil {
+				server.proxy.Output().Log("Couldn't receive column definitions from MySQL server: %s", err)
+				server.finished = true
+				return
+			}
+			column = traceResult(column, traces, int(i))
+			column.ruleSet = server.proxy.RuleSet()
+			column.watermark = server.proxy.Watermark()
+			if column.NeedsRetyping() {
+				packet, column = RetypeAsText(packet, column)
+			}
+			definitions = append(definitions, packet)
+			chunkColumns = append(chunkColumns, column)
+		}
+		if !server.proxy.deprecateEOF() {
+			packet, err := ReadPacket(server.stream)
+			if err != nil {
+				server.proxy.Output().Log("Couldn't receive column definitions from MySQL server: %s", err)
+				server.finished = true
+				return
+			}
+			definitions = append(definitions, packet)
+		}
+
+		if columns == nil {
+			if unclassified := strictViolations(chunkColumns); len(unclassified) > 0 {
+				server.refuseResult(sequenceId, unclassified, true)
+				return
+			}
+			columns = chunkColumns
+			width = server.proxy.resultWidth(columns)
+			for i, column := range columns {
+				if column.Name == plan.key {
+					keyIndex = i
+				}
+			}
+			if keyIndex < 0 {
+				// planPagination should have made sure this can't happen.
+				server.proxy.Output().Log("Paginated result set has no '%s' column", plan.key)
+				server.finished = true
+				return
+			}
+			for _, packet := range definitions {
+				forward(packet)
+			}
+		}
+
+		rowCount := 0
+		for {
+			rowPacket, err := ReadPacket(server.stream)
+			if err != nil {
+				server.proxy.Output().Log("Couldn't receive row values from MySQL server: %s", err)
+				server.finished = true
+				return
+			}
+			if packetIsERR(rowPacket) {
+				forward(rowPacket)
+				return
+			}
+			if packetEndsRows(rowPacket) { // rows starting with an empty string can look like OKs
+				if rowCount < config.PaginationChunkSize {
+					forward(rowPacket)
+					return
+				}
+				break
+			}
+			if config.MaxResultDuration > 0 && time.Since(started) > time.Duration(config.MaxResultDuration)*time.Second {
+				server.abortResult(sequenceId)
+				return
+			}
+
+			parser := NewPacketParser(rowPacket)
+			for i := 0; i < keyIndex; i++ {
+				parser.ReadStringOrNull()
+			}
+			key, _ := parser.ReadStringOrNull()
+			after = &key
+			rowCount++
+
+			row := rowPacket
+			if server.proxy.Sanitizing() {
+				rows, err := readRowValues(rowPacket, columns)
+				if err != nil {
+					server.proxy.DumpTrace("a row we couldn't read")
+					server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), sequenceId, err))
+					server.finished = true
+					return
+				}
+				row = constructNewResponse(rowPacket, rows)
+			}
+			if width > 0 {
+				row = truncateRow(row, columns, width)
+			}
+			forward(row)
+			server.proxy.countRow(len(row.Payload))
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+var testPaginationKeys = map[string]string{"honk.bonk": "id"}
+
+func TestNewPaginationKeys(t *testing.T) {
+	keys, err := newPaginationKeys([]string{"Honk.Bonk.ID"})
+	if err != nil {
+		t.Fatalf("newPaginationKeys failed: %s", err)
+	}
+	if keys["honk.bonk"] != "id" {
+		t.Errorf("Bogus pagination keys: %v", keys)
+	}
+
+	if _, err := newPaginationKeys([]string{"honk.bonk.id", "honk.bonk.uuid"}); err == nil {
+		t.Error("Two keys for one table should be an error")
+	}
+}
+
+func TestPlanPagination(t *testing.T) {
+	queries := map[string]bool{
+		"SELECT * FROM bonk":                           true,
+		"select id, name from `honk`.`bonk`;":          true,
+		"/* export */ SELECT id FROM bonk WHERE x > 3": true,
+		"SELECT name FROM bonk":                        false,
+		"SELECT * FROM other":                          false,
+		"SELECT * FROM blarp.bonk":                     false,
+		"SELECT * FROM bonk ORDER BY name":             false,
+		"SELECT * FROM bonk LIMIT 10":                  false,
+		"SELECT * FROM bonk, other":                    false,
+		"SELECT * FROM bonk JOIN other USING (id)":     false,
+		"SELECT * FROM bonk WHERE name = 'LIMIT'":      false,
+		"SELECT COUNT(*) FROM bonk GROUP BY name":      false,
+		"UPDATE bonk SET name = NULL":                  false,
+	}
+
+	for query, expected := range queries {
+		plan := planPagination(query, "honk", testPaginationKeys)
+		if (plan != nil) != expected {
+			t.Errorf("Bogus plan for %q: %v", query, plan)
+		}
+	}
+}
+
+func TestChunkQuery(t *testing.T) {
+	plan := planPagination("SELECT id, name FROM bonk WHERE x > 3", "honk", testPaginationKeys)
+
+	if query := plan.chunkQuery(nil, 10); query != "SELECT id, name FROM bonk WHERE (x > 3) ORDER BY `id` LIMIT 10" {
+		t.Errorf("Bogus first chunk query: %s", query)
+	}
+
+	after := "it's"
+	if query := plan.chunkQuery(&after, 10); query != "SELECT id, name FROM bonk WHERE (x > 3) AND `id` > 'it\\'s' ORDER BY `id` LIMIT 10" {
+		t.Errorf("Bogus later chunk query: %s", query)
+	}
+}
+
+func TestHandlePaginatedQuery(t *testing.T) {
+	oldChunkSize := config.PaginationChunkSize
+	config.PaginationChunkSize = 2
+	defer func() { config.PaginationChunkSize = oldChunkSize }()
+
+	proxyEnd, backendEnd := net.Pipe()
+	defer proxyEnd.Close()
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+	// The fake server has rows 1, 2, and 3, and records what it was asked.
+	queries := make(chan string, 10)
+	go func() {
+		backend := mysqlproto.NewStream(backendEnd)
+		chunks := [][]string{{"1", "2"}, {"3"}}
+		for _, chunk := range chunks {
+			command, err := backend.NextPacket()
+			if err != nil {
+				return
+			}
+			queries <- string(command.Payload[1:])
+			packets := []mysqlproto.Packet{{1, LengthEncodedInt(1)}, selftestColumnPacket(1, "id", 0x03), EOFPacket(2)}
+			for _, id := range chunk {
+				packets = append(packets, TextRowPacket(packets[len(packets)-1].SequenceID, []string{id}))
+			}
+			packets = append(packets, EOFPacket(packets[len(packets)-1].SequenceID))
+			for _, packet := range packets {
+				WritePacket(backend, packet)
+			}
+		}
+	}()
+
+	plan := &paginationPlan{"id", "bonk", "", "id"}
+	server.handlePaginatedQuery(0, plan)
+	close(proxy.ClientChannel)
+
+	if query := <-queries; query != "SELECT id FROM bonk ORDER BY `id` LIMIT 2" {
+		t.Errorf("Bogus first query: %s", query)
+	}
+	if query := <-queries; query != "SELECT id FROM bonk WHERE `id` > '2' ORDER BY `id` LIMIT 2" {
+		t.Errorf("Bogus second query: %s", query)
+	}
+
+	// Column count, column definition, EOF, three rows, EOF.
+	packets := []mysqlproto.Packet{}
+	for packet := range proxy.ClientChannel {
+		packets = append(packets, packet)
+	}
+	if len(packets) != 7 {
+		t.Fatalf("Expected 7 packets, got %d", len(packets))
+	}
+	for i, packet := range packets {
+		if packet.SequenceID != byte(i+1) {
+			t.Errorf("Packet %d has the wrong sequence ID: %d", i, packet.SequenceID)
+		}
+	}
+	if string(packets[5].Payload) != "\x013" || !packetIsEOF(packets[6]) {
+		t.Errorf("Bogus end of result set: %v, %v", packets[5].Payload, packets[6].Payload)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+)
+
+// E.164 caps phone numbers at 15 digits; anything under 7 is probably an
+// extension or junk.
+const (
+	phoneMinDigits       = 7
+	phoneMaxDigits       = 15
+	phoneMinMaskedDigits = 4
+	phoneSeparators      = " -.()/"
+)
+
+// maskPhoneNumber deterministically replaces the subscriber digits of a
+// phone number while keeping the country and area codes, the punctuation,
+// and the length intact. It returns false if the value doesn't look like a
+// phone number.
+func maskPhoneNumber(value []byte, salt []byte) ([]byte, bool) {
+	digits := []byte{}
+	groupLengths := []int{}
+	inGroup := false
+	for i, char := range value {
+		if char >= '0' && char <= '9' {
+			digits = append(digits, char)
+			if !inGroup {
+				groupLengths = append(groupLengths, 0)
+				inGroup = true
+			}
+			groupLengths[len(groupLengths)-1]++
+		} else if (char == '+' && i == 0) || strings.IndexByte(phoneSeparators, char) >= 0 {
+			inGroup = false
+		} else {
+			return nil, false
+		}
+	}
+	if len(digits) < phoneMinDigits || len(digits) > phoneMaxDigits {
+		return nil, false
+	}
+
+	keep := phonePrefixLength(value[0] == '+', digits, groupLengths)
+	if len(digits)-keep < phoneMinMaskedDigits {
+		keep = len(digits) - phoneMinMaskedDigits
+	}
+
+	sum := hasher.Sum(digits, salt)
+	for i := keep; i < len(digits); i++ {
+		digits[i] = '0' + sum[i]%10
+	}
+
+	masked := make([]byte, len(value))
+	next := 0
+	for i, char := range value {
+		if char >= '0' && char <= '9' {
+			masked[i] = digits[next]
+			next++
+		} else {
+			masked[i] = char
+		}
+	}
+	return masked, true
+}
+
+// phonePrefixLength guesses how many leading digits are country and area
+// codes. When the number is split into groups we trust the formatting and
+// keep everything but the last two groups ("+1 (415) 555-2671", "+44 20 7946
+// 0958"); otherwise we fall back to some rules of thumb.
+func phonePrefixLength(plus bool, digits []byte, groupLengths []int) int {
+	if len(groupLengths) >= 3 {
+		keep := 0
+		for _, length := range groupLengths[:len(groupLengths)-2] {
+			keep += length
+		}
+		return keep
+	}
+	if len(groupLengths) == 2 {
+		// Probably "(415) 5552671" or "+44 2079460958".
+		return groupLengths[0]
+	}
+
+	switch {
+	case plus && digits[0] == '1':
+		return 4 // +1 and the three-digit NANP area code
+	case plus:
+		return 4 // A two-digit country code and a guess at the area code
+	case digits[0] == '0' && digits[1] == '0':
+		return 6 // 00, a two-digit country code, and a guess at the area code
+	case len(digits) == 11 && digits[0] == '1':
+		return 4
+	default:
+		return 3
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMaskPhoneNumber(t *testing.T) {
+	tests := []struct {
+		value  string
+		prefix string
+	}{
+		{"+1 (415) 555-2671", "+1 (415) "},
+		{"+44 20 7946 0958", "+44 20 "},
+		{"415-555-2671", "415-"},
+		{"(415) 5552671", "(415) "},
+		{"+14155552671", "+1415"},
+		{"4155552671", "415"},
+		{"004930123456", "004930"},
+	}
+
+	for _, test := range tests {
+		masked, ok := maskPhoneNumber([]byte(test.value), []byte("salt"))
+		if !ok {
+			t.Errorf("Phone number '%s' wasn't masked!", test.value)
+			continue
+		}
+		if len(masked) != len(test.value) {
+			t.Errorf("Masked phone number '%s' changed length: '%s'", test.value, masked)
+		}
+		if string(masked[:len(test.prefix)]) != test.prefix {
+			t.Errorf("Masked phone number '%s' lost its prefix: '%s'", test.value, masked)
+		}
+		for i := range masked {
+			isDigit := masked[i] >= '0' && masked[i] <= '9'
+			wasDigit := test.value[i] >= '0' && test.value[i] <= '9'
+			if isDigit != wasDigit || (!isDigit && masked[i] != test.value[i]) {
+				t.Errorf("Masked phone number '%s' lost its punctuation: '%s'", test.value, masked)
+				break
+			}
+		}
+
+		again, _ := maskPhoneNumber([]byte(test.value), []byte("salt"))
+		if string(again) != string(masked) {
+			t.Errorf("Phone masking isn't deterministic: '%s' vs. '%s'", masked, again)
+		}
+	}
+}
+
+func TestMaskPhoneNumber_NotAPhone(t *testing.T) {
+	for _, value := range []string{"12345", "call me maybe", "555-CALL-NOW", "1234567890123456"} {
+		if _, ok := maskPhoneNumber([]byte(value), []byte("salt")); ok {
+			t.Errorf("'%s' was treated as a phone number!", value)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Columns need this many sampled values before we'll guess what's in them,
+// and at least this fraction of them have to match the same shape.
+const (
+	piiMinSamples    = 20
+	piiMatchFraction = 0.5
+)
+
+var piiShapes = []struct {
+	kind  string
+	regex *regexp.Regexp
+}{
+	{"email", regexp.MustCompile(`^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$`)},
+	{"ssn", regexp.MustCompile(`^\d{3}-\d{2}-\d{4}$`)},
+	{"ip", regexp.MustCompile(`^(?:\d{1,3}\.){3}\d{1,3}$|^[0-9A-Fa-f:]*:[0-9A-Fa-f:]+$`)},
+	{"card", regexp.MustCompile(`^(?:\d[ -]?){11,18}\d$`)},
+	{"phone", regexp.MustCompile(`^\+?[\d\s().-]{7,20}$`)},
+}
+
+var piiDateRegex = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+var piiColumnNameRegex = regexp.MustCompile(`(?i)e_?mail|phone|mobile|ssn|social_security|card|iban|passport|birth|dob|address|zip|postcode|password|secret|token|ip_?addr`)
+
+// PIIDiscovery samples values flowing through the proxy and keeps track of
+// what they look like, so we can point out columns that probably hold PII
+// but aren't configured as such. Only the shape of each value is recorded,
+// never the value itself.
+type PIIDiscovery struct {
+	mutex      sync.Mutex
+	sampleRate uint64
+	counter    uint64
+	columns    map[string]*piiColumnShapes
+}
+
+type piiColumnShapes struct {
+	column  Column
+	samples int
+	matches map[string]int
+}
+
+// NewPIIDiscovery returns a PIIDiscovery that inspects one value in sampleRate.
+func NewPIIDiscovery(sampleRate int) *PIIDiscovery {
+	if sampleRate < 1 {
+		sampleRate = 1
+	}
+	return &PIIDiscovery{sampleRate: uint64(sampleRate), columns: map[string]*piiColumnShapes{}}
+}
+
+// Observe records the shape of a value read from the given column.
+func (discovery *PIIDiscovery) Observe(col Column, value []byte) {
+	if !col.IsString || col.Database == "" {
+		return
+	}
+
+	discovery.mutex.Lock()
+	defer discovery.mutex.Unlock()
+
+	discovery.counter++
+	if discovery.counter%discovery.sampleRate != 0 {
+		return
+	}
+
+	key := col.Database + "." + col.Table + "." + col.Name
+	shapes, ok := discovery.columns[key]
+	if !ok {
+		shapes = &piiColumnShapes{col, 0, map[string]int{}}
+		discovery.columns[key] = shapes
+	}
+	shapes.samples++
+	if kind := piiShape(value); kind != "" {
+		shapes.matches[kind]++
+	}
+}
+
+// piiShape returns what kind of PII the value looks like, or "" if it
+// doesn't look like anything in particular.
+func piiShape(value []byte) string {
+	for _, shape := range piiShapes {
+		if shape.regex.Match(value) {
+			if shape.kind == "card" && !scrubLuhnValid(string(value)) {
+				continue
+			}
+			// Otherwise dates and short numbers look like phone numbers.
+			if shape.kind == "phone" && (countDigits(value) < phoneMinDigits || piiDateRegex.Match(value)) {
+				continue
+			}
+			return shape.kind
+		}
+	}
+	if looksLikeToken(value) {
+		return "token"
+	}
+	return ""
+}
+
+func countDigits(value []byte) int {
+	count := 0
+	for _, char := range value {
+		if char >= '0' && char <= '9' {
+			count++
+		}
+	}
+	return count
+}
+
+// API keys, session tokens, and the like are long and random-looking.
+func looksLikeToken(value []byte) bool {
+	if len(value) < 20 || len(value) > 512 {
+		return false
+	}
+	counts := map[byte]int{}
+	for _, char := range value {
+		if !(char >= '0' && char <= '9') && !(char >= 'a' && char <= 'z') && !(char >= 'A' && char <= 'Z') &&
+			char != '-' && char != '_' && char != '+' && char != '/' && char != '=' {
+			return false
+		}
+		counts[char]++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(len(value))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy >= 4.0
+}
+
+// Report returns one line per column that looks like unclassified PII,
+// with a suggested fix.
+func (discovery *PIIDiscovery) Report() []string {
+	discovery.mutex.Lock()
+	defer discovery.mutex.Unlock()
+
+	lines := []string{}
+	for key, shapes := range discovery.columns {
+		kind, fraction := shapes.dominantShape()
+		nameHint := piiColumnNameRegex.MatchString(shapes.column.Name)
+		if kind == "" && !nameHint {
+			continue
+		}
+
+		suggestion := piiSuggestion(shapes.column, kind)
+		if suggestion == "" {
+			continue
+		}
+		if kind != "" {
+			lines = append(lines, fmt.Sprintf("%s looks like %s (%.0f%% of %d samples): %s", key, kind, fraction*100, shapes.samples, suggestion))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s has a PII-ish name: %s", key, suggestion))
+		}
+	}
+
+	sort.Strings(lines)
+	return lines
+}
+
+func (shapes *piiColumnShapes) dominantShape() (string, float64) {
+	if shapes.samples < piiMinSamples {
+		return "", 0
+	}
+	best := ""
+	bestCount := 0
+	for kind, count := range shapes.matches {
+		if count > bestCount || (count == bestCount && kind < best) {
+			best = kind
+			bestCount = count
+		}
+	}
+	fraction := float64(bestCount) / float64(shapes.samples)
+	if fraction < piiMatchFraction {
+		return "", 0
+	}
+	return best, fraction
+}
+
+// Suggests what to do about a column, or returns "" if it's already
+// configured sensibly.
+func piiSuggestion(col Column, kind string) string {
+	if col.IsSafe() {
+		return "it's whitelisted, so values are passing through unsanitized; consider removing it from " + config.WhitelistFile
+	}
+
+	switch {
+	case kind == "card" && !cardColumns.Contains(col):
+		return "consider adding it to CardColumns"
+	case kind == "phone" && !phoneColumns.Contains(col):
+		return "consider adding it to PhoneColumns"
+	case kind == "email" && col.Rules().Action(col) != ruleEmail:
+		return "consider giving it an \"email\" rule, so it stays a valid address"
+	case kind == "ip" && !ipColumns.Contains(col):
+		return "consider adding it to IPColumns"
+	case kind == "ssn" && !kdf.Handles(col):
+		return "it's low-entropy, so consider adding it to Kdf.Columns"
+	}
+	return ""
+}
+
+// RunReports logs a discovery report every interval, forever.
+func (discovery *PIIDiscovery) RunReports(interval time.Duration) {
+	for range time.Tick(interval) {
+		lines := discovery.Report()
+		if len(lines) == 0 {
+			continue
+		}
+		output.Log("PII discovery report: %d columns need a look", len(lines))
+		for _, line := range lines {
+			output.Log("    %s", line)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Connection pools love to ping, sometimes before every single query, and
+// each of those is a round trip to the server that tells us nothing new if
+// the session was busy a moment ago. With FastPing we answer them ourselves.
+// So that a dead server doesn't go unnoticed forever, a ping still goes
+// through when the server hasn't answered anything in FastPingVerifyInterval
+// seconds.
+
+// answerPing answers a COM_PING without bothering the server, if FastPing
+// allows it. It returns false if the packet should be handled as usual.
+func (server *ServerConnection) answerPing(packet mysqlproto.Packet) bool {
+	if !config.FastPing || packetCommand(packet) != COM_PING {
+		return false
+	}
+	verify := time.Duration(config.FastPingVerifyInterval) * time.Second
+	if verify > 0 && time.Since(server.lastReply) > verify {
+		return false
+	}
+
+	server.proxy.SendToClient(OKPacket(packet.SequenceID))
+	return true
+}
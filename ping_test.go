@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestAnswerPing(t *testing.T) {
+	oldFastPing, oldInterval := config.FastPing, config.FastPingVerifyInterval
+	defer func() { config.FastPing, config.FastPingVerifyInterval = oldFastPing, oldInterval }()
+	config.FastPingVerifyInterval = 60
+
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	server := &ServerConnection{proxy, nil, false, false, false, nil, time.Now()}
+	ping := mysqlproto.Packet{0, []byte{COM_PING}}
+
+	config.FastPing = false
+	if server.answerPing(ping) {
+		t.Error("Pings should go to the server without FastPing")
+	}
+
+	config.FastPing = true
+	if server.answerPing(mysqlproto.Packet{0, []byte{COM_QUERY, 'x'}}) {
+		t.Error("FastPing should only answer pings")
+	}
+	if !server.answerPing(ping) {
+		t.Fatal("FastPing should have answered the ping")
+	}
+	if response := <-proxy.ClientChannel; !packetIsOK(response) || response.SequenceID != 1 {
+		t.Errorf("Bogus ping response: %v", response)
+	}
+
+	server.lastReply = time.Now().Add(-2 * time.Minute)
+	if server.answerPing(ping) {
+		t.Error("A ping should go to the server when it's been quiet for too long")
+	}
+	config.FastPingVerifyInterval = 0
+	if !server.answerPing(ping) {
+		t.Error("FastPingVerifyInterval = 0 should never pass pings on")
+	}
+}
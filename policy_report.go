@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// The policy report lists every column on the server with what the proxy
+// does to it and why, for auditors who'd rather not read TOML. It's built
+// from the same config, whitelist, rules and catalog the proxy runs with, and
+// the server's own information_schema, so it can't drift from reality the way
+// a hand-written document would.
+
+var policyReportHeader = []string{"Database", "Table", "Column", "Policy", "Rationale"}
+var policyReportFormats = map[string]bool{"markdown": true, "html": true, "csv": true}
+
+// explainColumn returns what happens to the column's values in a normal
+// session, and why.
+func explainColumn(col Column) (string, string) {
+	if isStrictDatabase(col.Database) && len(strictViolations([]Column{col})) > 0 {
+		return "refused", "Strict mode, and the column has no classification"
+	}
+
+	rule := columnRules.Match(col)
+	switch {
+	case rule != nil && rule.action == rulePass && catalog.Classify(col) == classSensitive:
+		return explainMasking(col, "Rule "+rule.describe()+", overridden by a sensitive catalog tag")
+	case rule != nil && rule.action == rulePass:
+		return "pass", "Rule " + rule.describe()
+	case rule != nil && rule.action == ruleHash:
+		return explainMasking(col, "Rule "+rule.describe())
+	case rule != nil:
+		return rule.action, "Rule " + rule.describe()
+	case !col.IsString:
+		return "pass", "Not a string column"
+	case catalog.Classify(col) == classSensitive:
+		return explainMasking(col, "Tagged sensitive in the catalog")
+	case catalog.Classify(col) == classPublic:
+		return "pass", "Tagged public in the catalog"
+	case whitelist.IsColumnPresent(col.Database, col.Table, col.Name):
+		return "pass", "Whitelisted"
+	}
+	return explainMasking(col, "Not whitelisted")
+}
+
+// explainMasking says which kind of hashing a sanitized column gets.
+func explainMasking(col Column, why string) (string, string) {
+	if group, ok := identifierGroups[col.Database+"."+col.Table+"."+col.Name]; ok {
+		return "pseudonym", why + "; identifier group '" + group.name + "'"
+	}
+	for _, masking := range []struct {
+		columns ColumnSet
+		name    string
+		setting string
+	}{
+		{cardColumns, "card mask", "CardColumns"},
+		{phoneColumns, "phone mask", "PhoneColumns"},
+		{ipColumns, "IP pseudonym", "IPColumns"},
+		{urlColumns, "URL mask", "URLColumns"},
+	} {
+		if masking.columns.Contains(col) {
+			return masking.name, why + "; listed in " + masking.setting
+		}
+	}
+	if scrubber.Handles(col) {
+		return "scrub", why + "; listed in Scrub"
+	}
+	if kdf.Handles(col) {
+		return config.Kdf.Algorithm, why + "; listed in Kdf"
+	}
+	return "hash", why
+}
+
+// WritePolicyReport writes the policy for each column in the given format:
+// markdown, html or csv.
+func WritePolicyReport(out io.Writer, format string, columns []Column) error {
+	rows := [][]string{}
+	for _, col := range columns {
+		policy, rationale := explainColumn(col)
+		rows = append(rows, []string{col.Database, col.Table, col.Name, policy, rationale})
+	}
+
+	switch format {
+	case "markdown":
+		fmt.Fprintf(out, "# mysql-sanitizer policy\n\nWhitelist version %s, rules version %s.\n\n", whitelist.Version(), config.RulesVersion)
+		fmt.Fprintf(out, "| %s |\n|%s\n", strings.Join(policyReportHeader, " | "), strings.Repeat(" --- |", len(policyReportHeader)))
+		for _, row := range rows {
+			for i := range row {
+				row[i] = strings.Replace(row[i], "|", "\\|", -1)
+			}
+			fmt.Fprintf(out, "| %s |\n", strings.Join(row, " | "))
+		}
+	case "html":
+		fmt.Fprintf(out, "<!DOCTYPE html>\n<title>mysql-sanitizer policy</title>\n<h1>mysql-sanitizer policy</h1>\n")
+		fmt.Fprintf(out, "<p>Whitelist version %s, rules version %s.</p>\n<table>\n", html.EscapeString(whitelist.Version()), html.EscapeString(config.RulesVersion))
+		for i, row := range append([][]string{policyReportHeader}, rows...) {
+			cell := "td"
+			if i == 0 {
+				cell = "th"
+			}
+			fmt.Fprint(out, "<tr>")
+			for _, value := range row {
+				fmt.Fprintf(out, "<%s>%s</%s>", cell, html.EscapeString(value), cell)
+			}
+			fmt.Fprint(out, "</tr>\n")
+		}
+		fmt.Fprint(out, "</table>\n")
+	case "csv":
+		writer := csv.NewWriter(out)
+		writer.Write(policyReportHeader)
+		writer.WriteAll(rows)
+		return writer.Error()
+	default:
+		return fmt.Errorf("Unknown policy report format '%s'", format)
+	}
+	return nil
+}
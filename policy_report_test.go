@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExplainColumn(t *testing.T) {
+	oldRules, oldCards := columnRules, cardColumns
+	defer func() { columnRules, cardColumns = oldRules, oldCards }()
+	columnRules, _ = NewColumnRules(map[string]interface{}{"some_db.table2.honk": "redact"}, []PatternRule{})
+	cardColumns = ColumnSet{"some_db.table1.card": true}
+
+	cases := []struct {
+		col       Column
+		policy    string
+		rationale string
+	}{
+		{Column{IsString: true, Database: "some_db", Table: "table1", Name: "name"}, "pass", "Whitelisted"},
+		{Column{IsString: true, Database: "some_db", Table: "table1", Name: "secret"}, "hash", "Not whitelisted"},
+		{Column{IsString: true, Database: "some_db", Table: "table1", Name: "card"}, "card mask", "Not whitelisted; listed in CardColumns"},
+		{Column{IsString: false, Database: "some_db", Table: "table1", Name: "count"}, "pass", "Not a string column"},
+		{Column{IsString: true, Database: "some_db", Table: "table2", Name: "honk"}, "redact", `Rule "some_db.table2.honk" = "redact"`},
+	}
+	for _, c := range cases {
+		if policy, rationale := explainColumn(c.col); policy != c.policy || rationale != c.rationale {
+			t.Errorf("Bogus policy for %s.%s: %s (%s)", c.col.Table, c.col.Name, policy, rationale)
+		}
+	}
+}
+
+func TestWritePolicyReport(t *testing.T) {
+	columns := []Column{{IsString: true, Database: "some_db", Table: "table1", Name: "name"}}
+
+	var out bytes.Buffer
+	if err := WritePolicyReport(&out, "csv", columns); err != nil {
+		t.Fatalf("CSV report failed: %s", err)
+	}
+	if out.String() != "Database,Table,Column,Policy,Rationale\nsome_db,table1,name,pass,Whitelisted\n" {
+		t.Errorf("Bogus CSV report: %q", out.String())
+	}
+
+	out.Reset()
+	WritePolicyReport(&out, "markdown", columns)
+	if !strings.Contains(out.String(), "| some_db | table1 | name | pass | Whitelisted |\n") {
+		t.Errorf("Bogus markdown report: %q", out.String())
+	}
+
+	out.Reset()
+	WritePolicyReport(&out, "html", columns)
+	if !strings.Contains(out.String(), "<tr><td>some_db</td><td>table1</td><td>name</td><td>pass</td><td>Whitelisted</td></tr>") {
+		t.Errorf("Bogus HTML report: %q", out.String())
+	}
+
+	if err := WritePolicyReport(&out, "honk", columns); err == nil {
+		t.Error("Unknown format should be an error")
+	}
+}
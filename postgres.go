@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The PostgreSQL front-end (see PostgresPort) is for BI tools that can only
+// talk to Postgres. It's experimental: it speaks just enough of the v3 wire
+// protocol to log in without a password and run simple SELECTs, which it
+// translates to MySQL and runs through a LocalSession, so they're sanitized
+// like anything else. Every column comes back as text.
+
+const postgresProtocolVersion = 196608 // 3.0
+const postgresSSLRequest = 80877103
+const postgresCancelRequest = 80877102
+const postgresTextOID = 25
+
+var postgresSelectRegex = regexp.MustCompile(`(?is)^\s*SELECT\s`)
+
+// ServePostgresPort accepts Postgres clients until the context is cancelled.
+func ServePostgresPort(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				output.Log("Can't accept incoming PostgreSQL connection: %s", err)
+			}
+			return
+		}
+		go servePostgresClient(ctx, conn)
+	}
+}
+
+type postgresConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func servePostgresClient(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	pg := &postgresConn{conn, bufio.NewReader(conn)}
+
+	params, err := pg.readStartup()
+	if err != nil {
+		output.Verbose("PostgreSQL client went away during startup: %s", err)
+		return
+	}
+	if params == nil {
+		return // A cancel request, which we can't do anything with
+	}
+
+	session, err := OpenLocalSession(ctx, params["user"], params["database"])
+	if err != nil {
+		output.Log("Can't open session for PostgreSQL client: %s", err)
+		message := "mysql-sanitizer couldn't open a session"
+		if proxyErr, ok := err.(*ProxyError); ok {
+			message = proxyErr.Message
+		}
+		pg.sendError("FATAL", "08006", message)
+		return
+	}
+	defer session.Close()
+
+	pg.send('R', int32Bytes(0)) // AuthenticationOk
+	for _, param := range [][2]string{
+		{"server_version", "9.6.0"},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"standard_conforming_strings", "on"},
+		{"integer_datetimes", "on"},
+	} {
+		pg.send('S', []byte(param[0]+"\x00"+param[1]+"\x00"))
+	}
+	pg.send('Z', []byte{'I'})
+
+	// After an error in the extended query protocol, everything up to the
+	// next Sync is ignored.
+	skipToSync := false
+	for {
+		msgType, body, err := pg.readMessage()
+		if err != nil {
+			output.Verbose("Disconnected from PostgreSQL client: %s", err)
+			return
+		}
+
+		switch msgType {
+		case 'Q':
+			pg.runQuery(session, strings.TrimRight(string(body), "\x00"))
+			pg.send('Z', []byte{'I'})
+		case 'X':
+			return
+		case 'S':
+			skipToSync = false
+			pg.send('Z', []byte{'I'})
+		case 'H':
+			// Flush; we never buffer anything.
+		default:
+			if !skipToSync {
+				pg.sendError("ERROR", "0A000", "mysql-sanitizer only supports the simple query protocol")
+				skipToSync = true
+			}
+		}
+	}
+}
+
+// readStartup reads the startup message and returns its parameters, after
+// turning down SSL if the client asks for it first. It returns nil for cancel
+// requests.
+func (pg *postgresConn) readStartup() (map[string]string, error) {
+	for {
+		body, err := pg.readBody()
+		if err != nil {
+			return nil, err
+		}
+		if len(body) < 4 {
+			return nil, fmt.Errorf("Startup message too short")
+		}
+
+		switch binary.BigEndian.Uint32(body) {
+		case postgresSSLRequest:
+			if _, err := pg.conn.Write([]byte{'N'}); err != nil {
+				return nil, err
+			}
+			continue
+		case postgresCancelRequest:
+			return nil, nil
+		case postgresProtocolVersion:
+		default:
+			pg.sendError("FATAL", "0A000", "mysql-sanitizer only supports protocol version 3.0")
+			return nil, fmt.Errorf("Unsupported protocol version %d", binary.BigEndian.Uint32(body))
+		}
+
+		params := map[string]string{}
+		fields := strings.Split(string(body[4:]), "\x00")
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fields[i] == "" {
+				break
+			}
+			params[fields[i]] = fields[i+1]
+		}
+		return params, nil
+	}
+}
+
+// readMessage reads a regular message, which starts with its type.
+func (pg *postgresConn) readMessage() (byte, []byte, error) {
+	msgType, err := pg.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	body, err := pg.readBody()
+	return msgType, body, err
+}
+
+// readBody reads a length-prefixed message body.
+func (pg *postgresConn) readBody() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(pg.reader, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 4 || length > 1<<24 {
+		return nil, fmt.Errorf("Bogus message length %d", length)
+	}
+	body := make([]byte, length-4)
+	_, err := io.ReadFull(pg.reader, body)
+	return body, err
+}
+
+func (pg *postgresConn) send(msgType byte, body []byte) {
+	message := append([]byte{msgType}, int32Bytes(int32(len(body)+4))...)
+	pg.conn.Write(append(message, body...))
+}
+
+func (pg *postgresConn) sendError(severity string, sqlState string, message string) {
+	body := []byte{}
+	for _, field := range [][2]string{{"S", severity}, {"V", severity}, {"C", sqlState}, {"M", message}} {
+		body = append(body, field[0]...)
+		body = append(body, field[1]...)
+		body = append(body, 0x00)
+	}
+	pg.send('E', append(body, 0x00))
+}
+
+func (pg *postgresConn) runQuery(session *LocalSession, query string) {
+	if strings.TrimSpace(strings.TrimRight(strings.TrimSpace(query), ";")) == "" {
+		pg.send('I', []byte{}) // EmptyQueryResponse
+		return
+	}
+	translated, err := translatePostgresQuery(query)
+	if err != nil {
+		pg.sendError("ERROR", "0A000", err.Error())
+		return
+	}
+
+	result, err := session.Query(translated)
+	if err != nil {
+		pg.sendError("ERROR", "XX000", err.Error())
+		return
+	}
+
+	description := int16Bytes(int16(len(result.Columns)))
+	for _, column := range result.Columns {
+		description = append(description, column...)
+		description = append(description, 0x00)
+		description = append(description, int32Bytes(0)...)               // table OID
+		description = append(description, int16Bytes(0)...)               // column number
+		description = append(description, int32Bytes(postgresTextOID)...) // type OID
+		description = append(description, int16Bytes(-1)...)              // type size
+		description = append(description, int32Bytes(-1)...)              // type modifier
+		description = append(description, int16Bytes(0)...)               // text format
+	}
+	pg.send('T', description)
+
+	for _, row := range result.Rows {
+		data := int16Bytes(int16(len(row)))
+		for _, value := range row {
+			if value == nil {
+				data = append(data, int32Bytes(-1)...)
+				continue
+			}
+			data = append(data, int32Bytes(int32(len(*value)))...)
+			data = append(data, *value...)
+		}
+		pg.send('D', data)
+	}
+	pg.send('C', []byte("SELECT "+strconv.Itoa(len(result.Rows))+"\x00"))
+}
+
+// translatePostgresQuery turns a simple Postgres SELECT into MySQL: "quoted"
+// identifiers get backticks, and backslashes in strings are escaped, since
+// Postgres doesn't treat them specially but MySQL does.
+func translatePostgresQuery(query string) (string, error) {
+	query = strings.TrimSpace(query)
+	query = strings.TrimSpace(strings.TrimSuffix(query, ";"))
+	if !postgresSelectRegex.MatchString(query) {
+		return "", fmt.Errorf("mysql-sanitizer's PostgreSQL front-end only supports SELECT")
+	}
+
+	translated := []byte{}
+	for i := 0; i < len(query); i++ {
+		switch query[i] {
+		case '"':
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				return "", fmt.Errorf("Unterminated quoted identifier")
+			}
+			identifier := query[i+1 : i+1+end]
+			if strings.Contains(identifier, "`") {
+				return "", fmt.Errorf("Identifiers with backticks aren't supported")
+			}
+			translated = append(translated, '`')
+			translated = append(translated, identifier...)
+			translated = append(translated, '`')
+			i += end + 1
+		case '\'':
+			translated = append(translated, '\'')
+			for i++; ; i++ {
+				if i >= len(query) {
+					return "", fmt.Errorf("Unterminated string")
+				}
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						translated = append(translated, '\'', '\'')
+						i++
+						continue
+					}
+					break
+				}
+				if query[i] == '\\' {
+					translated = append(translated, '\\')
+				}
+				translated = append(translated, query[i])
+			}
+			translated = append(translated, '\'')
+		case ';':
+			return "", fmt.Errorf("Multiple statements aren't supported")
+		default:
+			translated = append(translated, query[i])
+		}
+	}
+	return string(translated), nil
+}
+
+func int16Bytes(num int16) []byte {
+	bytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(bytes, uint16(num))
+	return bytes
+}
+
+func int32Bytes(num int32) []byte {
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, uint32(num))
+	return bytes
+}
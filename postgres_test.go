@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestTranslatePostgresQuery(t *testing.T) {
+	translated, err := translatePostgresQuery(`SELECT "name", 'it''s a \ test' FROM "users";`)
+	if err != nil {
+		t.Fatalf("translatePostgresQuery failed: %s", err)
+	}
+	if translated != "SELECT `name`, 'it''s a \\\\ test' FROM `users`" {
+		t.Errorf("Bogus translation: %s", translated)
+	}
+
+	for _, query := range []string{
+		"DELETE FROM users",
+		"SELECT 1; DROP TABLE users",
+		`SELECT "name FROM users`,
+		"SELECT 'oops FROM users",
+	} {
+		if _, err := translatePostgresQuery(query); err == nil {
+			t.Errorf("Query should have been refused: %s", query)
+		}
+	}
+}
+
+func TestServePostgresClient(t *testing.T) {
+	oldHost, oldPort := config.MysqlHost, config.MysqlPort
+	defer func() { config.MysqlHost, config.MysqlPort = oldHost, oldPort }()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go serveSelftestBackend(backend)
+	config.MysqlHost = "127.0.0.1"
+	config.MysqlPort = backend.Addr().(*net.TCPAddr).Port
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		servePostgresClient(context.Background(), server)
+		done <- true
+	}()
+	reader := bufio.NewReader(client)
+
+	startup := int32Bytes(postgresProtocolVersion)
+	startup = append(startup, "user\x00honk\x00\x00"...)
+	client.Write(append(int32Bytes(int32(len(startup)+4)), startup...))
+	readPostgresMessagesUntil(t, reader, 'Z')
+	open := sessions.List()
+	proxy := open[len(open)-1] // The one we just opened
+
+	query := append([]byte(selftestQuery), 0x00)
+	client.Write(append(append([]byte{'Q'}, int32Bytes(int32(len(query)+4))...), query...))
+	messages := readPostgresMessagesUntil(t, reader, 'Z')
+
+	if len(messages['D']) != 1 {
+		t.Fatalf("Expected one row, got %d", len(messages['D']))
+	}
+	row := string(messages['D'][0])
+	if !strings.Contains(row, "42") || strings.Contains(row, "Alice Example") {
+		t.Errorf("Bogus row: %q", row)
+	}
+	if !strings.HasSuffix(row, "\xff\xff\xff\xff") {
+		t.Errorf("NULL should have been passed through: %q", row)
+	}
+	if len(messages['C']) != 1 || string(messages['C'][0]) != "SELECT 1\x00" {
+		t.Errorf("Bogus command tag: %q", messages['C'])
+	}
+
+	client.Write([]byte{'X', 0x00, 0x00, 0x00, 0x04})
+	<-done
+	proxy.Wait()
+}
+
+// readPostgresMessagesUntil reads messages until one of the given type, and
+// returns their bodies by type.
+func readPostgresMessagesUntil(t *testing.T, reader *bufio.Reader, last byte) map[byte][][]byte {
+	messages := map[byte][][]byte{}
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			t.Fatalf("Couldn't read message: %s", err)
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			t.Fatalf("Couldn't read message: %s", err)
+		}
+
+		if header[0] == 'E' {
+			t.Fatalf("Got an error: %q", body)
+		}
+		messages[header[0]] = append(messages[header[0]], body)
+		if header[0] == last {
+			return messages
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Prepared statements get the same checks, rewriting and sampling as
+// COM_QUERY when they're prepared, since that's when the server sees the
+// SQL. Executing one sends its rows in the binary protocol (see
+// binary_row.go), so we decode them with the columns' types, sanitize them
+// like text rows, and encode them again.
+//
+// With a cursor (COM_STMT_EXECUTE with CURSOR_TYPE_READ_ONLY, like JDBC's
+// useCursorFetch), the execute only sends the column definitions, and the
+// rows come later in batches from COM_STMT_FETCH, with no definitions of
+// their own. So we remember each statement's last set of columns to
+// sanitize those with. COM_STMT_SEND_LONG_DATA just streams a parameter's
+// value to the server in pieces, which doesn't get an answer.
+
+// A preparedStatement is one the client's prepared on the server.
+type preparedStatement struct {
+	query    string
+	columns  []Column // Of its last result set, for fetching from a cursor
+	received []Column // The same, as the server typed them
+}
+
+// carriesQuery returns whether the packet is a command with SQL after it.
+func carriesQuery(packet mysqlproto.Packet) bool {
+	return packetCommand(packet) == COM_QUERY || packetCommand(packet) == COM_STMT_PREPARE
+}
+
+// runsQuery returns whether the packet gets the server to run a query, so
+// it counts towards admission control and budgets.
+func runsQuery(packet mysqlproto.Packet) bool {
+	return packetCommand(packet) == COM_QUERY || packetCommand(packet) == COM_STMT_EXECUTE
+}
+
+// statementFor returns the statement a COM_STMT_* packet is for, or nil if
+// we don't know it.
+func (proxy *ProxyConnection) statementFor(packet mysqlproto.Packet) *preparedStatement {
+	if len(packet.Payload) < 5 {
+		return nil
+	}
+	return proxy.statements[binary.LittleEndian.Uint32(packet.Payload[1:5])]
+}
+
+// checkStatement returns an error for executing or fetching from a statement
+// we don't know about, since we wouldn't know what to make of its rows.
+func (proxy *ProxyConnection) checkStatement(packet mysqlproto.Packet) error {
+	if packetCommand(packet) != COM_STMT_EXECUTE && packetCommand(packet) != COM_STMT_FETCH {
+		return nil
+	}
+	statement := proxy.statementFor(packet)
+	if statement == nil {
+		return NewProxyError(ErrProtocol, nil, "mysql-sanitizer doesn't know that prepared statement")
+	}
+	if packetCommand(packet) == COM_STMT_FETCH && statement.columns == nil {
+		return NewProxyError(ErrProtocol, nil, "That prepared statement hasn't been executed with a cursor")
+	}
+	return nil
+}
+
+// closeStatement forgets the statement a COM_STMT_CLOSE is for.
+func (proxy *ProxyConnection) closeStatement(packet mysqlproto.Packet) {
+	if len(packet.Payload) >= 5 {
+		delete(proxy.statements, binary.LittleEndian.Uint32(packet.Payload[1:5]))
+	}
+}
+
+// handlePrepareResponse forwards the server's response to COM_STMT_PREPARE,
+// and remembers the statement if it worked.
+func (server *ServerConnection) handlePrepareResponse(query string) {
+	response, err := ReadPacket(server.stream)
+	if err != nil {
+		server.lostBackend(0, fmt.Errorf("Couldn't receive packet from MySQL server: %s", err))
+		return
+	}
+	server.proxy.Output().Dump(response.Payload, "Prepare response packet from server:\n")
+	if packetIsERR(response) {
+		server.proxy.recordResponse(response)
+		server.proxy.SendToClient(response)
+		return
+	}
+	if response.Payload[0] != 0x00 || len(response.Payload) < 12 {
+		server.proxy.Output().Log("Weird response to COM_STMT_PREPARE from MySQL server")
+		server.finished = true
+		return
+	}
+	id := binary.LittleEndian.Uint32(response.Payload[1:5])
+	columnCount := int(binary.LittleEndian.Uint16(response.Payload[5:7]))
+	paramCount := int(binary.LittleEndian.Uint16(response.Payload[7:9]))
+	packets := []mysqlproto.Packet{response}
+
+	// The parameters' definitions don't say anything about the data, so
+	// they go through as they are. The result's columns get retyped like
+	// any result set's, so they match what executing it sends.
+	if paramCount > 0 && !server.proxy.deprecateEOF() {
+		paramCount++
+	}
+	for i := 0; i < paramCount; i++ {
+		packet, err := ReadPacket(server.stream)
+		if err != nil {
+			server.lostBackend(0, fmt.Errorf("Couldn't receive parameter definitions from MySQL server: %s", err))
+			return
+		}
+		packets = append(packets, packet)
+	}
+	_, _, definitions, err := server.readColumns(columnCount, true)
+	if err != nil {
+		server.proxy.Output().Log("Couldn't receive column definitions from MySQL server: %s", err)
+		server.finished = true
+		return
+	}
+	packets = append(packets, definitions...)
+	if columnCount > 0 && !server.proxy.deprecateEOF() {
+		eofPacket, err := ReadPacket(server.stream)
+		if err != nil {
+			server.lostBackend(0, fmt.Errorf("Couldn't receive column definitions from MySQL server: %s", err))
+			return
+		}
+		packets = append(packets, eofPacket)
+	}
+
+	for _, packet := range packets {
+		server.proxy.SendToClient(packet)
+	}
+	if server.proxy.statements == nil {
+		server.proxy.statements = map[uint32]*preparedStatement{}
+	}
+	server.proxy.statements[id] = &preparedStatement{query: query}
+}
+
+// handleFetchResponse forwards a batch of rows from a cursor.
+func (server *ServerConnection) handleFetchResponse(statement *preparedStatement) {
+	sequenceId := byte(0)
+	server.forwardRows(statement.columns, statement.received, time.Now(), &sequenceId)
+}
+
+// cursorOpened returns whether a packet ending a result set's column
+// definitions says the rows went into a cursor.
+func (proxy *ProxyConnection) cursorOpened(packet mysqlproto.Packet) bool {
+	flags, ok := proxy.statusFlags(packet)
+	return ok && flags&SERVER_STATUS_CURSOR_EXISTS != 0
+}
+
+// sanitizedBinaryRow is sanitizedRow for a binary protocol row. Every row
+// gets decoded and encoded again, even if there's nothing to sanitize,
+// since retyped columns have to be sent as strings.
+func (server *ServerConnection) sanitizedBinaryRow(rowPacket mysqlproto.Packet, columns, received []Column, width int) (mysqlproto.Packet, mysqlproto.Packet, error) {
+	values, err := NewPacketParser(rowPacket).ReadBinaryRow(received)
+	if err != nil {
+		return rowPacket, rowPacket, err
+	}
+	if server.proxy.Sanitizing() {
+		if values, err = sanitizeRowValues(columns, values); err != nil {
+			return rowPacket, rowPacket, err
+		}
+	}
+	if width > 0 {
+		truncateValues(values, columns, width)
+	}
+	row, err := constructNewBinaryResponse(rowPacket, columns, values)
+	if err != nil {
+		return rowPacket, rowPacket, err
+	}
+	return row, constructNewResponse(rowPacket, values), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// preparedSession returns a session whose server sends the given packets.
+func preparedSession(t *testing.T, packets []mysqlproto.Packet) *ServerConnection {
+	proxyEnd, backendEnd := net.Pipe()
+	t.Cleanup(func() { proxyEnd.Close() })
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	proxy.Capabilities = mysqlproto.CLIENT_PROTOCOL_41
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+	go func() {
+		backend := mysqlproto.NewStream(backendEnd)
+		for _, packet := range packets {
+			WritePacket(backend, packet)
+		}
+	}()
+	return server
+}
+
+func TestHandlePrepareResponse(t *testing.T) {
+	defer setMode(modeNormal)
+	setMode(modeForceSanitize) // So the INT column gets sanitized
+
+	// Statement 7, with a column and a parameter.
+	server := preparedSession(t, []mysqlproto.Packet{{1, []byte{0x00, 7, 0, 0, 0, 1, 0, 1, 0, 0x00, 0, 0}},
+		ColumnDefinitionPacket(1, "?"), EOFPacket(2), selftestColumnPacket(3, "id", TYPE_LONG), EOFPacket(4)})
+	server.handlePrepareResponse("SELECT id FROM users WHERE name = ?")
+
+	if len(server.proxy.ClientChannel) != 5 {
+		t.Fatalf("Expected 5 packets, got %d", len(server.proxy.ClientChannel))
+	}
+	for i := 0; i < 3; i++ {
+		<-server.proxy.ClientChannel
+	}
+	column, err := ReadColumn(NewPacketParser(<-server.proxy.ClientChannel))
+	if err != nil || column.Type != TYPE_VAR_STRING {
+		t.Errorf("Sanitized INT column should have been retyped: %v, %v", column, err)
+	}
+	if statement := server.proxy.statements[7]; statement == nil || statement.query != "SELECT id FROM users WHERE name = ?" {
+		t.Errorf("Bogus statement: %v", statement)
+	}
+}
+
+func TestHandleResults_cursor(t *testing.T) {
+	defer setMode(modeNormal)
+	setMode(modeForceSanitize) // So the INT column gets sanitized
+
+	cursorEOF := mysqlproto.Packet{4, []byte{0xFE, 0x00, 0x00, 0x42, 0x00}} // SERVER_STATUS_CURSOR_EXISTS
+	row := append([]byte{0x00, 0x00}, VariableString("Alice")...)
+	row = append(row, 42, 0, 0, 0)
+	server := preparedSession(t, []mysqlproto.Packet{{1, LengthEncodedInt(2)},
+		selftestColumnPacket(1, "name", TYPE_VAR_STRING), selftestColumnPacket(2, "id", TYPE_LONG), cursorEOF,
+		{1, row}, EOFPacket(1)})
+	statement := &preparedStatement{query: "SELECT name, id FROM users"}
+	server.proxy.statements = map[uint32]*preparedStatement{7: statement}
+
+	server.handleResults(statement)
+	if len(server.proxy.ClientChannel) != 4 {
+		t.Fatalf("Expected just the column definitions, got %d packets", len(server.proxy.ClientChannel))
+	}
+	for i := 0; i < 4; i++ {
+		<-server.proxy.ClientChannel
+	}
+	if len(statement.columns) != 2 || statement.columns[1].Type != TYPE_VAR_STRING || statement.received[1].Type != TYPE_LONG {
+		t.Fatalf("Bogus cursor columns: %v, %v", statement.columns, statement.received)
+	}
+
+	fetch := mysqlproto.Packet{0, []byte{COM_STMT_FETCH, 7, 0, 0, 0, 100, 0, 0, 0}}
+	if err := server.proxy.checkStatement(fetch); err != nil {
+		t.Fatalf("Bogus error fetching from an open cursor: %s", err)
+	}
+	server.handleFetchResponse(server.proxy.statementFor(fetch))
+	if len(server.proxy.ClientChannel) != 2 {
+		t.Fatalf("Expected a row and an EOF, got %d packets", len(server.proxy.ClientChannel))
+	}
+	values, err := NewPacketParser(<-server.proxy.ClientChannel).ReadBinaryRow(statement.columns)
+	if err != nil {
+		t.Fatalf("Bogus binary row: %s", err)
+	}
+	if string(values[0]) == "Alice" || string(values[1]) == "42" || len(values[1]) == 0 {
+		t.Errorf("Row from a cursor should have been sanitized: %q", values)
+	}
+}
+
+func TestCheckStatement(t *testing.T) {
+	proxy := &ProxyConnection{statements: map[uint32]*preparedStatement{7: {query: "SELECT 1"}}}
+	packets := map[string]bool{
+		"\x17\x07\x00\x00\x00\x00\x01\x00\x00\x00": true,  // COM_STMT_EXECUTE
+		"\x17\x08\x00\x00\x00\x00\x01\x00\x00\x00": false, // Some other statement
+		"\x1c\x07\x00\x00\x00\x64\x00\x00\x00":     false, // COM_STMT_FETCH, with no cursor
+		"\x19\x08\x00\x00\x00":                     true,  // COM_STMT_CLOSE, which the server can sort out
+	}
+	for payload, allowed := range packets {
+		if err := proxy.checkStatement(mysqlproto.Packet{0, []byte(payload)}); (err == nil) != allowed {
+			t.Errorf("Bogus check for %q: %v", payload, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// We used to assume the server was Percona 5.6 and had max_statement_time.
+// Now at startup we log in, look at a few server variables, and log what we
+// found: the version, the default auth plugin, the character set,
+// max_allowed_packet, and how (or whether) we can time out statements.
+// CompatibilityCheck decides what happens if something we need is missing:
+//
+//   - "warn" (the default) logs it and carries on without it.
+//   - "require" refuses to start, and also refuses if the server can't be
+//     reached at all.
+//   - "off" skips the check and assumes max_statement_time, like before.
+
+const (
+	compatibilityWarn    = "warn"
+	compatibilityRequire = "require"
+	compatibilityOff     = "off"
+)
+
+func checkCompatibilityMode(mode string) bool {
+	return mode == compatibilityWarn || mode == compatibilityRequire || mode == compatibilityOff
+}
+
+// timeoutSetting is how to set the statement timeout on a kind of server.
+type timeoutSetting struct {
+	variable  string // Empty if the server can't do it
+	perSecond int    // What the variable counts in
+}
+
+func (setting timeoutSetting) query(seconds int) string {
+	return fmt.Sprintf("SET %s = %d", setting.variable, seconds*setting.perSecond)
+}
+
+// statementTimeout is what setStatementTimeout uses. Until the probe says
+// otherwise, it's Percona's milliseconds.
+var statementTimeout = timeoutSetting{"max_statement_time", 1000}
+
+// probedVariables are the server variables the check looks at. Servers
+// leave out the ones they don't have.
+var probedVariables = []string{"version", "version_comment", "default_authentication_plugin", "authentication_policy",
+	"character_set_server", "collation_server", "max_allowed_packet", "max_statement_time", "max_execution_time"}
+
+// backendCompatibility is what we make of the server's variables.
+type backendCompatibility struct {
+	report   []string
+	problems []string
+	timeout  timeoutSetting
+}
+
+// fetchBackendVariables logs in to the server and reads probedVariables.
+func fetchBackendVariables() (map[string]string, error) {
+	server, err := NewServerConnection(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer server.Close()
+	if _, err := server.handshake(pooledCapabilities); err != nil {
+		return nil, err
+	}
+
+	result, err := runTextQuery(server.stream, "SHOW VARIABLES WHERE Variable_name IN ('"+strings.Join(probedVariables, "', '")+"')")
+	if err != nil {
+		return nil, err
+	}
+	variables := map[string]string{}
+	for _, row := range result.Rows {
+		if len(row) == 2 && row[0] != nil && row[1] != nil {
+			variables[strings.ToLower(*row[0])] = *row[1]
+		}
+	}
+	return variables, nil
+}
+
+// analyzeBackend works out what the server can do for us.
+func analyzeBackend(variables map[string]string, timeoutSeconds int) backendCompatibility {
+	var result backendCompatibility
+	version := variables["version"]
+	mariaDB := strings.Contains(strings.ToLower(version+" "+variables["version_comment"]), "mariadb")
+	result.report = append(result.report, fmt.Sprintf("MySQL server version %s (%s)", version, variables["version_comment"]))
+
+	plugin := variables["default_authentication_plugin"]
+	if plugin == "" {
+		plugin = variables["authentication_policy"]
+	}
+	result.report = append(result.report, fmt.Sprintf("Default auth plugin: %s", plugin))
+	result.report = append(result.report, fmt.Sprintf("Character set: %s (%s)", variables["character_set_server"], variables["collation_server"]))
+	if packet, err := strconv.Atoi(variables["max_allowed_packet"]); err == nil {
+		result.report = append(result.report, fmt.Sprintf("max_allowed_packet: %d bytes", packet))
+	}
+
+	_, hasStatementTime := variables["max_statement_time"]
+	_, hasExecutionTime := variables["max_execution_time"]
+	switch {
+	case hasStatementTime && mariaDB:
+		// MariaDB's counts in seconds.
+		result.timeout = timeoutSetting{"max_statement_time", 1}
+	case hasStatementTime:
+		result.timeout = timeoutSetting{"max_statement_time", 1000}
+	case hasExecutionTime:
+		result.timeout = timeoutSetting{"max_execution_time", 1000}
+		if timeoutSeconds > 0 {
+			result.problems = append(result.problems, "The server only has max_execution_time, so StatementTimeout only applies to SELECTs")
+		}
+	default:
+		if timeoutSeconds > 0 {
+			result.problems = append(result.problems, "The server has neither max_statement_time nor max_execution_time, so StatementTimeout can't be enforced")
+		}
+	}
+	if result.timeout.variable != "" {
+		result.report = append(result.report, fmt.Sprintf("Statement timeout: %s", result.timeout.variable))
+	}
+	return result
+}
+
+// checkCompatibility probes the server, logs what it found, and sets up
+// the statement timeout to match. It returns an error if the mode says we
+// shouldn't start.
+func checkCompatibility(mode string) error {
+	if mode == compatibilityOff {
+		return nil
+	}
+	variables, err := fetchBackendVariables()
+	if err != nil {
+		if mode == compatibilityRequire {
+			return fmt.Errorf("Can't check the MySQL server's compatibility: %s", err)
+		}
+		output.Log("Can't check the MySQL server's compatibility, assuming max_statement_time: %s", err)
+		return nil
+	}
+
+	result := analyzeBackend(variables, config.StatementTimeout)
+	for _, line := range result.report {
+		output.Log("%s", line)
+	}
+	for _, problem := range result.problems {
+		output.Log("Compatibility problem: %s", problem)
+	}
+	statementTimeout = result.timeout
+	if mode == compatibilityRequire && len(result.problems) > 0 {
+		return fmt.Errorf("The MySQL server is missing features we need: %s", strings.Join(result.problems, "; "))
+	}
+	return nil
+}
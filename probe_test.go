@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestAnalyzeBackend(t *testing.T) {
+	cases := []struct {
+		variables map[string]string
+		timeout   timeoutSetting
+		problems  int
+	}{
+		{map[string]string{"version": "5.6.40-84.0", "version_comment": "Percona Server", "max_statement_time": "0"}, timeoutSetting{"max_statement_time", 1000}, 0},
+		{map[string]string{"version": "10.6.12-MariaDB", "max_statement_time": "0.000000"}, timeoutSetting{"max_statement_time", 1}, 0},
+		{map[string]string{"version": "8.0.36", "max_execution_time": "0"}, timeoutSetting{"max_execution_time", 1000}, 1},
+		{map[string]string{"version": "5.6.51"}, timeoutSetting{"", 0}, 1},
+	}
+	for _, c := range cases {
+		result := analyzeBackend(c.variables, 20)
+		if result.timeout != c.timeout || len(result.problems) != c.problems {
+			t.Errorf("Bogus compatibility for %s: %+v", c.variables["version"], result)
+		}
+	}
+
+	if result := analyzeBackend(map[string]string{"version": "5.6.51"}, 0); len(result.problems) != 0 {
+		t.Errorf("A missing timeout variable shouldn't matter without a StatementTimeout: %v", result.problems)
+	}
+}
+
+// serveProbeBackend is a fake MySQL server that answers SHOW VARIABLES with
+// the variables.
+func serveProbeBackend(listener net.Listener, variables map[string]string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			stream := mysqlproto.NewStream(conn)
+			authPluginData := make([]byte, 20)
+			rand.Read(authPluginData)
+			WritePacket(stream, HandshakePacket(authPluginData, minimalCapabilities))
+			response, err := stream.NextPacket()
+			if err != nil {
+				return
+			}
+			WritePacket(stream, OKPacket(response.SequenceID))
+
+			command, err := stream.NextPacket()
+			if err != nil || !strings.HasPrefix(string(command.Payload[1:]), "SHOW VARIABLES") {
+				return
+			}
+			rows := [][]string{}
+			for name, value := range variables {
+				rows = append(rows, []string{name, value})
+			}
+			for _, packet := range ResultSetPackets(command.SequenceID, []string{"Variable_name", "Value"}, rows) {
+				WritePacket(stream, packet)
+			}
+		}()
+	}
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't start the fake MySQL server: %s", err)
+	}
+	defer backend.Close()
+	go serveProbeBackend(backend, map[string]string{"version": "5.6.51", "max_allowed_packet": "4194304"})
+
+	oldConfig, oldTimeout := config, statementTimeout
+	defer func() { config, statementTimeout = oldConfig, oldTimeout }()
+	config.MysqlHost = "127.0.0.1"
+	config.MysqlPort = backend.Addr().(*net.TCPAddr).Port
+	config.StatementTimeout = 20
+
+	if err := checkCompatibility(compatibilityRequire); err == nil {
+		t.Error("A server without a timeout variable should fail the check in require mode")
+	}
+	if err := checkCompatibility(compatibilityWarn); err != nil || statementTimeout.variable != "" {
+		t.Errorf("A server without a timeout variable should only be warned about: %v (%+v)", err, statementTimeout)
+	}
+
+	config.MysqlPort = 1
+	if err := checkCompatibility(compatibilityRequire); err == nil {
+		t.Error("An unreachable server should fail the check in require mode")
+	}
+}
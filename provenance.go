@@ -0,0 +1,620 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The server's column definitions only say where a column came from when
+// it's a table's column as-is. Expressions (even CAST(email AS CHAR)) come
+// back with no table, and columns of derived tables and scalar subqueries
+// can too, depending on the server, so a rule on users.email wouldn't see
+// `SELECT contact FROM (SELECT email AS contact FROM users) u`. Tracing
+// picks apart the select list and the FROM clause, and follows each result
+// column back through aliases, JOINs and subqueries to the table columns
+// it's made of. Like the rest of sql.go, it's not a real parser: anything it
+// can't follow is left to the column definitions, same as before.
+
+// columnTrace is where a result column's values come from.
+type columnTrace struct {
+	name    string   // What the column's called in the result
+	sources []Column // The table columns it's made of (just Database, Table and Name)
+	direct  bool     // Whether it's its one source as-is, rather than an expression on it
+
+	// Some of what it's made of couldn't be followed, so sources is
+	// incomplete. Without this, it'd look just like a constant.
+	untraceable bool
+}
+
+// traceTable is something a select list can take columns from.
+type traceTable struct {
+	database string
+	name     string
+	derived  bool          // A subquery in the FROM clause, rather than a real table
+	columns  []columnTrace // The subquery's columns
+}
+
+// traceScope is the tables in a SELECT's FROM clause, by alias (or name, if
+// they don't have one).
+type traceScope struct {
+	database   string
+	tables     map[string]traceTable
+	incomplete bool // Some of the FROM clause couldn't be followed
+}
+
+// maxTraceDepth stops us from recursing forever into nested subqueries.
+const maxTraceDepth = 16
+
+var traceIdentifier = "(?:\\d*[a-zA-Z_$][\\w$]*|`[^`]+`)" // Not a number
+var traceReferenceRegex = regexp.MustCompile("^" + traceIdentifier + "(?:\\s*\\.\\s*" + traceIdentifier + "){0,2}(?:\\s*\\.\\s*\\*)?$|^\\*$")
+var traceTableRegex = regexp.MustCompile("(?is)^(" + traceIdentifier + ")(?:\\s*\\.\\s*(" + traceIdentifier + "))?(?:\\s+(?:AS\\s+)?(" + traceIdentifier + "))?$")
+var traceDerivedAliasRegex = regexp.MustCompile("(?is)^(?:AS\\s+)?(" + traceIdentifier + ")")
+
+// tracePassthroughRegexes match expressions that hand back their argument's
+// value, only retyped or recollated.
+var tracePassthroughRegexes = []*regexp.Regexp{
+	regexp.MustCompile(`(?is)^CAST\s*\((.+)\s+AS\s+[\w\s(),]+\)$`),
+	regexp.MustCompile(`(?is)^CONVERT\s*\((.+?)\s*(?:,|\s+USING\s)[\w\s(),]+\)$`),
+	regexp.MustCompile(`(?is)^BINARY\s+(.+)$`),
+	regexp.MustCompile(`(?is)^(.+?)\s+COLLATE\s+[\w'"]+$`),
+}
+
+var traceSelectModifierRegex = regexp.MustCompile(`(?i)^((ALL|DISTINCT|DISTINCTROW|HIGH_PRIORITY|STRAIGHT_JOIN|SQL_\w+)\s+)+`)
+var traceAliasRegex = regexp.MustCompile("(?is)^(.+?)\\s+AS\\s+([\\w$]+|`[^`]+`|'[^']*'|\"[^\"]*\")$")
+var traceImplicitAliasRegex = regexp.MustCompile("(?s)^(.*[\\w`)'\"])\\s+([\\w$]+|`[^`]+`)$")
+
+// traceKeywords can follow a table or an expression without being its
+// alias, or sit in an expression without being a column.
+var traceKeywords = map[string]bool{
+	"WHERE": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "CROSS": true, "NATURAL": true,
+	"STRAIGHT_JOIN": true, "GROUP": true, "ORDER": true, "LIMIT": true, "HAVING": true, "UNION": true,
+	"FOR": true, "LOCK": true, "INTO": true, "WINDOW": true, "END": true, "USE": true, "FORCE": true, "IGNORE": true,
+	"ON": true, "USING": true, "OUTER": true,
+
+	"AND": true, "OR": true, "XOR": true, "NOT": true, "NULL": true, "IS": true, "IN": true, "LIKE": true,
+	"REGEXP": true, "RLIKE": true, "BETWEEN": true, "CASE": true, "WHEN": true, "THEN": true, "ELSE": true,
+	"AS": true, "DISTINCT": true, "TRUE": true, "FALSE": true, "UNKNOWN": true, "INTERVAL": true, "DIV": true,
+	"MOD": true, "SEPARATOR": true, "COLLATE": true, "BINARY": true, "ESCAPE": true, "SOUNDS": true,
+	"ALL": true, "ANY": true, "SOME": true, "EXISTS": true, "OVER": true, "PARTITION": true, "BY": true,
+	"ASC": true, "DESC": true, "ROWS": true, "RANGE": true, "PRECEDING": true, "FOLLOWING": true,
+	"CURRENT": true, "ROW": true, "UNBOUNDED": true, "DUAL": true,
+
+	"SIGNED": true, "UNSIGNED": true, "INTEGER": true, "INT": true, "CHAR": true, "YEAR": true,
+	"MICROSECOND": true, "SECOND": true, "MINUTE": true, "HOUR": true, "DAY": true, "WEEK": true, "MONTH": true,
+	"QUARTER": true, "SECOND_MICROSECOND": true, "MINUTE_MICROSECOND": true,
+	"MINUTE_SECOND": true, "HOUR_MICROSECOND": true, "HOUR_SECOND": true, "HOUR_MINUTE": true,
+	"DAY_MICROSECOND": true, "DAY_SECOND": true, "DAY_MINUTE": true, "DAY_HOUR": true, "YEAR_MONTH": true,
+
+	"CURRENT_DATE": true, "CURRENT_TIME": true, "CURRENT_TIMESTAMP": true, "CURRENT_USER": true,
+	"LOCALTIME": true, "LOCALTIMESTAMP": true, "UTC_DATE": true, "UTC_TIME": true, "UTC_TIMESTAMP": true,
+}
+
+// traceBuiltinFunctions are the server's own functions, whose values come
+// from their arguments. Anything else called like a function is a stored
+// function (or a UDF), which can read whatever it likes, so there's no
+// telling what it's made of.
+var traceBuiltinFunctions = map[string]bool{}
+
+func init() {
+	for _, name := range strings.Fields(`
+		ABS ACOS ADDDATE ADDTIME AES_DECRYPT AES_ENCRYPT ANY_VALUE ASCII ASIN ATAN ATAN2 AVG
+		BENCHMARK BIN BIN_TO_UUID BIT_AND BIT_COUNT BIT_LENGTH BIT_OR BIT_XOR
+		CAST CEIL CEILING CHAR CHAR_LENGTH CHARACTER_LENGTH CHARSET COALESCE COERCIBILITY COLLATION
+		COMPRESS CONCAT CONCAT_WS CONNECTION_ID CONV CONVERT CONVERT_TZ COS COT COUNT CRC32
+		CUME_DIST CURDATE CURRENT_DATE CURRENT_ROLE CURRENT_TIME CURRENT_TIMESTAMP CURRENT_USER CURTIME
+		DATABASE DATE DATE_ADD DATE_FORMAT DATE_SUB DATEDIFF DAY DAYNAME DAYOFMONTH DAYOFWEEK DAYOFYEAR
+		DEFAULT DEGREES DENSE_RANK ELT EXP EXPORT_SET EXTRACT FIELD FIND_IN_SET FIRST_VALUE FLOOR
+		FORMAT FORMAT_BYTES FORMAT_PICO_TIME FOUND_ROWS FROM_BASE64 FROM_DAYS FROM_UNIXTIME
+		GET_FORMAT GREATEST GROUP_CONCAT GROUPING HEX HOUR IF IFNULL INET_ATON INET_NTOA INET6_ATON
+		INET6_NTOA INSERT INSTR INTERVAL IS_IPV4 IS_IPV6 IS_UUID ISNULL JSON_ARRAY JSON_ARRAYAGG
+		JSON_ARRAY_APPEND JSON_ARRAY_INSERT JSON_CONTAINS JSON_CONTAINS_PATH JSON_DEPTH JSON_EXTRACT
+		JSON_INSERT JSON_KEYS JSON_LENGTH JSON_MERGE JSON_MERGE_PATCH JSON_MERGE_PRESERVE JSON_OBJECT
+		JSON_OBJECTAGG JSON_OVERLAPS JSON_PRETTY JSON_QUOTE JSON_REMOVE JSON_REPLACE JSON_SEARCH
+		JSON_SET JSON_TYPE JSON_UNQUOTE JSON_VALID JSON_VALUE LAG LAST_DAY LAST_INSERT_ID LAST_VALUE
+		LCASE LEAD LEAST LEFT LENGTH LN LOCALTIME LOCALTIMESTAMP LOCATE LOG LOG10 LOG2 LOWER LPAD
+		LTRIM MAKE_SET MAKEDATE MAKETIME MAX MD5 MICROSECOND MID MIN MINUTE MOD MONTH MONTHNAME
+		NOW NTH_VALUE NTILE NULLIF OCT OCTET_LENGTH ORD PERCENT_RANK PERIOD_ADD PERIOD_DIFF PI
+		POSITION POW POWER QUARTER QUOTE RADIANS RAND RANDOM_BYTES RANK REGEXP_INSTR REGEXP_LIKE
+		REGEXP_REPLACE REGEXP_SUBSTR REPEAT REPLACE REVERSE RIGHT ROUND ROW_COUNT ROW_NUMBER RPAD
+		RTRIM SCHEMA SEC_TO_TIME SECOND SESSION_USER SHA SHA1 SHA2 SIGN SIN SOUNDEX SPACE SQRT
+		STD STDDEV STDDEV_POP STDDEV_SAMP STR_TO_DATE STRCMP SUBDATE SUBSTR SUBSTRING SUBSTRING_INDEX
+		SUBTIME SUM SYSDATE SYSTEM_USER TAN TIME TIME_FORMAT TIME_TO_SEC TIMEDIFF TIMESTAMP
+		TIMESTAMPADD TIMESTAMPDIFF TO_BASE64 TO_DAYS TO_SECONDS TRIM TRUNCATE UCASE UNCOMPRESS
+		UNCOMPRESSED_LENGTH UNHEX UNIX_TIMESTAMP UPPER USER UTC_DATE UTC_TIME UTC_TIMESTAMP UUID
+		UUID_SHORT UUID_TO_BIN VALUES VAR_POP VAR_SAMP VARIANCE VERSION WEEK WEEKDAY WEEKOFYEAR
+		WEIGHT_STRING YEAR YEARWEEK`) {
+		traceBuiltinFunctions[name] = true
+	}
+}
+
+// traceJoinModifiers can come before JOIN.
+var traceJoinModifiers = map[string]bool{
+	"INNER": true, "LEFT": true, "RIGHT": true, "OUTER": true, "CROSS": true, "NATURAL": true, "FULL": true,
+}
+
+// traceClauseEnds end the FROM clause.
+var traceClauseEnds = map[string]bool{
+	"WHERE": true, "GROUP": true, "HAVING": true, "ORDER": true, "LIMIT": true, "WINDOW": true,
+	"FOR": true, "LOCK": true, "INTO": true, "PROCEDURE": true,
+}
+
+// traceColumns traces each of the columns in the query's result, or returns
+// nil if it can't follow the query well enough to say which is which.
+func traceColumns(query string, database string, count int) []columnTrace {
+	statements := splitStatements(query)
+	if len(statements) != 1 {
+		return nil
+	}
+	// Statements that describe things rather than read them don't have
+	// any table's values in their results.
+	switch firstKeyword(statements[0]) {
+	case "EXPLAIN", "DESCRIBE", "DESC", "SHOW":
+		return make([]columnTrace, count)
+	}
+	traces := traceSelect(statements[0], database, 0)
+	if len(traces) != count {
+		return nil
+	}
+	for _, trace := range traces {
+		if trace.name == "*" {
+			return nil
+		}
+	}
+	return traces
+}
+
+// traceResult fills in where a result column came from, if the server
+// didn't say and its trace does. Expressions get the columns they're made
+// of as their inputs.
+func traceResult(column Column, traces []columnTrace, i int) Column {
+	if column.Database != "" || i >= len(traces) || traces[i].untraceable {
+		return column
+	}
+	if trace := traces[i]; trace.direct && len(trace.sources) == 1 {
+		source := trace.sources[0]
+		column.Database, column.Table, column.Name = source.Database, source.Table, source.Name
+	} else {
+		column.inputs = append([]Column{}, trace.sources...)
+	}
+	return column
+}
+
+// traceSelect traces the columns of a SELECT, or returns nil for anything
+// else. "*" can't be expanded, so it comes back as a column of its own.
+func traceSelect(query string, database string, depth int) []columnTrace {
+	query = strings.TrimSpace(stripLeadingComments(query))
+	words := topLevelWords(query)
+	if depth > maxTraceDepth || len(words) == 0 || words[0].word != "SELECT" {
+		return nil
+	}
+
+	selectEnd, fromStart, fromEnd := len(query), -1, len(query)
+	for _, word := range words[1:] {
+		if word.word == "UNION" || word.word == "EXCEPT" || word.word == "INTERSECT" {
+			// The columns' values come from more than one select list.
+			return nil
+		}
+		if fromStart < 0 && word.word == "FROM" {
+			selectEnd, fromStart = word.start, word.end
+		} else if fromStart < 0 && word.word == "INTO" {
+			return nil
+		} else if fromStart >= 0 && fromEnd == len(query) && traceClauseEnds[word.word] {
+			fromEnd = word.start
+		}
+	}
+
+	scope := traceScope{database, map[string]traceTable{}, false}
+	if fromStart >= 0 {
+		scope.addTables(query[fromStart:fromEnd], depth)
+	}
+	traces := []columnTrace{}
+	selectList := traceSelectModifierRegex.ReplaceAllString(strings.TrimSpace(query[words[0].end:selectEnd]), "")
+	for _, item := range splitTopLevel(selectList, ',') {
+		traces = append(traces, scope.traceItem(strings.TrimSpace(item), depth))
+	}
+	return traces
+}
+
+// addTables adds the tables from a FROM clause to the scope.
+func (scope *traceScope) addTables(clause string, depth int) {
+	pieces := []string{}
+	start := 0
+	words := topLevelWords(clause)
+	for i, word := range words {
+		if word.word != "JOIN" && word.word != "STRAIGHT_JOIN" {
+			continue
+		}
+		end := word.start
+		for j := i - 1; j >= 0 && traceJoinModifiers[words[j].word]; j-- {
+			end = words[j].start
+		}
+		pieces = append(pieces, clause[start:end])
+		start = word.end
+	}
+	pieces = append(pieces, clause[start:])
+
+	for _, piece := range pieces {
+		for _, factor := range splitTopLevel(piece, ',') {
+			scope.addTable(strings.TrimSpace(factor), depth)
+		}
+	}
+}
+
+// addTable adds one table, subquery or parenthesized join to the scope.
+func (scope *traceScope) addTable(factor string, depth int) {
+	for _, word := range topLevelWords(factor) {
+		if word.word == "ON" || word.word == "USING" || word.word == "USE" || word.word == "FORCE" || word.word == "IGNORE" {
+			factor = strings.TrimSpace(factor[:word.start])
+			break
+		}
+	}
+	for _, word := range topLevelWords(factor) {
+		if word.word == "PARTITION" && strings.HasPrefix(strings.TrimSpace(factor[word.end:]), "(") {
+			rest := strings.TrimSpace(factor[word.end:])
+			if end := closingParen(rest); end >= 0 {
+				factor = strings.TrimSpace(factor[:word.start]) + " " + strings.TrimSpace(rest[end+1:])
+				factor = strings.TrimSpace(factor)
+			}
+			break
+		}
+	}
+	if words := topLevelWords(factor); len(words) > 0 && words[0].start == 0 && words[0].word == "LATERAL" {
+		factor = strings.TrimSpace(factor[words[0].end:])
+	}
+
+	if strings.HasPrefix(factor, "(") {
+		end := closingParen(factor)
+		if end < 0 {
+			scope.incomplete = true
+			return
+		}
+		inner := factor[1:end]
+		if firstKeyword(inner) != "SELECT" {
+			scope.addTables(inner, depth)
+			return
+		}
+		alias := traceDerivedAliasRegex.FindStringSubmatch(strings.TrimSpace(factor[end+1:]))
+		if alias == nil {
+			scope.incomplete = true
+			return
+		}
+		name := strings.ToLower(unquoteIdentifier(alias[1]))
+		columns := traceSelect(inner, scope.database, depth+1)
+		if columns == nil {
+			scope.incomplete = true
+		}
+		scope.tables[name] = traceTable{"", name, true, columns}
+		return
+	}
+
+	match := traceTableRegex.FindStringSubmatch(factor)
+	if match == nil || traceKeywords[strings.ToUpper(match[1])] && match[2] == "" {
+		if !strings.EqualFold(factor, "DUAL") {
+			scope.incomplete = true
+		}
+		return
+	}
+	table := traceTable{database: scope.database, name: strings.ToLower(unquoteIdentifier(match[1]))}
+	if match[2] != "" {
+		table.database, table.name = table.name, strings.ToLower(unquoteIdentifier(match[2]))
+	}
+	alias := table.name
+	if match[3] != "" && !traceKeywords[strings.ToUpper(match[3])] {
+		alias = strings.ToLower(unquoteIdentifier(match[3]))
+	}
+	scope.tables[alias] = table
+}
+
+// traceItem traces one expression in a select list.
+func (scope *traceScope) traceItem(item string, depth int) columnTrace {
+	expression, alias := splitSelectAlias(item)
+	name := alias
+	if name == "" {
+		name = expression
+	}
+	expression = unwrapParens(expression)
+
+	// A scalar subquery is whatever its one column is.
+	if strings.HasPrefix(expression, "(") && closingParen(expression) == len(expression)-1 {
+		if traces := traceSelect(expression[1:len(expression)-1], scope.database, depth+1); len(traces) == 1 {
+			traces[0].name = name
+			return traces[0]
+		}
+	}
+
+	for unwrapped := true; unwrapped; {
+		unwrapped = false
+		for _, passthrough := range tracePassthroughRegexes {
+			if match := passthrough.FindStringSubmatch(expression); match != nil {
+				expression, unwrapped = unwrapParens(match[1]), true
+				break
+			}
+		}
+	}
+	if traceReferenceRegex.MatchString(expression) {
+		if alias == "" && item == expression {
+			// The server names plain columns without the table.
+			name = unquoteIdentifier(expression[strings.LastIndex(expression, ".")+1:])
+		}
+		trace, ok := scope.resolve(expression)
+		if !ok {
+			return columnTrace{name: name, untraceable: true}
+		}
+		trace.name = name
+		return trace
+	}
+
+	trace := columnTrace{name: name}
+	references, subqueries, opaque := columnReferences(expression)
+	trace.untraceable = opaque
+	for _, reference := range references {
+		sources, ok := scope.candidates(reference)
+		trace.sources = append(trace.sources, sources...)
+		trace.untraceable = trace.untraceable || !ok
+	}
+	for _, subquery := range subqueries {
+		traces := traceSelect(subquery, scope.database, depth+1)
+		trace.untraceable = trace.untraceable || traces == nil
+		for _, resolved := range traces {
+			trace.sources = append(trace.sources, resolved.sources...)
+			trace.untraceable = trace.untraceable || resolved.untraceable
+		}
+	}
+	return trace
+}
+
+// resolve traces a column reference, like name, u.name or shop.users.name.
+func (scope *traceScope) resolve(reference string) (columnTrace, bool) {
+	parts := strings.Split(reference, ".")
+	for i := range parts {
+		parts[i] = strings.ToLower(unquoteIdentifier(parts[i]))
+	}
+	name := parts[len(parts)-1]
+
+	switch len(parts) {
+	case 3:
+		return columnTrace{name, []Column{{Database: parts[0], Table: parts[1], Name: name}}, true, false}, true
+	case 2:
+		// A table we don't know is most likely an outer query's, but we
+		// don't keep track of those.
+		if table, ok := scope.tables[parts[0]]; ok {
+			return table.resolve(name)
+		}
+		return columnTrace{}, false
+	}
+
+	if len(scope.tables) == 1 && !scope.incomplete {
+		for _, table := range scope.tables {
+			return table.resolve(name)
+		}
+	}
+	// With more than one table, only a subquery's columns have names we
+	// know, so those are all we can match.
+	found, ok := columnTrace{}, false
+	for _, table := range scope.tables {
+		if trace, has := table.resolve(name); has && table.derived && name != "*" {
+			if ok {
+				return columnTrace{}, false
+			}
+			found, ok = trace, true
+		}
+	}
+	return found, ok
+}
+
+// candidates returns the columns a reference in an expression might be,
+// and whether we could tell. When we can't tell which table an unqualified
+// column is from, it's every table that might have it, since leaving the
+// right one out would let its values through.
+func (scope *traceScope) candidates(reference string) ([]Column, bool) {
+	if trace, ok := scope.resolve(reference); ok {
+		return trace.sources, !trace.untraceable
+	}
+	if strings.Contains(reference, ".") || scope.incomplete {
+		return nil, false
+	}
+	sources := []Column{}
+	for _, table := range scope.tables {
+		if trace, ok := table.resolve(strings.ToLower(unquoteIdentifier(reference))); ok {
+			if trace.untraceable {
+				return nil, false
+			}
+			sources = append(sources, trace.sources...)
+		}
+	}
+	return sources, len(sources) > 0
+}
+
+// resolve traces one of the table's columns.
+func (table traceTable) resolve(name string) (columnTrace, bool) {
+	if !table.derived {
+		return columnTrace{name, []Column{{Database: table.database, Table: table.name, Name: name}}, true, false}, true
+	}
+	var star *columnTrace
+	for i, trace := range table.columns {
+		if trace.name == "*" {
+			star = &table.columns[i]
+		} else if strings.EqualFold(trace.name, name) {
+			return trace, true
+		}
+	}
+	// A subquery's "*" has whatever columns its table has.
+	if star != nil && star.direct && len(star.sources) == 1 {
+		source := star.sources[0]
+		return columnTrace{name, []Column{{Database: source.Database, Table: source.Table, Name: name}}, true, false}, true
+	}
+	return columnTrace{}, false
+}
+
+// splitSelectAlias splits a select list item into its expression and its
+// alias, which is "" if it doesn't have one.
+func splitSelectAlias(item string) (string, string) {
+	if aliased := traceAliasRegex.FindStringSubmatch(item); aliased != nil {
+		return strings.TrimSpace(aliased[1]), unquoteIdentifier(aliased[2])
+	}
+	if aliased := traceImplicitAliasRegex.FindStringSubmatch(item); aliased != nil && !traceKeywords[strings.ToUpper(aliased[2])] {
+		return strings.TrimSpace(aliased[1]), unquoteIdentifier(aliased[2])
+	}
+	return strings.TrimSpace(item), ""
+}
+
+// unwrapParens strips parentheses from around the whole expression, unless
+// they're a subquery's.
+func unwrapParens(expression string) string {
+	expression = strings.TrimSpace(expression)
+	for strings.HasPrefix(expression, "(") && closingParen(expression) == len(expression)-1 &&
+		firstKeyword(expression[1:len(expression)-1]) != "SELECT" {
+		expression = strings.TrimSpace(expression[1 : len(expression)-1])
+	}
+	return expression
+}
+
+// closingParen returns the index of the parenthesis closing the one the
+// string starts with, or -1.
+func closingParen(str string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(str); i++ {
+		char := str[i]
+		switch {
+		case quote != 0:
+			if char == '\\' && quote != '`' {
+				i++
+			} else if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"' || char == '`':
+			quote = char
+		case char == '(':
+			depth++
+		case char == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// sqlWord is a bare word outside quotes and parentheses, uppercased.
+type sqlWord struct {
+	word       string
+	start, end int
+}
+
+// topLevelWords returns the bare words outside quotes and parentheses,
+// which is where a statement's keywords are. Words that are part of a
+// qualified name or a variable are left out.
+func topLevelWords(str string) []sqlWord {
+	words := []sqlWord{}
+	depth := 0
+	var quote byte
+	for i := 0; i < len(str); i++ {
+		char := str[i]
+		switch {
+		case quote != 0:
+			if char == '\\' && quote != '`' {
+				i++
+			} else if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"' || char == '`':
+			quote = char
+		case char == '(':
+			depth++
+		case char == ')':
+			depth--
+		case isWordChar(char):
+			start := i
+			for i < len(str) && isWordChar(str[i]) {
+				i++
+			}
+			qualified := (start > 0 && (str[start-1] == '.' || str[start-1] == '@')) || (i < len(str) && str[i] == '.')
+			if depth == 0 && !qualified {
+				words = append(words, sqlWord{strings.ToUpper(str[start:i]), start, i})
+			}
+			i--
+		}
+	}
+	return words
+}
+
+func isWordChar(char byte) bool {
+	return char == '_' || char == '$' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')
+}
+
+// columnReferences returns the column references in an expression, the
+// text of any subqueries in it, and whether it has anything else we can't
+// see into: a user variable (which could have been set from any table) or
+// a function that isn't built in.
+func columnReferences(expression string) ([]string, []string, bool) {
+	references, subqueries := []string{}, []string{}
+	skipNext, opaque := false, false
+	for i := 0; i < len(expression); i++ {
+		char := expression[i]
+		switch {
+		case char == '\'' || char == '"':
+			for i++; i < len(expression) && expression[i] != char; i++ {
+				if expression[i] == '\\' {
+					i++
+				}
+			}
+		case char == '(':
+			if firstKeyword(expression[i+1:]) == "SELECT" {
+				end := closingParen(expression[i:])
+				if end < 0 {
+					return references, subqueries, true
+				}
+				subqueries = append(subqueries, expression[i+1:i+end])
+				i += end
+			}
+		case char == '@':
+			opaque = opaque || !strings.HasPrefix(expression[i:], "@@")
+			for i+1 < len(expression) && (expression[i+1] == '@' || expression[i+1] == '.' || isWordChar(expression[i+1])) {
+				i++
+			}
+		case char == '`' || (isWordChar(char) && (char < '0' || char > '9')):
+			start := i
+			for i < len(expression) {
+				if expression[i] == '`' {
+					end := strings.IndexByte(expression[i+1:], '`')
+					if end < 0 {
+						return references, subqueries, true
+					}
+					i += end + 2
+				} else {
+					for i < len(expression) && isWordChar(expression[i]) {
+						i++
+					}
+				}
+				if i >= len(expression) || expression[i] != '.' {
+					break
+				}
+				i++
+			}
+			reference := expression[start:i]
+			rest := strings.TrimLeft(expression[i:], " \t\r\n")
+			i--
+			word := strings.ToUpper(reference)
+			switch {
+			case skipNext:
+				skipNext = false
+			case strings.HasPrefix(rest, "("):
+				opaque = opaque || !traceKeywords[word] && !traceBuiltinFunctions[word]
+			case strings.HasPrefix(rest, "'"):
+				// A literal like _utf8mb4'...', x'ff' or DATE '2024-01-01'.
+			case word == "AS" || word == "USING" || word == "COLLATE":
+				// Followed by a type, a character set or a collation.
+				skipNext = true
+			case !traceKeywords[word]:
+				references = append(references, reference)
+			}
+		case char >= '0' && char <= '9':
+			for i+1 < len(expression) && isWordChar(expression[i+1]) {
+				i++
+			}
+		}
+	}
+	return references, subqueries, opaque
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestTraceSelect(t *testing.T) {
+	queries := map[string][]string{
+		"SELECT u.email AS contact, o.total FROM users u JOIN shop.orders AS o ON o.user_id = u.id": {
+			"contact <- some_db.users.email", "total <- shop.orders.total"},
+		"SELECT contact FROM (SELECT email AS contact FROM users) x LEFT OUTER JOIN orders USING (id)": {
+			"contact <- some_db.users.email"},
+		"SELECT (SELECT email FROM users LIMIT 1) AS e, CAST(`name` AS CHAR(10)) n FROM customers": {
+			"e <- some_db.users.email", "n <- some_db.customers.name"},
+		"SELECT CONCAT(u.name, ' <', LOWER(u.email), '>') AS who, COUNT(*), @@version FROM users u": {
+			"who <~ some_db.users.name some_db.users.email", "COUNT(*) <~", "@@version <~"},
+		"SELECT name, x.email FROM users, (SELECT email FROM archive.users) AS x": {
+			"name <?", "email <- archive.users.email"},
+		"SELECT LOWER(email) FROM users PARTITION (p0)": {
+			"LOWER(email) <~ some_db.users.email"},
+		"SELECT UPPER(email) FROM (SELECT * FROM users) t": {
+			"UPPER(email) <~ some_db.users.email"},
+		"SELECT UPPER(email) FROM (SELECT email FROM a UNION SELECT email FROM b) t": {
+			"UPPER(email) <?"},
+		"SELECT LOWER(x.email), y.name FROM users u": {
+			"LOWER(x.email) <?", "name <?"},
+		"SELECT LOWER(email) FROM JSON_TABLE(@j, '$[*]' COLUMNS (email TEXT PATH '$')) AS jt": {
+			"LOWER(email) <?"},
+		"SELECT a.b FROM (SELECT 1 AS b) a WHERE a.b IN (SELECT id FROM users)": {
+			"b <~"},
+		"SELECT DATE_FORMAT(created, '%Y') AS year, DATE '2024-01-01', id + INTERVAL 1 DAY FROM t": {
+			"year <~ some_db.t.created", "DATE '2024-01-01' <~", "id + INTERVAL 1 DAY <~ some_db.t.id"},
+		"SELECT @e, CONCAT(@e, ''), @@version, leak_email(1), shop.leak(name) AS l FROM users": {
+			"@e <?", "CONCAT(@e, '') <?", "@@version <~", "leak_email(1) <?", "l <? some_db.users.name"},
+	}
+	for query, expected := range queries {
+		traces := traceSelect(query, "some_db", 0)
+		got := []string{}
+		for _, trace := range traces {
+			arrow := " <~"
+			if trace.direct {
+				arrow = " <-"
+			} else if trace.untraceable {
+				arrow = " <?"
+			}
+			described := trace.name + arrow
+			for _, source := range trace.sources {
+				described += " " + source.Database + "." + source.Table + "." + source.Name
+			}
+			got = append(got, described)
+		}
+		if strings.Join(got, ", ") != strings.Join(expected, ", ") {
+			t.Errorf("Bogus trace for '%s':\n%s\ninstead of\n%s", query, strings.Join(got, ", "), strings.Join(expected, ", "))
+		}
+	}
+
+	for _, query := range []string{"SELECT * FROM users", "SELECT a FROM t UNION SELECT b FROM u", "SELECT 1; SELECT 2", "UPDATE t SET a = 1"} {
+		if traces := traceColumns(query, "some_db", 1); traces != nil {
+			t.Errorf("Shouldn't have traced '%s': %v", query, traces)
+		}
+	}
+	if traces := traceColumns("SELECT a, b FROM t", "some_db", 3); traces != nil {
+		t.Errorf("Traces for the wrong number of columns: %v", traces)
+	}
+}
+
+func TestReadColumns_traced(t *testing.T) {
+	// The server doesn't say where an expression's values came from.
+	server := preparedSession(t, []mysqlproto.Packet{{1, LengthEncodedInt(1)},
+		ColumnDefinitionPacket(1, "s"), EOFPacket(2), TextRowPacket(3, []string{"hunter2"}), EOFPacket(4)})
+	server.proxy.SetQuery("SELECT CAST(secret AS CHAR) AS s FROM some_db.table1")
+
+	server.handleResults(nil)
+	if len(server.proxy.ClientChannel) != 5 {
+		t.Fatalf("Expected 5 packets, got %d", len(server.proxy.ClientChannel))
+	}
+	for i := 0; i < 3; i++ {
+		<-server.proxy.ClientChannel
+	}
+	values, err := readRowValues(<-server.proxy.ClientChannel, []Column{{IsString: true}})
+	if err != nil || string(values[0]) == "hunter2" {
+		t.Errorf("Traced column should have been sanitized: %q, %v", values, err)
+	}
+
+	column := traceResult(Column{Database: "other", Table: "t", Name: "x"}, traceSelect("SELECT secret FROM table1", "some_db", 0), 0)
+	if column.Database != "other" {
+		t.Errorf("Column definitions that say where they're from should win: %v", column)
+	}
+	column = traceResult(Column{IsString: true, Alias: "n"}, traceSelect("SELECT LOWER(x.email) AS n FROM users u", "some_db", 0), 0)
+	if column.inputs != nil {
+		t.Errorf("Expressions we couldn't follow shouldn't get inputs: %v", column.inputs)
+	}
+	column = traceResult(Column{IsString: true, Alias: "s"}, traceSelect("SELECT SUBSTRING(secret, 1, 3) AS s FROM table1", "some_db", 0), 0)
+	if len(column.inputs) != 1 || column.inputs[0].Name != "secret" || column.IsSafe() {
+		t.Errorf("Expressions should get their inputs, and be as unsafe as them: %v", column)
+	}
+
+	for _, query := range []string{
+		"SELECT LOWER(email) FROM users PARTITION (p0)",
+		"SELECT UPPER(email) FROM (SELECT * FROM users) t",
+		"SELECT UPPER(email) FROM (SELECT email FROM a UNION SELECT email FROM b) t",
+		"SELECT LOWER(email) FROM JSON_TABLE(@j, '$[*]' COLUMNS (email TEXT PATH '$')) AS jt",
+		"SELECT @e",
+		"SELECT CONCAT(@e,'')",
+		"SELECT leak_email(1)",
+	} {
+		column := traceResult(Column{IsString: true, Alias: "e"}, traceColumns(query, "some_db", 1), 0)
+		if column.IsSafe() {
+			t.Errorf("Expression in '%s' should have been sanitized: %v", query, column)
+		}
+	}
+	for _, query := range []string{"SELECT VERSION()", "EXPLAIN SELECT LOWER(email) FROM users"} {
+		column := traceResult(Column{IsString: true, Alias: "v"}, traceColumns(query, "some_db", 1), 0)
+		if !column.IsSafe() {
+			t.Errorf("Column in '%s' isn't made from any table's, so it should be safe: %v", query, column)
+		}
+	}
+}
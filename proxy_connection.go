@@ -1,41 +1,211 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/pubnative/mysqlproto-go"
 )
 
 type ProxyConnection struct {
-	client        *ClientConnection
-	server        *ServerConnection
-	ClientChannel chan mysqlproto.Packet
-	ServerChannel chan mysqlproto.Packet
-	Capabilities  uint32
-	Database      string
+	client          *ClientConnection
+	server          *ServerConnection
+	ClientChannel   chan mysqlproto.Packet
+	ServerChannel   chan mysqlproto.Packet
+	Capabilities    uint32
+	zstdLevel       byte // The zstd compression level the client asked for, if it did
+	Database        string
+	closeOnce       sync.Once
+	ctx             context.Context
+	cancel          context.CancelFunc
+	credentials     Credentials // What we log into the server with, fixed for the whole session
+	id              uint64      // For the admin API
+	clientAddr      string
+	started         time.Time
+	usedQueries     int64 // What the session's used of its budget
+	usedRows        int64
+	usedBytes       int64
+	throttled       bool // Over budget, and we've said so
+	trace           *PacketTrace
+	capture         *dedupCapture                 // Set while we're running a query other sessions are waiting on
+	transactionOpen bool                          // As of the server's last reply, so we don't share its results
+	outVariables    bool                          // Passed a user variable to a CALL, which might have put something sensitive in it
+	statements      map[uint32]*preparedStatement // Prepared on the server, by ID
+
+	// The client goroutine sets these during the handshake, so they're
+	// protected by labelMutex.
+	labelMutex    sync.Mutex
+	username      string
+	admin         bool   // Logged in as one of the AdminUsers
+	output        Output // Like the global one, but with the labels attached
+	labelCounters []*LabelCounters
+	recorder      *SessionRecorder // nil unless the user's sessions are recorded
+	ruleSet       *RuleSet         // Which version of the column rules the session gets
+	query         string           // The query the server's working on, if any
+	unsanitized   bool             // Sanitizing turned off through the admin API
+	watermark     string           // Key for the session's watermark, if any
+	labels        map[string]string
+
+	// For handing the session over to another instance; see handoff.go.
+	clientConn   *handoffConn
+	handoffs     chan *handoffRequest
+	adopted      bool     // Handed over to us already logged in
+	clientBytes  int64    // Bytes of whole packets read from the client
+	inFlight     int64    // Packets read from the client that the server side hasn't taken yet
+	settings     []string // SETs the server accepted, to replay after a hand-off
+	unreplayable bool     // Ran a SET or USE we wouldn't know how to replay
+
+	running sync.WaitGroup // The client and server goroutines
 }
 
-func NewProxyConnection(conn net.Conn) (*ProxyConnection, error) {
+// NewProxyConnection connects the client to a new MySQL session. Cancelling
+// the context closes both sides.
+func NewProxyConnection(ctx context.Context, conn net.Conn) (*ProxyConnection, error) {
 	var err error
+	proxy := newProxyConnection(ctx, conn)
+	if serverPool != nil {
+		proxy.server, err = serverPool.Get(proxy)
+	} else {
+		proxy.server, err = NewServerConnection(proxy)
+	}
+	if err != nil {
+		proxy.cancel()
+		return nil, err
+	}
+	proxy.server.traceWith(proxy.trace)
+	proxy.opened()
+	return proxy, nil
+}
+
+// newProxyConnection sets up the client side of a session.
+func newProxyConnection(ctx context.Context, conn net.Conn) *ProxyConnection {
 	var proxy ProxyConnection
 	proxy.ClientChannel = make(chan mysqlproto.Packet)
 	proxy.ServerChannel = make(chan mysqlproto.Packet)
+	proxy.handoffs = make(chan *handoffRequest)
+	proxy.ctx, proxy.cancel = context.WithCancel(ctx)
+	proxy.output = output
+	proxy.credentials = currentCredentials()
+	proxy.clientAddr = conn.RemoteAddr().String()
+	proxy.started = clock()
 
-	proxy.client = NewClientConnection(&proxy, conn)
-	proxy.server, err = NewServerConnection(&proxy)
-	if err != nil {
-		return nil, err
-	}
+	proxy.trace = NewPacketTrace(config.PacketTraceSize)
+	proxy.clientConn = newHandoffConn(conn)
+	proxy.client = NewClientConnection(&proxy, newTracedConn(newCompressedConn(proxy.clientConn), proxy.trace, "client"))
+	return &proxy
+}
 
-	return &proxy, nil
+// opened starts keeping track of the session, once it has a server side.
+func (proxy *ProxyConnection) opened() {
+	stats.SessionOpened()
+	sessions.Add(proxy)
+}
+
+// backendUnavailable is the error for clients we couldn't connect to the
+// MySQL server.
+func backendUnavailable(err error) *ProxyError {
+	return NewProxyError(ErrBackendUnavailable, err, "mysql-sanitizer can't reach the MySQL server")
 }
 
 func (proxy *ProxyConnection) Start() {
-	go proxy.client.Run()
-	go proxy.server.Run()
+	proxy.running.Add(2)
+	go func() {
+		defer proxy.running.Done()
+		proxy.client.Run()
+	}()
+	go func() {
+		defer proxy.running.Done()
+		proxy.server.Run()
+	}()
+
+	// Closing the sockets is the only way to interrupt a blocked read.
+	go func() {
+		<-proxy.ctx.Done()
+		proxy.Close()
+	}()
+}
+
+// Wait waits for both sides of a started session to stop.
+func (proxy *ProxyConnection) Wait() {
+	proxy.running.Wait()
 }
 
+// Close closes both sides of the connection. Both sides call this when they
+// notice a problem, so only the first call does anything.
 func (proxy *ProxyConnection) Close() {
-	proxy.client.Close()
-	proxy.server.Close()
+	proxy.closeWithCause(nil)
+}
+
+// Fail is Close for when something went wrong, so the reason makes it into
+// the logs.
+func (proxy *ProxyConnection) Fail(cause error) {
+	proxy.closeWithCause(cause)
+}
+
+func (proxy *ProxyConnection) closeWithCause(cause error) {
+	proxy.closeOnce.Do(func() {
+		proxy.cancel()
+		stats.SessionClosed()
+		sessions.Remove(proxy)
+		if cause != nil {
+			proxy.Output().Log("Closing session: %s", cause)
+			proxy.DumpTrace("closing the session")
+		}
+		if username := proxy.Username(); username != "" {
+			if cause != nil {
+				proxy.Output().Audit("Session closed for %s: %s", username, cause)
+			} else {
+				proxy.Output().Audit("Session closed for %s", username)
+			}
+		}
+		proxy.labelMutex.Lock()
+		proxy.recorder.Close()
+		proxy.labelMutex.Unlock()
+		proxy.client.Close()
+		proxy.server.Close()
+	})
+}
+
+// SendToClient hands the packet to the client side, unless the connection is
+// closed, in which case nobody's listening and it's dropped.
+func (proxy *ProxyConnection) SendToClient(packet mysqlproto.Packet) {
+	if proxy.capture != nil {
+		proxy.capture.add(packet)
+	}
+	select {
+	case proxy.ClientChannel <- packet:
+	case <-proxy.ctx.Done():
+	}
+}
+
+// SendToServer is SendToClient for the other direction.
+func (proxy *ProxyConnection) SendToServer(packet mysqlproto.Packet) {
+	select {
+	case proxy.ServerChannel <- packet:
+	case <-proxy.ctx.Done():
+	}
+}
+
+// RefuseConnection tells a client why we won't proxy its connection (usually
+// because we couldn't reach the MySQL server), instead of just hanging up on
+// it. Clients won't read an error until they've sent their handshake
+// response, so we have to pretend to be a server until then.
+func RefuseConnection(conn net.Conn, reason *ProxyError) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	stream := mysqlproto.NewStream(conn)
+
+	authPluginData := make([]byte, 20)
+	rand.Read(authPluginData)
+	WritePacket(stream, HandshakePacket(authPluginData, minimalCapabilities))
+
+	response, err := stream.NextPacket()
+	if err != nil {
+		output.Log("Client went away before we could tell it why it's being refused: %s", err)
+		return
+	}
+	WritePacket(stream, clientErrorPacket(output, response.SequenceID, reason))
 }
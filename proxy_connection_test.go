@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestProxyConnection_Cancel(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't start the fake MySQL server: %s", err)
+	}
+	defer backend.Close()
+	go serveSelftestBackend(backend)
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.MysqlHost = "127.0.0.1"
+	config.MysqlPort = backend.Addr().(*net.TCPAddr).Port
+
+	clientEnd, proxyEnd := net.Pipe()
+	defer clientEnd.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	proxy, err := NewProxyConnection(ctx, proxyEnd)
+	if err != nil {
+		t.Fatalf("NewProxyConnection failed: %s", err)
+	}
+	proxy.Start()
+
+	client := mysqlproto.NewStream(clientEnd)
+	if _, err := client.NextPacket(); err != nil {
+		t.Fatalf("No greeting: %s", err)
+	}
+
+	// The proxy is now waiting for our handshake response, which never comes.
+	cancel()
+	clientEnd.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.NextPacket(); err == nil {
+		t.Error("The proxy should have hung up")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Error("The proxy didn't hang up after being cancelled")
+	}
+}
+
+func TestProxyConnection_SlowClient(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't start the fake MySQL server: %s", err)
+	}
+	defer backend.Close()
+	go serveSelftestBackend(backend)
+
+	oldHost, oldPort, oldTimeout := config.MysqlHost, config.MysqlPort, config.WriteTimeout
+	defer func() { config.MysqlHost, config.MysqlPort, config.WriteTimeout = oldHost, oldPort, oldTimeout }()
+	config.MysqlHost = "127.0.0.1"
+	config.MysqlPort = backend.Addr().(*net.TCPAddr).Port
+	config.WriteTimeout = 1
+
+	clientEnd, proxyEnd := net.Pipe()
+	defer clientEnd.Close()
+	proxy, err := NewProxyConnection(context.Background(), proxyEnd)
+	if err != nil {
+		t.Fatalf("NewProxyConnection failed: %s", err)
+	}
+	proxy.Start()
+
+	// We never read the greeting, so the write should time out and take
+	// the session down.
+	select {
+	case <-proxy.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("The proxy didn't give up on a client that won't read")
+	}
+}
+
+func TestProxyConnection_IdleClient(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't start the fake MySQL server: %s", err)
+	}
+	defer backend.Close()
+	go serveSelftestBackend(backend)
+
+	oldHost, oldPort, oldTimeout := config.MysqlHost, config.MysqlPort, config.IdleTimeout
+	defer func() { config.MysqlHost, config.MysqlPort, config.IdleTimeout = oldHost, oldPort, oldTimeout }()
+	config.MysqlHost = "127.0.0.1"
+	config.MysqlPort = backend.Addr().(*net.TCPAddr).Port
+	config.IdleTimeout = 1
+
+	clientEnd, proxyEnd := net.Pipe()
+	defer clientEnd.Close()
+	proxy, err := NewProxyConnection(context.Background(), proxyEnd)
+	if err != nil {
+		t.Fatalf("NewProxyConnection failed: %s", err)
+	}
+	proxy.Start()
+
+	if _, err := mysqlproto.NewStream(clientEnd).NextPacket(); err != nil {
+		t.Fatalf("No greeting: %s", err)
+	}
+	select {
+	case <-proxy.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("The proxy didn't close the idle session")
+	}
+}
+
+func TestRefuseConnection(t *testing.T) {
+	clientEnd, proxyEnd := net.Pipe()
+	defer clientEnd.Close()
+	go RefuseConnection(proxyEnd, NewProxyError(ErrOverloaded, nil, "Too many connections"))
+
+	client := mysqlproto.NewStream(clientEnd)
+	greeting, err := client.NextPacket()
+	if err != nil {
+		t.Fatalf("No greeting: %s", err)
+	}
+	WritePacket(client, mysqlproto.Packet{greeting.SequenceID + 1, []byte{0x00}})
+	errPacket, err := client.NextPacket()
+	if err != nil || !packetIsERR(errPacket) {
+		t.Fatalf("Expected an error packet, got %v (%v)", errPacket, err)
+	}
+	if message := errorPacketMessage(errPacket); message != "1040: Too many connections" {
+		t.Errorf("Bogus refusal: %s", message)
+	}
+}
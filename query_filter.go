@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// QueryFilterConfig lets the operator turn away queries by their text, for
+// things like SELECT ... INTO OUTFILE, information_schema scans, or reports
+// known to flatten the server. Each statement is checked after rewrite rules
+// and sampling, so the patterns see what the server would, with comments
+// turned into spaces (and what's in executable ones left in, since the
+// server runs it). Patterns are case-insensitive, since SQL is.
+type QueryFilterConfig struct {
+	Deny  []string // Regexes for statements to refuse
+	Allow []string // If set, regexes one of which every statement has to match
+}
+
+var defaultQueryFilterConfig = QueryFilterConfig{
+	[]string{}, // Deny
+	[]string{}, // Allow
+}
+
+// QueryFilter checks statements against the configured patterns and counts
+// how many queries it turns away.
+type QueryFilter struct {
+	deny   []*regexp.Regexp
+	allow  []*regexp.Regexp
+	denied int64
+}
+
+// NewQueryFilter returns a QueryFilter, or nil if there are no patterns.
+func NewQueryFilter(filterConfig QueryFilterConfig) (*QueryFilter, error) {
+	if len(filterConfig.Deny) == 0 && len(filterConfig.Allow) == 0 {
+		return nil, nil
+	}
+	filter := QueryFilter{}
+	for _, pattern := range filterConfig.Deny {
+		compiled, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Bad Deny pattern '%s': %s", pattern, err)
+		}
+		filter.deny = append(filter.deny, compiled)
+	}
+	for _, pattern := range filterConfig.Allow {
+		compiled, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Bad Allow pattern '%s': %s", pattern, err)
+		}
+		filter.allow = append(filter.allow, compiled)
+	}
+	return &filter, nil
+}
+
+// Check returns why the query's not allowed, or "" if it is. Only COM_QUERY
+// and COM_STMT_PREPARE have any SQL to check.
+func (filter *QueryFilter) Check(packet mysqlproto.Packet) string {
+	if filter == nil || !carriesQuery(packet) {
+		return ""
+	}
+	for _, statement := range splitStatements(string(packet.Payload[1:])) {
+		if reason := filter.checkStatement(strings.TrimSpace(stripComments(statement))); reason != "" {
+			atomic.AddInt64(&filter.denied, 1)
+			return reason
+		}
+	}
+	return ""
+}
+
+func (filter *QueryFilter) checkStatement(statement string) string {
+	for _, pattern := range filter.deny {
+		if pattern.MatchString(statement) {
+			return fmt.Sprintf("it matches the denied pattern '%s'", pattern.String()[len("(?i)"):])
+		}
+	}
+	if len(filter.allow) == 0 {
+		return ""
+	}
+	for _, pattern := range filter.allow {
+		if pattern.MatchString(statement) {
+			return ""
+		}
+	}
+	return "it doesn't match any of the allowed patterns"
+}
+
+// statusRows returns SHOW SANITIZER STATUS rows counting denied queries.
+func (filter *QueryFilter) statusRows() [][]string {
+	if filter == nil {
+		return nil
+	}
+	return [][]string{{"Queries_denied", strconv.FormatInt(atomicLoad(&filter.denied), 10)}}
+}
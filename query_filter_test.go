@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestQueryFilter(t *testing.T) {
+	filter, err := NewQueryFilter(QueryFilterConfig{
+		Deny:  []string{`\bINTO\s+(OUT|DUMP)FILE\b`, `\binformation_schema\.`},
+		Allow: []string{`^SELECT\b`, `^(SHOW|USE)\b`},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't make the filter: %s", err)
+	}
+
+	queries := map[string]bool{
+		"SELECT name FROM users":                                 true,
+		"/* report */ select name from users":                    true,
+		"USE shop; SELECT 1":                                     true,
+		"SELECT name FROM users INTO OUTFILE '/tmp/users.csv'":   false,
+		"select * from INFORMATION_SCHEMA.columns":               false,
+		"DELETE FROM users":                                      false,
+		"SELECT 1; DROP TABLE users":                             false,
+		"SELECT 'patterns see inside strings, into outfile too'": false,
+		"/*!50000 DELETE FROM users */":                          false,
+		"SELECT name FROM users INTO/**/OUTFILE '/tmp/x'":        false,
+	}
+	for query, allowed := range queries {
+		reason := filter.Check(mysqlproto.Packet{0, append([]byte{COM_QUERY}, query...)})
+		if (reason == "") != allowed {
+			t.Errorf("Bogus check for '%s': '%s'", query, reason)
+		}
+	}
+	if reason := filter.Check(mysqlproto.Packet{0, append([]byte{COM_STMT_PREPARE}, "DELETE FROM users WHERE id = ?"...)}); reason == "" {
+		t.Error("Prepared statements should be checked too")
+	}
+	if reason := filter.Check(mysqlproto.Packet{0, []byte{COM_PING}}); reason != "" {
+		t.Errorf("Commands without SQL should be left alone: '%s'", reason)
+	}
+	if filter.denied != 8 {
+		t.Errorf("Expected 8 denied queries, got %d", filter.denied)
+	}
+
+	if filter, err := NewQueryFilter(defaultQueryFilterConfig); filter != nil || err != nil {
+		t.Errorf("No patterns should mean no filter: %v, %v", filter, err)
+	}
+	if _, err := NewQueryFilter(QueryFilterConfig{Deny: []string{"(unclosed"}}); err == nil {
+		t.Error("Bogus pattern should be an error")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// RecordingConfig sets up session recording, for compliance teams who need
+// to reconstruct what somebody (usually a contractor) saw. Transcripts hold
+// the queries plus a summary of each response: column names, row counts,
+// affected rows, and error codes. Values never go in, sanitized or not, and
+// neither do error messages, since those can quote data.
+//
+// Everybody logs in to the server with our credentials, so the usernames
+// clients give us are whatever they say they are. Users can't be relied on
+// to catch somebody who'd rather not be recorded, which is why the default
+// is everybody.
+type RecordingConfig struct {
+	Directory     string   // Where transcripts go ("" disables recording)
+	KeyFile       string   // File holding the hex-encoded AES-256 key transcripts are encrypted with
+	Users         []string // Usernames whose sessions get recorded ("*", the default, for everybody)
+	RetentionDays int      // Delete transcripts older than this (0 keeps them forever)
+}
+
+var defaultRecordingConfig = RecordingConfig{
+	"",            // Directory
+	"",            // KeyFile
+	[]string{"*"}, // Users
+	0,             // RetentionDays
+}
+
+const recordingSuffix = ".rec"
+
+// A RecordingArchive is the directory of encrypted transcripts.
+type RecordingArchive struct {
+	config RecordingConfig
+	aead   cipher.AEAD
+	users  map[string]bool
+}
+
+// A SessionRecorder writes one session's transcript. A nil one records
+// nothing, so callers don't have to check.
+type SessionRecorder struct {
+	mutex sync.Mutex
+	file  *os.File
+	aead  cipher.AEAD
+}
+
+// A RecordingEntry is one line of a transcript.
+type RecordingEntry struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"` // "open", "query", "columns", "rows", "ok", "error", or "close"
+	Username     string    `json:"username,omitempty"`
+	Query        string    `json:"query,omitempty"`
+	Columns      []string  `json:"columns,omitempty"`
+	Rows         uint64    `json:"rows,omitempty"`
+	AffectedRows uint64    `json:"affected_rows,omitempty"`
+	ErrorCode    uint16    `json:"error_code,omitempty"`
+}
+
+// NewRecordingArchive loads the key and returns the archive, or nil if
+// recording is off.
+func NewRecordingArchive(recordingConfig RecordingConfig) (*RecordingArchive, error) {
+	if recordingConfig.Directory == "" {
+		return nil, nil
+	}
+	if recordingConfig.KeyFile == "" {
+		return nil, fmt.Errorf("Recording needs a KeyFile")
+	}
+	key, err := loadRecordingKey(recordingConfig.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]bool{}
+	for _, username := range recordingConfig.Users {
+		users[username] = true
+	}
+	if !users["*"] {
+		output.Log("Only recording sessions for %s. Clients pick their own usernames, so anybody can avoid recording by using another one",
+			strings.Join(recordingConfig.Users, ", "))
+	}
+	return &RecordingArchive{recordingConfig, aead, users}, nil
+}
+
+func loadRecordingKey(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&0077 > 0 {
+		return nil, fmt.Errorf("The recording key file has excessively permissive permissions! Try \"chmod 0600 %s\".", path)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("The recording key in %s should be 64 hex digits", path)
+	}
+	return key, nil
+}
+
+// Open starts a transcript for the user's session, or returns nil if they
+// aren't recorded.
+func (archive *RecordingArchive) Open(username string) (*SessionRecorder, error) {
+	if archive == nil || !(archive.users[username] || archive.users["*"]) {
+		return nil, nil
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%s-%s-%x%s", clock().UTC().Format("20060102T150405Z"),
+		strings.Map(safeFilenameRune, username), suffix, recordingSuffix)
+	file, err := os.OpenFile(filepath.Join(archive.config.Directory, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &SessionRecorder{file: file, aead: archive.aead}
+	if err := recorder.Record(RecordingEntry{Event: "open", Username: username}); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recorder, nil
+}
+
+func safeFilenameRune(r rune) rune {
+	if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '.' {
+		return r
+	}
+	return '_'
+}
+
+// Record encrypts the entry and appends it to the transcript. Each entry is
+// sealed on its own, so a transcript cut short by a crash is still readable
+// up to that point.
+func (recorder *SessionRecorder) Record(entry RecordingEntry) error {
+	if recorder == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = clock().UTC()
+	}
+	plaintext, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, recorder.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := recorder.aead.Seal(nonce, nonce, plaintext, nil)
+	frame := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.file == nil {
+		return fmt.Errorf("The transcript is already closed")
+	}
+	_, err = recorder.file.Write(append(frame, sealed...))
+	return err
+}
+
+// Close finishes the transcript.
+func (recorder *SessionRecorder) Close() {
+	if recorder == nil {
+		return
+	}
+	recorder.Record(RecordingEntry{Event: "close"})
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.file != nil {
+		recorder.file.Close()
+		recorder.file = nil
+	}
+}
+
+// Read decrypts a transcript and writes its entries to out, one JSON object
+// per line.
+func (archive *RecordingArchive) Read(path string, out io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Transcript %s is truncated", path)
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(reader, sealed); err != nil {
+			return fmt.Errorf("Transcript %s is truncated", path)
+		}
+		nonceSize := archive.aead.NonceSize()
+		if len(sealed) < nonceSize {
+			return fmt.Errorf("Transcript %s is corrupt", path)
+		}
+		plaintext, err := archive.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+		if err != nil {
+			return fmt.Errorf("Can't decrypt %s (wrong key, or it's been tampered with)", path)
+		}
+		fmt.Fprintln(out, string(plaintext))
+	}
+}
+
+// Prune deletes transcripts older than RetentionDays.
+func (archive *RecordingArchive) Prune() {
+	if archive.config.RetentionDays <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(archive.config.RetentionDays) * 24 * time.Hour)
+	paths, err := filepath.Glob(filepath.Join(archive.config.Directory, "*"+recordingSuffix))
+	if err != nil {
+		output.Log("Can't list session transcripts: %s", err)
+		return
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			output.Log("Can't delete expired session transcript %s: %s", path, err)
+		} else {
+			output.Audit("Deleted expired session transcript %s", path)
+		}
+	}
+}
+
+// RunPruning prunes the archive every interval, forever.
+func (archive *RecordingArchive) RunPruning(interval time.Duration) {
+	for {
+		archive.Prune()
+		time.Sleep(interval)
+	}
+}
+
+// StartRecording opens a transcript for the session if its user is one of
+// the recorded ones.
+func (proxy *ProxyConnection) StartRecording(username string) error {
+	recorder, err := recordings.Open(username)
+	if err != nil {
+		return err
+	}
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	proxy.recorder = recorder
+	return nil
+}
+
+// Record adds the entry to the session's transcript, if it has one. If it
+// can't, the session is over: a gap in the transcript is exactly what
+// recording is meant to prevent.
+func (proxy *ProxyConnection) Record(entry RecordingEntry) {
+	proxy.labelMutex.Lock()
+	recorder := proxy.recorder
+	proxy.labelMutex.Unlock()
+	if err := recorder.Record(entry); err != nil {
+		proxy.Fail(fmt.Errorf("Couldn't record the session: %s", err))
+	}
+}
+
+// recordResponse summarizes an OK or ERR packet in the transcript.
+func (proxy *ProxyConnection) recordResponse(packet mysqlproto.Packet) {
+	if packetIsERR(packet) && len(packet.Payload) >= 3 {
+		proxy.Record(RecordingEntry{Event: "error", ErrorCode: binary.LittleEndian.Uint16(packet.Payload[1:3])})
+	} else if ok, err := proxy.ParseOK(packet); err == nil {
+		proxy.Record(RecordingEntry{Event: "ok", AffectedRows: ok.AffectedRows})
+	}
+}
+
+func columnNames(columns []Column) []string {
+	names := []string{}
+	for _, col := range columns {
+		names = append(names, col.Database+"."+col.Table+"."+col.Name)
+	}
+	return names
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestArchive(t *testing.T, retentionDays int) *RecordingArchive {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatalf("Can't write the key file: %s", err)
+	}
+	archive, err := NewRecordingArchive(RecordingConfig{dir, keyFile, []string{"contractor"}, retentionDays})
+	if err != nil {
+		t.Fatalf("NewRecordingArchive failed: %s", err)
+	}
+	return archive
+}
+
+func TestRecordingArchive_everybody(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)), 0600)
+	recordingConfig := defaultRecordingConfig
+	recordingConfig.Directory, recordingConfig.KeyFile = dir, keyFile
+	archive, err := NewRecordingArchive(recordingConfig)
+	if err != nil {
+		t.Fatalf("NewRecordingArchive failed: %s", err)
+	}
+	recorder, err := archive.Open("whoever")
+	if err != nil || recorder == nil {
+		t.Fatalf("Everybody should be recorded by default: %v, %v", recorder, err)
+	}
+	recorder.Close()
+}
+
+func TestRecordingArchive_RoundTrip(t *testing.T) {
+	archive := newTestArchive(t, 0)
+
+	if recorder, err := archive.Open("employee"); recorder != nil || err != nil {
+		t.Errorf("Unrecorded users shouldn't get a transcript: %v, %v", recorder, err)
+	}
+
+	recorder, err := archive.Open("contractor")
+	if err != nil || recorder == nil {
+		t.Fatalf("Couldn't open a transcript: %s", err)
+	}
+	recorder.Record(RecordingEntry{Event: "query", Query: "SELECT email FROM users"})
+	recorder.Record(RecordingEntry{Event: "rows", Rows: 3})
+	recorder.Close()
+
+	paths, _ := filepath.Glob(filepath.Join(archive.config.Directory, "*"+recordingSuffix))
+	if len(paths) != 1 {
+		t.Fatalf("Bogus transcripts: %v", paths)
+	}
+	raw, _ := os.ReadFile(paths[0])
+	if bytes.Contains(raw, []byte("SELECT")) {
+		t.Error("The transcript isn't encrypted")
+	}
+
+	var out bytes.Buffer
+	if err := archive.Read(paths[0], &out); err != nil {
+		t.Fatalf("Couldn't read the transcript: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[0], `"username":"contractor"`) ||
+		!strings.Contains(lines[1], `"query":"SELECT email FROM users"`) || !strings.Contains(lines[2], `"rows":3`) ||
+		!strings.Contains(lines[3], `"event":"close"`) {
+		t.Errorf("Bogus transcript:\n%s", out.String())
+	}
+
+	raw[len(raw)-1] ^= 1
+	os.WriteFile(paths[0], raw, 0600)
+	if err := archive.Read(paths[0], &out); err == nil {
+		t.Error("A tampered transcript should have been refused")
+	}
+}
+
+func TestRecordingArchive_Prune(t *testing.T) {
+	archive := newTestArchive(t, 30)
+	oldPath := filepath.Join(archive.config.Directory, "old"+recordingSuffix)
+	newPath := filepath.Join(archive.config.Directory, "new"+recordingSuffix)
+	os.WriteFile(oldPath, []byte{}, 0600)
+	os.WriteFile(newPath, []byte{}, 0600)
+	longAgo := time.Now().Add(-31 * 24 * time.Hour)
+	os.Chtimes(oldPath, longAgo, longAgo)
+
+	archive.Prune()
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Error("Expired transcript wasn't deleted")
+	}
+	if _, err := os.Stat(newPath); err != nil {
+		t.Errorf("Recent transcript was deleted: %s", err)
+	}
+}
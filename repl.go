@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// The REPL (-repl) is for whoever's writing the rules: type a query, and see
+// what the proxy would do with it, without a MySQL server anywhere. Queries
+// go through the same checks, rewrite rules, sampling and pagination as in a
+// normal session, and each column in the select list gets explained the way
+// the policy report does it. Without a server we can't know the columns'
+// types, so they're all assumed to be strings (the worst case), and "*"
+// can't be expanded.
+//
+// Queries end with a semicolon, like in the mysql client, and USE switches
+// databases for the ones after it.
+
+const replPrompt = "mysql-sanitizer> "
+const replContinuationPrompt = "               -> "
+
+type replSession struct {
+	database string
+}
+
+// RunREPL explains each query read from in until it runs out, or the user
+// types quit.
+func RunREPL(in io.Reader, out io.Writer) error {
+	session := replSession{}
+	scanner := bufio.NewScanner(in)
+	query := ""
+	fmt.Fprint(out, replPrompt)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if query == "" && (line == "quit" || line == "exit" || line == `\q`) {
+			return nil
+		}
+		if line != "" {
+			query = strings.TrimSpace(query + "\n" + line)
+		}
+		if strings.HasSuffix(query, ";") {
+			session.explain(out, strings.TrimSuffix(query, ";"))
+			query = ""
+		}
+		if query == "" {
+			fmt.Fprint(out, replPrompt)
+		} else {
+			fmt.Fprint(out, replContinuationPrompt)
+		}
+	}
+	if query != "" {
+		session.explain(out, query)
+	}
+	return scanner.Err()
+}
+
+// explain says what a session would do with the query, in the order Run
+// does it.
+func (session *replSession) explain(out io.Writer, query string) {
+	packet := mysqlproto.Packet{0, append([]byte{COM_QUERY}, query...)}
+	if isStatusQuery(packet) {
+		fmt.Fprintln(out, "Answered by mysql-sanitizer itself")
+		return
+	}
+	if len(splitStatements(query)) > 1 && !config.MultiStatements {
+		fmt.Fprintln(out, "Refused: sending several statements at once needs MultiStatements = true")
+		return
+	}
+
+	packet = rewriter.RewritePacket(packet)
+	if rewritten := string(packet.Payload[1:]); rewritten != query {
+		fmt.Fprintf(out, "Rewritten to: %s\n", rewritten)
+		query = rewritten
+	}
+	packet, err := sampler.RewritePacket(packet, session.database)
+	if err != nil {
+		fmt.Fprintf(out, "Refused: %s\n", err)
+		return
+	}
+	if sampled := string(packet.Payload[1:]); sampled != query {
+		fmt.Fprintf(out, "Sampled as: %s\n", sampled)
+		query = sampled
+	}
+	if err := checkCommandPolicy(packet, false); err != nil {
+		fmt.Fprintf(out, "Refused: %s\n", err)
+		return
+	}
+	if reason := queryFilter.Check(packet); reason != "" {
+		fmt.Fprintf(out, "Refused: %s\n", reason)
+		return
+	}
+	packet, _ = enforceStatementTimeout(packet)
+	if stripped := string(packet.Payload[1:]); stripped != query {
+		fmt.Fprintf(out, "Statement timeout hints stripped: %s\n", stripped)
+		query = stripped
+	}
+
+	statements := splitStatements(query)
+	var plan *paginationPlan
+	if len(statements) == 1 {
+		plan = planPagination(query, session.database, paginationKeys)
+	}
+	_, deduplicated := dedupKey(&ProxyConnection{Database: session.database}, packet)
+	switch {
+	case plan != nil:
+		fmt.Fprintf(out, "Paginated through %s by %s\n", plan.table, plan.key)
+	case deduplicated && deduper != nil:
+		fmt.Fprintln(out, "Sent to the MySQL server, sharing results with identical queries from other sessions")
+	default:
+		fmt.Fprintln(out, "Sent to the MySQL server")
+	}
+
+	for _, statement := range statements {
+		if database, ok := databaseChange(mysqlproto.Packet{0, append([]byte{COM_QUERY}, statement...)}); ok {
+			session.database = database
+			fmt.Fprintf(out, "Switched to database %s\n", database)
+			continue
+		}
+		columns := replColumns(statement, session.database)
+		if len(columns) == 0 {
+			continue
+		}
+		fmt.Fprintln(out, "Columns (assuming they're all strings):")
+		writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, col := range columns {
+			policy, rationale := explainResultColumn(col)
+			fmt.Fprintf(writer, "  %s\t%s\t%s\t%s\n", col.Alias, replSource(col), policy, rationale)
+		}
+		writer.Flush()
+	}
+}
+
+// replColumns returns the columns in a SELECT's select list, filled in the
+// way ReadColumn would fill them in from the server's column definitions,
+// plus whatever tracing can add. Other statements don't have any.
+func replColumns(statement string, database string) []Column {
+	traces := traceSelect(statement, database, 0)
+	if traces == nil {
+		return nil
+	}
+	columns := []Column{}
+	for i, trace := range traces {
+		col := traceResult(Column{IsString: true, Length: 255, Type: TYPE_VAR_STRING}, traces, i)
+		col.Alias = trace.name
+		columns = append(columns, col)
+	}
+	return columns
+}
+
+// explainResultColumn is explainColumn for a column in a select list, which
+// might not come from a table at all.
+func explainResultColumn(col Column) (string, string) {
+	if col.Name == "*" {
+		return "varies", "Each column gets its own policy; list them to see"
+	}
+	if col.Table != "" {
+		return explainColumn(col)
+	}
+	if input, unsafe := col.unsafeInput(); unsafe {
+		return explainMasking(col, "Made from "+replSource(input))
+	}
+	if col.IsSafe() {
+		return "pass", "No table"
+	}
+	return explainMasking(col, "Expression with no table")
+}
+
+// replSource says where a column's values come from.
+func replSource(col Column) string {
+	if col.Table == "" {
+		return "(expression)"
+	}
+	if col.Database == "" {
+		return col.Table + "." + col.Name
+	}
+	return col.Database + "." + col.Table + "." + col.Name
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestReplColumns(t *testing.T) {
+	columns := replColumns("SELECT DISTINCT name, t.secret AS s, other.col, db2.tbl.x, `id` ident, CONCAT(name, ', ') AS c, @@version, * FROM table1 t WHERE id > 3", "some_db")
+	expected := []string{
+		"name some_db.table1.name",
+		"s some_db.table1.secret",
+		"col (expression)",
+		"x db2.tbl.x",
+		"ident some_db.table1.id",
+		"c (expression)",
+		"@@version (expression)",
+		"* some_db.table1.*",
+	}
+	if len(columns) != len(expected) {
+		t.Fatalf("Expected %d columns, got %v", len(expected), columns)
+	}
+	for i, col := range columns {
+		if got := col.Alias + " " + replSource(col); got != expected[i] {
+			t.Errorf("Bogus column: '%s' instead of '%s'", got, expected[i])
+		}
+	}
+
+	if columns := replColumns("UPDATE table1 SET name = 'x'", "some_db"); columns != nil {
+		t.Errorf("Only SELECTs have columns: %v", columns)
+	}
+}
+
+func TestRunREPL(t *testing.T) {
+	input := "USE some_db;\nSELECT name, secret AS s,\n  CONCAT(name, 'x'), LOWER(secret) l FROM table1;\nSELECT @@version;\n" +
+		"LOAD DATA LOCAL INFILE 'honk.csv' INTO TABLE table1;\nquit\nSELECT 'never';\n"
+	var out bytes.Buffer
+	if err := RunREPL(strings.NewReader(input), &out); err != nil {
+		t.Fatalf("REPL failed: %s", err)
+	}
+
+	for _, expected := range []string{
+		`Switched to database some_db\n`,
+		`\n  name +some_db\.table1\.name +pass +Whitelisted\n`,
+		`\n  s +some_db\.table1\.secret +hash +Not whitelisted\n`,
+		`\n  CONCAT\(name, 'x'\) +\(expression\) `,
+		`\n  l +\(expression\) +hash +Made from some_db\.table1\.secret\n`,
+		`\n  @@version +\(expression\) +pass +No table\n`,
+		`Refused: LOAD DATA LOCAL INFILE is turned off`,
+	} {
+		if !regexp.MustCompile(expected).MatchString(out.String()) {
+			t.Errorf("REPL output is missing %s:\n%s", expected, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "never") {
+		t.Errorf("REPL should have stopped at quit:\n%s", out.String())
+	}
+}
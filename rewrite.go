@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// RewriteRule is a regex find-and-replace applied to incoming queries, for
+// things like pointing a legacy table name at a view or stripping hints.
+// Rules run in the order they're configured, each on the previous one's
+// output, before any of our other query checks.
+type RewriteRule struct {
+	Name    string // For logs and SHOW SANITIZER STATUS
+	Match   string // The regex to replace
+	Replace string // The replacement, which can use $1 etc.
+	OnlyIf  string // If set, only rewrite queries matching this regex
+	Unless  string // If set, don't rewrite queries matching this regex
+}
+
+type compiledRewriteRule struct {
+	name    string
+	match   *regexp.Regexp
+	replace string
+	onlyIf  *regexp.Regexp
+	unless  *regexp.Regexp
+	applied int64
+}
+
+// Rewriter applies the configured rewrite rules and counts how often each
+// one fires.
+type Rewriter struct {
+	rules []*compiledRewriteRule
+}
+
+// NewRewriter returns a Rewriter, or an error if any of the rules is bogus.
+func NewRewriter(rules []RewriteRule) (*Rewriter, error) {
+	rewriter := Rewriter{}
+	names := map[string]bool{}
+
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = strconv.Itoa(i + 1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("More than one rewrite rule is named '%s'", rule.Name)
+		}
+		names[rule.Name] = true
+
+		compiled := compiledRewriteRule{name: rule.Name, replace: rule.Replace}
+		var err error
+		if compiled.match, err = regexp.Compile(rule.Match); err != nil {
+			return nil, fmt.Errorf("Bad Match for rewrite rule '%s': %s", rule.Name, err)
+		}
+		if rule.OnlyIf != "" {
+			if compiled.onlyIf, err = regexp.Compile(rule.OnlyIf); err != nil {
+				return nil, fmt.Errorf("Bad OnlyIf for rewrite rule '%s': %s", rule.Name, err)
+			}
+		}
+		if rule.Unless != "" {
+			if compiled.unless, err = regexp.Compile(rule.Unless); err != nil {
+				return nil, fmt.Errorf("Bad Unless for rewrite rule '%s': %s", rule.Name, err)
+			}
+		}
+		rewriter.rules = append(rewriter.rules, &compiled)
+	}
+	return &rewriter, nil
+}
+
+// Rewrite runs the query through every rule.
+func (rewriter *Rewriter) Rewrite(query string) string {
+	for _, rule := range rewriter.rules {
+		if rule.onlyIf != nil && !rule.onlyIf.MatchString(query) {
+			continue
+		}
+		if rule.unless != nil && rule.unless.MatchString(query) {
+			continue
+		}
+		if !rule.match.MatchString(query) {
+			continue
+		}
+
+		query = rule.match.ReplaceAllString(query, rule.replace)
+		atomic.AddInt64(&rule.applied, 1)
+	}
+	return query
+}
+
+// RewritePacket rewrites the query in a COM_QUERY or COM_STMT_PREPARE
+// packet. Other packets are returned as-is.
+func (rewriter *Rewriter) RewritePacket(packet mysqlproto.Packet) mysqlproto.Packet {
+	if len(rewriter.rules) == 0 || !carriesQuery(packet) {
+		return packet
+	}
+
+	query := string(packet.Payload[1:])
+	rewritten := rewriter.Rewrite(query)
+	if rewritten == query {
+		return packet
+	}
+	output.Debug("Rewrote query \"%s\" to \"%s\"", query, rewritten)
+	return mysqlproto.Packet{packet.SequenceID, append([]byte{packetCommand(packet)}, rewritten...)}
+}
+
+// statusRows returns SHOW SANITIZER STATUS rows counting each rule's rewrites.
+func (rewriter *Rewriter) statusRows() [][]string {
+	rows := [][]string{}
+	for _, rule := range rewriter.rules {
+		rows = append(rows, []string{"Rewrites{" + rule.name + "}", strconv.FormatInt(atomicLoad(&rule.applied), 10)})
+	}
+	return rows
+}
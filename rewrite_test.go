@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestRewriter_Rewrite(t *testing.T) {
+	rewriter, err := NewRewriter([]RewriteRule{
+		{"legacy", "(?i)\\blegacy_users\\b", "users_view", "", ""},
+		{"no_cache", "(?i)\\s*SQL_NO_CACHE\\b", "", "(?i)^\\s*SELECT", ""},
+		{"index", "(?i)FROM users_view\\b", "FROM users_view FORCE INDEX (email)", "(?i)WHERE email", "(?i)FORCE INDEX"},
+	})
+	if err != nil {
+		t.Fatalf("NewRewriter failed: %s", err)
+	}
+
+	queries := map[string]string{
+		"SELECT * FROM legacy_users":                              "SELECT * FROM users_view",
+		"SELECT SQL_NO_CACHE id FROM legacy_users WHERE email=1":  "SELECT id FROM users_view FORCE INDEX (email) WHERE email=1",
+		"SELECT * FROM users_view FORCE INDEX (id) WHERE email=1": "SELECT * FROM users_view FORCE INDEX (id) WHERE email=1",
+		"UPDATE honk SET x = 'SQL_NO_CACHE'":                      "UPDATE honk SET x = 'SQL_NO_CACHE'",
+	}
+	for query, expected := range queries {
+		if rewritten := rewriter.Rewrite(query); rewritten != expected {
+			t.Errorf("Bogus rewrite of %q: %q", query, rewritten)
+		}
+	}
+
+	rows := rewriter.statusRows()
+	if len(rows) != 3 || rows[0][0] != "Rewrites{legacy}" || rows[0][1] != "2" || rows[2][1] != "1" {
+		t.Errorf("Bogus rewrite counts: %v", rows)
+	}
+}
+
+func TestRewriter_RewritePacket(t *testing.T) {
+	rewriter, _ := NewRewriter([]RewriteRule{{"", "honk", "bonk", "", ""}})
+
+	packet := rewriter.RewritePacket(mysqlproto.Packet{0, []byte("\x03SELECT honk")})
+	if string(packet.Payload) != "\x03SELECT bonk" {
+		t.Errorf("Bogus rewritten packet: %q", packet.Payload)
+	}
+	packet = rewriter.RewritePacket(mysqlproto.Packet{0, []byte("\x02honk")})
+	if string(packet.Payload) != "\x02honk" {
+		t.Errorf("Only COM_QUERY should be rewritten: %q", packet.Payload)
+	}
+}
+
+func TestNewRewriter_Errors(t *testing.T) {
+	if _, err := NewRewriter([]RewriteRule{{"a", "(", "", "", ""}}); err == nil {
+		t.Error("A bad regex should be an error")
+	}
+	if _, err := NewRewriter([]RewriteRule{{"a", "x", "", "", ""}, {"a", "y", "", "", ""}}); err == nil {
+		t.Error("Duplicate rule names should be an error")
+	}
+}
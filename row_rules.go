@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RowRule rewrites one column based on the rest of the row, for redaction
+// that can't be decided one value at a time. For example, to blank salaries
+// for executives only:
+//
+//	[[RowRules]]
+//	Column = "hr.employees.salary"
+//	When = "role = 'executive'"
+//	Value = ""
+//
+// or to keep the country in fake email addresses:
+//
+//	[[RowRules]]
+//	Column = "app.users.email"
+//	Value = "{self}@{country}.example.com"
+//
+// Conditions look at the real values, but {column} placeholders are filled
+// in with what the client is going to see, so they can't leak anything the
+// client couldn't see anyway. If the column in When isn't part of the result
+// set, we can't tell, so the rule applies.
+type RowRule struct {
+	Column string // The "database.table.column" to rewrite
+	When   string // Optional "column = 'value'" or "column != 'value'" on the same table
+	Value  string // The replacement, with {column} for other columns and {self} for this one
+	Null   bool   // Send NULL instead of Value
+}
+
+type compiledRowRule struct {
+	table      string // "database.table"
+	column     string
+	whenColumn string
+	whenValue  string
+	whenEqual  bool
+	value      string
+	null       bool
+}
+
+var rowRuleConditionRegex = regexp.MustCompile(`^\s*(\w+)\s*(=|!=)\s*'((?:[^'\\]|\\.)*)'\s*$`)
+var rowRulePlaceholderRegex = regexp.MustCompile(`\{(\w+)\}`)
+
+// NewRowRules checks and compiles the rules.
+func NewRowRules(rules []RowRule) ([]compiledRowRule, error) {
+	compiled := []compiledRowRule{}
+	for _, rule := range rules {
+		name := strings.ToLower(rule.Column)
+		if strings.Count(name, ".") != 2 {
+			return nil, fmt.Errorf("Column '%s' should look like database.table.column", rule.Column)
+		}
+		dot := strings.LastIndex(name, ".")
+		compiledRule := compiledRowRule{table: name[:dot], column: name[dot+1:], value: rule.Value, null: rule.Null}
+
+		if rule.When != "" {
+			match := rowRuleConditionRegex.FindStringSubmatch(rule.When)
+			if match == nil {
+				return nil, fmt.Errorf("Can't understand condition \"%s\" for %s", rule.When, rule.Column)
+			}
+			compiledRule.whenColumn = strings.ToLower(match[1])
+			compiledRule.whenEqual = match[2] == "="
+			compiledRule.whenValue = strings.Replace(match[3], "\\'", "'", -1)
+		}
+		compiled = append(compiled, compiledRule)
+	}
+	return compiled, nil
+}
+
+// applyRowRules rewrites values (what we're about to send the client) in
+// place. raw has the real values, for checking conditions. NULLs are nil in
+// both.
+func applyRowRules(rules []compiledRowRule, columns []Column, raw [][]byte, values [][]byte) {
+	for _, rule := range rules {
+		for i, col := range columns {
+			if col.Database+"."+col.Table != rule.table || col.Name != rule.column {
+				continue
+			}
+			if !rule.matches(columns, raw, col) {
+				continue
+			}
+
+			if rule.null {
+				values[i] = nil
+				continue
+			}
+			newValue := rowRulePlaceholderRegex.ReplaceAllStringFunc(rule.value, func(placeholder string) string {
+				name := strings.ToLower(placeholder[1 : len(placeholder)-1])
+				if name == "self" {
+					return string(values[i])
+				}
+				for j, other := range columns {
+					if other.Database == col.Database && other.Table == col.Table && other.Name == name {
+						return string(values[j])
+					}
+				}
+				return ""
+			})
+			if uint32(len(newValue)) > col.Length {
+				newValue = newValue[:col.Length]
+			}
+			values[i] = []byte(newValue)
+		}
+	}
+}
+
+// matches reports whether the rule's condition holds for the row.
+func (rule compiledRowRule) matches(columns []Column, raw [][]byte, col Column) bool {
+	if rule.whenColumn == "" {
+		return true
+	}
+	for j, other := range columns {
+		if other.Database == col.Database && other.Table == col.Table && other.Name == rule.whenColumn {
+			equal := raw[j] != nil && string(raw[j]) == rule.whenValue
+			return equal == rule.whenEqual
+		}
+	}
+	// We can't tell, so play it safe.
+	return true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewRowRules_BadConfig(t *testing.T) {
+	if _, err := NewRowRules([]RowRule{{Column: "bonk.salary"}}); err == nil {
+		t.Errorf("Unqualified column should have been refused")
+	}
+	if _, err := NewRowRules([]RowRule{{Column: "honk.bonk.salary", When: "role LIKE 'exec%'"}}); err == nil {
+		t.Errorf("Unsupported condition should have been refused")
+	}
+}
+
+func TestApplyRowRules_Condition(t *testing.T) {
+	rules, err := NewRowRules([]RowRule{{Column: "honk.bonk.salary", When: "role = 'executive'", Null: true}})
+	if err != nil {
+		t.Fatalf("NewRowRules failed: %s", err)
+	}
+	columns := []Column{
+		{true, "honk", "bonk", "role", "role", 255, 0, 0, nil, "", false, nil},
+		{false, "honk", "bonk", "salary", "salary", 11, 0, 0, nil, "", false, nil},
+	}
+
+	values := [][]byte{[]byte("garbage"), []byte("50000")}
+	applyRowRules(rules, columns, [][]byte{[]byte("intern"), []byte("50000")}, values)
+	if string(values[1]) != "50000" {
+		t.Errorf("Bogus salary for intern: %v", values[1])
+	}
+
+	values = [][]byte{[]byte("garbage"), []byte("900000")}
+	applyRowRules(rules, columns, [][]byte{[]byte("executive"), []byte("900000")}, values)
+	if values[1] != nil {
+		t.Errorf("Bogus salary for executive: %v", values[1])
+	}
+
+	// Without the role column there's no telling, so it gets redacted.
+	values = [][]byte{[]byte("900000")}
+	applyRowRules(rules, columns[1:], [][]byte{[]byte("900000")}, values)
+	if values[0] != nil {
+		t.Errorf("Bogus salary without role: %v", values[0])
+	}
+}
+
+func TestApplyRowRules_Template(t *testing.T) {
+	rules, err := NewRowRules([]RowRule{{Column: "honk.bonk.email", Value: "{self}@{country}.example.com"}})
+	if err != nil {
+		t.Fatalf("NewRowRules failed: %s", err)
+	}
+	columns := []Column{
+		{true, "honk", "bonk", "email", "email", 32, 0, 0, nil, "", false, nil},
+		{true, "honk", "bonk", "country", "country", 2, 0, 0, nil, "", false, nil},
+	}
+
+	// The template sees sanitized values, not the real ones.
+	values := [][]byte{[]byte("a1b2c3"), []byte("de")}
+	applyRowRules(rules, columns, [][]byte{[]byte("bob@example.de"), []byte("de")}, values)
+	if string(values[0]) != "a1b2c3@de.example.com" {
+		t.Errorf("Bogus email: %s", values[0])
+	}
+
+	values = [][]byte{[]byte("a1b2c3d4e5f6a1b2c3d4e5f6"), []byte("de")}
+	applyRowRules(rules, columns, [][]byte{[]byte("bob@example.de"), []byte("de")}, values)
+	if len(values[0]) != 32 {
+		t.Errorf("Email should have been truncated to the column length: %s", values[0])
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// HashSaltConfig is one version of the hash salt. Listing them in HashSalts
+// (oldest first) lets the salt be rotated: we hash with the newest one, and
+// prefix hashed values with its version ("v2:<hash>") so whoever ends up
+// with them knows which salt made them. Keep the old ones listed, so there's
+// a record of which salt each version was.
+type HashSaltConfig struct {
+	Version string // Goes in front of hashed values, so keep it short
+	Salt    string
+}
+
+// newestHashSalt checks the salts and returns the one to hash with.
+func newestHashSalt(salts []HashSaltConfig) (HashSaltConfig, error) {
+	seen := map[string]bool{}
+	for _, salt := range salts {
+		if salt.Version == "" || strings.ContainsAny(salt.Version, ": ") {
+			return HashSaltConfig{}, fmt.Errorf("Salt version '%s' should be non-empty, with no colons or spaces", salt.Version)
+		}
+		if seen[salt.Version] {
+			return HashSaltConfig{}, fmt.Errorf("Salt version '%s' is listed twice", salt.Version)
+		}
+		if salt.Salt == "" {
+			return HashSaltConfig{}, fmt.Errorf("Salt version '%s' has no salt", salt.Version)
+		}
+		seen[salt.Version] = true
+	}
+	return salts[len(salts)-1], nil
+}
+
+// hashVersionMinDigits is how much of a hash has to fit next to the salt
+// version. In narrower columns, the prefix would leave so little of the hash
+// (or none) that different values would come out the same, so they get the
+// hash without it.
+const hashVersionMinDigits = 6
+
+var narrowHashVersionWarning sync.Once
+
+// prefixHashVersion puts the salt version in front of a hashed value,
+// truncating the hash rather than the prefix if it won't fit.
+func prefixHashVersion(hashed []byte, length uint32) []byte {
+	if len(config.HashSalts) == 0 {
+		return hashed
+	}
+	prefix := config.HashSalts[len(config.HashSalts)-1].Version + ":"
+	if uint32(len(prefix)+hashVersionMinDigits) > length {
+		narrowHashVersionWarning.Do(func() {
+			output.Log("Some hashed columns (like one %d bytes wide) are too narrow for the salt version prefix '%s', so their hashes go out without it", length, prefix)
+		})
+		return hashed
+	}
+	if uint32(len(prefix)+len(hashed)) > length {
+		hashed = hashed[:length-uint32(len(prefix))]
+	}
+	return append([]byte(prefix), hashed...)
+}
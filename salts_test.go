@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNewestHashSalt(t *testing.T) {
+	newest, err := newestHashSalt([]HashSaltConfig{{"v1", "honk"}, {"v2", "bonk"}})
+	if err != nil || newest.Version != "v2" || newest.Salt != "bonk" {
+		t.Errorf("Bogus newest salt: %v, %v", newest, err)
+	}
+
+	for _, salts := range [][]HashSaltConfig{
+		{{"v1", "honk"}, {"v1", "bonk"}},
+		{{"v:1", "honk"}},
+		{{"", "honk"}},
+		{{"v1", ""}},
+	} {
+		if _, err := newestHashSalt(salts); err == nil {
+			t.Errorf("Bogus salts should have been refused: %v", salts)
+		}
+	}
+}
+
+func TestSanitizeRow_SaltVersion(t *testing.T) {
+	oldSalts := config.HashSalts
+	defer func() { config.HashSalts = oldSalts }()
+	config.HashSalts = []HashSaltConfig{{"v1", "honk"}, {"v2", "bonk"}}
+
+	col := Column{true, "honk", "bonk", "blarp", "blarp", 255, 0, 0, nil, "", false, nil}
+	hashed, _ := sanitizeRow([]byte("secret"), col)
+	if !strings.HasPrefix(string(hashed), "v2:") || len(hashed) != 3+64 {
+		t.Errorf("Bogus versioned hash: '%s'", hashed)
+	}
+
+	col.Length = 10
+	hashed, _ = sanitizeRow([]byte("secret"), col)
+	if !strings.HasPrefix(string(hashed), "v2:") || len(hashed) != 10 {
+		t.Errorf("Bogus truncated versioned hash: '%s'", hashed)
+	}
+
+	// Too narrow for the prefix and enough of the hash to tell values apart.
+	for _, length := range []uint32{2, 3, 8} {
+		col.Length = length
+		distinct := map[string]bool{}
+		for i := 0; i < 10; i++ {
+			hashed, _ := sanitizeRow([]byte(fmt.Sprintf("secret %d", i)), col)
+			if strings.Contains(string(hashed), ":") || len(hashed) != int(length) {
+				t.Errorf("Bogus hash for a %d byte column: '%s'", length, hashed)
+			}
+			distinct[string(hashed)] = true
+		}
+		if len(distinct) < 2 {
+			t.Errorf("Values in a %d byte column all hashed the same: %v", length, distinct)
+		}
+	}
+}
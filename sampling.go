@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Sampling lets people read only a fixed pseudo-random slice of some tables,
+// e.g. 1% of the users, which is plenty for poking around without handing
+// over the whole thing. We do it by adding a keyed hash of the table's key
+// column to the WHERE clause, so the same rows come back every time (until
+// the salt changes) and nobody can guess which ones those are.
+//
+// Like pagination, this only understands "SELECT ... FROM table [WHERE ...]",
+// optionally followed by GROUP BY, ORDER BY and LIMIT. Any other query that
+// so much as mentions a sampled table gets refused, since we can't tell
+// whether it'd read rows outside the sample. Admins aren't sampled.
+
+// SampledTable is the sampling policy for one table.
+type SampledTable struct {
+	Column  string  // The table's key column, as "database.table.column"
+	Percent float64 // How much of the table to show, from 0 to 100
+}
+
+type samplingRule struct {
+	key       string
+	threshold int // Rows whose hash bucket is below this are in the sample
+}
+
+// samplingBuckets is how finely we can slice a table; 10000 buckets gets us
+// down to 0.01%.
+const samplingBuckets = 10000
+
+var samplingTailRegex = regexp.MustCompile(`(?is)\s+(GROUP\s+BY|ORDER\s+BY|LIMIT)\b`)
+var samplingBlockerRegex = regexp.MustCompile(`(?i)\b(UNION|JOIN|INTO|FOR|LOCK|PROCEDURE)\b`)
+var samplingHarmlessRegex = regexp.MustCompile(`(?i)^(SHOW|DESCRIBE|DESC|EXPLAIN)\b`)
+var samplingSelectRegex = regexp.MustCompile(`(?i)\bSELECT\b`)
+
+// Sampler rewrites queries on sampled tables.
+type Sampler struct {
+	tables  map[string]samplingRule // By "database.table"
+	mention *regexp.Regexp          // Matches any sampled table's bare name
+	salt    string
+}
+
+// NewSampler returns a Sampler, or an error if the configuration is bogus.
+func NewSampler(tables []SampledTable, salt []byte) (*Sampler, error) {
+	sampler := Sampler{tables: map[string]samplingRule{}}
+	if len(tables) == 0 {
+		return &sampler, nil
+	}
+
+	names := map[string]bool{}
+	for _, table := range tables {
+		if strings.Count(table.Column, ".") != 2 {
+			return nil, fmt.Errorf("Sampled column '%s' should look like database.table.column", table.Column)
+		}
+		if table.Percent < 0 || table.Percent > 100 {
+			return nil, fmt.Errorf("Sampling percentage for '%s' should be between 0 and 100", table.Column)
+		}
+		column := strings.ToLower(table.Column)
+		dot := strings.LastIndex(column, ".")
+		if _, ok := sampler.tables[column[:dot]]; ok {
+			return nil, fmt.Errorf("Table '%s' is sampled more than once", column[:dot])
+		}
+		threshold := int(math.Round(table.Percent * samplingBuckets / 100))
+		sampler.tables[column[:dot]] = samplingRule{column[dot+1:], threshold}
+		names[regexp.QuoteMeta(column[strings.Index(column, ".")+1:dot])] = true
+	}
+
+	alternatives := []string{}
+	for name := range names {
+		alternatives = append(alternatives, name)
+	}
+	sort.Strings(alternatives)
+	sampler.mention = regexp.MustCompile(`(?i)\b(` + strings.Join(alternatives, "|") + `)\b`)
+
+	// Queries show up in the server's process list and logs, so don't put the
+	// hash salt itself in them.
+	sampler.salt = hex.EncodeToString(hasher.Sum([]byte("sampling"), salt))
+	return &sampler, nil
+}
+
+// Rewrite returns the query with the sampling predicate added, the query
+// unchanged if it doesn't touch a sampled table, or an error if it does but
+// we can't rewrite it.
+func (sampler *Sampler) Rewrite(query string, database string) (string, error) {
+	if sampler.mention == nil || !sampler.mention.MatchString(query) {
+		return query, nil
+	}
+	original := query
+	query = stripLeadingComments(query)
+	if samplingHarmlessRegex.MatchString(query) {
+		return original, nil
+	}
+
+	refusal := fmt.Errorf("Only simple SELECTs can read sampled tables")
+	// Quoted strings could be hiding anything from our regexes, and a second
+	// SELECT means a subquery we'd have to sample too.
+	if strings.ContainsAny(query, "'\"") || samplingBlockerRegex.MatchString(query) ||
+		len(samplingSelectRegex.FindAllString(query, -1)) > 1 {
+		return "", refusal
+	}
+
+	tail := ""
+	if loc := samplingTailRegex.FindStringIndex(query); loc != nil {
+		query, tail = query[:loc[0]], query[loc[0]:]
+	}
+	match := paginationQueryRegex.FindStringSubmatch(query)
+	if match == nil {
+		return "", refusal
+	}
+
+	parts := strings.Split(match[2], ".")
+	name := strings.ToLower(database + "." + unquoteIdentifier(parts[0]))
+	if len(parts) == 2 {
+		name = strings.ToLower(unquoteIdentifier(parts[0]) + "." + unquoteIdentifier(parts[1]))
+	} else if len(parts) > 2 {
+		return "", refusal
+	}
+	rule, ok := sampler.tables[name]
+	if !ok {
+		// Same name, different database.
+		return original, nil
+	}
+
+	conditions := []string{sampler.predicate(rule)}
+	if match[3] != "" {
+		conditions = []string{"(" + match[3] + ")", conditions[0]}
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s", match[1], match[2], strings.Join(conditions, " AND ")) + tail, nil
+}
+
+// predicate returns the condition that picks out the rule's sample: the
+// first 32 bits of a keyed hash of the key column, modulo the bucket count.
+func (sampler *Sampler) predicate(rule samplingRule) string {
+	return fmt.Sprintf("CONV(SUBSTRING(SHA2(CONCAT('%s', `%s`), 256), 1, 8), 16, 10) %% %d < %d",
+		sampler.salt, rule.key, samplingBuckets, rule.threshold)
+}
+
+// rewriteStatements is Rewrite for each of the statements in the query, in
+// case it's got several. A USE in among them would change the database the
+// rest (and every query after) should be resolved in, and we don't find out
+// whether it worked, so those are refused.
+func (sampler *Sampler) rewriteStatements(query string, database string) (string, error) {
+	statements := splitStatements(query)
+	if len(statements) < 2 {
+		return sampler.Rewrite(query, database)
+	}
+	for i, statement := range statements {
+		if _, isUse := databaseChange(mysqlproto.Packet{0, append([]byte{COM_QUERY}, statement...)}); isUse {
+			return "", fmt.Errorf("USE has to be sent on its own while tables are sampled, not in a multi-statement query")
+		}
+		rewritten, err := sampler.Rewrite(statement, database)
+		if err != nil {
+			return "", err
+		}
+		statements[i] = rewritten
+	}
+	return strings.Join(statements, ";"), nil
+}
+
+// RewritePacket samples the query in a COM_QUERY or COM_STMT_PREPARE
+// packet. Other packets are returned as-is.
+func (sampler *Sampler) RewritePacket(packet mysqlproto.Packet, database string) (mysqlproto.Packet, error) {
+	if sampler.mention == nil || !carriesQuery(packet) {
+		return packet, nil
+	}
+
+	query := string(packet.Payload[1:])
+	rewritten, err := sampler.rewriteStatements(query, database)
+	if err != nil || rewritten == query {
+		return packet, err
+	}
+	output.Debug("Sampled query \"%s\" as \"%s\"", query, rewritten)
+	return mysqlproto.Packet{packet.SequenceID, append([]byte{packetCommand(packet)}, rewritten...)}, nil
+}
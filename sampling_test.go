@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testSampler(t *testing.T) *Sampler {
+	sampler, err := NewSampler([]SampledTable{{"Honk.Bonk.ID", 1}}, []byte("salt"))
+	if err != nil {
+		t.Fatalf("NewSampler failed: %s", err)
+	}
+	return sampler
+}
+
+func TestNewSampler_bogus(t *testing.T) {
+	bogus := [][]SampledTable{
+		{{"honk.bonk", 1}},
+		{{"honk.bonk.id", 101}},
+		{{"honk.bonk.id", 1}, {"honk.bonk.uuid", 5}},
+	}
+	for _, tables := range bogus {
+		if _, err := NewSampler(tables, []byte("salt")); err == nil {
+			t.Errorf("Bogus sampling config %v should be an error", tables)
+		}
+	}
+}
+
+func TestSamplerRewrite(t *testing.T) {
+	sampler := testSampler(t)
+	predicate := sampler.predicate(sampler.tables["honk.bonk"])
+	if !strings.HasSuffix(predicate, "% 10000 < 100") {
+		t.Errorf("Bogus sampling predicate: %s", predicate)
+	}
+	if strings.Contains(predicate, "salt") {
+		t.Errorf("Sampling predicate gives away the salt: %s", predicate)
+	}
+
+	queries := map[string]string{
+		"SELECT * FROM bonk":                                    "SELECT * FROM bonk WHERE " + predicate,
+		"select id from `honk`.`bonk`;":                         "SELECT id FROM `honk`.`bonk` WHERE " + predicate,
+		"SELECT name FROM bonk WHERE x > 3 OR y < 2":            "SELECT name FROM bonk WHERE (x > 3 OR y < 2) AND " + predicate,
+		"SELECT * FROM bonk ORDER BY name LIMIT 10":             "SELECT * FROM bonk WHERE " + predicate + " ORDER BY name LIMIT 10",
+		"SELECT COUNT(*) FROM bonk GROUP BY name":               "SELECT COUNT(*) FROM bonk WHERE " + predicate + " GROUP BY name",
+		"SELECT * FROM other":                                   "SELECT * FROM other",
+		"SELECT * FROM blarp.bonk":                              "SELECT * FROM blarp.bonk",
+		"SELECT * FROM bonks":                                   "SELECT * FROM bonks",
+		"DESCRIBE bonk":                                         "DESCRIBE bonk",
+		"SELECT * FROM bonk, other":                             "",
+		"SELECT * FROM bonk b":                                  "",
+		"SELECT * FROM other JOIN bonk USING (id)":              "",
+		"SELECT * FROM other WHERE id IN (SELECT id FROM bonk)": "",
+		"SELECT * FROM bonk UNION SELECT * FROM bonk":           "",
+		"SELECT * FROM bonk WHERE name = 'x' OR 1":              "",
+		"UPDATE bonk SET name = NULL":                           "",
+	}
+
+	for query, expected := range queries {
+		rewritten, err := sampler.Rewrite(query, "honk")
+		if expected == "" {
+			if err == nil {
+				t.Errorf("Sampled table query %q should have been refused, got %q", query, rewritten)
+			}
+			continue
+		}
+		if err != nil || rewritten != expected {
+			t.Errorf("Bogus rewrite of %q: %q (%v)", query, rewritten, err)
+		}
+	}
+}
+
+func TestSamplerRewrite_unconfigured(t *testing.T) {
+	sampler, err := NewSampler([]SampledTable{}, []byte("salt"))
+	if err != nil {
+		t.Fatalf("NewSampler failed: %s", err)
+	}
+	if rewritten, err := sampler.Rewrite("SELECT * FROM bonk JOIN honk", "honk"); err != nil || rewritten != "SELECT * FROM bonk JOIN honk" {
+		t.Errorf("Bogus rewrite with no sampled tables: %q (%v)", rewritten, err)
+	}
+}
+
+func TestSamplerRewriteStatements(t *testing.T) {
+	sampler := testSampler(t)
+	predicate := sampler.predicate(sampler.tables["honk.bonk"])
+
+	if rewritten, err := sampler.rewriteStatements("SELECT 1; SELECT * FROM bonk", "honk"); err != nil || rewritten != "SELECT 1;SELECT * FROM bonk WHERE "+predicate {
+		t.Errorf("Bogus rewrite of several statements: %q (%v)", rewritten, err)
+	}
+	// The second statement would be resolved in the wrong database, and
+	// so would everything after.
+	for _, query := range []string{"USE other; SELECT * FROM bonk", "USE honk; SELECT 1", "SELECT 1; /*!USE other*/"} {
+		if rewritten, err := sampler.rewriteStatements(query, "honk"); err == nil {
+			t.Errorf("%q should have been refused, got %q", query, rewritten)
+		}
+	}
+	if rewritten, err := sampler.rewriteStatements("USE other", "honk"); err != nil || rewritten != "USE other" {
+		t.Errorf("USE on its own should be fine: %q (%v)", rewritten, err)
+	}
+}
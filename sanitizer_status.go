@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+var statusQueryRegex = regexp.MustCompile(`(?is)^\s*SHOW\s+SANITIZER\s+STATUS\s*;?\s*$`)
+
+// isStatusQuery reports whether the packet is our made-up SHOW SANITIZER
+// STATUS command, which we answer ourselves instead of forwarding.
+func isStatusQuery(packet mysqlproto.Packet) bool {
+	return packetCommand(packet) == COM_QUERY && statusQueryRegex.Match(packet.Payload[1:])
+}
+
+// statusResponse returns the packets for a SHOW STATUS-style result set
+// describing the proxy, so its health can be checked from any MySQL client.
+func statusResponse(sequenceId byte) []mysqlproto.Packet {
+	uptime := stats.Uptime().Seconds()
+	queries := atomicLoad(&stats.queries)
+
+	rows := [][]string{
+		{"Uptime", strconv.Itoa(int(uptime))},
+		{"Mode", modeNames[currentMode()]},
+		{"Active_sessions", strconv.FormatInt(atomicLoad(&stats.activeSessions), 10)},
+		{"Total_sessions", strconv.FormatInt(atomicLoad(&stats.totalSessions), 10)},
+		{"Goroutines", strconv.Itoa(runtime.NumGoroutine())},
+		{"Backend_health", stats.BackendHealth()},
+		{"Whitelist_version", whitelist.Version()},
+		{"Queries", strconv.FormatInt(queries, 10)},
+		{"Queries_per_second", fmt.Sprintf("%.3f", float64(queries)/uptime)},
+		{"Rows_forwarded", strconv.FormatInt(atomicLoad(&stats.rows), 10)},
+		{"Values_sanitized", strconv.FormatInt(atomicLoad(&stats.valuesSanitized), 10)},
+		{"Rows_affected", strconv.FormatInt(atomicLoad(&stats.affectedRows), 10)},
+		{"Warnings", strconv.FormatInt(atomicLoad(&stats.warnings), 10)},
+	}
+	rows = append(rows, stats.labelRows()...)
+	rows = append(rows, rewriter.statusRows()...)
+	rows = append(rows, queryFilter.statusRows()...)
+	rows = append(rows, canary.statusRows()...)
+	rows = append(rows, lengthStats.statusRows()...)
+	rows = append(rows, admission.statusRows()...)
+	rows = append(rows, deduper.statusRows()...)
+	rows = append(rows, balancer.statusRows()...)
+	rows = append(rows, dlpScanner.statusRows()...)
+
+	return ResultSetPackets(sequenceId, []string{"Variable_name", "Value"}, rows)
+}
+
+// statisticsResponse answers COM_STATISTICS (mysqladmin status) with numbers
+// about the proxy rather than the server, in the same format MySQL uses so
+// existing tools can still parse it.
+func statisticsResponse(sequenceId byte) mysqlproto.Packet {
+	uptime := stats.Uptime().Seconds()
+	queries := atomicLoad(&stats.queries)
+
+	status := fmt.Sprintf("Uptime: %d  Threads: %d  Questions: %d  Slow queries: 0  Opens: 0  Flush tables: 0  Open tables: 0  Queries per second avg: %.3f",
+		int(uptime), atomicLoad(&stats.activeSessions), queries, float64(queries)/uptime)
+	return mysqlproto.Packet{sequenceId + 1, []byte(status)}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestStatisticsResponse_format(t *testing.T) {
+	packet := statisticsResponse(0)
+	if packet.SequenceID != 1 {
+		t.Errorf("Bogus sequence ID: %d", packet.SequenceID)
+	}
+
+	// mysqladmin status just prints this, but other tools split it up, so it
+	// has to look exactly like the server's.
+	format := regexp.MustCompile(`^Uptime: \d+  Threads: \d+  Questions: \d+  Slow queries: 0  Opens: 0  Flush tables: 0  Open tables: 0  Queries per second avg: [\d.]+$`)
+	if !format.Match(packet.Payload) {
+		t.Errorf("Bogus statistics: %q", packet.Payload)
+	}
+}
+
+func TestIsStatusQuery_matching(t *testing.T) {
+	queries := map[string]bool{
+		"SHOW SANITIZER STATUS":          true,
+		"  show sanitizer\n status; ":    true,
+		"SHOW STATUS":                    false,
+		"SHOW SANITIZER STATUS LIKE 'x'": false,
+	}
+
+	for query, expected := range queries {
+		packet := mysqlproto.Packet{0, append([]byte{COM_QUERY}, query...)}
+		if isStatusQuery(packet) != expected {
+			t.Errorf("Bogus match for %q: expected %v", query, expected)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Schema metadata isn't data, so it normally passes through untouched, but
+// people leave notes like "COMMENT 'SSN, e.g. 123-45-6789'" and sample values
+// as column defaults. So we redact comments and string defaults in
+// SHOW CREATE TABLE, SHOW [FULL] COLUMNS, SHOW TABLE STATUS and the
+// information_schema tables behind them, and leave the types, keys and so on
+// alone. Defaults that are numbers, NULL or CURRENT_TIMESTAMP are structure,
+// not data, so they stay too.
+
+// schemaLiteralRegex finds a COMMENT or DEFAULT clause's string literal in
+// CREATE TABLE statements, along with an optional charset introducer.
+var schemaLiteralRegex = regexp.MustCompile(`(?i)\b(COMMENT\s*=?\s*|DEFAULT\s+(?:_\w+)?)'((?:[^'\\]|\\.|'')*)'`)
+var structuralDefaultRegex = regexp.MustCompile(`(?i)^(-?[0-9]+(\.[0-9]+)?|NULL|CURRENT_TIMESTAMP(\([0-9]*\))?|b'[01]*')$`)
+
+// schemaColumnKind says what a result column holds, if it's one we redact:
+// "comment", "default" or "create".
+func schemaColumnKind(col Column) string {
+	name := col.Name
+	if name == "" {
+		name = strings.ToLower(col.Alias)
+	}
+	if col.Database == "" && col.Table == "" && name == "create table" {
+		return "create"
+	}
+	if col.Database != "information_schema" {
+		return ""
+	}
+	switch col.Table + "." + name {
+	case "columns.column_comment", "tables.table_comment":
+		return "comment"
+	case "columns.column_default":
+		return "default"
+	}
+	return ""
+}
+
+// redactSchemaValue redacts comments and defaults in the value according to
+// the config, returning false if the column isn't schema metadata.
+func redactSchemaValue(value []byte, col Column) ([]byte, bool) {
+	switch schemaColumnKind(col) {
+	case "comment":
+		if config.RedactSchemaComments && len(value) > 0 {
+			return []byte(redactedValue), true
+		}
+		return value, true
+	case "default":
+		if config.RedactSchemaDefaults && !structuralDefaultRegex.Match(value) {
+			return []byte(redactedValue), true
+		}
+		return value, true
+	case "create":
+		return []byte(redactCreateTable(string(value))), true
+	}
+	return nil, false
+}
+
+// redactCreateTable redacts the comments and string defaults in a
+// CREATE TABLE statement.
+func redactCreateTable(statement string) string {
+	return schemaLiteralRegex.ReplaceAllStringFunc(statement, func(clause string) string {
+		match := schemaLiteralRegex.FindStringSubmatch(clause)
+		isComment := strings.HasPrefix(strings.ToUpper(match[1]), "COMMENT")
+		if isComment && (!config.RedactSchemaComments || match[2] == "") {
+			return clause
+		}
+		if !isComment && (!config.RedactSchemaDefaults || structuralDefaultRegex.MatchString(match[2])) {
+			return clause
+		}
+		return match[1] + "'" + redactedValue + "'"
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRedactCreateTable(t *testing.T) {
+	statement := "CREATE TABLE `users` (\n" +
+		"  `id` int(11) NOT NULL DEFAULT '0',\n" +
+		"  `ssn` varchar(11) DEFAULT '123-45-6789' COMMENT 'SSN, like ''123-45-6789''',\n" +
+		"  `note` varchar(20) DEFAULT _utf8mb4'it\\'s secret' COMMENT '',\n" +
+		"  `created_at` datetime DEFAULT CURRENT_TIMESTAMP,\n" +
+		"  PRIMARY KEY (`id`)\n" +
+		") ENGINE=InnoDB COMMENT='Has PII'"
+	expected := "CREATE TABLE `users` (\n" +
+		"  `id` int(11) NOT NULL DEFAULT '0',\n" +
+		"  `ssn` varchar(11) DEFAULT 'REDACTED' COMMENT 'REDACTED',\n" +
+		"  `note` varchar(20) DEFAULT _utf8mb4'REDACTED' COMMENT '',\n" +
+		"  `created_at` datetime DEFAULT CURRENT_TIMESTAMP,\n" +
+		"  PRIMARY KEY (`id`)\n" +
+		") ENGINE=InnoDB COMMENT='REDACTED'"
+	if redacted := redactCreateTable(statement); redacted != expected {
+		t.Errorf("Bogus redacted CREATE TABLE:\n%s", redacted)
+	}
+
+	oldComments := config.RedactSchemaComments
+	defer func() { config.RedactSchemaComments = oldComments }()
+	config.RedactSchemaComments = false
+	if redacted := redactCreateTable("`a` int COMMENT 'honk'"); redacted != "`a` int COMMENT 'honk'" {
+		t.Errorf("Comments shouldn't be redacted: %s", redacted)
+	}
+}
+
+func TestRedactSchemaValue(t *testing.T) {
+	comment := Column{true, "information_schema", "columns", "Comment", "column_comment", 1024, TYPE_VAR_STRING, 0, nil, "", false, nil}
+	defaultValue := Column{true, "information_schema", "columns", "Default", "column_default", 1024, TYPE_VAR_STRING, 0, nil, "", false, nil}
+	create := Column{true, "", "", "Create Table", "", 1024, TYPE_VAR_STRING, 0, nil, "", false, nil}
+	other := Column{true, "information_schema", "columns", "Field", "column_name", 64, TYPE_VAR_STRING, 0, nil, "", false, nil}
+
+	cases := []struct {
+		col      Column
+		value    string
+		expected string
+	}{
+		{comment, "SSN", "REDACTED"},
+		{comment, "", ""},
+		{defaultValue, "alice@example.com", "REDACTED"},
+		{defaultValue, "-1.5", "-1.5"},
+		{defaultValue, "current_timestamp(6)", "current_timestamp(6)"},
+		{create, "`a` int COMMENT 'honk'", "`a` int COMMENT 'REDACTED'"},
+	}
+	for _, c := range cases {
+		redacted, ok := redactSchemaValue([]byte(c.value), c.col)
+		if !ok || string(redacted) != c.expected {
+			t.Errorf("Bogus redaction of %q in %s: %q", c.value, c.col.Alias, redacted)
+		}
+	}
+	if _, ok := redactSchemaValue([]byte("id"), other); ok {
+		t.Error("Column names aren't schema comments or defaults")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The SchemaWatcher notices when tables change on the server, either by
+// checksumming information_schema.columns every SchemaWatchInterval seconds
+// or sooner when DDL goes through the proxy. When the schema changes, it
+// refreshes the catalog's tags, warns about new columns nobody has made a
+// decision about, and about rules that no longer match anything.
+type SchemaWatcher struct {
+	checksum [sha256.Size]byte
+	columns  map[string]Column // "database.table.column" -> column
+	poke     chan struct{}
+}
+
+// Schemas that belong to MySQL itself, which nobody writes rules for.
+const schemaWatchQuery = "SELECT table_schema, table_name, column_name, data_type FROM information_schema.columns " +
+	"WHERE table_schema NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys') " +
+	"ORDER BY table_schema, table_name, ordinal_position"
+
+var ddlRegex = regexp.MustCompile(`(?is)^\s*(CREATE|ALTER|DROP|RENAME)\s+TABLE\b`)
+
+// The information_schema data types that come back as strings.
+var stringDataTypes = map[string]bool{
+	"char": true, "varchar": true, "binary": true, "varbinary": true,
+	"tinytext": true, "text": true, "mediumtext": true, "longtext": true,
+	"tinyblob": true, "blob": true, "mediumblob": true, "longblob": true,
+	"enum": true, "set": true, "json": true,
+}
+
+var schemaWatcher *SchemaWatcher
+
+// NewSchemaWatcher returns a SchemaWatcher that hasn't looked yet.
+func NewSchemaWatcher() *SchemaWatcher {
+	return &SchemaWatcher{poke: make(chan struct{}, 1)}
+}
+
+// Poke asks for a check as soon as possible, without waiting for it.
+func (watcher *SchemaWatcher) Poke() {
+	if watcher == nil {
+		return
+	}
+	select {
+	case watcher.poke <- struct{}{}:
+	default:
+		// A check is already on its way.
+	}
+}
+
+// Run checks the schema every interval, or when poked, forever.
+func (watcher *SchemaWatcher) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		if err := watcher.Check(); err != nil {
+			output.Log("Couldn't check the schema for changes: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-watcher.poke:
+		}
+	}
+}
+
+// Check fetches the schema and deals with any changes since last time.
+func (watcher *SchemaWatcher) Check() error {
+	columns, err := fetchSchema()
+	if err != nil {
+		return err
+	}
+	watcher.Update(columns)
+	return nil
+}
+
+// fetchSchema reads the columns straight from the server, since going
+// through a proxy session would log and count it like a client's query.
+func fetchSchema() ([]Column, error) {
+	server, err := NewServerConnection(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer server.Close()
+	if _, err := server.logIn(); err != nil {
+		return nil, err
+	}
+
+	result, err := runTextQuery(server.stream, schemaWatchQuery)
+	if err != nil {
+		return nil, err
+	}
+	columns := []Column{}
+	for _, row := range result.Rows {
+		if len(row) != 4 || row[0] == nil || row[1] == nil || row[2] == nil || row[3] == nil {
+			return nil, fmt.Errorf("Weird row from information_schema.columns")
+		}
+		col := Column{}
+		col.Database = strings.ToLower(*row[0])
+		col.Table = strings.ToLower(*row[1])
+		col.Name = strings.ToLower(*row[2])
+		col.Alias = col.Name
+		col.IsString = stringDataTypes[strings.ToLower(*row[3])]
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
+
+// Update compares the columns with what we saw last time. The first time,
+// it just lints the rules.
+func (watcher *SchemaWatcher) Update(columns []Column) {
+	hash := sha256.New()
+	current := map[string]Column{}
+	for _, col := range columns {
+		fmt.Fprintf(hash, "%s.%s.%s:%t\n", col.Database, col.Table, col.Name, col.IsString)
+		current[col.Database+"."+col.Table+"."+col.Name] = col
+	}
+	var checksum [sha256.Size]byte
+	copy(checksum[:], hash.Sum(nil))
+
+	first := watcher.columns == nil
+	if !first && checksum == watcher.checksum {
+		return
+	}
+	previous := watcher.columns
+	watcher.checksum, watcher.columns = checksum, current
+
+	if !first {
+		output.Audit("Schema changed on %s (checksum %x)", config.MysqlHost, checksum[:8])
+		if config.Catalog.URL != "" {
+			if err := catalog.Refresh(); err != nil {
+				output.Log("Couldn't refresh catalog tags after a schema change, keeping the old ones: %s", err)
+			}
+		}
+		for _, warning := range unclassifiedColumnWarnings(previous, current) {
+			output.Log("%s", warning)
+		}
+	}
+	for _, warning := range lintColumnRules(columnRules, columns) {
+		output.Log("%s", warning)
+	}
+}
+
+// unclassifiedColumnWarnings describes the new columns that have no rule,
+// whitelist entry, or catalog tag, so they get the default treatment.
+func unclassifiedColumnWarnings(previous map[string]Column, current map[string]Column) []string {
+	names := []string{}
+	for name := range current {
+		if _, ok := previous[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	warnings := []string{}
+	for _, name := range names {
+		col := current[name]
+		if col.Rules().Action(col) != ruleNone || catalog.Classify(col) != classUnknown ||
+			whitelist.IsColumnPresent(col.Database, col.Table, col.Name) {
+			continue
+		}
+		if col.IsString {
+			warnings = append(warnings, fmt.Sprintf("New column %s has no sanitization policy, so it's being hashed", name))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("New column %s has no sanitization policy, and it's not a string, so it's passing through unsanitized!", name))
+		}
+	}
+	return warnings
+}
+
+// lintColumnRules describes the rules that don't match any column, which
+// usually means a typo or a column that's been dropped.
+func lintColumnRules(rules ColumnRules, columns []Column) []string {
+	warnings := []string{}
+	for _, rule := range rules {
+		matched := false
+		for _, col := range columns {
+			if (ColumnRules{rule}).Action(col) != ruleNone {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			warnings = append(warnings, fmt.Sprintf("Column rule %s doesn't match any column on the server", rule.describe()))
+		}
+	}
+	return warnings
+}
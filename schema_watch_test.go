@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnclassifiedColumnWarnings(t *testing.T) {
+	oldRules := columnRules
+	defer func() { columnRules = oldRules }()
+	columnRules, _ = NewColumnRules(map[string]interface{}{"honk.bonk.ssn": "redact"}, nil)
+
+	previous := map[string]Column{
+		"honk.bonk.id": {false, "honk", "bonk", "id", "id", 0, 0, 0, nil, "", false, nil},
+	}
+	current := map[string]Column{
+		"honk.bonk.id":        {false, "honk", "bonk", "id", "id", 0, 0, 0, nil, "", false, nil},
+		"honk.bonk.ssn":       {true, "honk", "bonk", "ssn", "ssn", 0, 0, 0, nil, "", false, nil},
+		"honk.bonk.notes":     {true, "honk", "bonk", "notes", "notes", 0, 0, 0, nil, "", false, nil},
+		"honk.bonk.salary":    {false, "honk", "bonk", "salary", "salary", 0, 0, 0, nil, "", false, nil},
+		"some_db.table2.honk": {true, "some_db", "table2", "honk", "honk", 0, 0, 0, nil, "", false, nil}, // whitelisted
+	}
+
+	warnings := unclassifiedColumnWarnings(previous, current)
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "honk.bonk.notes") || !strings.Contains(warnings[0], "hashed") ||
+		!strings.Contains(warnings[1], "honk.bonk.salary") || !strings.Contains(warnings[1], "unsanitized") {
+		t.Errorf("Bogus warnings: %v", warnings)
+	}
+}
+
+func TestLintColumnRules(t *testing.T) {
+	rules, _ := NewColumnRules(map[string]interface{}{"bonk.ssn": "redact", "bonk.sssn": "redact"},
+		[]PatternRule{{Column: ".*_email", Action: ruleEmail}})
+	columns := []Column{{true, "honk", "bonk", "ssn", "ssn", 0, 0, 0, nil, "", false, nil}}
+
+	warnings := lintColumnRules(rules, columns)
+	if len(warnings) != 2 || !strings.Contains(warnings[0], `"*.bonk.sssn" = "redact"`) ||
+		!strings.Contains(warnings[1], `{Column = ".*_email", Action = "email"}`) {
+		t.Errorf("Bogus lint warnings: %v", warnings)
+	}
+}
+
+func TestSchemaWatcher_Update(t *testing.T) {
+	watcher := NewSchemaWatcher()
+	columns := []Column{{false, "honk", "bonk", "id", "id", 0, 0, 0, nil, "", false, nil}}
+	watcher.Update(columns)
+	checksum := watcher.checksum
+
+	watcher.Update(columns)
+	if watcher.checksum != checksum {
+		t.Error("The checksum shouldn't change when the schema doesn't")
+	}
+
+	watcher.Update(append(columns, Column{true, "honk", "bonk", "name", "name", 0, 0, 0, nil, "", false, nil}))
+	if watcher.checksum == checksum || len(watcher.columns) != 2 {
+		t.Error("The watcher didn't notice a new column")
+	}
+
+	// Poking twice before anyone's listening shouldn't block.
+	watcher.Poke()
+	watcher.Poke()
+	var nobody *SchemaWatcher
+	nobody.Poke()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ScrubConfig configures inline redaction of PII embedded in free text
+// (support tickets, notes, etc.), where hashing the whole value would make
+// it useless.
+type ScrubConfig struct {
+	Columns        []string // "database.table.column" names to scrub
+	Packs          []string // Built-in pattern packs to use; see scrubPacks
+	Patterns       []string // Extra regular expressions to redact
+	DictionaryFile string   // A file of words (one per line) to redact, e.g. customer names
+}
+
+var defaultScrubConfig = ScrubConfig{
+	[]string{}, // Columns
+	[]string{"email", "card", "ssn", "phone", "ipv4"}, // Packs
+	[]string{}, // Patterns
+	"",         // DictionaryFile
+}
+
+// ScrubStep finds PII in a chunk of text and replaces it using redact. This
+// is the hook point for smarter detectors (NER models and the like) that
+// don't fit in a regex.
+type ScrubStep interface {
+	Scrub(text string, redact func(kind string, match string) string) string
+}
+
+type regexScrubStep struct {
+	kind   string
+	regex  *regexp.Regexp
+	verify func(match string) bool // Optional extra check to cut down on false positives
+}
+
+func (step regexScrubStep) Scrub(text string, redact func(string, string) string) string {
+	return step.regex.ReplaceAllStringFunc(text, func(match string) string {
+		if step.verify != nil && !step.verify(match) {
+			return match
+		}
+		return redact(step.kind, match)
+	})
+}
+
+// The built-in pattern packs, in the order they're applied. Order matters:
+// card numbers would otherwise get eaten by the phone pattern.
+var scrubPackOrder = []string{"email", "card", "ssn", "phone", "ipv4"}
+var scrubPacks = map[string]regexScrubStep{
+	"email": {"email", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), nil},
+	"card":  {"card", regexp.MustCompile(`\b(?:\d[ -]?){11,18}\d\b`), scrubLuhnValid},
+	"ssn":   {"ssn", regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), nil},
+	"phone": {"phone", regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?\(?\b\d{3}\)?[\s.-]?\d{3}[\s.-]?\d{4}\b`), nil},
+	"ipv4":  {"ip", regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`), nil},
+}
+
+func scrubLuhnValid(match string) bool {
+	digits := []byte{}
+	for _, char := range []byte(match) {
+		if char >= '0' && char <= '9' {
+			digits = append(digits, char)
+		}
+	}
+	return luhnCheckDigit(digits[:len(digits)-1]) == digits[len(digits)-1]
+}
+
+// Scrubber redacts PII from the configured free-text columns.
+type Scrubber struct {
+	columns ColumnSet
+	steps   []ScrubStep
+}
+
+// NewScrubber returns a Scrubber, or an error if the configuration is bogus.
+func NewScrubber(scrubConfig ScrubConfig) (*Scrubber, error) {
+	columns, err := NewColumnSet(scrubConfig.Columns)
+	if err != nil {
+		return nil, err
+	}
+	scrubber := Scrubber{columns, []ScrubStep{}}
+
+	enabled := map[string]bool{}
+	for _, pack := range scrubConfig.Packs {
+		if _, ok := scrubPacks[pack]; !ok {
+			return nil, fmt.Errorf("Unknown scrub pack '%s'", pack)
+		}
+		enabled[pack] = true
+	}
+	for _, pack := range scrubPackOrder {
+		if enabled[pack] {
+			scrubber.steps = append(scrubber.steps, scrubPacks[pack])
+		}
+	}
+
+	for _, pattern := range scrubConfig.Patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Bad scrub pattern '%s': %s", pattern, err)
+		}
+		scrubber.steps = append(scrubber.steps, regexScrubStep{"custom", regex, nil})
+	}
+
+	if scrubConfig.DictionaryFile != "" {
+		step, err := readScrubDictionary(scrubConfig.DictionaryFile)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read scrub dictionary %s: %s", scrubConfig.DictionaryFile, err)
+		}
+		scrubber.steps = append(scrubber.steps, step)
+	}
+
+	return &scrubber, nil
+}
+
+// Turns a word list into one big case-insensitive regex. Go's regexp
+// handles large alternations without backtracking, so this is fine for a
+// few thousand names.
+func readScrubDictionary(path string) (ScrubStep, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	words := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("No words found")
+	}
+
+	regex, err := regexp.Compile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+	if err != nil {
+		return nil, err
+	}
+	return regexScrubStep{"word", regex, nil}, nil
+}
+
+// Handles reports whether the column should be scrubbed rather than hashed.
+func (scrubber *Scrubber) Handles(col Column) bool {
+	return scrubber.columns.Contains(col)
+}
+
+// Scrub returns the text with every match replaced by a short deterministic
+// token like "[email:1a2b3c4d]", so the same value redacts the same way
+// everywhere and analysts can still tell that two tickets mention the same
+// address.
+func (scrubber *Scrubber) Scrub(value []byte, salt []byte) []byte {
+	text := string(value)
+	redact := func(kind string, match string) string {
+		return "[" + kind + ":" + hex.EncodeToString(hasher.Sum([]byte(match), salt)[:4]) + "]"
+	}
+
+	for _, step := range scrubber.steps {
+		text = step.Scrub(text, redact)
+	}
+	return []byte(text)
+}
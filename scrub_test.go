@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestScrubberScrub(t *testing.T) {
+	scrubber, err := NewScrubber(defaultScrubConfig)
+	if err != nil {
+		t.Fatalf("NewScrubber failed: %s", err)
+	}
+
+	text := "Customer bob@example.com called from (415) 555-2671 about card 4111 1111 1111 1111, SSN 078-05-1120, from 10.1.2.3. Order 1234567890123 is late."
+	scrubbed := string(scrubber.Scrub([]byte(text), []byte("salt")))
+
+	for _, secret := range []string{"bob@example.com", "555-2671", "4111 1111", "078-05-1120", "10.1.2.3"} {
+		if strings.Contains(scrubbed, secret) {
+			t.Errorf("Scrubbed text still contains '%s': '%s'", secret, scrubbed)
+		}
+	}
+	for _, kept := range []string{"Customer ", " called from ", "[email:", "[card:", "[ssn:", "[phone:", "[ip:", "Order 1234567890123 is late."} {
+		if !strings.Contains(scrubbed, kept) {
+			t.Errorf("Scrubbed text is missing '%s': '%s'", kept, scrubbed)
+		}
+	}
+}
+
+func TestScrubberScrub_Deterministic(t *testing.T) {
+	scrubber, _ := NewScrubber(defaultScrubConfig)
+	first := scrubber.Scrub([]byte("mail bob@example.com"), []byte("salt"))
+	second := scrubber.Scrub([]byte("bob@example.com again"), []byte("salt"))
+	if string(first[5:]) != string(second[:len(first)-5]) {
+		t.Errorf("Same address got different tokens: '%s' vs. '%s'", first, second)
+	}
+}
+
+func TestScrubberScrub_PatternsAndDictionary(t *testing.T) {
+	dictionary, err := ioutil.TempFile("", "scrub-dictionary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dictionary.Name())
+	dictionary.WriteString("# Customer names\nAlice Smith\nMallory\n")
+	dictionary.Close()
+
+	scrubConfig := defaultScrubConfig
+	scrubConfig.Patterns = []string{`ACCT-[0-9]{6}`}
+	scrubConfig.DictionaryFile = dictionary.Name()
+	scrubber, err := NewScrubber(scrubConfig)
+	if err != nil {
+		t.Fatalf("NewScrubber failed: %s", err)
+	}
+
+	scrubbed := string(scrubber.Scrub([]byte("alice smith and MALLORY share ACCT-123456."), []byte("salt")))
+	if strings.Contains(strings.ToLower(scrubbed), "alice") || strings.Contains(strings.ToLower(scrubbed), "mallory") {
+		t.Errorf("Dictionary words weren't scrubbed: '%s'", scrubbed)
+	}
+	if strings.Contains(scrubbed, "ACCT-123456") || !strings.Contains(scrubbed, "[custom:") {
+		t.Errorf("Custom pattern wasn't scrubbed: '%s'", scrubbed)
+	}
+	if !strings.Contains(scrubbed, " and ") || !strings.HasSuffix(scrubbed, ".") {
+		t.Errorf("Scrubbing mangled the rest of the text: '%s'", scrubbed)
+	}
+}
+
+func TestNewScrubber_BadConfig(t *testing.T) {
+	scrubConfig := defaultScrubConfig
+	scrubConfig.Packs = []string{"horoscopes"}
+	if _, err := NewScrubber(scrubConfig); err == nil {
+		t.Error("Unknown scrub pack was accepted!")
+	}
+
+	scrubConfig = defaultScrubConfig
+	scrubConfig.Patterns = []string{"(unclosed"}
+	if _, err := NewScrubber(scrubConfig); err == nil {
+		t.Error("Bogus scrub pattern was accepted!")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// The self-test (--selftest) runs a fake MySQL server and a real proxy
+// listener in-process, then connects to the proxy like a client and checks
+// that everything comes back the way it should. It uses the real config and
+// whitelist, so it's a decent smoke test for a new host.
+
+const selftestDatabase = "mysql_sanitizer_selftest"
+const selftestQuery = "SELECT id, name, nickname FROM users"
+
+type selftestScenario struct {
+	name string
+	run  func(client *mysqlproto.Stream) error
+}
+
+var selftestScenarios = []selftestScenario{
+	{"handshake", func(client *mysqlproto.Stream) error { return nil }},
+	{"ping", selftestPing},
+	{"result set sanitization", selftestSanitization},
+	{"SHOW SANITIZER STATUS", selftestStatus},
+	{"unsupported command", selftestUnsupported},
+}
+
+// runSelfTest runs every scenario, prints a report, and returns whether they
+// all passed.
+func runSelfTest() bool {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("FAIL Can't start the fake MySQL server: %s\n", err)
+		return false
+	}
+	defer backend.Close()
+	go serveSelftestBackend(backend)
+
+	config.MysqlHost = "127.0.0.1"
+	config.MysqlPort = backend.Addr().(*net.TCPAddr).Port
+	config.MysqlSocket = ""
+	balancer = nil
+	SetBackendDialer(dialBackend)
+
+	frontend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("FAIL Can't start the proxy listener: %s\n", err)
+		return false
+	}
+	defer frontend.Close()
+	// Don't return while sessions are still winding down, since the caller
+	// may put the config back.
+	var running sync.WaitGroup
+	defer running.Wait()
+	go func() {
+		for {
+			conn, err := frontend.Accept()
+			if err != nil {
+				return
+			}
+			proxy, err := NewProxyConnection(context.Background(), conn)
+			if err != nil {
+				go RefuseConnection(conn, backendUnavailable(err))
+				continue
+			}
+			running.Add(1)
+			proxy.Start()
+			go func() {
+				defer running.Done()
+				proxy.Wait()
+			}()
+		}
+	}()
+
+	passed := 0
+	for _, scenario := range selftestScenarios {
+		err := runSelftestScenario(frontend.Addr().String(), scenario)
+		if err != nil {
+			fmt.Printf("FAIL %s: %s\n", scenario.name, err)
+		} else {
+			fmt.Printf("ok   %s\n", scenario.name)
+			passed++
+		}
+	}
+
+	fmt.Printf("%d/%d self-test scenarios passed\n", passed, len(selftestScenarios))
+	return passed == len(selftestScenarios)
+}
+
+// runSelftestScenario logs into the proxy, runs the scenario, and quits.
+func runSelftestScenario(addr string, scenario selftestScenario) error {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	client := mysqlproto.NewStream(conn)
+
+	if err := clientLogIn(client, "selftest", ""); err != nil {
+		return err
+	}
+
+	if err := scenario.run(client); err != nil {
+		return err
+	}
+	WritePacket(client, mysqlproto.Packet{0, []byte{COM_QUIT}})
+	return nil
+}
+
+func selftestPing(client *mysqlproto.Stream) error {
+	WritePacket(client, mysqlproto.Packet{0, []byte{COM_PING}})
+	response, err := client.NextPacket()
+	if err != nil {
+		return err
+	}
+	if !packetIsOK(response) {
+		return fmt.Errorf("Expected OK, got %v", response.Payload)
+	}
+	return nil
+}
+
+func selftestSanitization(client *mysqlproto.Stream) error {
+	rows, err := selftestRunQuery(client, selftestQuery)
+	if err != nil {
+		return err
+	}
+	if len(rows) != 1 || len(rows[0]) != 3 {
+		return fmt.Errorf("Expected one row of three columns, got %v", rows)
+	}
+
+	row := rows[0]
+	if row[0] == nil || *row[0] != "42" {
+		return fmt.Errorf("Integer column was changed: %v", row[0])
+	}
+	if row[1] == nil || *row[1] == "" || *row[1] == "Alice Example" {
+		return fmt.Errorf("String column wasn't sanitized: %v", row[1])
+	}
+	if row[2] != nil {
+		return fmt.Errorf("NULL wasn't passed through: %v", *row[2])
+	}
+	return nil
+}
+
+func selftestStatus(client *mysqlproto.Stream) error {
+	rows, err := selftestRunQuery(client, "SHOW SANITIZER STATUS")
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 || rows[0][0] == nil || *rows[0][0] != "Uptime" {
+		return fmt.Errorf("Bogus status: %v", rows)
+	}
+	return nil
+}
+
+func selftestUnsupported(client *mysqlproto.Stream) error {
+	WritePacket(client, mysqlproto.Packet{0, []byte{0x12, 4, 0, 0, 0, 0, 0, 1, 0, 0, 0}}) // COM_BINLOG_DUMP
+	response, err := client.NextPacket()
+	if err != nil {
+		return err
+	}
+	if !packetIsERR(response) {
+		return fmt.Errorf("Expected ERR, got %v", response.Payload)
+	}
+	return nil
+}
+
+// selftestRunQuery sends a query and returns the rows of its result set, with
+// nil for NULLs.
+func selftestRunQuery(client *mysqlproto.Stream, query string) ([][]*string, error) {
+	result, err := runTextQuery(client, query)
+	if err != nil {
+		return nil, err
+	}
+	return result.Rows, nil
+}
+
+var selftestSetRegex = regexp.MustCompile(`(?i)^\s*SET\s`)
+
+// serveSelftestBackend pretends to be a MySQL server that accepts any login
+// and knows exactly one query.
+func serveSelftestBackend(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go serveSelftestSession(conn)
+	}
+}
+
+func serveSelftestSession(conn net.Conn) {
+	defer conn.Close()
+	server := mysqlproto.NewStream(conn)
+
+	authPluginData := make([]byte, 20)
+	rand.Read(authPluginData)
+	WritePacket(server, HandshakePacket(authPluginData, minimalCapabilities))
+	response, err := server.NextPacket()
+	if err != nil {
+		return
+	}
+	WritePacket(server, OKPacket(response.SequenceID))
+
+	for {
+		command, err := server.NextPacket()
+		if err != nil || packetCommand(command) == COM_QUIT {
+			return
+		}
+
+		query := string(command.Payload[1:])
+		switch {
+		case packetCommand(command) == COM_PING:
+			WritePacket(server, OKPacket(command.SequenceID))
+		case packetCommand(command) == COM_QUERY && selftestSetRegex.MatchString(query):
+			WritePacket(server, OKPacket(command.SequenceID))
+		case packetCommand(command) == COM_QUERY && strings.TrimSpace(query) == selftestQuery:
+			for _, packet := range selftestResultSet(command.SequenceID) {
+				WritePacket(server, packet)
+			}
+		default:
+			WritePacket(server, ErrorPacket(command.SequenceID, 1064, "42000", "The self-test server doesn't understand this"))
+		}
+	}
+}
+
+// selftestResultSet returns the packets answering selftestQuery: one row with
+// an integer, a string, and a NULL.
+func selftestResultSet(sequenceId byte) []mysqlproto.Packet {
+	packets := []mysqlproto.Packet{{sequenceId + 1, LengthEncodedInt(3)}}
+	packets = append(packets, selftestColumnPacket(sequenceId+1, "id", 0x03)) // LONG
+	packets = append(packets, selftestColumnPacket(sequenceId+2, "name", TYPE_VAR_STRING))
+	packets = append(packets, selftestColumnPacket(sequenceId+3, "nickname", TYPE_VAR_STRING))
+	packets = append(packets, EOFPacket(sequenceId+4))
+
+	row := append(VariableString("42"), VariableString("Alice Example")...)
+	row = append(row, 0xFB) // NULL
+	packets = append(packets, mysqlproto.Packet{sequenceId + 6, row})
+
+	return append(packets, EOFPacket(sequenceId+6))
+}
+
+// selftestColumnPacket returns a column definition for a column in the fake
+// users table.
+func selftestColumnPacket(sequenceId byte, name string, colType byte) mysqlproto.Packet {
+	chunks := VariableString("def")
+	chunks = append(chunks, VariableString(selftestDatabase)...) // schema
+	chunks = append(chunks, VariableString("users")...)          // table
+	chunks = append(chunks, VariableString("users")...)          // original table
+	chunks = append(chunks, VariableString("%s", name)...)       // name
+	chunks = append(chunks, VariableString("%s", name)...)       // original name
+	chunks = append(chunks, 0x0C)                                // length of the fixed fields
+	chunks = append(chunks, 0x21, 0x00)                          // character set (utf8_general_ci)
+	chunks = append(chunks, 0xFF, 0x00, 0x00, 0x00)              // column length
+	chunks = append(chunks, colType)
+	chunks = append(chunks, 0x00, 0x00) // flags
+	chunks = append(chunks, 0x00)       // decimals
+	chunks = append(chunks, 0x00, 0x00) // filler
+
+	return mysqlproto.Packet{sequenceId + 1, chunks}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+
+	if !runSelfTest() {
+		t.Error("The self-test failed!")
+	}
+}
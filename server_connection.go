@@ -1,12 +1,13 @@
 package main
 
 import (
-	"crypto/sha256"
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
-	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/pubnative/mysqlproto-go"
 )
@@ -18,6 +19,12 @@ const COM_FIELD_LIST byte = 0x04
 const COM_STATISTICS byte = 0x09
 const COM_PROCESS_KILL byte = 0x0c
 const COM_PING byte = 0x0e
+const COM_STMT_PREPARE byte = 0x16
+const COM_STMT_EXECUTE byte = 0x17
+const COM_STMT_SEND_LONG_DATA byte = 0x18
+const COM_STMT_CLOSE byte = 0x19
+const COM_STMT_RESET byte = 0x1a
+const COM_STMT_FETCH byte = 0x1c
 
 // ServerConnection is a connection to the MySQL server.
 type ServerConnection struct {
@@ -25,24 +32,21 @@ type ServerConnection struct {
 	stream     *mysqlproto.Stream
 	sanitizing bool
 	finished   bool
+	pooled     bool // Already logged in, so we greet the client ourselves
+	conn       net.Conn
+	lastReply  time.Time // When the server last answered a command, for FastPing
 }
 
 // NewServerConnection returns a ServerConnection that's connected to the MySQL server.
 func NewServerConnection(proxy *ProxyConnection) (*ServerConnection, error) {
-	server := ServerConnection{proxy, nil, false, false}
+	server := ServerConnection{proxy, nil, false, false, false, nil, time.Now()}
 
-	addrString := config.MysqlHost + ":" + strconv.Itoa(config.MysqlPort)
-	addr, err := net.ResolveTCPAddr("tcp", addrString)
+	socket, err := backendDialer()
 	if err != nil {
-		return nil, fmt.Errorf("Can't resolve host %s: %s", config.MysqlHost, err)
+		return nil, err
 	}
-	addr.Port = config.MysqlPort
-
-	socket, err := net.DialTCP("tcp", nil, addr)
-	if err != nil {
-		return nil, fmt.Errorf("Can't connect to %s on port %d:  %s", config.MysqlHost, addr.Port, err)
-	}
-	server.stream = mysqlproto.NewStream(socket)
+	server.conn = newCompressedConn(socket)
+	server.stream = mysqlproto.NewStream(server.conn)
 
 	return &server, nil
 }
@@ -53,170 +57,574 @@ func (server *ServerConnection) ToggleSanitizing(active bool) {
 
 func (server *ServerConnection) Run() {
 	defer server.proxy.Close()
-	server.doHandshake()
+	defer server.proxy.dumpTraceOnPanic()
+	if server.proxy.adopted {
+		// Both sides logged in before the session was handed to us.
+	} else if server.pooled {
+		server.doPooledHandshake()
+	} else {
+		server.doHandshake()
+	}
 
 	for !server.finished {
-		packet := <-server.proxy.ServerChannel
+		var packet mysqlproto.Packet
+		select {
+		case packet = <-server.proxy.ServerChannel:
+		case request := <-server.proxy.handoffs:
+			request.done <- server.handOff(request.peer)
+			continue
+		case <-server.proxy.ctx.Done():
+			return
+		}
+		if runsQuery(packet) {
+			server.proxy.countQuery()
+		}
 
-		if supportedCommand(packet) {
-			WritePacket(server.stream, packet)
+		if isStatusQuery(packet) {
+			for _, response := range server.proxy.resultSet(statusResponse(packet.SequenceID)) {
+				server.proxy.SendToClient(response)
+			}
+			continue
+		}
+		if packetCommand(packet) == COM_STATISTICS {
+			server.proxy.SendToClient(statisticsResponse(packet.SequenceID))
+			continue
+		}
+		if server.answerPing(packet) {
+			continue
+		}
+		if currentMode() == modeLockdown && packetCommand(packet) != COM_QUIT && packetCommand(packet) != COM_PING {
+			err := NewProxyError(ErrOffline, nil, "mysql-sanitizer is in lockdown mode; try again later")
+			server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), packet.SequenceID, err))
+			continue
+		}
+		if runsQuery(packet) && !admission.Admit(server.proxy.Username()) {
+			err := NewProxyError(ErrOverloaded, nil, "The MySQL server is overloaded, so mysql-sanitizer is turning away low-priority queries; try again in %d seconds", config.Admission.RetryAfter)
+			server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), packet.SequenceID, err))
+			continue
+		}
+
+		if runsQuery(packet) {
+			if exceeded := server.proxy.overBudget(); exceeded != "" && !server.enforceBudget(packet, exceeded) {
+				continue
+			}
+		}
+
+		// Rewrite rules go first, so everything else sees the final query.
+		packet = rewriter.RewritePacket(packet)
+		var sampleErr error
+		if !server.proxy.IsAdmin() {
+			packet, sampleErr = sampler.RewritePacket(packet, server.proxy.Database)
+		}
+		if err := checkCommandPolicy(packet, server.proxy.IsAdmin()); err != nil {
+			err = NewProxyError(ErrPolicyViolation, nil, "%s", err)
+			server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), packet.SequenceID, err))
+		} else if reason := queryFilter.Check(packet); reason != "" {
+			server.proxy.Output().Audit("Refused %s a query because %s: %s", server.proxy.Username(), reason, packet.Payload[1:])
+			err := NewProxyError(ErrPolicyViolation, nil, "mysql-sanitizer doesn't allow this query: %s", reason)
+			server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), packet.SequenceID, err))
+		} else if sampleErr != nil {
+			err := NewProxyError(ErrPolicyViolation, nil, "%s", sampleErr)
+			server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), packet.SequenceID, err))
+		} else if err := server.proxy.checkStatement(packet); err != nil {
+			server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), packet.SequenceID, err))
+		} else if supportedCommand(packet) {
+			if adminCommand(packet) {
+				server.proxy.Output().Audit("%s ran %s", server.proxy.Username(), adminCommandNames[packetCommand(packet)])
+			}
+			packet, reassertTimeout := enforceStatementTimeout(packet)
+			var plan *paginationPlan
+			if packetCommand(packet) == mysqlproto.COM_QUERY && len(splitStatements(string(packet.Payload[1:]))) == 1 {
+				plan = planPagination(string(packet.Payload[1:]), server.proxy.Database, paginationKeys)
+			}
 
 			if packetCommand(packet) == mysqlproto.COM_QUERY {
-				server.handleQueryResponse()
+				server.proxy.Record(RecordingEntry{Event: "query", Query: string(packet.Payload[1:])})
+				server.proxy.SetQuery(string(packet.Payload[1:]))
+				server.proxy.noteCall(string(packet.Payload[1:]))
+			} else if packetCommand(packet) == COM_STMT_PREPARE {
+				server.proxy.SetQuery(string(packet.Payload[1:]))
+			} else if packetCommand(packet) == COM_STMT_EXECUTE {
+				statement := server.proxy.statementFor(packet)
+				server.proxy.Record(RecordingEntry{Event: "query", Query: statement.query})
+				server.proxy.SetQuery(statement.query)
+				server.proxy.noteCall(statement.query)
+				reassertTimeout = mentionsTimeout(statement.query)
+			}
+
+			if plan != nil {
+				server.handlePaginatedQuery(packet.SequenceID, plan)
+			} else if server.runDeduplicated(packet) {
+				// Done, one way or another.
 			} else {
-				server.handleOtherResponse()
+				if err := server.write(packet); err != nil {
+					server.lostBackend(packet.SequenceID, fmt.Errorf("Couldn't write to MySQL server: %s", err))
+				} else if packetCommand(packet) == mysqlproto.COM_QUERY {
+					server.handleQueryResponse()
+					if ddlRegex.Match(packet.Payload[1:]) {
+						schemaWatcher.Poke()
+					}
+				} else if packetCommand(packet) == COM_STMT_PREPARE {
+					server.handlePrepareResponse(string(packet.Payload[1:]))
+				} else if packetCommand(packet) == COM_STMT_EXECUTE {
+					server.handleResults(server.proxy.statementFor(packet))
+				} else if packetCommand(packet) == COM_STMT_FETCH {
+					server.handleFetchResponse(server.proxy.statementFor(packet))
+				} else if packetCommand(packet) == COM_STMT_SEND_LONG_DATA {
+					// The server doesn't answer these.
+				} else if packetCommand(packet) == COM_STMT_CLOSE {
+					// Or these.
+					server.proxy.closeStatement(packet)
+				} else if packetCommand(packet) == COM_QUIT {
+					// The server just hangs up, which isn't it dying on us.
+					server.finished = true
+				} else if server.handleOtherResponse() && packetCommand(packet) == COM_INIT_DB {
+					server.proxy.Database = string(packet.Payload[1:])
+				}
+			}
+
+			server.proxy.SetQuery("")
+			if !server.finished {
+				server.lastReply = time.Now()
+			}
+			if reassertTimeout && !server.finished {
+				if err := server.setStatementTimeout(config.StatementTimeout); err != nil {
+					server.proxy.Output().Log("Couldn't re-assert max_statement_time: %s", err)
+					server.finished = true
+				}
 			}
 		} else {
-			errPacket := ErrorPacket(packet.SequenceID, 1002, "HY000", "mysql-sanitizer doesn't support this command: 0x%02x", packetCommand(packet))
-			server.proxy.ClientChannel <- errPacket
+			err := NewProxyError(ErrUnsupported, nil, "mysql-sanitizer doesn't support this command: 0x%02x", packetCommand(packet))
+			server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), packet.SequenceID, err))
 		}
 	}
 }
 
+// write sends the server a packet, giving up after WriteTimeout.
+func (server *ServerConnection) write(packet mysqlproto.Packet) error {
+	if server.conn != nil {
+		server.conn.SetWriteDeadline(writeDeadline())
+	}
+	return WritePacket(server.stream, packet)
+}
+
 // Close closes the connection to the MySQL server.
 func (server *ServerConnection) Close() {
 	server.stream.Close()
 }
 
 // We currently permit only the minimal set of functionality needed to do
-// basic operations. If you need something more complex (prepared
-// statements, stored procedures, etc.), patches welcome!
+// basic operations. If you need something more complex (replication,
+// changing users, etc.), patches welcome!
 func supportedCommand(packet mysqlproto.Packet) bool {
 	cmd := packetCommand(packet)
 	return cmd == COM_QUIT || cmd == COM_INIT_DB || cmd == COM_QUERY || cmd == COM_FIELD_LIST ||
-		cmd == COM_STATISTICS || cmd == COM_PROCESS_KILL || cmd == COM_PING
+		cmd == COM_STATISTICS || cmd == COM_PROCESS_KILL || cmd == COM_PING || adminCommand(packet) ||
+		cmd == COM_STMT_PREPARE || cmd == COM_STMT_EXECUTE || cmd == COM_STMT_SEND_LONG_DATA ||
+		cmd == COM_STMT_CLOSE || cmd == COM_STMT_RESET || cmd == COM_STMT_FETCH
+}
+
+// checkCommandPolicy returns an error if the command is supported but we
+// don't want to let it through anyway.
+func checkCommandPolicy(packet mysqlproto.Packet, admin bool) error {
+	if adminCommand(packet) && !admin {
+		return fmt.Errorf("%s is only allowed for mysql-sanitizer admins", adminCommandNames[packetCommand(packet)])
+	}
+	if !carriesQuery(packet) {
+		return checkDatabaseChange(packet, config.PinnedDatabase)
+	}
+	// With CLIENT_MULTI_STATEMENTS, a SET or USE could be hiding behind
+	// another statement.
+	for _, statement := range splitStatements(string(packet.Payload[1:])) {
+		if err := checkDatabaseChange(mysqlproto.Packet{packet.SequenceID, append([]byte{COM_QUERY}, statement...)}, config.PinnedDatabase); err != nil {
+			return err
+		}
+		if err := checkSetStatement(statement); err != nil {
+			return err
+		}
+		if err := checkLocalInfile(statement); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (server *ServerConnection) doHandshake() {
-	welcomePacket, err := server.stream.NextPacket()
-	output.Dump(welcomePacket.Payload, "Welcome packet from server:\n")
+	welcomePacket, err := ReadPacket(server.stream)
+	server.proxy.Output().Dump(welcomePacket.Payload, "Welcome packet from server:\n")
 	if err != nil {
-		output.Log("Couldn't complete handshake to MySQL server: %s", err)
+		server.proxy.Output().Log("Couldn't complete handshake to MySQL server: %s", err)
 		server.finished = true
 		return
 	}
-	server.proxy.ClientChannel <- welcomePacket
+	server.proxy.SendToClient(welcomePacket)
 
-	clientHandshake := <-server.proxy.ServerChannel
-	WritePacket(server.stream, clientHandshake)
-
-	response, err := server.stream.NextPacket()
-	output.Dump(response.Payload, "Handshake response packet from server:\n")
+	var clientHandshake mysqlproto.Packet
+	select {
+	case clientHandshake = <-server.proxy.ServerChannel:
+	case <-server.proxy.ctx.Done():
+		server.finished = true
+		return
+	}
+	if err := server.write(clientHandshake); err != nil {
+		server.proxy.Fail(fmt.Errorf("Couldn't write handshake to MySQL server: %s", err))
+		server.finished = true
+		return
+	}
 
+	response, err := ReadPacket(server.stream)
 	if err != nil {
-		output.Log("Couldn't complete handshake to MySQL server: %s", err)
+		server.proxy.Output().Log("Couldn't complete handshake to MySQL server: %s", err)
 		server.finished = true
 		return
 	}
-	if !packetIsOK(response) {
-		output.Log("Bad handshake response from MySQL server")
+	server.proxy.Output().Dump(response.Payload, "Handshake response packet from server:\n")
+
+	authPluginData, _ := parseGreeting(welcomePacket)
+	response, err = authenticate(server.stream, response, server.proxy.credentials.MysqlPassword, authPluginData)
+	if err != nil {
+		err = NewProxyError(ErrBackendFailed, err, "mysql-sanitizer couldn't log into the MySQL server")
+		server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), clientHandshake.SequenceID, err))
 		server.finished = true
 		return
 	}
+	if compression := server.proxy.negotiatedCompression(server.conn); compression != nil {
+		compression.enable()
+	}
 
-	err = server.setStatementTimeout(20) // Kill queries if they run for over 20 seconds
+	err = server.initializeSession()
 	if err != nil {
-		output.Log("Couldn't set max_statement_time: %s", err)
+		err = NewProxyError(ErrBackendFailed, err, "mysql-sanitizer couldn't initialize the session")
+		server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), clientHandshake.SequenceID, err))
 		server.finished = true
 		return
 	}
 
-	server.proxy.ClientChannel <- response
+	// Any auth plugin switching happened behind the client's back, so the
+	// OK has to follow on from its handshake response.
+	response.SequenceID = clientHandshake.SequenceID + 1
+	server.proxy.SendToClient(response)
+}
+
+// initializeSession sets the statement timeout and runs the configured
+// SessionInitStatements, in that order, before the client gets to send
+// anything.
+func (server *ServerConnection) initializeSession() error {
+	err := server.setStatementTimeout(config.StatementTimeout)
+	if err != nil {
+		return fmt.Errorf("Couldn't set max_statement_time: %s", err)
+	}
+
+	for _, statement := range config.SessionInitStatements {
+		err = server.execute(statement)
+		if err != nil {
+			return fmt.Errorf("Init statement \"%s\" failed: %s", statement, err)
+		}
+	}
+	return nil
 }
 
-// This is a Percona-specific feature. Later versions of MySQL (5.7.4 and
-// up) have similar functionality built in, so we should use that instead
-// once we've upgraded.
-// https://www.percona.com/doc/percona-server/5.6/management/statement_timeout.html
+// Which variable that takes depends on the server; see probe.go. Without
+// one, there's nothing to set.
 func (server *ServerConnection) setStatementTimeout(seconds int) error {
-	query := fmt.Sprintf("\x03SET max_statement_time = %d", seconds*1000)
-	setCommand := mysqlproto.Packet{0, []byte(query)}
-	output.Dump(setCommand.Payload, "Sending max_statement_time packet to server:\n")
-	WritePacket(server.stream, setCommand)
+	if statementTimeout.variable == "" {
+		return nil
+	}
+	return server.execute(statementTimeout.query(seconds))
+}
+
+// execute runs a query of our own on the server between client commands,
+// and returns an error unless it succeeds. Any rows it returns are thrown
+// away.
+func (server *ServerConnection) execute(query string) error {
+	return server.command(append([]byte{COM_QUERY}, query...))
+}
+
+// command is execute for any command, not just COM_QUERY.
+func (server *ServerConnection) command(payload []byte) error {
+	command := mysqlproto.Packet{0, payload}
+	server.proxy.Output().Dump(command.Payload, "Sending our own command to server:\n")
+	if err := server.write(command); err != nil {
+		return err
+	}
+
+	response, err := ReadPacket(server.stream)
+	if err != nil {
+		return err
+	}
+	server.proxy.Output().Dump(response.Payload, "Got response to our own command from server:\n")
 
-	response, err := server.stream.NextPacket()
 	if packetIsERR(response) {
-		return errors.New("Got error from max_statement_time!")
+		return errors.New(errorPacketMessage(response))
+	} else if packetIsOK(response) {
+		return nil
+	}
+
+	// It's a result set, so skip past the column definitions and rows.
+	end, err := server.skipResultSet()
+	if err != nil {
+		return err
+	}
+	if packetIsERR(end) {
+		return errors.New(errorPacketMessage(end))
+	}
+	return nil
+}
+
+// skipResultSet reads the rest of a result set after its column count,
+// returning the packet that ends it.
+func (server *ServerConnection) skipResultSet() (mysqlproto.Packet, error) {
+	// With CLIENT_DEPRECATE_EOF there's no EOF after the definitions.
+	eofCount := 0
+	if server.proxy.deprecateEOF() {
+		eofCount = 1
+	}
+	for {
+		packet, err := ReadPacket(server.stream)
+		if err != nil {
+			return packet, err
+		}
+		if packetIsERR(packet) {
+			return packet, nil
+		} else if packetEndsRows(packet) {
+			eofCount++
+			if eofCount == 2 {
+				return packet, nil
+			}
+		}
+	}
+}
+
+// discardResults throws away whatever results the server has left to send
+// after the one this packet ended, for when the client's already had an
+// error instead.
+func (server *ServerConnection) discardResults(packet mysqlproto.Packet) error {
+	for server.proxy.moreResults(packet) {
+		var err error
+		if packet, err = ReadPacket(server.stream); err != nil {
+			return err
+		}
+		if !packetIsOK(packet) && !packetIsERR(packet) {
+			if packet, err = server.skipResultSet(); err != nil {
+				return err
+			}
+		}
 	}
-	output.Dump(response.Payload, "Got max_statement_time response from server:\n")
-	return err
+	return nil
 }
 
+// handleQueryResponse forwards the server's response to a query. That's one
+// result (an OK, an ERR, or a result set), or several in a row for multiple
+// statements and CALLs, each saying whether there's another after it.
 func (server *ServerConnection) handleQueryResponse() {
+	server.handleResults(nil)
+}
+
+// handleResults is handleQueryResponse for a query or, if statement isn't
+// nil, for executing a prepared statement, whose rows come in the binary
+// protocol.
+func (server *ServerConnection) handleResults(statement *preparedStatement) {
+	started := time.Now()
+	sequenceId := byte(0) // The last packet the client got; commands always start at 0
+	first := true
+
 	for {
-		response, err := server.stream.NextPacket()
+		response, err := ReadPacket(server.stream)
 		if err != nil {
-			output.Log("Couldn't receive packet from MySQL server: %s", err)
-			server.finished = true
+			if first {
+				admission.Observe(time.Since(started), nil)
+			}
+			server.lostBackend(sequenceId, fmt.Errorf("Couldn't receive packet from MySQL server: %s", err))
 			return
 		}
-		output.Dump(response.Payload, "Packet from server:\n")
+		if first {
+			admission.Observe(time.Since(started), &response)
+			first = false
+		}
+		server.proxy.Output().Dump(response.Payload, "Packet from server:\n")
+		if packetIsLocalInfileRequest(response) {
+			if !server.handleLocalInfile(response, &sequenceId) {
+				return
+			}
+			continue
+		}
+		// Sanitizing big rows in an earlier result can change how many
+		// pieces they take, so everything after gets renumbered.
+		response.SequenceID = sequenceId + byte(packetPieces(len(response.Payload)))
 
 		if packetIsOK(response) || packetIsERR(response) || packetIsEOF(response) {
-			server.proxy.ClientChannel <- response
-			break
-		} else {
-			columns, err := server.readColumnDefinitions(response)
-			if err != nil {
-				output.Log("Couldn't receive column definitions from MySQL server: %s", err)
-				server.finished = true
+			server.proxy.recordResponse(response)
+			server.proxy.countAffectedRows(response)
+			server.proxy.noteStatus(response)
+			if ok, err := server.proxy.ParseOK(response); err == nil {
+				stats.OKReceived(ok)
+				server.proxy.auditWrite(server.proxy.query, ok)
+				server.proxy.rememberSession(server.proxy.query)
+			}
+			server.proxy.SendToClient(response)
+			if !server.proxy.moreResults(response) {
 				return
 			}
+			sequenceId = response.SequenceID
+			continue
+		}
 
-			eofPacket, err := server.stream.NextPacket()
+		columns, received, definitions, err := server.readColumnDefinitions(response, statement != nil)
+		if err != nil {
+			server.proxy.Output().Log("Couldn't receive column definitions from MySQL server: %s", err)
+			server.finished = true
+			return
+		}
+		if !server.proxy.deprecateEOF() {
+			eofPacket, err := ReadPacket(server.stream)
 			if err != nil {
-				output.Log("Couldn't receive column definitions from MySQL server: %s", err)
-				server.finished = true
+				server.lostBackend(sequenceId, fmt.Errorf("Couldn't receive column definitions from MySQL server: %s", err))
 				return
 			}
-			output.Dump(eofPacket.Payload, "End of column definitions packet from server:\n")
-			server.proxy.ClientChannel <- eofPacket
+			server.proxy.Output().Dump(eofPacket.Payload, "End of column definitions packet from server:\n")
+			definitions = append(definitions, eofPacket)
+		}
 
-			for {
-				rowPacket, err := server.stream.NextPacket()
-				output.Dump(rowPacket.Payload, "Response packet from server:\n")
+		// A cursor keeps the rows for COM_STMT_FETCH. Without
+		// CLIENT_DEPRECATE_EOF the EOF above says so; with it there's
+		// an extra one, which forwardRows passes along as the end.
+		cursor := statement != nil && !server.proxy.deprecateEOF() && server.proxy.cursorOpened(definitions[len(definitions)-1])
+		if unclassified := strictViolations(columns); len(unclassified) > 0 {
+			server.refuseResult(sequenceId, unclassified, !cursor)
+			return
+		}
+		if statement == nil {
+			received = nil // Text rows don't care how the server typed them
+		} else {
+			statement.columns, statement.received = columns, received
+		}
+		for _, definition := range definitions {
+			definition.SequenceID = sequenceId + 1
+			server.proxy.SendToClient(definition)
+			sequenceId = definition.SequenceID
+		}
+		server.proxy.Record(RecordingEntry{Event: "columns", Columns: columnNames(columns)})
+		if cursor {
+			return
+		}
+		if !server.forwardRows(columns, received, started, &sequenceId) {
+			return
+		}
+	}
+}
 
-				if err != nil {
-					output.Log("Couldn't receive column definitions from MySQL server: %s", err)
-					server.finished = true
-					return
-				}
-				if packetIsOK(rowPacket) || packetIsERR(rowPacket) || packetIsEOF(rowPacket) {
-					server.proxy.ClientChannel <- rowPacket
-					return
-				}
+// forwardRows sanitizes and forwards a result set's rows and the packet that
+// ends them. received is nil for text protocol rows, or for binary ones the
+// columns as the server typed them. sequenceId is the last packet the client
+// got, and gets updated as we go. It returns true if there's another result
+// to come after this one.
+func (server *ServerConnection) forwardRows(columns, received []Column, started time.Time, sequenceId *byte) bool {
+	var rowCount uint64
+	var tracker slowClientTracker
+	scan := dlpScanner.Start(server.proxy, columns)
+	width := server.proxy.resultWidth(columns)
 
-				rows, err := readRowValues(rowPacket, columns)
-				if err != nil {
-					output.Log("Couldn't receive row values from MySQL server: %s", err)
-					server.finished = true
-					return
-				}
+	for {
+		rowPacket, err := ReadPacket(server.stream)
+		server.proxy.Output().Dump(rowPacket.Payload, "Response packet from server:\n")
 
-				server.proxy.ClientChannel <- constructNewResponse(rowPacket, rows)
-			}
+		if err != nil {
+			server.lostBackend(*sequenceId, fmt.Errorf("Couldn't receive rows from MySQL server: %s", err))
+			return false
+		}
+		// Rows never end with a plain OK (with CLIENT_DEPRECATE_EOF it
+		// still has an EOF header), and plenty of rows parse like one:
+		// binary rows start with 0x00, and so do text rows whose first
+		// value is an empty string.
+		if packetIsERR(rowPacket) || packetEndsRows(rowPacket) {
+			server.proxy.Record(RecordingEntry{Event: "rows", Rows: rowCount})
+			server.proxy.recordResponse(rowPacket)
+			server.proxy.noteStatus(rowPacket)
+			rowPacket.SequenceID = *sequenceId + 1
+			server.proxy.SendToClient(rowPacket)
+			scan.finish()
+			*sequenceId = rowPacket.SequenceID
+			return server.proxy.moreResults(rowPacket)
+		}
+		if config.MaxResultDuration > 0 && time.Since(started) > time.Duration(config.MaxResultDuration)*time.Second {
+			server.abortResult(*sequenceId)
+			return false
+		}
+
+		row, scanned, err := server.sanitizedRow(rowPacket, columns, received, width)
+		if err != nil {
+			server.proxy.DumpTrace("a row we couldn't read")
+			server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), *sequenceId, err))
+			server.finished = true
+			return false
+		}
+		// Sanitizing can change how many pieces a big row takes, so
+		// number it from what the client's had so far.
+		row.SequenceID = *sequenceId + byte(packetPieces(len(row.Payload)))
+
+		if !server.sendRow(row, &tracker) {
+			return false
+		}
+		server.proxy.countRow(len(row.Payload))
+		scan.addRow(scanned)
+		rowCount++
+		*sequenceId = row.SequenceID
+	}
+}
+
+// sanitizedRow returns the row to send the client in place of one from the
+// server, and the same row in the text protocol, for the DLP scanner.
+func (server *ServerConnection) sanitizedRow(rowPacket mysqlproto.Packet, columns, received []Column, width int) (mysqlproto.Packet, mysqlproto.Packet, error) {
+	if received != nil {
+		return server.sanitizedBinaryRow(rowPacket, columns, received, width)
+	}
+	row := rowPacket
+	if server.proxy.Sanitizing() {
+		rows, err := readRowValues(rowPacket, columns)
+		if err != nil {
+			return rowPacket, rowPacket, err
 		}
+		row = constructNewResponse(rowPacket, rows)
 	}
+	if width > 0 {
+		row = truncateRow(row, columns, width)
+	}
+	return row, row, nil
+}
+
+// abortResult gives up on a result set that's taken too long to stream
+// (usually because the client is reading it slowly). Hanging up on the
+// server is the only way to stop it sending the rest, and it kills the query
+// as soon as it notices, so the session is over after this.
+func (server *ServerConnection) abortResult(sequenceId byte) {
+	server.stream.Close()
+	err := NewProxyError(ErrTimeout, nil, "mysql-sanitizer killed a result set that took longer than %d seconds to stream", config.MaxResultDuration)
+	server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), sequenceId, err))
+	server.finished = true
 }
 
-func (server *ServerConnection) handleOtherResponse() {
+// handleOtherResponse forwards the response to anything but a query, and
+// returns whether it was an OK.
+func (server *ServerConnection) handleOtherResponse() bool {
+	sequenceId := byte(0)
 	for {
-		response, err := server.stream.NextPacket()
+		response, err := ReadPacket(server.stream)
 		if err != nil {
-			output.Log("Couldn't receive packet from MySQL server: %s", err)
-			server.finished = true
-			return
+			server.lostBackend(sequenceId, fmt.Errorf("Couldn't receive packet from MySQL server: %s", err))
+			return false
 		}
-		output.Dump(response.Payload, "Miscellaneous response packet from server:\n")
-		server.proxy.ClientChannel <- response
-		if packetIsOK(response) || packetIsERR(response) || packetIsEOF(response) {
-			break
+		server.proxy.Output().Dump(response.Payload, "Miscellaneous response packet from server:\n")
+		server.proxy.SendToClient(response)
+		sequenceId = response.SequenceID
+		if packetIsOK(response) || packetIsERR(response) || packetEndsRows(response) {
+			return packetIsOK(response)
 		}
 	}
 }
 
 func packetIsOK(packet mysqlproto.Packet) bool {
-	return packet.Payload[0] == 0 && len(packet.Payload) >= 7
+	_, err := ParseOK(packet, 0)
+	return err == nil
 }
 
 func packetIsERR(packet mysqlproto.Packet) bool {
@@ -227,70 +635,225 @@ func packetIsEOF(packet mysqlproto.Packet) bool {
 	return packet.Payload[0] == 0xFE && len(packet.Payload) < 9
 }
 
+// packetEndsRows returns whether a packet ends a result set's rows: an EOF,
+// or with CLIENT_DEPRECATE_EOF, the OK with an EOF header that replaces it,
+// which can be a lot longer. Rows only start with 0xFE when their first
+// value is over 16MB, so the length tells them apart.
+func packetEndsRows(packet mysqlproto.Packet) bool {
+	return packet.Payload[0] == 0xFE && len(packet.Payload) < maxPacketPayload
+}
+
 func packetCommand(packet mysqlproto.Packet) byte {
 	return packet.Payload[0]
 }
 
-func (server *ServerConnection) readColumnDefinitions(packet mysqlproto.Packet) ([]Column, error) {
+// readColumnDefinitions reads a result set's column definitions, returning
+// the columns, the same columns as the server typed them (which only differ
+// if we retyped some), and the packets to forward to the client (starting
+// with the column count packet). binary is whether the rows will be in the
+// binary protocol.
+func (server *ServerConnection) readColumnDefinitions(packet mysqlproto.Packet, binary bool) ([]Column, []Column, []mysqlproto.Packet, error) {
 	parser := NewPacketParser(packet)
 	columnCount := parser.ReadEncodedInt()
 
-	columns := make([]Column, columnCount)
-	server.proxy.ClientChannel <- packet
+	columns, received, definitions, err := server.readColumns(int(columnCount), binary)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return columns, received, append([]mysqlproto.Packet{packet}, definitions...), nil
+}
 
-	for i := 0; i < int(columnCount); i++ {
-		packet, err := server.stream.NextPacket()
+// readColumns reads count column definitions, for readColumnDefinitions.
+func (server *ServerConnection) readColumns(count int, binary bool) ([]Column, []Column, []mysqlproto.Packet, error) {
+	columns := make([]Column, count)
+	received := make([]Column, count)
+	definitions := []mysqlproto.Packet{}
+	tainted := server.proxy.readsOutVariables(server.proxy.query) || (binary && callsProcedure(server.proxy.query))
+	traces := traceColumns(server.proxy.query, server.proxy.Database, count)
+
+	for i := 0; i < count; i++ {
+		packet, err := ReadPacket(server.stream)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
-		output.Dump(packet.Payload, "Column definition packet from server:\n")
-		parser = NewPacketParser(packet)
-		server.proxy.ClientChannel <- packet
+		server.proxy.Output().Dump(packet.Payload, "Column definition packet from server:\n")
+		parser := NewPacketParser(packet)
 
 		column, err := ReadColumn(parser)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
+		}
+		column = traceResult(column, traces, i)
+		column.ruleSet = server.proxy.RuleSet()
+		column.watermark = server.proxy.Watermark()
+		column.tainted = tainted && column.Database == "" && column.Table == ""
+		received[i] = column
+		if column.NeedsRetyping() {
+			packet, column = RetypeAsText(packet, column)
 		}
+		definitions = append(definitions, packet)
 		columns[i] = column
 	}
-	return columns, nil
+	return columns, received, definitions, nil
 }
 
 func readRowValues(packet mysqlproto.Packet, columns []Column) ([][]byte, error) {
 	parser := NewPacketParser(packet)
-	rows := [][]byte{}
+	raw := [][]byte{}
 
-	for _, col := range columns {
+	for range columns {
 		value, nonNull := parser.ReadStringOrNull()
 		if nonNull {
-			rowVal := []byte(value)
-			if !col.IsSafe() {
-				rowVal = sanitizeRow(rowVal, col)
-			}
-			rows = append(rows, rowVal)
+			raw = append(raw, []byte(value))
 		} else {
+			raw = append(raw, nil)
+		}
+	}
+
+	return sanitizeRowValues(columns, raw)
+}
+
+// sanitizeRowValues returns the values to send the client in place of the
+// row's raw values, in the text protocol's format. NULLs are nil.
+func sanitizeRowValues(columns []Column, raw [][]byte) ([][]byte, error) {
+	var err error
+	rows := [][]byte{}
+
+	for i, col := range columns {
+		if raw[i] == nil {
 			rows = append(rows, nil)
+			continue
+		}
+
+		rowVal := append([]byte{}, raw[i]...) // never nil, since that means NULL
+		if config.PIIDiscoveryInterval > 0 {
+			piiDiscovery.Observe(col, rowVal)
+		}
+		if redacted, ok := redactSchemaValue(rowVal, col); ok {
+			rowVal = redacted
+		} else if len(rowVal) == 0 && !col.IsSafe() && (preserveEmptyColumns.Contains(col) || nullEmptyColumns.Contains(col)) {
+			// Hashing would make empty strings look like real data, so
+			// some columns want them left alone or turned into NULLs.
+			if nullEmptyColumns.Contains(col) {
+				rowVal = nil
+			} else {
+				rowVal = []byte{}
+			}
+		} else if !col.IsSafe() {
+			rowVal, err = maskStrategyFor(col.Rules().Action(col)).Mask(rowVal, col)
+			if err != nil {
+				return nil, err
+			}
+			lengthStats.Observe(col, raw[i], rowVal)
+			stats.ValueSanitized()
+			if col.ruleSet != nil {
+				atomic.AddInt64(&col.ruleSet.valuesSanitized, 1)
+			}
 		}
+		rows = append(rows, rowVal)
 	}
 
+	applyRowRules(rowRules, columns, raw, rows)
+
+	// Whatever the server sent must already fit, so only check what we
+	// changed.
+	for i, col := range columns {
+		if (rows[i] == nil) == (raw[i] == nil) && bytes.Equal(rows[i], raw[i]) {
+			continue
+		}
+		if problem := col.CheckReplacement(rows[i]); problem != "" {
+			output.Log("Replacement for %s.%s.%s doesn't fit the column (%s), sending '%s' instead",
+				col.Database, col.Table, col.Name, problem, col.Sentinel())
+			rows[i] = col.Sentinel()
+		}
+	}
 	return rows, nil
 }
 
-func sanitizeRow(row []byte, column Column) []byte {
-	sum := sha256.Sum256(append(row, config.HashSaltBytes...))
-	newRow := make([]byte, sha256.Size*2)
-	hex.Encode(newRow, sum[:])
+func sanitizeRow(row []byte, column Column) ([]byte, error) {
+	var newRow []byte
+	hashed := false
+
+	if pseudonym, ok := identifierGroups.Pseudonym(row, column); ok {
+		return pseudonym, nil
+	}
+
+	// Card and phone numbers keep their length, and IP addresses fit in
+	// whatever held the original, so there's nothing to truncate. Anything
+	// that doesn't parse just gets hashed.
+	if cardColumns.Contains(column) {
+		if masked, ok := maskCardNumber(row, config.HashSaltBytes); ok {
+			return masked, nil
+		}
+	}
+	if phoneColumns.Contains(column) {
+		if masked, ok := maskPhoneNumber(row, config.HashSaltBytes); ok {
+			return masked, nil
+		}
+	}
+	if ipColumns.Contains(column) {
+		if masked, ok := maskIPAddress(row, ipAnonymizer); ok {
+			return masked, nil
+		}
+	}
+
+	if urlColumns.Contains(column) {
+		// Masked URLs and scrubbed text can come out longer than the
+		// original, so these still need truncating below.
+		newRow, _ = maskURL(row, config.HashSaltBytes, urlParams)
+	} else if scrubber.Handles(column) {
+		newRow = scrubber.Scrub(row, config.HashSaltBytes)
+	}
+
+	if newRow == nil && kdf.Handles(column) {
+		var err error
+		newRow, err = kdf.Hash(row, config.HashSaltBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't run %s on %s.%s.%s: %s", config.Kdf.Algorithm, column.Database, column.Table, column.Name, err)
+		}
+		newRow = prefixHashVersion(newRow, column.Length)
+		checkHashTruncation(newRow, column)
+		hashed = true
+	} else if newRow == nil {
+		sum := hasher.Sum(row, config.HashSaltBytes)
+		newRow = make([]byte, hex.EncodedLen(len(sum)))
+		hex.Encode(newRow, sum)
+		newRow = prefixHashVersion(newRow, column.Length)
+		checkHashTruncation(newRow, column)
+		hashed = true
+	}
 
 	if uint32(len(newRow)) > column.Length {
 		newRow = newRow[:column.Length]
 	}
-	return newRow
+	if hashed {
+		newRow = applyWatermark(newRow, column.watermark, config.Watermark.Bits)
+	}
+	return newRow, nil
+}
+
+// checkHashTruncation keeps track of hex hashes that are about to be cut
+// short to fit the column.
+func checkHashTruncation(hashed []byte, column Column) {
+	if uint32(len(hashed)) <= column.Length {
+		return
+	}
+	prefix := bytes.IndexByte(hashed, ':') + 1 // the salt version, if any
+	bits := 4 * (int(column.Length) - prefix)
+	if bits < 0 {
+		bits = 0
+	}
+	lengthStats.HashTruncated(column, bits)
 }
 
 func constructNewResponse(originalPacket mysqlproto.Packet, rows [][]byte) mysqlproto.Packet {
 	newPacket := mysqlproto.Packet{originalPacket.SequenceID, []byte{}}
 
 	for _, row := range rows {
+		if row == nil {
+			newPacket.Payload = append(newPacket.Payload, 0xFB) // NULL
+			continue
+		}
 		row = append(LengthEncodedInt(uint(len(row))), row...)
 		newPacket.Payload = append(newPacket.Payload, row...)
 	}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestReadRowValues_EmptyStrings(t *testing.T) {
+	preserveEmptyColumns, _ = NewColumnSet([]string{"honk.bonk.preserved"})
+	nullEmptyColumns, _ = NewColumnSet([]string{"honk.bonk.nulled"})
+	defer func() {
+		preserveEmptyColumns = nil
+		nullEmptyColumns = nil
+	}()
+
+	columns := []Column{
+		{true, "honk", "bonk", "preserved", "preserved", 255, 0, 0, nil, "", false, nil},
+		{true, "honk", "bonk", "nulled", "nulled", 255, 0, 0, nil, "", false, nil},
+		{true, "honk", "bonk", "nulled", "nulled", 255, 0, 0, nil, "", false, nil},
+	}
+	packet := mysqlproto.Packet{3, []byte("\x00\x00\xfb")}
+
+	rows, err := readRowValues(packet, columns)
+	if err != nil {
+		t.Fatalf("readRowValues failed: %s", err)
+	}
+	if rows[0] == nil || len(rows[0]) != 0 {
+		t.Errorf("Empty string should have been preserved: %v", rows[0])
+	}
+	if rows[1] != nil || rows[2] != nil {
+		t.Errorf("Empty string and NULL should both be NULL: %v, %v", rows[1], rows[2])
+	}
+
+	response := constructNewResponse(packet, rows)
+	if string(response.Payload) != "\x00\xfb\xfb" {
+		t.Errorf("Bogus row packet: %v", response.Payload)
+	}
+}
+
+func TestReadRowValues_Sentinel(t *testing.T) {
+	nullEmptyColumns, _ = NewColumnSet([]string{"honk.bonk.nulled"})
+	rowRules, _ = NewRowRules([]RowRule{{Column: "honk.bonk.salary", Value: "redacted"}})
+	defer func() {
+		nullEmptyColumns = nil
+		rowRules = nil
+	}()
+
+	columns := []Column{
+		{true, "honk", "bonk", "nulled", "nulled", 255, TYPE_VAR_STRING, NOT_NULL_FLAG, nil, "", false, nil},
+		{false, "honk", "bonk", "salary", "salary", 11, TYPE_LONG, 0, nil, "", false, nil},
+	}
+	packet := mysqlproto.Packet{3, []byte("\x00\x0550000")}
+
+	rows, err := readRowValues(packet, columns)
+	if err != nil {
+		t.Fatalf("readRowValues failed: %s", err)
+	}
+	if rows[0] == nil || len(rows[0]) != 0 {
+		t.Errorf("NOT NULL column should have gotten an empty string: %v", rows[0])
+	}
+	if string(rows[1]) != "0" {
+		t.Errorf("Integer column should have gotten 0: %s", rows[1])
+	}
+}
+
+func TestHandleQueryResponse_deprecateEOF(t *testing.T) {
+	proxyEnd, backendEnd := net.Pipe()
+	defer proxyEnd.Close()
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	proxy.Capabilities = mysqlproto.CLIENT_PROTOCOL_41 | mysqlproto.CLIENT_DEPRECATE_EOF
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+	// No EOF after the definitions, and the rows end with an OK that's too
+	// long to pass for an EOF, in a transaction.
+	end := mysqlproto.Packet{4, append([]byte{0xFE, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00}, "honk honk"...)}
+	go func() {
+		backend := mysqlproto.NewStream(backendEnd)
+		packets := []mysqlproto.Packet{{1, LengthEncodedInt(1)}, selftestColumnPacket(1, "email", 0xfd),
+			TextRowPacket(2, []string{"honk@example.com"}), end}
+		for _, packet := range packets {
+			WritePacket(backend, packet)
+		}
+	}()
+	server.handleQueryResponse()
+
+	packets := []mysqlproto.Packet{}
+	for len(proxy.ClientChannel) > 0 {
+		packets = append(packets, <-proxy.ClientChannel)
+	}
+	if len(packets) != 4 {
+		t.Fatalf("Bogus result set with CLIENT_DEPRECATE_EOF: %d packets", len(packets))
+	}
+	if last := packets[3]; last.SequenceID != 4 || string(last.Payload) != string(end.Payload) {
+		t.Errorf("Bogus end of result set: %v", last)
+	}
+	if !proxy.transactionOpen {
+		t.Error("Bogus status: missed the transaction in the final OK")
+	}
+}
+
+func TestHandleQueryResponse_multipleResults(t *testing.T) {
+	proxyEnd, backendEnd := net.Pipe()
+	defer proxyEnd.Close()
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	proxy.Capabilities = mysqlproto.CLIENT_PROTOCOL_41
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+	// A result set, an OK for an UPDATE, then the OK that ends a CALL.
+	more := []byte{0xFE, 0x00, 0x00, 0x0A, 0x00}
+	go func() {
+		backend := mysqlproto.NewStream(backendEnd)
+		packets := []mysqlproto.Packet{{1, LengthEncodedInt(1)}, selftestColumnPacket(1, "email", 0xfd), EOFPacket(2),
+			TextRowPacket(3, []string{"honk@example.com"}), {5, more},
+			{6, []byte{0x00, 0x03, 0x00, 0x0A, 0x00, 0x00, 0x00}}, OKPacket(6)}
+		for _, packet := range packets {
+			WritePacket(backend, packet)
+		}
+	}()
+	server.handleQueryResponse()
+
+	packets := []mysqlproto.Packet{}
+	for len(proxy.ClientChannel) > 0 {
+		packets = append(packets, <-proxy.ClientChannel)
+	}
+	if len(packets) != 7 {
+		t.Fatalf("Bogus multiple results: %d packets", len(packets))
+	}
+	for i, packet := range packets {
+		if packet.SequenceID != byte(i+1) {
+			t.Errorf("Packet %d has the wrong sequence ID: %d", i, packet.SequenceID)
+		}
+	}
+	if ok, err := ParseOK(packets[5], proxy.Capabilities); err != nil || ok.AffectedRows != 3 {
+		t.Errorf("Bogus UPDATE result: %v", packets[5].Payload)
+	}
+}
+
+func TestHandleQueryResponse_emptyFirstValue(t *testing.T) {
+	proxyEnd, backendEnd := net.Pipe()
+	defer proxyEnd.Close()
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	proxy.Capabilities = mysqlproto.CLIENT_PROTOCOL_41
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+	// SELECT '', email FROM users: the row starts with 0x00, like an OK.
+	row := TextRowPacket(4, []string{"", "alice@example.com"})
+	if !packetIsOK(row) {
+		t.Fatal("Test row should parse as an OK, or it isn't testing anything")
+	}
+	go func() {
+		backend := mysqlproto.NewStream(backendEnd)
+		packets := []mysqlproto.Packet{{1, LengthEncodedInt(2)}, selftestColumnPacket(1, "blank", 0xfd),
+			selftestColumnPacket(2, "email", 0xfd), EOFPacket(3), row, EOFPacket(5)}
+		for _, packet := range packets {
+			WritePacket(backend, packet)
+		}
+	}()
+	server.handleQueryResponse()
+
+	packets := []mysqlproto.Packet{}
+	for len(proxy.ClientChannel) > 0 {
+		packets = append(packets, <-proxy.ClientChannel)
+	}
+	if len(packets) != 6 {
+		t.Fatalf("Bogus result set with an empty first value: %d packets", len(packets))
+	}
+	if strings.Contains(string(packets[4].Payload), "alice") {
+		t.Errorf("Row should have been sanitized: %q", packets[4].Payload)
+	}
+	if !packetIsEOF(packets[5]) {
+		t.Errorf("Bogus end of result set: %v", packets[5])
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// ServerPool keeps a few server connections logged in and initialized ahead
+// of time (see WarmConnections), so new clients don't have to wait for all
+// that. Since we log in as MysqlUsername no matter who the client is, we
+// don't need the client around to do it. Pooled connections are only ever
+// used once, so no session state leaks between clients.
+//
+// The catch is that we have to greet clients ourselves, so they get whatever
+// capabilities we negotiated with the server up front instead of their own.
+type ServerPool struct {
+	connections  chan *ServerConnection
+	capabilities uint32 // What we negotiated with the server
+}
+
+// pooledCapabilities are the capability flags pooled connections ask for.
+const pooledCapabilities = mysqlproto.CLIENT_LONG_PASSWORD | mysqlproto.CLIENT_LONG_FLAG |
+	mysqlproto.CLIENT_PROTOCOL_41 | mysqlproto.CLIENT_TRANSACTIONS |
+	mysqlproto.CLIENT_SECURE_CONNECTION | mysqlproto.CLIENT_PLUGIN_AUTH |
+	mysqlproto.CLIENT_MULTI_RESULTS | mysqlproto.CLIENT_PS_MULTI_RESULTS
+
+var serverPool *ServerPool
+
+// NewServerPool returns an empty pool that holds up to size connections.
+func NewServerPool(size int) *ServerPool {
+	return &ServerPool{connections: make(chan *ServerConnection, size)}
+}
+
+// Fill keeps the pool topped up forever.
+func (pool *ServerPool) Fill() {
+	failures := 0
+	for {
+		server, err := pool.connect()
+		stats.BackendResult(err)
+		if err != nil {
+			failures++
+			output.Log("Couldn't warm up a connection to %s: %s", config.MysqlHost, err)
+			time.Sleep(time.Duration(failures) * time.Second)
+			continue
+		}
+		failures = 0
+		pool.connections <- server
+	}
+}
+
+// Get returns a logged-in server connection for the proxy, from the pool if
+// there's a good one handy.
+func (pool *ServerPool) Get(proxy *ProxyConnection) (*ServerConnection, error) {
+	for {
+		var server *ServerConnection
+		select {
+		case server = <-pool.connections:
+		default:
+			server, err := pool.connect()
+			if err != nil {
+				return nil, err
+			}
+			server.proxy = proxy
+			return server, nil
+		}
+
+		// The server may have hung up on it while it was sitting around.
+		if err := server.command([]byte{COM_PING}); err != nil {
+			output.Verbose("Discarding stale pooled connection: %s", err)
+			server.Close()
+			continue
+		}
+		server.proxy = proxy
+		return server, nil
+	}
+}
+
+// connect opens a new server connection and logs it in.
+func (pool *ServerPool) connect() (*ServerConnection, error) {
+	server, err := NewServerConnection(nil)
+	if err != nil {
+		return nil, err
+	}
+	server.pooled = true
+
+	capabilities, err := server.logIn()
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	atomic.StoreUint32(&pool.capabilities, capabilities)
+	return server, nil
+}
+
+// logIn does the handshake with the server on our own, then initializes the
+// session. It returns the capability flags we ended up with.
+func (server *ServerConnection) logIn() (uint32, error) {
+	return server.logInWith(pooledCapabilities)
+}
+
+// logInWith is logIn, asking for the given capability flags instead of the
+// usual ones.
+func (server *ServerConnection) logInWith(wanted uint32) (uint32, error) {
+	flags, err := server.handshake(wanted)
+	if err != nil {
+		return 0, err
+	}
+	return flags, server.initializeSession()
+}
+
+// handshake is logInWith without initializing the session.
+func (server *ServerConnection) handshake(wanted uint32) (uint32, error) {
+	greeting, err := server.stream.NextPacket()
+	if err != nil {
+		return 0, err
+	}
+	if packetIsERR(greeting) {
+		return 0, fmt.Errorf("Server refused connection: %s", errorPacketMessage(greeting))
+	}
+
+	authPluginData, capabilities := parseGreeting(greeting)
+	flags := wanted & capabilities
+	credentials := currentCredentials()
+	payload := mysqlproto.HandshakeResponse41(flags, 0x21, credentials.MysqlUsername, credentials.MysqlPassword,
+		authPluginData, "", nativePasswordPlugin, map[string]string{})
+	WritePacket(server.stream, mysqlproto.Packet{greeting.SequenceID + 1, payload[4:]})
+
+	response, err := server.stream.NextPacket()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := authenticate(server.stream, response, credentials.MysqlPassword, authPluginData); err != nil {
+		return 0, err
+	}
+	return flags, nil
+}
+
+// doPooledHandshake greets the client on behalf of an already logged-in
+// server connection, then switches to the database the client asked for.
+func (server *ServerConnection) doPooledHandshake() {
+	authPluginData := make([]byte, 20)
+	rand.Read(authPluginData)
+	capabilities := atomic.LoadUint32(&serverPool.capabilities) | mysqlproto.CLIENT_CONNECT_WITH_DB
+	server.proxy.SendToClient(HandshakePacket(authPluginData, capabilities))
+
+	var clientHandshake mysqlproto.Packet
+	select {
+	case clientHandshake = <-server.proxy.ServerChannel:
+	case <-server.proxy.ctx.Done():
+		server.finished = true
+		return
+	}
+
+	if server.proxy.Database != "" {
+		err := server.command(append([]byte{COM_INIT_DB}, server.proxy.Database...))
+		if err != nil {
+			err = NewProxyError(ErrBackendFailed, err, "mysql-sanitizer couldn't switch to database '%s'", server.proxy.Database)
+			server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), clientHandshake.SequenceID, err))
+			server.finished = true
+			return
+		}
+	}
+
+	server.proxy.SendToClient(OKPacket(clientHandshake.SequenceID))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServerPool_SelfTest(t *testing.T) {
+	oldConfig := config
+	defer func() {
+		config = oldConfig
+		serverPool = nil
+	}()
+	serverPool = NewServerPool(2)
+
+	// The pool is empty, so this exercises connecting on demand, then
+	// greeting the client ourselves.
+	if !runSelfTest() {
+		t.Error("The self-test failed with a server pool")
+	}
+}
+
+func TestServerPool_Get(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't start the fake MySQL server: %s", err)
+	}
+	defer backend.Close()
+	go serveSelftestBackend(backend)
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.MysqlHost = "127.0.0.1"
+	config.MysqlPort = backend.Addr().(*net.TCPAddr).Port
+
+	pool := NewServerPool(1)
+	server, err := pool.connect()
+	if err != nil {
+		t.Fatalf("Couldn't connect: %s", err)
+	}
+	pool.connections <- server
+	if pool.capabilities&minimalCapabilities != minimalCapabilities {
+		t.Errorf("Bogus negotiated capabilities: %x", pool.capabilities)
+	}
+
+	proxy := &ProxyConnection{}
+	got, err := pool.Get(proxy)
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if got != server || got.proxy != proxy || !got.pooled {
+		t.Error("Get should have returned the pooled connection, attached to the proxy")
+	}
+	got.Close()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var defaultBlockedSetVariables = []string{"sql_log_bin", "gtid_next", "pseudo_thread_id"}
+var defaultAllowedIsolationLevels = []string{"READ COMMITTED", "REPEATABLE READ"}
+
+var setScopeRegex = regexp.MustCompile(`(?is)^(GLOBAL|PERSIST_ONLY|PERSIST|SESSION|LOCAL)\s+(.*)$`)
+var setSystemVariableRegex = regexp.MustCompile(`(?is)^@@(?:(GLOBAL|PERSIST_ONLY|PERSIST|SESSION|LOCAL)\.)?(.*)$`)
+var setStatementForRegex = regexp.MustCompile(`(?is)\s+FOR\s+\S`)
+var setIsolationRegex = regexp.MustCompile(`(?is)ISOLATION\s+LEVEL\s+(READ\s+UNCOMMITTED|READ\s+COMMITTED|REPEATABLE\s+READ|SERIALIZABLE)`)
+
+// checkSetStatement returns an error explaining why the query isn't allowed
+// if it's a SET statement that would change global state, change one of the
+// variables we depend on (like the statement timeout or anything set by
+// SessionInitStatements), or pick a transaction isolation level we don't
+// allow. Anything that isn't a SET statement is fine as far as this check
+// is concerned.
+func checkSetStatement(query string) error {
+	assignments, keyword, isSet := parseSetStatement(query)
+	if !isSet {
+		return nil
+	}
+	if keyword == "PASSWORD" || keyword == "DEFAULT" {
+		return fmt.Errorf("SET %s isn't allowed through mysql-sanitizer", keyword)
+	}
+
+	for _, assignment := range assignments {
+		if err := checkSetAssignment(assignment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSetStatement splits a SET statement into its assignments. keyword is
+// set for the special forms (SET PASSWORD, SET NAMES, etc.) that don't have
+// any, and isSet is false if the query isn't a SET statement at all.
+func parseSetStatement(query string) (assignments []string, keyword string, isSet bool) {
+	query = strings.TrimSpace(stripComments(query))
+	if firstKeyword(query) != "SET" {
+		return nil, "", false
+	}
+	body := strings.TrimSpace(query[len("SET"):])
+	body = strings.TrimRight(body, "; \t\r\n")
+
+	switch firstKeyword(body) {
+	case "PASSWORD", "DEFAULT", "NAMES", "CHARACTER", "CHARSET", "ROLE":
+		return nil, firstKeyword(body), true
+	case "STATEMENT":
+		// SET STATEMENT var = value [, ...] FOR <statement>, which changes the
+		// variables for just the one statement.
+		body = strings.TrimSpace(body[len("STATEMENT"):])
+		if match := setStatementForRegex.FindStringIndex(body); match != nil {
+			body = body[:match[0]]
+		}
+	}
+
+	for _, assignment := range splitTopLevel(body, ',') {
+		assignments = append(assignments, strings.TrimSpace(assignment))
+	}
+	return assignments, "", true
+}
+
+// parseSetAssignment picks apart a single "[scope] name = value". The name
+// comes back lowercased, and is "transaction" for SET TRANSACTION (with the
+// rest of the clause as the value) or "" for user variables.
+func parseSetAssignment(assignment string) (scope string, name string, value string) {
+	scope = "SESSION"
+	if match := setScopeRegex.FindStringSubmatch(assignment); match != nil {
+		scope = strings.ToUpper(match[1])
+		assignment = strings.TrimSpace(match[2])
+	}
+
+	if firstKeyword(assignment) == "TRANSACTION" {
+		return scope, "transaction", assignment
+	}
+	// User variables (@foo) only affect this session.
+	if strings.HasPrefix(assignment, "@") && !strings.HasPrefix(assignment, "@@") {
+		return scope, "", ""
+	}
+
+	parts := strings.SplitN(assignment, "=", 2)
+	name = strings.TrimSpace(strings.TrimSuffix(parts[0], ":")) // Also catches the ":=" form.
+	if len(parts) == 2 {
+		value = strings.TrimSpace(parts[1])
+	}
+	if match := setSystemVariableRegex.FindStringSubmatch(name); match != nil {
+		if match[1] != "" {
+			scope = strings.ToUpper(match[1])
+		}
+		name = match[2]
+	}
+	return scope, strings.ToLower(unquoteIdentifier(name)), value
+}
+
+func checkSetAssignment(assignment string) error {
+	scope, name, value := parseSetAssignment(assignment)
+	if scope == "GLOBAL" || strings.HasPrefix(scope, "PERSIST") {
+		return fmt.Errorf("Changing %s state isn't allowed through mysql-sanitizer", strings.ToLower(scope))
+	}
+
+	switch {
+	case name == "":
+		return nil
+	case name == "transaction":
+		return checkIsolationLevel(value)
+	case name == "transaction_isolation" || name == "tx_isolation":
+		if err := checkIsolationLevel("ISOLATION LEVEL " + strings.Replace(unquoteIdentifier(value), "-", " ", -1)); err != nil {
+			return err
+		}
+	}
+
+	if isTimeoutVariable(name) || isInitStatementVariable(name) {
+		return fmt.Errorf("Changing %s isn't allowed through mysql-sanitizer", name)
+	}
+	for _, blocked := range config.BlockedSetVariables {
+		if name == strings.ToLower(blocked) {
+			return fmt.Errorf("Changing %s isn't allowed through mysql-sanitizer", name)
+		}
+	}
+	return nil
+}
+
+// isInitStatementVariable reports whether one of the SessionInitStatements
+// sets the variable, since there's no point enforcing (say) time_zone if
+// the client can just change it back.
+func isInitStatementVariable(name string) bool {
+	for _, statement := range config.SessionInitStatements {
+		assignments, _, _ := parseSetStatement(statement)
+		for _, assignment := range assignments {
+			if _, initName, _ := parseSetAssignment(assignment); initName == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkIsolationLevel(clause string) error {
+	match := setIsolationRegex.FindStringSubmatch(clause)
+	if match == nil {
+		// Probably "TRANSACTION READ ONLY" or similar.
+		return nil
+	}
+
+	level := strings.Join(strings.Fields(strings.ToUpper(match[1])), " ")
+	for _, allowed := range config.AllowedIsolationLevels {
+		if level == strings.ToUpper(allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Isolation level %s isn't allowed through mysql-sanitizer", level)
+}
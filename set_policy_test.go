@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestCheckSetStatement_Allowed(t *testing.T) {
+	queries := []string{
+		"SELECT * FROM users",
+		"SET NAMES utf8mb4",
+		"SET autocommit = 1",
+		"set @foo := 3, @bar = 'sql_log_bin'",
+		"SET SESSION sql_mode = 'TRADITIONAL'",
+		"SET @@session.time_zone = '+00:00'",
+		"SET TRANSACTION ISOLATION LEVEL READ COMMITTED",
+		"SET SESSION TRANSACTION READ ONLY",
+		"SET transaction_isolation = 'REPEATABLE-READ'",
+		"/* hi */ SET wait_timeout = 60;",
+	}
+	for _, query := range queries {
+		if err := checkSetStatement(query); err != nil {
+			t.Errorf("'%s' should be allowed: %s", query, err)
+		}
+	}
+}
+
+func TestCheckSetStatement_Blocked(t *testing.T) {
+	queries := []string{
+		"SET GLOBAL read_only = 0",
+		"SET PERSIST max_connections = 10",
+		"SET @@global.read_only = 0",
+		"SET sql_log_bin = 0",
+		"SET autocommit = 1, @@SESSION.sql_log_bin = 0",
+		"set `max_statement_time` = 0",
+		"SET LOCAL max_execution_time = 0",
+		"SET TRANSACTION ISOLATION LEVEL READ UNCOMMITTED",
+		"SET GLOBAL TRANSACTION ISOLATION LEVEL READ COMMITTED",
+		"SET tx_isolation = 'READ-UNCOMMITTED'",
+		"SET PASSWORD = 'hunter2'",
+		"SET DEFAULT ROLE ALL TO bob",
+		"# sneaky\nSET sql_log_bin = 0",
+		"/*!50000 SET GLOBAL max_execution_time=0 */",
+		"SET /**/ GLOBAL sql_log_bin=0",
+		"SET GLOBAL/* hi */read_only = 0",
+		"SET /*!80000 PERSIST */ max_connections = 10",
+	}
+	for _, query := range queries {
+		if err := checkSetStatement(query); err == nil {
+			t.Errorf("'%s' should be blocked!", query)
+		}
+	}
+}
+
+func TestSplitTopLevel(t *testing.T) {
+	parts := splitTopLevel("a = 1, b = 'x,y', c = CONCAT(1, 2), d = `e,f`", ',')
+	if len(parts) != 4 || parts[1] != " b = 'x,y'" || parts[2] != " c = CONCAT(1, 2)" {
+		t.Errorf("Bogus split: %q", parts)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	cases := map[string][]string{
+		"SELECT 1":                         {"SELECT 1"},
+		"SELECT 1;":                        {"SELECT 1"},
+		"SELECT 1; SELECT 2":               {"SELECT 1", " SELECT 2"},
+		"SELECT ';', `;`; SELECT 2":        {"SELECT ';', `;`", " SELECT 2"},
+		"SELECT 'it\\'s;'; SELECT 2":       {"SELECT 'it\\'s;'", " SELECT 2"},
+		"SELECT 1 /* ; */; -- ;\nSELECT 2": {"SELECT 1 /* ; */", " -- ;\nSELECT 2"},
+		"SELECT 1; # bye":                  {"SELECT 1"},
+		"SELECT 1 /*!; SET x = 1 */":       {"SELECT 1 /*!", " SET x = 1 */"},
+	}
+	for query, expected := range cases {
+		if statements := splitStatements(query); fmt.Sprintf("%q", statements) != fmt.Sprintf("%q", expected) {
+			t.Errorf("Bogus statements in %q: %q", query, statements)
+		}
+	}
+}
+
+func TestCheckCommandPolicy_MultiStatements(t *testing.T) {
+	for _, query := range []string{"SELECT 1; SET sql_log_bin = 0", "SELECT ';'; /* hi */ SET GLOBAL read_only = 0"} {
+		if checkCommandPolicy(mysqlproto.Packet{0, append([]byte{COM_QUERY}, query...)}, false) == nil {
+			t.Errorf("'%s' should be blocked!", query)
+		}
+	}
+	if err := checkCommandPolicy(mysqlproto.Packet{0, []byte("\x03SELECT ';SET sql_log_bin = 0'; SELECT 2")}, false); err != nil {
+		t.Errorf("Bogus refusal: %s", err)
+	}
+}
+
+func TestCheckCommandPolicy_ExecutableComments(t *testing.T) {
+	defer func(pinned string) { config.PinnedDatabase = pinned }(config.PinnedDatabase)
+	config.PinnedDatabase = "some_db"
+
+	for _, query := range []string{
+		"/*!50000 SET GLOBAL max_execution_time=0 */",
+		"SET /**/ GLOBAL sql_log_bin=0",
+		"/*!50000 USE other */",
+		"USE /* hi */ other",
+		"SELECT 1; /*!USE other*/",
+	} {
+		if checkCommandPolicy(mysqlproto.Packet{0, append([]byte{COM_QUERY}, query...)}, false) == nil {
+			t.Errorf("'%s' should be blocked!", query)
+		}
+	}
+	for _, query := range []string{"/*!50000 USE some_db */", "SELECT '/*!50000 SET GLOBAL read_only = 0 */'", "/* USE other */ SELECT 1"} {
+		if err := checkCommandPolicy(mysqlproto.Packet{0, append([]byte{COM_QUERY}, query...)}, false); err != nil {
+			t.Errorf("Bogus refusal of '%s': %s", query, err)
+		}
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	cases := map[string]string{
+		"SET /**/ GLOBAL x = 1":            "SET   GLOBAL x = 1",
+		"/*!50000 SET x = 1 */":            "  SET x = 1  ",
+		"SELECT '/* hi */' -- bye\n, 2":    "SELECT '/* hi */'  , 2",
+		"SELECT 1 /*M!100100 , 2 */ # end": "SELECT 1   , 2    ",
+	}
+	for query, expected := range cases {
+		if stripped := stripComments(query); stripped != expected {
+			t.Errorf("Bogus stripping of %q: %q", query, stripped)
+		}
+	}
+}
+
+func TestCheckSetStatement_InitStatementVariables(t *testing.T) {
+	defer func(statements []string) { config.SessionInitStatements = statements }(config.SessionInitStatements)
+	config.SessionInitStatements = []string{"SET SESSION time_zone = '+00:00', @@transaction_read_only = 1"}
+
+	for _, query := range []string{"SET time_zone = 'SYSTEM'", "SET SESSION transaction_read_only = 0"} {
+		if err := checkSetStatement(query); err == nil {
+			t.Errorf("'%s' should be blocked!", query)
+		}
+	}
+	if err := checkSetStatement("SET wait_timeout = 60"); err != nil {
+		t.Errorf("Unrelated variables should be allowed: %s", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"testing"
+)
+
+func TestChooseSHA256(t *testing.T) {
+	if name, err := chooseSHA256("auto", false); err != nil || sha256Implementations[name] == nil {
+		t.Errorf("Bogus automatic choice: %q (%v)", name, err)
+	}
+	if name, err := chooseSHA256("auto", true); err != nil || name != "stdlib" {
+		t.Errorf("FIPS mode should always get the standard library, got %q (%v)", name, err)
+	}
+	if _, err := chooseSHA256("simd", true); err == nil {
+		t.Error("sha256-simd should be refused in FIPS mode")
+	}
+	if _, err := chooseSHA256("openssl", false); err == nil {
+		t.Error("Unknown SHA-256 implementations should be refused")
+	}
+}
+
+func TestSHA256Implementations(t *testing.T) {
+	defer setSHA256("stdlib")
+
+	sums := [][]byte{}
+	for name, newHash := range sha256Implementations {
+		mac := hmac.New(newHash, []byte("Jefe"))
+		mac.Write([]byte("what do ya want for nothing?"))
+		sums = append(sums, mac.Sum(nil))
+
+		setSHA256(name)
+		legacy, _ := NewHasher("sha256")
+		sums = append(sums, legacy.Sum([]byte("honk"), []byte("bonk")))
+	}
+	if !bytes.Equal(sums[0], sums[2]) || !bytes.Equal(sums[1], sums[3]) {
+		t.Errorf("SHA-256 implementations disagree: %x", sums)
+	}
+
+	// Reusing a pooled HMAC doesn't leave anything behind.
+	hmacHasher, _ := NewHasher("hmac-sha256")
+	first := hmacHasher.Sum([]byte("honk"), []byte("bonk"))
+	hmacHasher.Sum([]byte("something else entirely"), []byte("bonk"))
+	if !bytes.Equal(first, hmacHasher.Sum([]byte("honk"), []byte("bonk"))) {
+		t.Error("Pooled HMAC gave a different answer the second time")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// Rows only come off the server as fast as the client takes them, so a slow
+// reader already throttles the backend. What it can still do is keep a query
+// (and its locks, and a server thread) open forever. SlowClientStall bounds
+// how long a result set may spend waiting on the client, and
+// SlowClientPolicy says what to do about it.
+const (
+	slowClientThrottle = "throttle" // Keep waiting, but say so in the log
+	slowClientEvict    = "evict"    // Kill the query and close the session
+)
+
+// slowClientTracker adds up how long one result set has spent waiting for
+// the client to take its rows.
+type slowClientTracker struct {
+	waited time.Duration
+	warned bool
+}
+
+func checkSlowClientPolicy(policy string) bool {
+	return policy == slowClientThrottle || policy == slowClientEvict
+}
+
+// sendRow hands the client a row, and returns false if that made the client
+// too slow to put up with, in which case the session is over.
+func (server *ServerConnection) sendRow(packet mysqlproto.Packet, tracker *slowClientTracker) bool {
+	started := time.Now()
+	server.proxy.SendToClient(packet)
+	tracker.waited += time.Since(started)
+
+	if config.SlowClientStall <= 0 || tracker.waited <= time.Duration(config.SlowClientStall)*time.Second {
+		return true
+	}
+	if config.SlowClientPolicy != slowClientEvict {
+		if !tracker.warned {
+			server.proxy.Output().Log("Client has kept a result set waiting for %s; throttling the server", tracker.waited.Round(time.Second))
+			tracker.warned = true
+		}
+		return true
+	}
+
+	server.proxy.Output().Log("Evicting client that kept a result set waiting for %s", tracker.waited.Round(time.Second))
+	server.stream.Close()
+	err := NewProxyError(ErrTimeout, nil, "mysql-sanitizer closed the session because the client read its results too slowly")
+	server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), packet.SequenceID, err))
+	server.finished = true
+	return false
+}
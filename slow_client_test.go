@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestSendRow_SlowClient(t *testing.T) {
+	oldStall, oldPolicy := config.SlowClientStall, config.SlowClientPolicy
+	defer func() { config.SlowClientStall, config.SlowClientPolicy = oldStall, oldPolicy }()
+	config.SlowClientStall = 1
+
+	proxyEnd, backendEnd := net.Pipe()
+	defer backendEnd.Close()
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+	row := TextRowPacket(2, []string{"honk"})
+
+	config.SlowClientPolicy = slowClientThrottle
+	tracker := slowClientTracker{waited: 2 * time.Second}
+	if !server.sendRow(row, &tracker) || server.finished || !tracker.warned {
+		t.Error("Throttling shouldn't evict the client")
+	}
+
+	config.SlowClientPolicy = slowClientEvict
+	tracker = slowClientTracker{waited: 2 * time.Second}
+	if server.sendRow(row, &tracker) || !server.finished {
+		t.Error("The slow client should have been evicted")
+	}
+	<-proxy.ClientChannel
+	<-proxy.ClientChannel
+	if errPacket := <-proxy.ClientChannel; !packetIsERR(errPacket) || errPacket.SequenceID != row.SequenceID+1 {
+		t.Errorf("Bogus eviction packet: %v", errPacket)
+	}
+
+	server.finished = false
+	tracker = slowClientTracker{}
+	if !server.sendRow(row, &tracker) {
+		t.Error("A fast client shouldn't be evicted")
+	}
+}
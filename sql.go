@@ -0,0 +1,203 @@
+package main
+
+import (
+	"strings"
+)
+
+// We don't parse SQL properly (yet), but a few features need to pick apart
+// simple statements. These helpers understand just enough about quoting and
+// comments to not be fooled by the obvious tricks.
+
+// stripLeadingComments removes whitespace and any /* */, -- and # comments
+// from the start of the query. The server runs what's in executable comments
+// (/*!50000 ... */), so those get unwrapped rather than thrown away.
+func stripLeadingComments(query string) string {
+	for {
+		query = strings.TrimLeft(query, " \t\r\n")
+		switch {
+		case isExecutableComment(query):
+			end := strings.Index(query, "*/")
+			if end < 0 {
+				return ""
+			}
+			body := strings.TrimLeft(query[strings.Index(query, "!")+1:end], "0123456789")
+			query = body + " " + query[end+2:]
+		case strings.HasPrefix(query, "/*"):
+			end := strings.Index(query, "*/")
+			if end < 0 {
+				return ""
+			}
+			query = query[end+2:]
+		case strings.HasPrefix(query, "-- ") || strings.HasPrefix(query, "#"):
+			end := strings.Index(query, "\n")
+			if end < 0 {
+				return ""
+			}
+			query = query[end+1:]
+		default:
+			return query
+		}
+	}
+}
+
+// stripComments replaces every comment outside of quotes with a space, the
+// way the server's lexer sees them, and unwraps executable comments. Checks
+// that match on more than the first keyword need this, or SET /**/ GLOBAL
+// would get by them.
+func stripComments(query string) string {
+	var stripped strings.Builder
+	var quote byte
+	executable := false
+
+	for i := 0; i < len(query); i++ {
+		char := query[i]
+		switch {
+		case quote != 0:
+			stripped.WriteByte(char)
+			if char == '\\' && quote != '`' && i+1 < len(query) {
+				i++
+				stripped.WriteByte(query[i])
+			} else if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"' || char == '`':
+			quote = char
+			stripped.WriteByte(char)
+		case isExecutableComment(query[i:]):
+			i += strings.Index(query[i:], "!")
+			for i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9' {
+				i++
+			}
+			executable = true
+			stripped.WriteByte(' ')
+		case executable && strings.HasPrefix(query[i:], "*/"):
+			i++
+			executable = false
+			stripped.WriteByte(' ')
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			stripped.WriteByte(' ')
+		case strings.HasPrefix(query[i:], "-- ") || char == '#':
+			end := strings.Index(query[i:], "\n")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+			stripped.WriteByte(' ')
+		default:
+			stripped.WriteByte(char)
+		}
+	}
+	return stripped.String()
+}
+
+// splitTopLevel splits the string on sep, ignoring separators inside
+// quotes, backticks, or parentheses.
+func splitTopLevel(str string, sep byte) []string {
+	parts := []string{}
+	depth := 0
+	var quote byte
+	start := 0
+
+	for i := 0; i < len(str); i++ {
+		char := str[i]
+		switch {
+		case quote != 0:
+			if char == '\\' && quote != '`' {
+				i++
+			} else if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"' || char == '`':
+			quote = char
+		case char == '(':
+			depth++
+		case char == ')':
+			depth--
+		case char == sep && depth == 0:
+			parts = append(parts, str[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, str[start:])
+}
+
+// firstKeyword returns the first word of the query, uppercased.
+func firstKeyword(query string) string {
+	query = stripLeadingComments(query)
+	end := strings.IndexAny(query, " \t\r\n(;/`'\"")
+	if end < 0 {
+		end = len(query)
+	}
+	return strings.ToUpper(query[:end])
+}
+
+// unquoteIdentifier strips backticks or quotes from around a name.
+func unquoteIdentifier(name string) string {
+	name = strings.TrimSpace(name)
+	if len(name) >= 2 && (name[0] == '`' || name[0] == '\'' || name[0] == '"') && name[len(name)-1] == name[0] {
+		return name[1 : len(name)-1]
+	}
+	return name
+}
+
+// splitStatements splits a query into its statements the way the server
+// does with CLIENT_MULTI_STATEMENTS: at semicolons that aren't in quotes or
+// comments. Executable comments (/*! ... */) get run, so semicolons in
+// those count. Statements that are only whitespace and comments (like after
+// a trailing semicolon) are left out.
+func splitStatements(query string) []string {
+	statements := []string{}
+	add := func(statement string) {
+		if stripLeadingComments(statement) != "" {
+			statements = append(statements, statement)
+		}
+	}
+	var quote byte
+	start := 0
+
+	for i := 0; i < len(query); i++ {
+		char := query[i]
+		switch {
+		case quote != 0:
+			if char == '\\' && quote != '`' {
+				i++
+			} else if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"' || char == '`':
+			quote = char
+		case strings.HasPrefix(query[i:], "/*") && !isExecutableComment(query[i:]):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+		case strings.HasPrefix(query[i:], "-- ") || char == '#':
+			end := strings.Index(query[i:], "\n")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+		case char == ';':
+			add(query[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(query) {
+		add(query[start:])
+	}
+	return statements
+}
+
+func isExecutableComment(query string) bool {
+	return strings.HasPrefix(query, "/*!") || strings.HasPrefix(query, "/*M!")
+}
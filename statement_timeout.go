@@ -0,0 +1,96 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// The variables that control how long a statement can run. Clients can never
+// change these, no matter what BlockedSetVariables says, since the timeout is
+// one of the main things keeping people from hammering the database.
+var timeoutVariables = []string{"max_statement_time", "max_execution_time"}
+
+var executionTimeHintRegex = regexp.MustCompile(`(?i)MAX_EXECUTION_TIME\s*\(\s*\d*\s*\)`)
+var selectStatementTimeRegex = regexp.MustCompile(`(?i)^SELECT\s+MAX_STATEMENT_TIME\s*=\s*\d+\s*`)
+
+func isTimeoutVariable(name string) bool {
+	for _, variable := range timeoutVariables {
+		if name == variable {
+			return true
+		}
+	}
+	return false
+}
+
+// mentionsTimeout reports whether the query refers to the timeout at all, in
+// which case we re-assert it afterwards just in case it found a way around
+// our checks (a stored procedure, say).
+func mentionsTimeout(query string) bool {
+	lower := strings.ToLower(query)
+	for _, variable := range timeoutVariables {
+		if strings.Contains(lower, variable) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripTimeoutHints removes MAX_EXECUTION_TIME() optimizer hints and the
+// MySQL 5.7.4-5.7.7 "SELECT MAX_STATEMENT_TIME = N" syntax from the query,
+// leaving string literals alone.
+func stripTimeoutHints(query string) string {
+	stripped := stripLeadingComments(query)
+	if selectStatementTimeRegex.MatchString(stripped) {
+		prefix := query[:len(query)-len(stripped)]
+		query = prefix + "SELECT " + selectStatementTimeRegex.ReplaceAllString(stripped, "")
+	}
+
+	var result strings.Builder
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		char := query[i]
+		if quote != 0 {
+			result.WriteByte(char)
+			if char == '\\' && quote != '`' && i+1 < len(query) {
+				i++
+				result.WriteByte(query[i])
+			} else if char == quote {
+				quote = 0
+			}
+		} else if char == '\'' || char == '"' || char == '`' {
+			quote = char
+			result.WriteByte(char)
+		} else if strings.HasPrefix(query[i:], "/*+") {
+			end := strings.Index(query[i:], "*/")
+			if end < 0 {
+				result.WriteString(query[i:])
+				break
+			}
+			result.WriteString(executionTimeHintRegex.ReplaceAllString(query[i:i+end+2], ""))
+			i += end + 1
+		} else {
+			result.WriteByte(char)
+		}
+	}
+	return result.String()
+}
+
+// enforceStatementTimeout strips any per-statement timeout overrides from a
+// COM_QUERY or COM_STMT_PREPARE packet, and reports whether we should
+// re-assert the timeout once the query finishes. Prepared statements only
+// run when they're executed, so that's when they get re-asserted.
+func enforceStatementTimeout(packet mysqlproto.Packet) (mysqlproto.Packet, bool) {
+	if !carriesQuery(packet) {
+		return packet, false
+	}
+
+	query := string(packet.Payload[1:])
+	stripped := stripTimeoutHints(query)
+	if stripped != query {
+		output.Verbose("Stripped statement timeout hints from query")
+		packet = mysqlproto.Packet{packet.SequenceID, append([]byte{packetCommand(packet)}, stripped...)}
+	}
+	return packet, packetCommand(packet) == COM_QUERY && mentionsTimeout(stripped)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStripTimeoutHints(t *testing.T) {
+	tests := map[string]string{
+		"SELECT /*+ MAX_EXECUTION_TIME(0) */ * FROM users":                  "SELECT /*+  */ * FROM users",
+		"SELECT /*+ BKA(t1) max_execution_time( 100 ) */ * FROM t1":         "SELECT /*+ BKA(t1)  */ * FROM t1",
+		"SELECT MAX_STATEMENT_TIME = 0 * FROM users":                        "SELECT * FROM users",
+		"/* hi */ select max_statement_time=5 id FROM users":                "/* hi */ SELECT id FROM users",
+		"SELECT * FROM notes WHERE body = '/*+ MAX_EXECUTION_TIME(0) */'":   "SELECT * FROM notes WHERE body = '/*+ MAX_EXECUTION_TIME(0) */'",
+		"SELECT * FROM notes /* MAX_EXECUTION_TIME(0) isn't a hint here */": "SELECT * FROM notes /* MAX_EXECUTION_TIME(0) isn't a hint here */",
+	}
+	for query, expected := range tests {
+		if stripped := stripTimeoutHints(query); stripped != expected {
+			t.Errorf("Bogus result stripping '%s': '%s'", query, stripped)
+		}
+	}
+}
+
+func TestCheckSetStatement_TimeoutAlwaysBlocked(t *testing.T) {
+	defer func(blocked []string) { config.BlockedSetVariables = blocked }(config.BlockedSetVariables)
+	config.BlockedSetVariables = []string{}
+
+	queries := []string{
+		"SET max_statement_time = 0",
+		"SET @@max_execution_time = 0",
+		"SET STATEMENT max_statement_time = 0 FOR SELECT * FROM users",
+		"SET STATEMENT sql_mode = '', MAX_STATEMENT_TIME=0 FOR SELECT 1",
+	}
+	for _, query := range queries {
+		if err := checkSetStatement(query); err == nil {
+			t.Errorf("'%s' should be blocked!", query)
+		}
+	}
+	if err := checkSetStatement("SET STATEMENT sql_mode = '' FOR SELECT 1"); err != nil {
+		t.Errorf("SET STATEMENT without a timeout should be allowed: %s", err)
+	}
+}
+
+func TestMentionsTimeout(t *testing.T) {
+	if !mentionsTimeout("CALL reset_MAX_STATEMENT_TIME()") {
+		t.Error("Didn't notice the timeout variable")
+	}
+	if mentionsTimeout("SELECT * FROM users") {
+		t.Error("Noticed a timeout variable that isn't there")
+	}
+}
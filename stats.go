@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats collects proxy-wide counters for SHOW SANITIZER STATUS.
+type Stats struct {
+	started         time.Time
+	activeSessions  int64
+	totalSessions   int64
+	queries         int64
+	rows            int64
+	valuesSanitized int64
+	affectedRows    int64
+	warnings        int64
+
+	backendMutex     sync.Mutex
+	backendLastError string
+	backendCheckedAt time.Time
+
+	labelMutex sync.Mutex
+	labels     map[string]*LabelCounters
+}
+
+var stats = NewStats()
+
+// NewStats returns a Stats object with the clock started.
+func NewStats() *Stats {
+	return &Stats{started: time.Now(), labels: map[string]*LabelCounters{}}
+}
+
+func (stats *Stats) SessionOpened() {
+	atomic.AddInt64(&stats.activeSessions, 1)
+	atomic.AddInt64(&stats.totalSessions, 1)
+}
+
+func (stats *Stats) SessionClosed() {
+	atomic.AddInt64(&stats.activeSessions, -1)
+}
+
+// ReserveSession counts a session as active before it's opened, unless there
+// are already limit of them. Checking and counting in one step means clients
+// arriving together can't all slip in under MaxConnections. The session counts
+// itself once it's open, so the reservation has to be released either way.
+func (stats *Stats) ReserveSession(limit int) bool {
+	for {
+		active := atomic.LoadInt64(&stats.activeSessions)
+		if active >= int64(limit) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&stats.activeSessions, active, active+1) {
+			return true
+		}
+	}
+}
+
+func (stats *Stats) ReleaseSession() {
+	atomic.AddInt64(&stats.activeSessions, -1)
+}
+
+func (stats *Stats) QueryReceived() {
+	atomic.AddInt64(&stats.queries, 1)
+}
+
+func (stats *Stats) RowForwarded() {
+	atomic.AddInt64(&stats.rows, 1)
+}
+
+func (stats *Stats) ValueSanitized() {
+	atomic.AddInt64(&stats.valuesSanitized, 1)
+}
+
+// OKReceived counts what a write did, going by the server's OK packet.
+func (stats *Stats) OKReceived(ok OKResult) {
+	atomic.AddInt64(&stats.affectedRows, int64(ok.AffectedRows))
+	atomic.AddInt64(&stats.warnings, int64(ok.Warnings))
+}
+
+// BackendResult records whether our latest attempt to reach MySQL worked.
+func (stats *Stats) BackendResult(err error) {
+	stats.backendMutex.Lock()
+	defer stats.backendMutex.Unlock()
+
+	stats.backendCheckedAt = time.Now()
+	if err != nil {
+		stats.backendLastError = err.Error()
+	} else {
+		stats.backendLastError = ""
+	}
+}
+
+// BackendHealth returns a human-readable summary of the last backend connection attempt.
+func (stats *Stats) BackendHealth() string {
+	stats.backendMutex.Lock()
+	defer stats.backendMutex.Unlock()
+
+	if stats.backendCheckedAt.IsZero() {
+		return "unknown"
+	} else if stats.backendLastError != "" {
+		return "failing: " + stats.backendLastError
+	}
+	return "ok"
+}
+
+func (stats *Stats) Uptime() time.Duration {
+	return time.Since(stats.started)
+}
+
+func atomicLoad(counter *int64) int64 {
+	return atomic.LoadInt64(counter)
+}
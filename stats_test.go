@@ -0,0 +1,33 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReserveSession(t *testing.T) {
+	stats := NewStats()
+	stats.SessionOpened()
+
+	var reserved int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if stats.ReserveSession(10) {
+				atomic.AddInt64(&reserved, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 9 || stats.activeSessions != 10 {
+		t.Errorf("Expected 9 reservations on top of the open session, got %d (%d active)", reserved, stats.activeSessions)
+	}
+
+	stats.ReleaseSession()
+	if !stats.ReserveSession(10) || stats.ReserveSession(10) {
+		t.Error("A released reservation should have been up for grabs again, once")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+)
+
+// A CALL's result sets come back one after another, followed by an OK for
+// the CALL itself, and get sanitized like any other. Its OUT parameters are
+// sneakier: with COM_QUERY they land in user variables, and reading those
+// back gives columns with no table, which we'd normally let through as
+// harmless (like "@@" variables). So once a session has passed a user
+// variable to a CALL, results with no table in any query that mentions a
+// user variable get sanitized, since we can't tell which of them came out
+// of the procedure. That catches copying one into another with SET, too.
+// A prepared CALL is simpler: its OUT parameters come straight back as a
+// result set of their own, so anything without a table in its results gets
+// sanitized.
+
+var callRegex = regexp.MustCompile(`(?is)^CALL\s`)
+
+// userVariableRegex matches a user variable, like @out or @`out`, but not a
+// system variable or the middle of an email address.
+var userVariableRegex = regexp.MustCompile("(?:^|[^@\\w.$])@(?:\\w|[`'\"])")
+
+// noteCall remembers whether any of the query's statements is a CALL that
+// passes a user variable.
+func (proxy *ProxyConnection) noteCall(query string) {
+	for _, statement := range splitStatements(query) {
+		statement = stripLeadingComments(statement)
+		if callRegex.MatchString(statement) && userVariableRegex.MatchString(statement) {
+			proxy.outVariables = true
+		}
+	}
+}
+
+// callsProcedure returns whether any of the query's statements is a CALL.
+func callsProcedure(query string) bool {
+	for _, statement := range splitStatements(query) {
+		if callRegex.MatchString(stripLeadingComments(statement)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readsOutVariables returns whether the query might read back a CALL's OUT
+// parameters, so its columns without a table can't be trusted.
+func (proxy *ProxyConnection) readsOutVariables(query string) bool {
+	return proxy.outVariables && userVariableRegex.MatchString(query)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestNoteCall(t *testing.T) {
+	proxy := &ProxyConnection{}
+	proxy.noteCall("CALL lookup(42, 'honk@example.com')")
+	if proxy.outVariables || proxy.readsOutVariables("SELECT @out") {
+		t.Error("CALL without user variables shouldn't taint anything")
+	}
+	proxy.noteCall("SELECT 1; /* hi */ call lookup(42, @out)")
+	if !proxy.outVariables {
+		t.Fatal("CALL with a user variable should taint user variables")
+	}
+
+	queries := map[string]bool{
+		"SELECT @out":                       true,
+		"SELECT @`out` AS contact":          true,
+		"SELECT CONCAT('x', @out)":          true,
+		"SELECT @@version":                  false,
+		"SELECT 'honk@example.com'":         false,
+		"SELECT name FROM users WHERE id=1": false,
+	}
+	for query, expected := range queries {
+		if proxy.readsOutVariables(query) != expected {
+			t.Errorf("Bogus readsOutVariables for '%s': expected %v", query, expected)
+		}
+	}
+}
+
+// variableColumnPacket is a column definition for something with no table,
+// like a user variable.
+func variableColumnPacket(sequenceId byte, name string) mysqlproto.Packet {
+	chunks := VariableString("def")
+	for i := 0; i < 3; i++ {
+		chunks = append(chunks, VariableString("")...) // schema, table, original table
+	}
+	chunks = append(chunks, VariableString("%s", name)...)
+	chunks = append(chunks, VariableString("")...) // original name
+	chunks = append(chunks, 0x0C, 0x21, 0x00, 0xFF, 0x00, 0x00, 0x00, TYPE_VAR_STRING, 0x00, 0x00, 0x00, 0x00, 0x00)
+	return mysqlproto.Packet{sequenceId + 1, chunks}
+}
+
+func TestHandleQueryResponse_outVariables(t *testing.T) {
+	// MaskExpressions sanitizes every user variable, since they could
+	// have been set from anything. This is what's left without it.
+	defer func() { config.MaskExpressions = true }()
+	config.MaskExpressions = false
+
+	for _, called := range []bool{false, true} {
+		proxyEnd, backendEnd := net.Pipe()
+		proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+		proxy.Capabilities = mysqlproto.CLIENT_PROTOCOL_41
+		proxy.outVariables = called
+		proxy.query = "SELECT @out AS contact"
+		server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+		go func() {
+			backend := mysqlproto.NewStream(backendEnd)
+			packets := []mysqlproto.Packet{{1, LengthEncodedInt(1)}, variableColumnPacket(1, "contact"), EOFPacket(2),
+				TextRowPacket(3, []string{"honk@example.com"}), EOFPacket(4)}
+			for _, packet := range packets {
+				WritePacket(backend, packet)
+			}
+		}()
+		server.handleQueryResponse()
+		proxyEnd.Close()
+
+		if len(proxy.ClientChannel) != 5 {
+			t.Fatalf("Expected 5 packets, got %d", len(proxy.ClientChannel))
+		}
+		for i := 0; i < 3; i++ {
+			<-proxy.ClientChannel
+		}
+		value, _ := NewPacketParser(<-proxy.ClientChannel).ReadStringOrNull()
+		if sanitized := value != "honk@example.com"; sanitized != called {
+			t.Errorf("Bogus value for a user variable (after a CALL with one: %v): '%s'", called, value)
+		}
+	}
+}
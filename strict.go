@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+)
+
+// In strict mode (StrictDatabases), every column in those databases has to
+// be classified one way or the other, by a whitelist entry, a column rule, or
+// a catalog tag. Result sets with any other columns from there are refused
+// outright, rather than falling back to the defaults (which pass non-string
+// columns through). We can't tell which columns a query touches until the
+// server describes the result, so the query does run; the client just never
+// sees any of it.
+
+// strictViolations returns the names of the columns that strict mode
+// doesn't allow, if any. Expressions are checked by what they're made of,
+// and ones we couldn't trace are refused outright, since they could be
+// made of anything.
+func strictViolations(columns []Column) []string {
+	if len(config.StrictDatabases) == 0 {
+		return nil
+	}
+	unclassified := []string{}
+	for _, col := range columns {
+		if col.Database != "" {
+			if isStrictDatabase(col.Database) && !strictlyClassified(col) {
+				unclassified = append(unclassified, col.Database+"."+col.Table+"."+col.Name)
+			}
+			continue
+		}
+		if col.Table == "" && col.inputs == nil && (col.Name == "" || col.tainted) {
+			unclassified = append(unclassified, col.Alias+" (expression)")
+			continue
+		}
+		for _, input := range col.inputs {
+			input.ruleSet = col.ruleSet
+			if isStrictDatabase(input.Database) && !strictlyClassified(input) {
+				unclassified = append(unclassified, input.Database+"."+input.Table+"."+input.Name)
+			}
+		}
+	}
+	return unclassified
+}
+
+// strictlyClassified returns whether something other than the defaults
+// says what to do with the column.
+func strictlyClassified(col Column) bool {
+	return col.Rules().Action(col) != ruleNone || catalog.Classify(col) != classUnknown ||
+		whitelist.IsColumnPresent(col.Database, col.Table, col.Name)
+}
+
+func isStrictDatabase(database string) bool {
+	for _, strict := range config.StrictDatabases {
+		if strict == "*" || strings.EqualFold(strict, database) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuseResult throws away the rest of a result set the client isn't
+// allowed to see, and sends it an error listing the unclassified columns
+// instead. rowsFollow is false when there's nothing left to throw away,
+// like when the rows went into a cursor.
+func (server *ServerConnection) refuseResult(sequenceId byte, unclassified []string, rowsFollow bool) {
+	// This starts after the column definitions and their EOF, if any.
+	for rowsFollow {
+		packet, err := ReadPacket(server.stream)
+		if err != nil {
+			server.proxy.Output().Log("Couldn't receive packet from MySQL server: %s", err)
+			server.finished = true
+			return
+		}
+		// Not OKs, which binary rows can look like.
+		if packetIsERR(packet) || packetEndsRows(packet) {
+			if err := server.discardResults(packet); err != nil {
+				server.proxy.Output().Log("Couldn't receive packet from MySQL server: %s", err)
+				server.finished = true
+				return
+			}
+			break
+		}
+	}
+
+	names := strings.Join(unclassified, ", ")
+	server.proxy.Output().Audit("Refused %s a result set with unclassified columns: %s", server.proxy.Username(), names)
+	err := NewProxyError(ErrPolicyViolation, nil, "mysql-sanitizer is in strict mode, and these columns have no classification: %s", names)
+	server.proxy.SendToClient(clientErrorPacket(server.proxy.Output(), sequenceId, err))
+}
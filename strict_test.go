@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestStrictViolations(t *testing.T) {
+	oldStrict := config.StrictDatabases
+	defer func() { config.StrictDatabases = oldStrict }()
+	columns := []Column{
+		{true, "some_db", "table2", "honk", "honk", 255, 0, 0, nil, "", false, nil}, // whitelisted
+		{false, "some_db", "table2", "secret", "secret", 11, 0, 0, nil, "", false, nil},
+		{true, "other_db", "bonk", "notes", "notes", 255, 0, 0, nil, "", false, nil},
+		{true, "", "", "NOW()", "NOW()", 255, 0, 0, nil, "", false, nil},
+	}
+
+	config.StrictDatabases = []string{}
+	if unclassified := strictViolations(columns); len(unclassified) != 0 {
+		t.Errorf("Strict mode is off, but these were refused: %v", unclassified)
+	}
+	config.StrictDatabases = []string{"SOME_DB"}
+	if unclassified := strictViolations(columns); len(unclassified) != 1 || unclassified[0] != "some_db.table2.secret" {
+		t.Errorf("Bogus unclassified columns: %v", unclassified)
+	}
+	config.StrictDatabases = []string{"*"}
+	if unclassified := strictViolations(columns); len(unclassified) != 2 || unclassified[1] != "other_db.bonk.notes" {
+		t.Errorf("Bogus unclassified columns: %v", unclassified)
+	}
+
+	// SELECT salary + 0, honk || '' FROM hr.employees, and something we
+	// couldn't trace.
+	config.StrictDatabases = []string{"hr"}
+	salary := Column{Database: "hr", Table: "employees", Name: "salary"}
+	honk := Column{Database: "some_db", Table: "table2", Name: "honk"}
+	expressions := []Column{
+		{false, "", "", "salary + 0", "", 11, TYPE_LONG, 0, nil, "", false, []Column{salary}},
+		{true, "", "", "x", "", 255, 0, 0, nil, "", false, []Column{honk}},
+		{true, "", "", "VERSION()", "", 255, 0, 0, nil, "", false, []Column{}},
+		{true, "", "", "CONCAT(secret, '')", "", 255, 0, 0, nil, "", false, nil},
+	}
+	unclassified := strictViolations(expressions)
+	if strings.Join(unclassified, ", ") != "hr.employees.salary, CONCAT(secret, '') (expression)" {
+		t.Errorf("Bogus unclassified expressions: %v", unclassified)
+	}
+}
+
+func TestHandleQueryResponse_Strict(t *testing.T) {
+	oldStrict := config.StrictDatabases
+	defer func() { config.StrictDatabases = oldStrict }()
+	config.StrictDatabases = []string{"*"}
+
+	proxyEnd, backendEnd := net.Pipe()
+	defer proxyEnd.Close()
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+	go func() {
+		backend := mysqlproto.NewStream(backendEnd)
+		packets := []mysqlproto.Packet{{1, LengthEncodedInt(2)}, selftestColumnPacket(1, "id", TYPE_LONG),
+			selftestColumnPacket(2, "secret", TYPE_LONG), EOFPacket(3), TextRowPacket(4, []string{"1", "2"}), EOFPacket(5)}
+		for _, packet := range packets {
+			WritePacket(backend, packet)
+		}
+	}()
+
+	server.handleQueryResponse()
+	close(proxy.ClientChannel)
+
+	packets := []mysqlproto.Packet{}
+	for packet := range proxy.ClientChannel {
+		packets = append(packets, packet)
+	}
+	if len(packets) != 1 || !packetIsERR(packets[0]) || packets[0].SequenceID != 1 {
+		t.Fatalf("Expected a single error packet, got %v", packets)
+	}
+	if message := errorPacketMessage(packets[0]); !strings.Contains(message, "users.id") || !strings.Contains(message, "users.secret") {
+		t.Errorf("Bogus error message: %s", message)
+	}
+	if server.finished {
+		t.Error("The session should carry on after a refused result set")
+	}
+}
+
+func TestHandleQueryResponse_StrictMultipleResults(t *testing.T) {
+	oldStrict := config.StrictDatabases
+	defer func() { config.StrictDatabases = oldStrict }()
+	config.StrictDatabases = []string{"*"}
+
+	proxyEnd, backendEnd := net.Pipe()
+	defer proxyEnd.Close()
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	proxy.Capabilities = mysqlproto.CLIENT_PROTOCOL_41
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+	// The refused result says there's more, so the rest has to be read
+	// and thrown away too.
+	written := make(chan struct{})
+	go func() {
+		backend := mysqlproto.NewStream(backendEnd)
+		packets := []mysqlproto.Packet{{1, LengthEncodedInt(1)}, selftestColumnPacket(1, "secret", TYPE_LONG), EOFPacket(2),
+			TextRowPacket(3, []string{"1"}), {5, []byte{0xFE, 0x00, 0x00, 0x0A, 0x00}},
+			{6, LengthEncodedInt(1)}, selftestColumnPacket(6, "secret", TYPE_LONG), EOFPacket(7), {9, []byte{0xFE, 0x00, 0x00, 0x0A, 0x00}},
+			OKPacket(9)}
+		for _, packet := range packets {
+			WritePacket(backend, packet)
+		}
+		close(written)
+	}()
+
+	server.handleQueryResponse()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("The rest of the results weren't read")
+	}
+	if len(proxy.ClientChannel) != 1 || !packetIsERR(<-proxy.ClientChannel) {
+		t.Error("Expected a single error packet")
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"time"
+)
+
+// --test-mode is for integration suites downstream that snapshot sanitized
+// output into golden files. Everything that would otherwise change from run
+// to run is pinned: the salt is fixed (and HashSalts ignored), so hashes,
+// fake names, pseudonyms and watermarks come out the same every time, on
+// every version of the proxy; and the clock that timestamps logs,
+// transcripts and sessions is stopped at testModeTime. Anybody can recompute
+// hashes made with a published salt, so this is only for test data.
+
+// testModeSalt must never change, or everyone's golden files break.
+const testModeSalt = "mysql-sanitizer test mode"
+
+var testModeTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func useTestMode(config *Config) {
+	config.HashSalt = testModeSalt
+	config.HashSalts = nil
+	config.HashSaltBytes = []byte(testModeSalt)
+	clock = func() time.Time { return testModeTime }
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUseTestMode(t *testing.T) {
+	defer func() { clock = time.Now }()
+
+	testConfig := defaultConfig
+	testConfig.HashSalts = []HashSaltConfig{{Version: "v2", Salt: "honk"}}
+	useTestMode(&testConfig)
+	if string(testConfig.HashSaltBytes) != testModeSalt || testConfig.HashSalts != nil {
+		t.Errorf("Bogus salt in test mode: %q", testConfig.HashSaltBytes)
+	}
+	if !clock().Equal(testModeTime) {
+		t.Errorf("Bogus clock in test mode: %s", clock())
+	}
+
+	// Golden files depend on this never changing.
+	if name := string(fakeValue("name", []byte("Alice"), testConfig.HashSaltBytes)); name != "Dmitri Moreau" {
+		t.Errorf("Bogus fake name in test mode: %s", name)
+	}
+}
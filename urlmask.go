@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// How many hex characters of hash replace each masked URL component.
+const urlComponentHashLen = 8
+
+// maskURL keeps a URL's scheme, host, and port (so referrer and domain
+// analytics still work), but replaces each path segment, query parameter
+// value (or whole parameter, if it has no value), fragment, and any
+// credentials with a short hash. Parameters in allowedParams keep their
+// values. It returns false if the value doesn't look like an absolute URL.
+func maskURL(value []byte, salt []byte, allowedParams map[string]bool) ([]byte, bool) {
+	parsed, err := url.Parse(string(value))
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return nil, false
+	}
+
+	if parsed.User != nil {
+		parsed.User = url.User(hashURLComponent(parsed.User.String(), salt))
+	}
+
+	segments := strings.Split(parsed.EscapedPath(), "/")
+	for i, segment := range segments {
+		if segment != "" {
+			segments[i] = hashURLComponent(segment, salt)
+		}
+	}
+	parsed.RawPath = ""
+	parsed.Path = strings.Join(segments, "/")
+
+	// Rebuild the query string by hand so parameter order stays put.
+	if parsed.RawQuery != "" {
+		params := strings.Split(parsed.RawQuery, "&")
+		for i, param := range params {
+			parts := strings.SplitN(param, "=", 2)
+			name, _ := url.QueryUnescape(parts[0])
+			switch {
+			case allowedParams[name] || param == "":
+			case len(parts) == 2:
+				params[i] = parts[0] + "=" + hashURLComponent(parts[1], salt)
+			default:
+				// Without an =, the name is the value (e.g. ?alice@example.com).
+				params[i] = hashURLComponent(param, salt)
+			}
+		}
+		parsed.RawQuery = strings.Join(params, "&")
+	}
+
+	if parsed.Fragment != "" {
+		parsed.Fragment = hashURLComponent(parsed.Fragment, salt)
+	}
+
+	return []byte(parsed.String()), true
+}
+
+func hashURLComponent(component string, salt []byte) string {
+	return hex.EncodeToString(hasher.Sum([]byte(component), salt))[:urlComponentHashLen]
+}
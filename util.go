@@ -2,21 +2,107 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/pubnative/mysqlproto-go"
 )
 
-func WritePacket(stream *mysqlproto.Stream, packet mysqlproto.Packet) {
-	contents := make([]byte, len(packet.Payload)+4)
-	contents[0] = byte(len(packet.Payload) & 0xFF)
-	contents[1] = byte((len(packet.Payload) >> 8) & 0xFF)
-	contents[2] = byte((len(packet.Payload) >> 16) & 0xFF)
-	contents[3] = packet.SequenceID
-	copied := copy(contents[4:], packet.Payload)
-	if copied != len(packet.Payload) {
+// maxPacketPayload is the most a single packet can carry. Anything bigger
+// is sent in pieces this size, and a shorter piece (even an empty one) ends
+// it.
+const maxPacketPayload = 0xffffff
+
+// packetPieces returns how many packets it takes to send a payload.
+func packetPieces(length int) int {
+	return length/maxPacketPayload + 1
+}
+
+// ReadPacket reads the next packet, putting it back together if it came in
+// pieces. Its sequence ID is the last piece's, so whatever comes next
+// follows on from it as usual.
+func ReadPacket(stream *mysqlproto.Stream) (mysqlproto.Packet, error) {
+	packet, err := stream.NextPacket()
+	if err != nil || len(packet.Payload) < maxPacketPayload {
+		return packet, err
+	}
+	payload := packet.Payload
+	for len(packet.Payload) == maxPacketPayload {
+		if packet, err = stream.NextPacket(); err != nil {
+			return packet, err
+		}
+		payload = append(payload, packet.Payload...)
+	}
+	return mysqlproto.Packet{packet.SequenceID, payload}, nil
+}
+
+// WritePacket writes the packet, in pieces if it's too big for one, and
+// returns an error if it couldn't all be written. Like with ReadPacket, the
+// sequence ID is the last piece's.
+func WritePacket(stream *mysqlproto.Stream, packet mysqlproto.Packet) error {
+	pieces := packetPieces(len(packet.Payload))
+	first := packet.SequenceID - byte(pieces-1)
+	for i := 0; i < pieces; i++ {
+		start := i * maxPacketPayload
+		end := start + maxPacketPayload
+		if end > len(packet.Payload) {
+			end = len(packet.Payload)
+		}
+		if err := writePiece(stream, first+byte(i), packet.Payload[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePiece writes one packet's worth, retrying short writes.
+func writePiece(stream *mysqlproto.Stream, sequenceId byte, payload []byte) error {
+	contents := make([]byte, len(payload)+4)
+	contents[0] = byte(len(payload) & 0xFF)
+	contents[1] = byte((len(payload) >> 8) & 0xFF)
+	contents[2] = byte((len(payload) >> 16) & 0xFF)
+	contents[3] = sequenceId
+	copied := copy(contents[4:], payload)
+	if copied != len(payload) {
 		panic("wtf")
 	}
-	stream.Write(contents)
+
+	for written := 0; written < len(contents); {
+		n, err := stream.Write(contents[written:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		written += n
+	}
+	return nil
+}
+
+// resetTimer restarts a timer that may or may not have fired. Only the
+// goroutine that reads the timer's channel may call it. A nil timer is left
+// alone.
+func resetTimer(timer *time.Timer, duration time.Duration) {
+	if timer == nil {
+		return
+	}
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(duration)
+}
+
+// writeDeadline returns when a write starting now has to be finished by, or
+// the zero time (no deadline) if WriteTimeout is 0.
+func writeDeadline() time.Time {
+	if config.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(config.WriteTimeout) * time.Second)
 }
 
 func LengthEncodedInt(num uint) []byte {
@@ -65,3 +151,120 @@ func ErrorPacket(sequenceId byte, code int, sqlState string, format string, args
 
 	return mysqlproto.Packet{sequenceId + 1, chunks}
 }
+
+// errorPacketMessage returns the human-readable part of an ERR packet.
+func errorPacketMessage(packet mysqlproto.Packet) string {
+	parser := NewPacketParser(packet)
+	parser.ReadFixedInt1() // header
+	code := parser.ReadFixedInt2()
+	if uint64(len(packet.Payload)) > parser.offset && packet.Payload[parser.offset] == 0x23 {
+		parser.ReadFixedString(6) // SQL state marker and SQL state
+	}
+	return fmt.Sprintf("%d: %s", code, parser.ReadFixedString(uint64(len(packet.Payload))-parser.offset))
+}
+
+// OKPacket returns an OK packet following the packet with the given sequence ID.
+func OKPacket(sequenceId byte) mysqlproto.Packet {
+	// No affected rows, no insert ID, SERVER_STATUS_AUTOCOMMIT, and no warnings.
+	return mysqlproto.Packet{sequenceId + 1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}}
+}
+
+// EOFPacket returns an EOF packet following the packet with the given sequence ID.
+func EOFPacket(sequenceId byte) mysqlproto.Packet {
+	// No warnings, and SERVER_STATUS_AUTOCOMMIT.
+	return mysqlproto.Packet{sequenceId + 1, []byte{0xFE, 0x00, 0x00, 0x02, 0x00}}
+}
+
+// ColumnDefinitionPacket returns a column definition for a VARCHAR column
+// that isn't backed by any real table.
+func ColumnDefinitionPacket(sequenceId byte, name string) mysqlproto.Packet {
+	chunks := VariableString("def")
+	chunks = append(chunks, VariableString("")...)         // schema
+	chunks = append(chunks, VariableString("")...)         // table
+	chunks = append(chunks, VariableString("")...)         // original table
+	chunks = append(chunks, VariableString("%s", name)...) // name
+	chunks = append(chunks, VariableString("%s", name)...) // original name
+	chunks = append(chunks, 0x0C)                          // length of the fixed fields
+	chunks = append(chunks, 0x21, 0x00)                    // character set (utf8_general_ci)
+	chunks = append(chunks, 0x00, 0x01, 0x00, 0x00)        // column length
+	chunks = append(chunks, TYPE_VAR_STRING)
+	chunks = append(chunks, 0x00, 0x00) // flags
+	chunks = append(chunks, 0x00)       // decimals
+	chunks = append(chunks, 0x00, 0x00) // filler
+
+	return mysqlproto.Packet{sequenceId + 1, chunks}
+}
+
+// TextRowPacket returns a text protocol row containing the given values.
+func TextRowPacket(sequenceId byte, values []string) mysqlproto.Packet {
+	chunks := []byte{}
+	for _, value := range values {
+		chunks = append(chunks, VariableString("%s", value)...)
+	}
+	return mysqlproto.Packet{sequenceId + 1, chunks}
+}
+
+// ResultSetPackets returns a complete text protocol result set of string
+// columns, for answering queries ourselves. The first packet follows the
+// one with the given sequence ID.
+func ResultSetPackets(sequenceId byte, columns []string, rows [][]string) []mysqlproto.Packet {
+	packets := []mysqlproto.Packet{{sequenceId + 1, LengthEncodedInt(uint(len(columns)))}}
+	for _, column := range columns {
+		packets = append(packets, ColumnDefinitionPacket(packets[len(packets)-1].SequenceID, column))
+	}
+	packets = append(packets, EOFPacket(packets[len(packets)-1].SequenceID))
+	for _, row := range rows {
+		packets = append(packets, TextRowPacket(packets[len(packets)-1].SequenceID, row))
+	}
+	packets = append(packets, EOFPacket(packets[len(packets)-1].SequenceID))
+	return packets
+}
+
+// DeprecateEOF reshapes a result set from ResultSetPackets for a client that
+// negotiated CLIENT_DEPRECATE_EOF: no EOF after the column definitions, and
+// an OK with an EOF header at the end.
+func DeprecateEOF(packets []mysqlproto.Packet) []mysqlproto.Packet {
+	columnCount := int(NewPacketParser(packets[0]).ReadEncodedInt())
+	reshaped := append([]mysqlproto.Packet{}, packets[:columnCount+1]...)
+	for _, row := range packets[columnCount+2 : len(packets)-1] {
+		reshaped = append(reshaped, mysqlproto.Packet{row.SequenceID - 1, row.Payload})
+	}
+	end := OKPacket(reshaped[len(reshaped)-1].SequenceID)
+	end.Payload[0] = 0xFE
+	return append(reshaped, end)
+}
+
+// resultSet returns a result set from ResultSetPackets the way the session's
+// client expects it.
+func (proxy *ProxyConnection) resultSet(packets []mysqlproto.Packet) []mysqlproto.Packet {
+	if proxy.deprecateEOF() {
+		return DeprecateEOF(packets)
+	}
+	return packets
+}
+
+// minimalCapabilities are the capability flags we advertise when we don't
+// care about anything beyond logging in.
+const minimalCapabilities = mysqlproto.CLIENT_LONG_PASSWORD | mysqlproto.CLIENT_PROTOCOL_41 |
+	mysqlproto.CLIENT_SECURE_CONNECTION | mysqlproto.CLIENT_PLUGIN_AUTH
+
+// HandshakePacket returns an initial handshake packet, for when we have to
+// greet a client ourselves instead of passing along the server's greeting.
+func HandshakePacket(authPluginData []byte, flags uint32) mysqlproto.Packet {
+	chunks := []byte{0x0A}                                          // protocol version
+	chunks = append(chunks, []byte("5.7.0-mysql-sanitizer\x00")...) // server version
+	chunks = append(chunks, 0x00, 0x00, 0x00, 0x00)                 // connection id
+	chunks = append(chunks, authPluginData[:8]...)
+	chunks = append(chunks, 0x00) // filler
+	chunks = append(chunks, byte(flags&0xFF), byte((flags>>8)&0xFF))
+	chunks = append(chunks, 0x21)       // character set (utf8_general_ci)
+	chunks = append(chunks, 0x02, 0x00) // status flags (SERVER_STATUS_AUTOCOMMIT)
+	chunks = append(chunks, byte((flags>>16)&0xFF), byte((flags>>24)&0xFF))
+	chunks = append(chunks, byte(len(authPluginData)+1))
+	chunks = append(chunks, make([]byte, 10)...) // reserved
+	chunks = append(chunks, authPluginData[8:]...)
+	chunks = append(chunks, 0x00)
+	chunks = append(chunks, []byte("mysql_native_password\x00")...)
+
+	return mysqlproto.Packet{0, chunks}
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
 )
 
 func TestLengthEncodedInt_1_byte(t *testing.T) {
@@ -67,3 +74,158 @@ func TestErrorPacket(t *testing.T) {
 		t.Errorf("Incorrect SQL state marker: '%s'", string(packet.Payload[4:9]))
 	}
 }
+
+func TestColumnDefinitionPacket(t *testing.T) {
+	packet := ColumnDefinitionPacket(4, "Value")
+	if packet.SequenceID != 5 {
+		t.Errorf("Sequence ID isn't one more than the original: %d.", packet.SequenceID)
+	}
+	column, err := ReadColumn(NewPacketParser(packet))
+	if err != nil {
+		t.Fatalf("Couldn't parse our own column definition: %s", err)
+	}
+	if !column.IsString || column.Name != "value" || column.Alias != "Value" || column.Database != "" {
+		t.Errorf("Unexpected column from our own column definition: %+v", column)
+	}
+}
+
+func TestResultSetPackets(t *testing.T) {
+	packets := ResultSetPackets(0, []string{"a", "b"}, [][]string{{"1", "2"}, {"3", "four"}})
+	if len(packets) != 7 {
+		t.Fatalf("Unexpected packet count: %d", len(packets))
+	}
+	for i, packet := range packets {
+		if packet.SequenceID != byte(i+1) {
+			t.Errorf("Packet %d has the wrong sequence ID: %d", i, packet.SequenceID)
+		}
+	}
+	if NewPacketParser(packets[0]).ReadEncodedInt() != 2 {
+		t.Errorf("Bogus column count packet: %v", packets[0].Payload)
+	}
+	if !packetIsEOF(packets[3]) || !packetIsEOF(packets[6]) {
+		t.Error("Result set is missing its EOF packets!")
+	}
+
+	parser := NewPacketParser(packets[5])
+	if parser.ReadVariableString() != "3" || parser.ReadVariableString() != "four" {
+		t.Errorf("Bogus row packet: %v", packets[5].Payload)
+	}
+}
+
+func TestDeprecateEOF(t *testing.T) {
+	packets := DeprecateEOF(ResultSetPackets(0, []string{"a", "b"}, [][]string{{"1", "2"}, {"3", "four"}}))
+	if len(packets) != 6 {
+		t.Fatalf("Unexpected packet count: %d", len(packets))
+	}
+	for i, packet := range packets {
+		if packet.SequenceID != byte(i+1) {
+			t.Errorf("Packet %d has the wrong sequence ID: %d", i, packet.SequenceID)
+		}
+	}
+	if packetIsEOF(packets[3]) {
+		t.Error("Bogus result set: still has an EOF after the column definitions")
+	}
+	proxy := &ProxyConnection{Capabilities: mysqlproto.CLIENT_PROTOCOL_41 | mysqlproto.CLIENT_DEPRECATE_EOF}
+	if ok, err := proxy.parseRowsEnd(packets[5]); err != nil || ok.StatusFlags != SERVER_STATUS_AUTOCOMMIT {
+		t.Errorf("Bogus end of result set: %v (%v)", packets[5].Payload, err)
+	}
+}
+
+func TestTextRowPacket_Percent(t *testing.T) {
+	packet := TextRowPacket(0, []string{"100%"})
+	if string(packet.Payload) != "\x04100%" {
+		t.Errorf("Bogus row packet: %v", packet.Payload)
+	}
+}
+
+func TestErrorPacketMessage(t *testing.T) {
+	packet := ErrorPacket(0, 1064, "42000", "You have an error in your SQL syntax")
+	if message := errorPacketMessage(packet); message != "1064: You have an error in your SQL syntax" {
+		t.Errorf("Bogus error message: '%s'", message)
+	}
+}
+
+func TestHandshakePacket(t *testing.T) {
+	authPluginData := []byte("0123456789abcdefghij")
+	client := ClientConnection{proxy: &ProxyConnection{}}
+
+	data := client.getAuthPluginData(HandshakePacket(authPluginData, minimalCapabilities))
+	if string(data) != string(authPluginData) {
+		t.Errorf("Bogus auth plugin data: '%s'", data)
+	}
+	if client.proxy.Capabilities&mysqlproto.CLIENT_PLUGIN_AUTH == 0 {
+		t.Errorf("Bogus capabilities: %x", client.proxy.Capabilities)
+	}
+}
+
+func TestWritePacket_pieces(t *testing.T) {
+	for _, length := range []int{maxPacketPayload - 1, maxPacketPayload, 2*maxPacketPayload + 10} {
+		proxyEnd, backendEnd := net.Pipe()
+		payload := bytes.Repeat([]byte{0xfe}, length)
+		go func() {
+			WritePacket(mysqlproto.NewStream(proxyEnd), mysqlproto.Packet{7, payload})
+			proxyEnd.Close()
+		}()
+
+		// On the wire, it's pieces numbered up to the one we asked for.
+		wire := mysqlproto.NewStream(backendEnd)
+		pieces := []mysqlproto.Packet{}
+		for {
+			piece, err := wire.NextPacket()
+			if err != nil {
+				break
+			}
+			pieces = append(pieces, piece)
+		}
+		if len(pieces) != packetPieces(length) || pieces[len(pieces)-1].SequenceID != 7 ||
+			pieces[0].SequenceID != byte(8-len(pieces)) || len(pieces[len(pieces)-1].Payload) == maxPacketPayload {
+			t.Errorf("Bogus pieces for a %d-byte payload: %d", length, len(pieces))
+		}
+		backendEnd.Close()
+
+		proxyEnd, backendEnd = net.Pipe()
+		go func() {
+			for _, piece := range pieces {
+				writePiece(mysqlproto.NewStream(backendEnd), piece.SequenceID, piece.Payload)
+			}
+		}()
+		packet, err := ReadPacket(mysqlproto.NewStream(proxyEnd))
+		if err != nil || packet.SequenceID != 7 || !bytes.Equal(packet.Payload, payload) {
+			t.Errorf("Bogus reassembled %d-byte packet: %d bytes, sequence ID %d (%v)", length, len(packet.Payload), packet.SequenceID, err)
+		}
+		proxyEnd.Close()
+		backendEnd.Close()
+	}
+}
+
+func TestHandleQueryResponse_bigRow(t *testing.T) {
+	proxyEnd, backendEnd := net.Pipe()
+	defer proxyEnd.Close()
+	proxy := &ProxyConnection{ClientChannel: make(chan mysqlproto.Packet, 100), ctx: context.Background()}
+	server := &ServerConnection{proxy, mysqlproto.NewStream(proxyEnd), false, false, false, proxyEnd, time.Time{}}
+
+	// A value too big for one packet, which sanitizing shrinks down to a
+	// hash, so the row takes fewer pieces on the way out than on the way in.
+	big := strings.Repeat("honk", maxPacketPayload/4+1)
+	go func() {
+		backend := mysqlproto.NewStream(backendEnd)
+		packets := []mysqlproto.Packet{{1, LengthEncodedInt(1)}, selftestColumnPacket(1, "email", 0xfd),
+			EOFPacket(2), TextRowPacket(4, []string{big}), EOFPacket(5)}
+		for _, packet := range packets {
+			WritePacket(backend, packet)
+		}
+	}()
+	server.handleQueryResponse()
+
+	packets := []mysqlproto.Packet{}
+	for len(proxy.ClientChannel) > 0 {
+		packets = append(packets, <-proxy.ClientChannel)
+	}
+	if len(packets) != 5 {
+		t.Fatalf("Bogus result set with a big row: %d packets", len(packets))
+	}
+	row, eof := packets[3], packets[4]
+	if len(row.Payload) >= maxPacketPayload || row.SequenceID != 4 || !packetIsEOF(eof) || eof.SequenceID != 5 {
+		t.Errorf("Bogus big row: %d bytes, sequence ID %d, then %v", len(row.Payload), row.SequenceID, eof)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Watermarking folds a few bits that depend on who's asking into every
+// hashed value, so if a sanitized dump turns up somewhere it shouldn't, we
+// can tell which profile's session it came out of. The last Bits/4 hex
+// digits of each hash are replaced with a keyed hash of the digits before
+// them, keyed by the session's profile: the username, or the value of one
+// of its labels (e.g. "tenant"). Checking a value against a profile then
+// only needs the value itself, not the original data.
+//
+// The catch is that the same value hashes differently for different
+// profiles (in those last few digits), so dumps from different profiles
+// don't join up any more.
+//
+// Nothing checks the username or labels a client gives us (everybody logs
+// in to the server with our credentials), so the profile is only what the
+// session claimed to be. That's enough to trace a careless leak back to
+// where it came from, but somebody leaking on purpose can just claim to be
+// somebody else, so a match says which profile a dump went through, not
+// who was behind it.
+
+// WatermarkConfig is the [Watermark] section of the config file.
+type WatermarkConfig struct {
+	Bits  int    // How many bits of each hash carry the watermark, in multiples of 4 (0 disables)
+	Label string // Label that names the profile, instead of the username
+}
+
+var defaultWatermarkConfig = WatermarkConfig{
+	0,  // Bits
+	"", // Label
+}
+
+// watermarkMinPrefix is how many hex digits have to be left over to key the
+// watermark with. Any fewer and a value doesn't say much either way.
+const watermarkMinPrefix = 8
+
+func checkWatermarkConfig(watermark WatermarkConfig) error {
+	if watermark.Bits < 0 || watermark.Bits > 32 || watermark.Bits%4 != 0 {
+		return fmt.Errorf("Bits should be a multiple of 4 between 0 and 32")
+	}
+	return nil
+}
+
+// watermarkProfile returns the profile a session's values are marked with.
+func watermarkProfile(username string, labels map[string]string) string {
+	if config.Watermark.Label != "" {
+		if value, ok := labels[config.Watermark.Label]; ok {
+			return value
+		}
+	}
+	return username
+}
+
+// watermarkKey returns the key for a profile's watermark.
+func watermarkKey(profile string, salt []byte) string {
+	return string(hasher.Sum([]byte("watermark "+profile), salt))
+}
+
+// watermarkDigits returns the hex digits that mark a hash prefix for the key.
+func watermarkDigits(prefix []byte, key string, bits int) []byte {
+	return []byte(hex.EncodeToString(hasher.Sum(prefix, []byte(key))))[:bits/4]
+}
+
+// applyWatermark marks a hex hash (possibly with a "version:" prefix) in
+// place, if it's long enough.
+func applyWatermark(hashed []byte, key string, bits int) []byte {
+	digits := bits / 4
+	start := bytes.LastIndexByte(hashed, ':') + 1
+	if key == "" || digits == 0 || len(hashed)-start < watermarkMinPrefix+digits {
+		return hashed
+	}
+	split := len(hashed) - digits
+	copy(hashed[split:], watermarkDigits(hashed[start:split], key, bits))
+	return hashed
+}
+
+// watermarkMatches reports whether a hash carries the key's watermark, and
+// whether it was long enough to tell.
+func watermarkMatches(hashed []byte, key string, bits int) (bool, bool) {
+	digits := bits / 4
+	start := bytes.LastIndexByte(hashed, ':') + 1
+	if len(hashed)-start < watermarkMinPrefix+digits {
+		return false, false
+	}
+	split := len(hashed) - digits
+	return bytes.Equal(hashed[split:], watermarkDigits(hashed[start:split], key, bits)), true
+}
+
+// SetWatermark picks the session's watermark once we know who it is.
+func (proxy *ProxyConnection) SetWatermark(username string, labels map[string]string) {
+	if config.Watermark.Bits == 0 {
+		return
+	}
+	key := watermarkKey(watermarkProfile(username, labels), config.HashSaltBytes)
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	proxy.watermark = key
+}
+
+// Watermark returns the session's watermark key, or "" if there isn't one.
+func (proxy *ProxyConnection) Watermark() string {
+	proxy.labelMutex.Lock()
+	defer proxy.labelMutex.Unlock()
+	return proxy.watermark
+}
+
+type watermarkScore struct {
+	profile string
+	matches int
+}
+
+// VerifyWatermark reads hashed values, one per line, and reports how many
+// of them carry each profile's watermark.
+func VerifyWatermark(in io.Reader, out io.Writer, profiles []string) error {
+	if config.Watermark.Bits == 0 {
+		return fmt.Errorf("Watermark.Bits isn't set, so there's nothing to look for")
+	}
+
+	scores := []watermarkScore{}
+	keys := []string{}
+	for _, profile := range profiles {
+		scores = append(scores, watermarkScore{profile, 0})
+		keys = append(keys, watermarkKey(profile, config.HashSaltBytes))
+	}
+
+	checked := 0
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		value := []byte(strings.TrimSpace(scanner.Text()))
+		counted := false
+		for i, key := range keys {
+			if match, ok := watermarkMatches(value, key, config.Watermark.Bits); ok {
+				counted = true
+				if match {
+					scores[i].matches++
+				}
+			}
+		}
+		if counted {
+			checked++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if checked == 0 {
+		return fmt.Errorf("None of the values were long enough to carry a watermark")
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].matches > scores[j].matches })
+	chance := 100 / float64(int(1)<<uint(config.Watermark.Bits))
+	fmt.Fprintf(out, "Checked %d values; a profile that didn't produce them would match about %.3g%% by chance.\n", checked, chance)
+	for _, score := range scores {
+		fmt.Fprintf(out, "%s: %d/%d (%.1f%%)\n", score.profile, score.matches, checked, 100*float64(score.matches)/float64(checked))
+	}
+	return nil
+}
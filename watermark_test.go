@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestApplyWatermark(t *testing.T) {
+	key := watermarkKey("alice", []byte("salt"))
+	other := watermarkKey("bob", []byte("salt"))
+
+	hashed := applyWatermark([]byte("v1:0123456789abcdef"), key, 8)
+	if !bytes.HasPrefix(hashed, []byte("v1:0123456789abcd")) {
+		t.Errorf("Watermark should only touch the last digits: %s", hashed)
+	}
+	if match, ok := watermarkMatches(hashed, key, 8); !match || !ok {
+		t.Errorf("Watermarked hash %s should match its own key", hashed)
+	}
+	if bytes.Equal(hashed, applyWatermark([]byte("v1:0123456789abcdef"), other, 8)) {
+		t.Error("Different profiles should get different watermarks")
+	}
+
+	if short := applyWatermark([]byte("0123456789"), key, 12); string(short) != "0123456789" {
+		t.Errorf("Hash too short to watermark was changed: %s", short)
+	}
+	if _, ok := watermarkMatches([]byte("v1:0123"), key, 8); ok {
+		t.Error("Short value shouldn't count either way")
+	}
+}
+
+func TestSanitizeRow_watermark(t *testing.T) {
+	oldWatermark := config.Watermark
+	defer func() { config.Watermark = oldWatermark }()
+	config.Watermark = WatermarkConfig{Bits: 8}
+
+	col := Column{true, "honk", "bonk", "name", "name", 255, 0, 0, nil, "", false, nil}
+	plain, _ := sanitizeRow([]byte("Alice"), col)
+	col.watermark = watermarkKey("alice", config.HashSaltBytes)
+	marked, _ := sanitizeRow([]byte("Alice"), col)
+	if len(plain) != len(marked) || !bytes.Equal(plain[:len(plain)-2], marked[:len(marked)-2]) {
+		t.Errorf("Watermark should only change the end of the hash: %s vs %s", plain, marked)
+	}
+	if match, _ := watermarkMatches(marked, col.watermark, 8); !match {
+		t.Errorf("Sanitized value %s should carry the watermark", marked)
+	}
+}
+
+func TestVerifyWatermark(t *testing.T) {
+	oldWatermark := config.Watermark
+	defer func() { config.Watermark = oldWatermark }()
+	config.Watermark = WatermarkConfig{Bits: 8}
+
+	key := watermarkKey("alice", config.HashSaltBytes)
+	values := []string{}
+	for _, value := range []string{"one", "two", "three", "four"} {
+		col := Column{true, "honk", "bonk", "name", "name", 255, 0, 0, nil, key, false, nil}
+		hashed, _ := sanitizeRow([]byte(value), col)
+		values = append(values, string(hashed))
+	}
+	values = append(values, "short")
+
+	var out bytes.Buffer
+	if err := VerifyWatermark(strings.NewReader(strings.Join(values, "\n")), &out, []string{"bob", "alice"}); err != nil {
+		t.Fatalf("VerifyWatermark failed: %s", err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if !strings.HasPrefix(lines[0], "Checked 4 values") || lines[1] != "alice: 4/4 (100.0%)" {
+		t.Errorf("Bogus watermark report:\n%s", out.String())
+	}
+
+	if err := VerifyWatermark(strings.NewReader("short\n"), &out, []string{"alice"}); err == nil {
+		t.Error("Nothing long enough to check should be an error")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -56,3 +58,28 @@ func (wl Whitelist) IsColumnPresent(database string, table string, colname strin
 	}
 	return false
 }
+
+// Version returns a short fingerprint of the whitelist's contents, so we
+// can tell which one a proxy is running with.
+func (wl Whitelist) Version() string {
+	// json.Marshal sorts map keys, so this is stable.
+	encoded, err := json.Marshal(wl.Databases)
+	if err != nil {
+		return "unknown"
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:6])
+}
+
+// Summary returns a short description of the whitelist's size, for logs.
+func (wl Whitelist) Summary() string {
+	tables := 0
+	columns := 0
+	for _, db := range wl.Databases {
+		tables += len(db)
+		for _, colnames := range db {
+			columns += len(colnames)
+		}
+	}
+	return fmt.Sprintf("%d databases, %d tables, %d columns", len(wl.Databases), tables, columns)
+}
@@ -51,3 +51,29 @@ func TestWhitelistIsColumnPresent(t *testing.T) {
 		t.Error("Found a column in a nonexistent database")
 	}
 }
+
+func TestWhitelistVersion(t *testing.T) {
+	wl, err := NewWhitelist(testJSONPath)
+	if err != nil {
+		t.Error("Whitelist not created: ", err)
+	}
+	version := wl.Version()
+	if len(version) != 12 {
+		t.Errorf("Bogus whitelist version: '%s'", version)
+	}
+
+	wl.Databases["another_db"]["table1"] = append(wl.Databases["another_db"]["table1"], "col3")
+	if wl.Version() == version {
+		t.Error("Whitelist version didn't change along with its contents")
+	}
+}
+
+func TestWhitelistSummary(t *testing.T) {
+	wl, err := NewWhitelist(testJSONPath)
+	if err != nil {
+		t.Error("Whitelist not created: ", err)
+	}
+	if wl.Summary() != "2 databases, 3 tables, 12 columns" {
+		t.Errorf("Bogus whitelist summary: '%s'", wl.Summary())
+	}
+}
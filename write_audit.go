@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+)
+
+// Where users are allowed to write, reviewers want a record of how much each
+// session changed. For usernames in AuditWrites, every statement the server
+// answers with an OK gets an audit line with the counts from it: rows
+// affected, the last insert ID, and warnings. The query itself stays out of
+// it, since that's where the data is. OKs for statements that aren't writes
+// and didn't report anything (SET, BEGIN and so on) are skipped.
+//
+// Clients pick their own usernames (everybody logs in to the server with our
+// credentials), so the default is everybody. A list of names only catches
+// the sessions that use them.
+
+// writeKeywords are the statements that get audited even when they don't
+// change anything, since "it matched no rows" is worth knowing too.
+var writeKeywords = map[string]bool{"INSERT": true, "UPDATE": true, "DELETE": true, "REPLACE": true, "LOAD": true}
+
+// warnAboutWriteAudit logs that AuditWrites can be dodged, if it doesn't
+// cover everybody.
+func warnAboutWriteAudit() {
+	if len(config.AuditWrites) > 0 && !auditsWrites("") {
+		output.Log("Only auditing writes for %s. Clients pick their own usernames, so anybody can avoid the audit by using another one",
+			strings.Join(config.AuditWrites, ", "))
+	}
+}
+
+func auditsWrites(username string) bool {
+	for _, audited := range config.AuditWrites {
+		if audited == username || audited == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// auditWrite logs what the statement the OK answered did, if it's one we
+// audit. query is the whole query it was part of.
+func (proxy *ProxyConnection) auditWrite(query string, ok OKResult) {
+	if !auditsWrites(proxy.Username()) {
+		return
+	}
+	statement := "statement"
+	if statements := splitStatements(query); len(statements) == 1 {
+		statement = firstKeyword(statements[0])
+	}
+	if !writeKeywords[statement] && ok.AffectedRows == 0 && ok.LastInsertID == 0 && ok.Warnings == 0 {
+		return
+	}
+	proxy.Output().Audit("%s's %s affected %d rows (last insert ID %d, %d warnings)",
+		proxy.Username(), statement, ok.AffectedRows, ok.LastInsertID, ok.Warnings)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAuditWrite(t *testing.T) {
+	config.AuditWrites = []string{"alice"}
+	defer func() { config.AuditWrites = defaultConfig.AuditWrites }()
+
+	var buffer bytes.Buffer
+	proxy := &ProxyConnection{username: "alice", output: Output{[]OutputSink{newTextSink(&buffer)}, logLevelNormal, nil}}
+	proxy.auditWrite("UPDATE users SET email = 'honk@example.com' WHERE id = 7", OKResult{AffectedRows: 1, Warnings: 2})
+	proxy.auditWrite("DELETE FROM users WHERE id = 8", OKResult{})
+	proxy.auditWrite("SET autocommit = 0", OKResult{})
+	proxy.auditWrite("INSERT INTO users VALUES (9, 'x'); INSERT INTO users VALUES (10, 'y')", OKResult{AffectedRows: 1, LastInsertID: 10})
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Bogus audit log: %q", lines)
+	}
+	if !strings.HasSuffix(lines[0], "alice's UPDATE affected 1 rows (last insert ID 0, 2 warnings)") ||
+		!strings.Contains(lines[1], "alice's DELETE affected 0 rows") ||
+		!strings.HasSuffix(lines[2], "alice's statement affected 1 rows (last insert ID 10, 0 warnings)") {
+		t.Errorf("Bogus audit log: %q", lines)
+	}
+	if strings.Contains(buffer.String(), "honk") {
+		t.Error("Bogus audit log: it has the data in it")
+	}
+
+	buffer.Reset()
+	proxy.username = "bob"
+	proxy.auditWrite("DELETE FROM users", OKResult{AffectedRows: 100})
+	if buffer.Len() > 0 {
+		t.Errorf("Bogus audit log for a user who isn't audited: %s", buffer.String())
+	}
+}
+
+func TestAuditWrite_everybody(t *testing.T) {
+	var buffer bytes.Buffer
+	proxy := &ProxyConnection{username: "whoever", output: Output{[]OutputSink{newTextSink(&buffer)}, logLevelNormal, nil}}
+	proxy.auditWrite("DELETE FROM users", OKResult{AffectedRows: 100})
+	if !strings.Contains(buffer.String(), "whoever's DELETE affected 100 rows") {
+		t.Errorf("Everybody's writes should be audited by default: %q", buffer.String())
+	}
+}
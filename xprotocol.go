@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+// The X Protocol (what MySQL Shell and the X DevAPI connectors speak, usually
+// on port 33060) is a completely different protobuf-based protocol. We don't
+// speak it, but we can at least recognize it and tell the user what to do
+// instead.
+
+const xClientCapabilitiesGet = 1 // Mysqlx.ClientMessages.CON_CAPABILITIES_GET
+const xServerError = 1           // Mysqlx.ServerMessages.ERROR
+const xSeverityFatal = 1         // Mysqlx.Error.Severity.FATAL
+
+// isXProtocolHello reports whether the first packet from a client on the
+// classic port is really an X Protocol CapabilitiesGet. X clients talk first,
+// and that message's frame (01 00 00 00 01) reads as a one-byte classic
+// packet, which no real handshake response is.
+func isXProtocolHello(packet mysqlproto.Packet) bool {
+	return packet.SequenceID == 0 && len(packet.Payload) == 1 && packet.Payload[0] == xClientCapabilitiesGet
+}
+
+// xProtocolHelp is the actionable part of the error we give X clients.
+func xProtocolHelp() string {
+	return fmt.Sprintf("mysql-sanitizer only supports the classic MySQL protocol, not the X Protocol. "+
+		"Use a classic session on port %d instead (e.g. mysqlsh --mysql, or the mysql client).", config.ListeningPort)
+}
+
+// XErrorFrame returns a framed, fatal Mysqlx.Error message.
+func XErrorFrame(code int, sqlState string, message string) []byte {
+	payload := []byte{0x08, xSeverityFatal} // severity
+	payload = append(payload, 0x10)         // code
+	payload = append(payload, protobufVarint(uint64(code))...)
+	payload = append(payload, 0x1A) // msg
+	payload = append(payload, protobufVarint(uint64(len(message)))...)
+	payload = append(payload, message...)
+	payload = append(payload, 0x22) // sql_state
+	payload = append(payload, protobufVarint(uint64(len(sqlState)))...)
+	payload = append(payload, sqlState...)
+
+	frame := littleEndian(uint64(len(payload)+1), 4)
+	frame = append(frame, xServerError)
+	return append(frame, payload...)
+}
+
+func protobufVarint(num uint64) []byte {
+	result := []byte{}
+	for num >= 0x80 {
+		result = append(result, byte(num&0x7F)|0x80)
+		num >>= 7
+	}
+	return append(result, byte(num))
+}
+
+// ServeXProtocolPort turns away every client on the X Protocol port with an
+// explanation, so they don't just get "connection refused".
+func ServeXProtocolPort(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			output.Log("Can't accept incoming X Protocol connection: %s", err)
+			return
+		}
+		go refuseXClient(conn)
+	}
+}
+
+func refuseXClient(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	output.Log("Turning away X Protocol client from %s", conn.RemoteAddr())
+
+	// Read the client's first message before answering, or closing the
+	// socket with unread data could reset the connection before the
+	// client sees our error.
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	length := int64(header[0]) | int64(header[1])<<8 | int64(header[2])<<16 | int64(header[3])<<24
+	io.CopyN(ioutil.Discard, conn, length)
+
+	code := errorCodes[ErrUnsupported]
+	conn.Write(XErrorFrame(code.code, code.sqlState, xProtocolHelp()))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pubnative/mysqlproto-go"
+)
+
+func TestIsXProtocolHello(t *testing.T) {
+	if !isXProtocolHello(mysqlproto.Packet{0, []byte{0x01}}) {
+		t.Error("CapabilitiesGet should have been recognized")
+	}
+	if isXProtocolHello(mysqlproto.Packet{1, []byte{0x01}}) {
+		t.Error("Packet with a later sequence ID isn't an X Protocol hello")
+	}
+	if isXProtocolHello(mysqlproto.Packet{1, []byte{0x0D, 0xA2, 0x0A, 0x00}}) {
+		t.Error("Handshake response isn't an X Protocol hello")
+	}
+}
+
+func TestXErrorFrame(t *testing.T) {
+	frame := XErrorFrame(1047, "08S01", "nope")
+	expected := []byte{
+		0x13, 0x00, 0x00, 0x00, // length
+		0x01,       // Mysqlx.Error
+		0x08, 0x01, // FATAL
+		0x10, 0x97, 0x08, // 1047
+		0x1A, 0x04, 'n', 'o', 'p', 'e',
+		0x22, 0x05, '0', '8', 'S', '0', '1',
+	}
+	if !bytes.Equal(frame, expected) {
+		t.Errorf("Bogus X error frame: %v", frame)
+	}
+}
+
+func TestRefuseXClient(t *testing.T) {
+	client, server := net.Pipe()
+	go refuseXClient(server)
+
+	client.Write([]byte{0x01, 0x00, 0x00, 0x00, xClientCapabilitiesGet})
+	response, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("Couldn't read response: %s", err)
+	}
+	if len(response) < 5 || response[4] != xServerError {
+		t.Fatalf("Bogus response: %v", response)
+	}
+	if !strings.Contains(string(response), "classic MySQL protocol") {
+		t.Errorf("Response should explain what to do: %q", response)
+	}
+}